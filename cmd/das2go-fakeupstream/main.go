@@ -0,0 +1,53 @@
+package main
+
+// das2go-fakeupstream - fake CMS data-services for DAS integration tests
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/dmwm/das2go/fakeupstream"
+)
+
+func main() {
+	var port int
+	flag.IntVar(&port, "port", 8250, "port number to listen on")
+	var config string
+	flag.StringVar(&config, "config", "", "JSON file with synthetic datasets, by default built-in datasets are used")
+	var verbose int
+	flag.IntVar(&verbose, "verbose", 0, "verbosity level")
+	flag.Parse()
+
+	cfg := fakeupstream.DefaultConfig()
+	if config != "" {
+		data, err := os.ReadFile(config)
+		if err != nil {
+			log.Fatalf("ERROR: unable to read %s, error %v\n", config, err)
+		}
+		cfg = fakeupstream.Config{}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			log.Fatalf("ERROR: unable to parse %s, error %v\n", config, err)
+		}
+	}
+	if verbose > 0 {
+		cfg.Verbose = verbose
+	}
+	server := fakeupstream.NewServer(cfg)
+	base := fmt.Sprintf("http://localhost:%d", port)
+	rules, _ := json.Marshal(fakeupstream.UrlRewrite(base))
+	fmt.Printf("fake upstream services are available at %s, use the following DAS settings:\n", base)
+	fmt.Printf("  config: \"frontend\": \"%s\", \"rucioUrl\": \"%s/rucio\", \"urlRewrite\": %s\n", base, base, string(rules))
+	fmt.Printf("  environment: RUCIO_AUTH_URL=%s/rucio\n", base)
+	for _, d := range server.Model.Datasets {
+		fmt.Printf("  dataset %s (%d blocks)\n", d.Name, len(d.Blocks))
+	}
+	addr := fmt.Sprintf(":%d", port)
+	log.Fatal(http.ListenAndServe(addr, server))
+}
@@ -11,39 +11,68 @@ import (
 	"fmt"
 	"log"
 	"os"
+
+	"github.com/dmwm/das2go/utils"
 )
 
 // Configuration stores DAS configuration parameters
 type Configuration struct {
-	Port                  int      `json:"port"`                  // DAS port number
-	Uri                   string   `json:"uri"`                   // DAS mongodb URI
-	Services              []string `json:"services"`              // DAS services
-	UrlQueueLimit         int32    `json:"urlQueueLimit"`         // DAS url queue limit
-	UrlRetry              int      `json:"urlRetry"`              // DAS url retry number
-	Templates             string   `json:"templates"`             // location of DAS templates
-	Jscripts              string   `json:"jscripts"`              // location of DAS JavaScript files
-	Images                string   `json:"images"`                // location of DAS images
-	Styles                string   `json:"styles"`                // location of DAS CSS styles
-	Hkey                  string   `json:"hkey"`                  // DAS HKEY file
-	Base                  string   `json:"base"`                  // DAS base path
-	DbsInstances          []string `json:"dbsInstances"`          // list of DBS instances
-	Views                 []string `json:"views"`                 // list of supported views
-	Verbose               int      `json:"verbose"`               // verbosity level
-	DasMaps               string   `json:"dasmaps"`               // location of dasmaps
-	DasExamples           string   `json:"dasexamples"`           // location of dasexamples
-	ServerKey             string   `json:"serverkey"`             // server key for https
-	ServerCrt             string   `json:"servercrt"`             // server certificate for https
-	UpdateDNs             int      `json:"updateDNs"`             // interval in minutes to update user DNs
-	Timeout               int      `json:"timeout"`               // query time out
-	Frontend              string   `json:"frontend"`              // frontend URI to use
-	RucioUrl              string   `json:"rucioUrl"`              // default RucioUrl
-	RucioTokenCurl        bool     `json:"rucioTokenCurl"`        // use curl method to obtain Rucio Token
-	ProfileFile           string   `json:"profileFile"`           // send profile data to a given file
-	TLSCertsRenewInterval int      `json:"tlsCertsRenewInterval"` // renewal interval for TLS certs
-	LogFile               string   `json:"logFile"`               // log file name
-	UseDNSCache           bool     `json:"useDNSCache"`           // use DNS Cache
-	AuthDN                bool     `json:"authDN"`                // user user DN authentication
-	KeepAlive             bool     `json:"keepAlive"`             // use keep-alive HTTP header
+	Port                  int                          `json:"port"`                  // DAS port number
+	Uri                   string                       `json:"uri"`                   // DAS mongodb URI
+	Services              []string                     `json:"services"`              // DAS services
+	UrlQueueLimit         int32                        `json:"urlQueueLimit"`         // DAS url queue limit
+	UrlRetry              int                          `json:"urlRetry"`              // DAS url retry number
+	Templates             string                       `json:"templates"`             // location of DAS templates
+	Jscripts              string                       `json:"jscripts"`              // location of DAS JavaScript files
+	Images                string                       `json:"images"`                // location of DAS images
+	Styles                string                       `json:"styles"`                // location of DAS CSS styles
+	Hkey                  string                       `json:"hkey"`                  // DAS HKEY file
+	Base                  string                       `json:"base"`                  // DAS base path
+	DbsInstances          []string                     `json:"dbsInstances"`          // list of DBS instances
+	Views                 []string                     `json:"views"`                 // list of supported views
+	Verbose               int                          `json:"verbose"`               // verbosity level
+	DasMaps               string                       `json:"dasmaps"`               // location of dasmaps
+	DasExamples           string                       `json:"dasexamples"`           // location of dasexamples
+	ServerKey             string                       `json:"serverkey"`             // server key for https
+	ServerCrt             string                       `json:"servercrt"`             // server certificate for https
+	UpdateDNs             int                          `json:"updateDNs"`             // interval in minutes to update user DNs
+	Timeout               int                          `json:"timeout"`               // query time out
+	Frontend              string                       `json:"frontend"`              // frontend URI to use
+	RucioUrl              string                       `json:"rucioUrl"`              // default RucioUrl
+	RucioTokenCurl        bool                         `json:"rucioTokenCurl"`        // use curl method to obtain Rucio Token
+	ProfileFile           string                       `json:"profileFile"`           // send profile data to a given file
+	TLSCertsRenewInterval int                          `json:"tlsCertsRenewInterval"` // renewal interval for TLS certs
+	LogFile               string                       `json:"logFile"`               // log file name
+	LogFormat             string                       `json:"logFormat"`             // format of log records: text (default) or json
+	LogLevel              string                       `json:"logLevel"`              // minimum level of log records: debug, info (default), warn or error
+	UseDNSCache           bool                         `json:"useDNSCache"`           // use DNS Cache
+	AuthDN                bool                         `json:"authDN"`                // user user DN authentication
+	KeepAlive             bool                         `json:"keepAlive"`             // use keep-alive HTTP header
+	AdminDNs              []string                     `json:"adminDNs"`              // list of DNs allowed to use admin APIs
+	WarmupQueries         []string                     `json:"warmupQueries"`         // list of DAS queries to keep warm in DAS cache
+	WarmupFile            string                       `json:"warmupFile"`            // file with DAS queries to keep warm (one per line)
+	WarmupExamples        []string                     `json:"warmupExamples"`        // DAS example files to keep warm, e.g. dataset_queries.txt
+	WarmupLogTopN         int                          `json:"warmupLogTopN"`         // keep warm top N queries found in DAS server logs
+	WarmupInterval        int                          `json:"warmupInterval"`        // cache warmer interval in seconds
+	WarmupLead            int                          `json:"warmupLead"`            // refresh queries which expire within lead time in seconds
+	WarmupConcurrency     int                          `json:"warmupConcurrency"`     // max number of queries processed by cache warmer at a time
+	WarmupMaxRequests     int                          `json:"warmupMaxRequests"`     // cache warmer waits while number of running upstream requests reaches this limit
+	BreakerThreshold      int                          `json:"breakerThreshold"`      // number of consecutive upstream failures which opens circuit breaker, negative value disables it
+	BreakerTimeout        int                          `json:"breakerTimeout"`        // time in seconds circuit breaker stays open before probe request
+	SystemLimits          map[string]utils.SystemLimit `json:"systemLimits"`          // concurrency and rate limits of upstream systems, e.g. dbs3, rucio
+	HTTPCacheMemory       int                          `json:"httpCacheMemory"`       // size in MB of upstream HTTP response cache kept in memory, 0 disables it
+	HTTPCacheDisk         int                          `json:"httpCacheDisk"`         // size in MB of upstream HTTP response cache kept on disk
+	HTTPCacheDir          string                       `json:"httpCacheDir"`          // directory of upstream HTTP response cache
+	FetchMode             string                       `json:"fetchMode"`             // upstream fetch mode: empty (live), record or replay
+	FixtureDir            string                       `json:"fixtureDir"`            // directory of recorded upstream fixtures
+	UrlRewrite            map[string]string            `json:"urlRewrite"`            // rewrite rules of upstream url prefixes, e.g. to use fake upstream services
+	AuthProviders         map[string]utils.AuthConfig  `json:"authProviders"`         // outbound auth providers of upstream systems, e.g. dbs3, rucio, default
+	Endpoints             map[string][]string          `json:"endpoints"`             // ordered lists of alternative base urls of upstream systems, e.g. dbs3, rucio
+	EndpointTimeout       int                          `json:"endpointTimeout"`       // time in seconds failed upstream endpoint is not used
+	HedgeBudget           float64                      `json:"hedgeBudget"`           // max fraction of upstream GET requests to hedge when they are slower than p95, e.g. 0.05
+	JobCallbackHosts      []string                     `json:"jobCallbackHosts"`      // allowed hosts of job callback urls, callbacks are denied when empty
+	TraceFile             string                       `json:"traceFile"`             // file to write request traces in OTLP JSON format
+	TraceEndpoint         string                       `json:"traceEndpoint"`         // OTLP/HTTP endpoint to export request traces, e.g. http://localhost:4318/v1/traces
 }
 
 // Config variable represents configuration object
@@ -73,6 +102,43 @@ func ParseConfig(configFile string) error {
 	if Config.TLSCertsRenewInterval == 0 {
 		Config.TLSCertsRenewInterval = 600
 	}
+	if Config.WarmupInterval == 0 {
+		Config.WarmupInterval = 600
+	}
+	if Config.WarmupLead == 0 {
+		Config.WarmupLead = 2 * Config.WarmupInterval
+	}
+	if Config.WarmupConcurrency == 0 {
+		Config.WarmupConcurrency = 2
+	}
+	if Config.WarmupMaxRequests == 0 {
+		Config.WarmupMaxRequests = 100
+	}
+	if Config.BreakerThreshold == 0 {
+		Config.BreakerThreshold = 5
+	}
+	if Config.BreakerTimeout == 0 {
+		Config.BreakerTimeout = 30
+	}
+	switch Config.FetchMode {
+	case "":
+	case "record", "replay":
+		if Config.FixtureDir == "" {
+			return fmt.Errorf("fetchMode %s requires fixtureDir", Config.FetchMode)
+		}
+	default:
+		return fmt.Errorf("unsupported fetchMode %s, should be record or replay", Config.FetchMode)
+	}
+	switch Config.LogFormat {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("unsupported logFormat %s, should be text or json", Config.LogFormat)
+	}
+	switch Config.LogLevel {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("unsupported logLevel %s, should be debug, info, warn or error", Config.LogLevel)
+	}
 	if Config.RucioUrl == "" {
 		Config.RucioUrl = "https://cms-rucio.cern.ch"
 	}
@@ -0,0 +1,407 @@
+package das
+
+// DAS aggregation module, it translates DAS aggregators and unique
+// filter into MongoDB aggregation pipelines and provides Go implementation
+// of aggregators which MongoDB can't express
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/utils"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// list of aggregators which can be computed by MongoDB
+var dbAggregators = []string{"sum", "min", "max", "avg", "mean", "count", "count_distinct", "stddev"}
+
+// helper function to split aggregator into function, key, parameter and group key
+func aggregatorParts(agg []string) (string, string, string, string) {
+	parts := make([]string, 4)
+	copy(parts, agg)
+	return parts[0], parts[1], parts[2], parts[3]
+}
+
+// helper function to build MongoDB expression which yields value of given
+// DAS key, e.g. file.size. DAS records keep their data in lists, e.g.
+// {"file":[{"name":..., "size":...}]}, therefore, similar to mongo.GetValue,
+// we take first value of the list
+func firstValue(key string) bson.M {
+	path := fmt.Sprintf("$%s", key)
+	return bson.M{"$cond": []interface{}{
+		bson.M{"$isArray": path},
+		bson.M{"$arrayElemAt": []interface{}{path, 0}},
+		path,
+	}}
+}
+
+// helper function to build MongoDB expression which yields numeric value of
+// given DAS key or null otherwise. Accumulators ignore null values, therefore,
+// similar to Go implementation of aggregators, non-numeric values are skipped
+func numericValue(key string) bson.M {
+	expr := firstValue(key)
+	numeric := []string{"double", "int", "long", "decimal"}
+	return bson.M{"$cond": []interface{}{
+		bson.M{"$in": []interface{}{bson.M{"$type": expr}, numeric}},
+		expr,
+		nil,
+	}}
+}
+
+// helper function to check if given aggregator can be computed by MongoDB
+func dbAggregatable(agg []string) bool {
+	fagg, key, _, gkey := aggregatorParts(agg)
+	// keys with $ sign would be interpreted by MongoDB as operators
+	return utils.InList(fagg, dbAggregators) && !strings.Contains(key, "$") && !strings.Contains(gkey, "$")
+}
+
+// helper function to build MongoDB accumulator for given aggregator function
+func accumulator(fagg, key string) bson.M {
+	expr := firstValue(key)
+	switch fagg {
+	case "min":
+		// MongoDB compares values of different types, e.g. strings are
+		// greater than numbers, while only numbers are aggregated in Go
+		return bson.M{"$min": numericValue(key)}
+	case "max":
+		return bson.M{"$max": numericValue(key)}
+	case "count":
+		return bson.M{"$sum": 1}
+	case "count_distinct":
+		return bson.M{"$addToSet": expr}
+	case "stddev":
+		return bson.M{"$stdDevPop": expr}
+	}
+	// sum, avg and mean, the latter are computed as sum over all records, see utils.Mean
+	return bson.M{"$sum": expr}
+}
+
+// helper function to convert value returned by MongoDB into float
+func toFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// helper function to convert value accumulated by MongoDB into aggregator
+// value, nrec is number of aggregated records
+func accumulatedValue(fagg string, val interface{}, nrec float64) interface{} {
+	switch fagg {
+	case "count":
+		return int(nrec)
+	case "count_distinct":
+		values, _ := val.([]interface{})
+		return utils.CountDistinct(values)
+	case "avg", "mean":
+		v, _ := toFloat(val)
+		return v / nrec
+	case "min":
+		if v, ok := toFloat(val); ok {
+			return v
+		}
+		return utils.Min(nil)
+	case "max":
+		if v, ok := toFloat(val); ok {
+			return v
+		}
+		return utils.Max(nil)
+	}
+	v, _ := toFloat(val)
+	return v
+}
+
+// helper function to create aggregator record
+func aggregateRecord(agg []string, result mongo.DASRecord, das interface{}) mongo.DASRecord {
+	fagg, key, param, gkey := aggregatorParts(agg)
+	rec := mongo.DASRecord{"function": fagg, "key": key, "result": result, "das": das}
+	if param != "" {
+		rec["param"] = param
+	}
+	if gkey != "" {
+		rec["by"] = gkey
+	}
+	return rec
+}
+
+// helper function to compute aggregators without group key in MongoDB,
+// it returns map of aggregator index and its record
+func dbAggregateAll(coll string, spec bson.M, aggrs [][]string, idxs []int) (map[int]mongo.DASRecord, error) {
+	out := make(map[int]mongo.DASRecord)
+	group := bson.M{"_id": nil, "das": bson.M{"$first": "$das"}, "nrec": bson.M{"$sum": 1}}
+	for _, idx := range idxs {
+		fagg, key, _, _ := aggregatorParts(aggrs[idx])
+		group[fmt.Sprintf("a%d", idx)] = accumulator(fagg, key)
+	}
+	pipeline := []bson.M{{"$match": spec}, {"$group": group}}
+	records, err := mongo.Aggregate("das", coll, pipeline)
+	if err != nil {
+		return out, err
+	}
+	for _, idx := range idxs {
+		if len(records) == 0 {
+			// no records to aggregate, use Go implementation for default values
+			out[idx] = AggregateRecords([]mongo.DASRecord{}, aggrs[idx])
+			continue
+		}
+		res := records[0]
+		fagg, _, _, _ := aggregatorParts(aggrs[idx])
+		nrec, _ := toFloat(res["nrec"])
+		value := accumulatedValue(fagg, res[fmt.Sprintf("a%d", idx)], nrec)
+		out[idx] = aggregateRecord(aggrs[idx], mongo.DASRecord{"value": value}, res["das"])
+	}
+	return out, nil
+}
+
+// helper function to compute aggregator with group key in MongoDB
+func dbAggregateGroup(coll string, spec bson.M, agg []string) (mongo.DASRecord, error) {
+	fagg, key, _, gkey := aggregatorParts(agg)
+	group := bson.M{"_id": firstValue(gkey), "das": bson.M{"$first": "$das"}, "nrec": bson.M{"$sum": 1}, "value": accumulator(fagg, key)}
+	pipeline := []bson.M{{"$match": spec}, {"$group": group}, {"$sort": bson.M{"_id": 1}}}
+	records, err := mongo.Aggregate("das", coll, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return AggregateRecords([]mongo.DASRecord{}, agg), nil
+	}
+	var groups []mongo.DASRecord
+	for _, res := range records {
+		nrec, _ := toFloat(res["nrec"])
+		groups = append(groups, mongo.DASRecord{"group": res["_id"], "value": accumulatedValue(fagg, res["value"], nrec)})
+	}
+	return aggregateRecord(agg, mongo.DASRecord{"groups": groups}, records[0]["das"]), nil
+}
+
+// helper function to aggregate records of given collection, aggregators
+// which can be expressed by MongoDB are computed there and the rest in Go.
+// Results are returned in order of given aggregators, failures of MongoDB
+// aggregation are logged by given logger
+func aggregateData(coll string, spec bson.M, aggrs [][]string, logger *slog.Logger) ([]mongo.DASRecord, error) {
+
+	// defer function profiler
+	defer utils.MeasureTime("das/aggregateData")()
+
+	results := make(map[int]mongo.DASRecord)
+	var plain, rest []int
+	for idx, agg := range aggrs {
+		if !dbAggregatable(agg) {
+			rest = append(rest, idx)
+			continue
+		}
+		if _, _, _, gkey := aggregatorParts(agg); gkey == "" {
+			plain = append(plain, idx)
+			continue
+		}
+		rec, err := dbAggregateGroup(coll, spec, agg)
+		if err != nil {
+			logger.Error("unable to aggregate data in MongoDB", "collection", coll, "aggregator", agg, "error", err)
+			rest = append(rest, idx)
+			continue
+		}
+		results[idx] = rec
+	}
+	if len(plain) > 0 {
+		records, err := dbAggregateAll(coll, spec, aggrs, plain)
+		if err != nil {
+			logger.Error("unable to aggregate data in MongoDB", "collection", coll, "aggregators", aggrs, "error", err)
+			rest = append(rest, plain...)
+		}
+		for idx, rec := range records {
+			results[idx] = rec
+		}
+	}
+	if len(rest) > 0 {
+		records, err := mongo.GetFilteredSorted("das", coll, spec, nil, nil, 0, -1)
+		if err != nil {
+			return nil, err
+		}
+		var goAggrs [][]string
+		for _, idx := range rest {
+			goAggrs = append(goAggrs, aggrs[idx])
+		}
+		for i, rec := range aggregateAll(records, goAggrs) {
+			results[rest[i]] = rec
+		}
+	}
+	var out []mongo.DASRecord
+	for idx := range aggrs {
+		if rec, ok := results[idx]; ok {
+			out = append(out, rec)
+		}
+	}
+	return out, nil
+}
+
+// helper function to aggregate results over provided aggregators
+// we'll use go routine to do this in parallel
+func aggregateAll(data []mongo.DASRecord, aggrs [][]string) []mongo.DASRecord {
+
+	// defer function profiler
+	defer utils.MeasureTime("das/aggregateAll")()
+
+	out := make([]mongo.DASRecord, len(aggrs))
+	var wg sync.WaitGroup
+	for idx, agg := range aggrs {
+		wg.Add(1)
+		go func(idx int, agg []string) {
+			defer wg.Done()
+			out[idx] = AggregateRecords(data, agg)
+		}(idx, agg)
+	}
+	wg.Wait()
+	return out
+}
+
+// helper function to compute aggregator function over given values
+func aggregateValues(fagg, param string, values []interface{}) interface{} {
+	switch fagg {
+	case "sum":
+		return utils.Sum(values)
+	case "min":
+		return utils.Min(values)
+	case "max":
+		return utils.Max(values)
+	case "mean":
+		return utils.Mean(values)
+	case "avg":
+		return utils.Avg(values)
+	case "count":
+		return len(values)
+	case "median":
+		return utils.Median(values)
+	case "count_distinct":
+		return utils.CountDistinct(values)
+	case "stddev":
+		return utils.StdDev(values)
+	case "percentile":
+		p, _ := strconv.ParseFloat(param, 64)
+		return utils.Percentile(values, p)
+	case "histogram":
+		nbins, err := strconv.Atoi(param)
+		if err != nil {
+			nbins = 10
+		}
+		return utils.Histogram(values, nbins)
+	}
+	return nil
+}
+
+// helper function to sort group names, numeric names are sorted by their values
+func sortGroups(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		v1, e1 := strconv.ParseFloat(names[i], 64)
+		v2, e2 := strconv.ParseFloat(names[j], 64)
+		if e1 == nil && e2 == nil {
+			return v1 < v2
+		}
+		return names[i] < names[j]
+	})
+}
+
+// Aggregate function aggregates results for given function and key
+func Aggregate(data []mongo.DASRecord, agg, key string) mongo.DASRecord {
+	return AggregateRecords(data, []string{agg, key})
+}
+
+// AggregateRecords aggregates DAS records for given aggregator, i.e.
+// [function, key, parameter, group key]. Aggregators with group key yield
+// list of groups along with their values
+func AggregateRecords(data []mongo.DASRecord, agg []string) mongo.DASRecord {
+	fagg, key, param, gkey := aggregatorParts(agg)
+	var result mongo.DASRecord
+	if gkey == "" {
+		var values []interface{}
+		for _, r := range data {
+			values = append(values, mongo.GetValue(r, key))
+		}
+		result = mongo.DASRecord{"value": aggregateValues(fagg, param, values)}
+	} else {
+		values := make(map[string][]interface{})
+		gvalues := make(map[string]interface{})
+		var names []string
+		for _, r := range data {
+			gval := mongo.GetValue(r, gkey)
+			name := fmt.Sprintf("%v", gval)
+			if _, ok := values[name]; !ok {
+				names = append(names, name)
+				gvalues[name] = gval
+			}
+			values[name] = append(values[name], mongo.GetValue(r, key))
+		}
+		sortGroups(names)
+		var groups []mongo.DASRecord
+		for _, name := range names {
+			groups = append(groups, mongo.DASRecord{"group": gvalues[name], "value": aggregateValues(fagg, param, values[name])})
+		}
+		result = mongo.DASRecord{"groups": groups}
+	}
+	var das interface{} = "Unable to aggregate"
+	if len(data) > 0 {
+		das = data[0]["das"]
+	}
+	return aggregateRecord(agg, result, das)
+}
+
+// helper function to build MongoDB sort document from given DAS sort keys,
+// e.g. -file.size, file.name, the order of keys is preserved
+func sortDoc(skeys []string) bson.D {
+	var doc bson.D
+	for _, key := range skeys {
+		if strings.HasPrefix(key, "-") {
+			doc = append(doc, bson.DocElem{Name: strings.TrimPrefix(key, "-"), Value: -1})
+		} else {
+			doc = append(doc, bson.DocElem{Name: strings.TrimPrefix(key, "+"), Value: 1})
+		}
+	}
+	return doc
+}
+
+// helper function to build MongoDB aggregation pipeline which selects
+// records with unique values of given keys. The pipeline applies
+// projection on given fields, sorting and pagination after deduplication
+func uniquePipeline(spec bson.M, fields, ukeys, skeys []string, idx, limit int) []bson.M {
+	pipeline := []bson.M{{"$match": spec}}
+	if len(fields) > 0 {
+		project := bson.M{"das": 1}
+		for _, key := range fields {
+			project[key] = 1
+		}
+		pipeline = append(pipeline, bson.M{"$project": project})
+	}
+	// group records on values of unique keys, field names can't contain dots
+	gid := bson.M{}
+	for i, key := range ukeys {
+		gid[fmt.Sprintf("k%d", i)] = fmt.Sprintf("$%s", key)
+	}
+	pipeline = append(pipeline, bson.M{"$group": bson.M{"_id": gid, "doc": bson.M{"$first": "$$ROOT"}}})
+	pipeline = append(pipeline, bson.M{"$replaceRoot": bson.M{"newRoot": "$doc"}})
+	if len(skeys) > 0 {
+		pipeline = append(pipeline, bson.M{"$sort": sortDoc(skeys)})
+	} else {
+		// keep stable order of records between pages
+		pipeline = append(pipeline, bson.M{"$sort": bson.M{"_id": 1}})
+	}
+	if idx > 0 {
+		pipeline = append(pipeline, bson.M{"$skip": idx})
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": limit})
+	}
+	return pipeline
+}
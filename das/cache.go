@@ -0,0 +1,252 @@
+package das
+
+// DAS cache administration module
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dmwm/das2go/dasmaps"
+	"github.com/dmwm/das2go/dasql"
+	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/utils"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// CacheRecord represents summary of cached DAS query
+type CacheRecord struct {
+	Qhash    string `json:"qhash"`
+	Query    string `json:"query"`
+	Instance string `json:"instance"`
+	Status   string `json:"status"`
+	Count    int    `json:"nrecords"`
+	Bytes    int    `json:"bytes"`
+	Expire   int64  `json:"expire"`
+}
+
+// CacheSelection defines conditions to select cached DAS queries
+type CacheSelection struct {
+	Qhash  string `json:"qhash"`  // DAS query hash
+	Query  string `json:"query"`  // regex pattern on DAS query text
+	System string `json:"system"` // DAS system, e.g. dbs3
+	Key    string `json:"key"`    // DAS key value, e.g. dataset=/a/b/c
+}
+
+// String returns string representation of CacheSelection
+func (c CacheSelection) String() string {
+	return fmt.Sprintf("<CacheSelection qhash=%s query=%s system=%s key=%s>", c.Qhash, c.Query, c.System, c.Key)
+}
+
+// helper function to build spec for DAS records (record=0) from given selection
+func selectionSpec(sel CacheSelection) (bson.M, error) {
+	spec := bson.M{"das.record": 0}
+	if sel.Qhash != "" {
+		spec["qhash"] = sel.Qhash
+	}
+	if sel.Query != "" {
+		if _, err := regexp.Compile(sel.Query); err != nil {
+			return spec, fmt.Errorf("invalid query pattern %s, error %v", sel.Query, err)
+		}
+		spec["query"] = bson.RegEx{Pattern: sel.Query}
+	}
+	if sel.System != "" {
+		pat := fmt.Sprintf("^%s:", regexp.QuoteMeta(sel.System))
+		spec["das.services"] = bson.RegEx{Pattern: pat}
+	}
+	return spec, nil
+}
+
+// helper function to find qhashes of DAS queries which refer to given DAS key
+// value, e.g. dataset=/a/b/c, either in their query or in their data records.
+// Data records are matched on record keys of DAS key from DAS maps, e.g.
+// run.run_number for run, or on <key>.name if DAS maps do not provide them
+func keyQueries(kval string, dmaps dasmaps.DASMaps) ([]string, error) {
+	arr := strings.SplitN(kval, "=", 2)
+	if len(arr) != 2 || arr[0] == "" || arr[1] == "" {
+		return nil, fmt.Errorf("invalid DAS key value %s, should be in key=value form", kval)
+	}
+	key := strings.TrimSpace(arr[0])
+	val := strings.TrimSpace(arr[1])
+	pat := fmt.Sprintf("%s\\s*=\\s*%s(\\s|$)", regexp.QuoteMeta(key), regexp.QuoteMeta(val))
+	spec := bson.M{"das.record": 0, "query": bson.RegEx{Pattern: pat}}
+	out, err := mongo.Distinct("das", "cache", "qhash", spec)
+	if err != nil {
+		return nil, err
+	}
+	// numeric values, e.g. run numbers, are stored as numbers in data records
+	values := []interface{}{val}
+	if v, err := strconv.ParseInt(val, 10, 64); err == nil {
+		values = append(values, v)
+	} else if v, err := strconv.ParseFloat(val, 64); err == nil {
+		values = append(values, v)
+	}
+	rkeys := dmaps.RecordKeys(key)
+	if len(rkeys) == 0 {
+		rkeys = []string{fmt.Sprintf("%s.name", key)}
+	}
+	var conds []bson.M
+	for _, rkey := range rkeys {
+		conds = append(conds, bson.M{rkey: bson.M{"$in": values}})
+	}
+	spec = bson.M{"das.record": 1, "$or": conds}
+	qhashes, err := mongo.Distinct("das", "cache", "qhash", spec)
+	if err != nil {
+		return nil, err
+	}
+	for _, qhash := range qhashes {
+		if !utils.InList(qhash, out) {
+			out = append(out, qhash)
+		}
+	}
+	return out, nil
+}
+
+// FindCachedQueries returns qhashes of cached DAS queries matching given
+// selection, DAS maps are used to look-up records of selected DAS key
+func FindCachedQueries(sel CacheSelection, dmaps dasmaps.DASMaps) ([]string, error) {
+	spec, err := selectionSpec(sel)
+	if err != nil {
+		return nil, err
+	}
+	if sel.Key != "" {
+		qhashes, err := keyQueries(sel.Key, dmaps)
+		if err != nil {
+			return nil, err
+		}
+		spec["qhash"] = bson.M{"$in": qhashes}
+		if sel.Qhash != "" {
+			if !utils.InList(sel.Qhash, qhashes) {
+				return []string{}, nil
+			}
+			spec["qhash"] = sel.Qhash
+		}
+	}
+	return mongo.Distinct("das", "cache", "qhash", spec)
+}
+
+// CachedQueries returns summary of cached DAS queries matching given selection
+func CachedQueries(sel CacheSelection, dmaps dasmaps.DASMaps) ([]CacheRecord, error) {
+
+	// defer function profiler
+	defer utils.MeasureTime("das/CachedQueries")()
+
+	var out []CacheRecord
+	qhashes, err := FindCachedQueries(sel, dmaps)
+	if err != nil {
+		return out, err
+	}
+	if len(qhashes) == 0 {
+		return out, nil
+	}
+	spec := bson.M{"das.record": 0, "qhash": bson.M{"$in": qhashes}}
+	records, err := mongo.Get("das", "cache", spec, 0, -1)
+	if err != nil {
+		return out, err
+	}
+	for _, rec := range records {
+		qhash, _ := rec["qhash"].(string)
+		query, _ := rec["query"].(string)
+		inst, _ := mongo.GetStringValue(rec, "das.instance")
+		status, _ := mongo.GetStringValue(rec, "das.status")
+		expire, _ := mongo.GetInt64Value(rec, "das.expire")
+		nrec, err := Count(qhash)
+		if err != nil {
+			return out, err
+		}
+		size, err := Bytes(qhash)
+		if err != nil {
+			return out, err
+		}
+		crec := CacheRecord{
+			Qhash:    qhash,
+			Query:    query,
+			Instance: inst,
+			Status:   status,
+			Count:    nrec,
+			Bytes:    size,
+			Expire:   expire,
+		}
+		out = append(out, crec)
+	}
+	return out, nil
+}
+
+// Invalidate removes DAS records of queries matching given selection from
+// das.cache and das.merge collections, it returns list of invalidated qhashes
+func Invalidate(sel CacheSelection, dmaps dasmaps.DASMaps) ([]string, error) {
+
+	// defer function profiler
+	defer utils.MeasureTime("das/Invalidate")()
+
+	if sel.Qhash == "" && sel.Query == "" && sel.System == "" && sel.Key == "" {
+		return nil, errors.New("empty cache selection, please provide qhash, query, system or key")
+	}
+	qhashes, err := FindCachedQueries(sel, dmaps)
+	if err != nil {
+		return nil, err
+	}
+	if len(qhashes) == 0 {
+		return qhashes, nil
+	}
+	if err := removeQueries(qhashes); err != nil {
+		return nil, err
+	}
+	log.Printf("invalidate DAS cache %s qhashes=%v\n", sel.String(), qhashes)
+	return qhashes, nil
+}
+
+// helper function to remove records of given DAS queries from das.cache and
+// das.merge collections
+func removeQueries(qhashes []string) error {
+	spec := bson.M{"qhash": bson.M{"$in": qhashes}}
+	if err := mongo.Remove("das", "cache", spec); err != nil {
+		return err
+	}
+	return mongo.Remove("das", "merge", spec)
+}
+
+// Refresh invalidates DAS queries matching given selection and process them
+// again, it returns list of refreshed qhashes
+func Refresh(sel CacheSelection, dmaps dasmaps.DASMaps) ([]string, error) {
+
+	// defer function profiler
+	defer utils.MeasureTime("das/Refresh")()
+
+	qhashes, err := FindCachedQueries(sel, dmaps)
+	if err != nil {
+		return nil, err
+	}
+	if len(qhashes) == 0 {
+		return qhashes, nil
+	}
+	// collect DAS queries before we wipe out their records
+	spec := bson.M{"das.record": 0, "qhash": bson.M{"$in": qhashes}}
+	records, err := mongo.Get("das", "cache", spec, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := Invalidate(sel, dmaps); err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, rec := range records {
+		query, _ := rec["query"].(string)
+		qhash, _ := rec["qhash"].(string)
+		inst, _ := mongo.GetStringValue(rec, "das.instance")
+		dasquery, qlerr, _ := dasql.Parse(query, inst, dmaps.DASKeys())
+		if qlerr != "" {
+			utils.QueryLogger(qhash, "", "").Error("unable to refresh DAS query", "query", query, "error", qlerr)
+			continue
+		}
+		go Process(dasquery, dmaps)
+		out = append(out, dasquery.Qhash)
+	}
+	return out, nil
+}
@@ -7,12 +7,11 @@ package das
 
 import (
 	"fmt"
-	"log"
 	"net/url"
 	"reflect"
 	"regexp"
-	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/dmwm/das2go/dasmaps"
@@ -172,7 +171,7 @@ func FormUrlCall(dasquery dasql.DASQuery, dasmap mongo.DASRecord) string {
 		base = strings.Replace(base, "xml", "json", -1)
 	}
 	if !ok {
-		log.Println("Unable to extract url from DAS map", dasmap)
+		dasquery.Logger().Error("unable to extract url from DAS map", "map", dasmap)
 	}
 	dasmaps := dasmaps.GetDASMaps(dasmap["das_map"])
 	var useArgs []string
@@ -353,7 +352,7 @@ func FormRESTUrl(dasquery dasql.DASQuery, dasmap mongo.DASRecord) string {
 	skeys := utils.MapKeys(spec)
 	base, ok := dasmap["url"].(string)
 	if !ok {
-		log.Println("Unable to extract url from DAS map", dasmap)
+		dasquery.Logger().Error("unable to extract url from DAS map", "map", dasmap)
 	}
 	if !strings.HasPrefix(base, "http") {
 		return "local_api"
@@ -391,7 +390,7 @@ func FormRESTUrl(dasquery dasql.DASQuery, dasmap mongo.DASRecord) string {
 					return base
 				}
 			default:
-				log.Printf("ERROR: invalid type for DAS key, type %T, key %v, map %v\n", spec[dkey], dkey, dmap)
+				dasquery.Logger().Error("invalid type for DAS key", "type", fmt.Sprintf("%T", spec[dkey]), "key", dkey, "map", dmap)
 				return ""
 			}
 		}
@@ -402,10 +401,56 @@ func FormRESTUrl(dasquery dasql.DASQuery, dasmap mongo.DASRecord) string {
 // DASRecords holds list of DAS records
 type DASRecords []mongo.DASRecord
 
+// helper function to start trace span of MongoDB operation of given DAS query
+func mongoSpan(dasquery dasql.DASQuery, op, coll string) *utils.Span {
+	span := utils.StartSpan(dasquery.Span, "mongo."+op)
+	span.SetAttr("db.system", "mongodb")
+	span.SetAttr("db.operation", op)
+	span.SetAttr("db.collection", coll)
+	return span
+}
+
+// helper function to insert records of given DAS query into DAS collection
+func insertRecords(dasquery dasql.DASQuery, coll string, records []mongo.DASRecord) error {
+	span := mongoSpan(dasquery, "Insert", coll)
+	defer span.End()
+	span.SetAttr("db.records", len(records))
+	err := mongo.Insert("das", coll, records)
+	span.SetError(err)
+	return err
+}
+
+// helper function to update status, expire and upstream endpoint of DAS
+// record after processing of given records of system:urn, it returns new
+// expire value
+func updateDASRecord(dasquery dasql.DASQuery, system, urn, endpoint string, records []mongo.DASRecord) int64 {
+	// get DAS record and adjust its settings
+	dasrecord := services.GetDASRecord(dasquery)
+	dasstatus := fmt.Sprintf("process %s:%s", system, urn)
+	dasexpire := services.GetExpire(dasrecord)
+	if len(records) != 0 {
+		rec := records[0]
+		recexpire := services.GetExpire(rec)
+		if dasexpire < recexpire {
+			dasexpire = recexpire
+		}
+	}
+	set := bson.M{"das.status": dasstatus}
+	if endpoint != "" && system != "" {
+		set["das.endpoints."+system] = endpoint
+	}
+	update := bson.M{"$set": set, "$max": bson.M{"das.expire": dasexpire}}
+	if err := services.ModifyDASRecord(dasquery.Qhash, update); err != nil {
+		dasquery.Logger().Error("unable to update DAS record", "error", err)
+	}
+	publishStatus(dasquery.Qhash, dasstatus, false)
+	return dasexpire
+}
+
 // helper function to process given set of URLs associted with dasquery
 func processLocalApis(dasquery dasql.DASQuery, dmaps []mongo.DASRecord, pkeys []string) {
-	if utils.WEBSERVER > 0 && utils.VERBOSE > 0 {
-		log.Println("processLocalApis", dmaps)
+	if utils.WEBSERVER > 0 {
+		dasquery.Logger().Debug("processLocalApis", "maps", dmaps)
 	}
 	// defer function will propagate error message to higher level
 	//     defer utils.ErrPropagate("processLocalApis")
@@ -415,14 +460,18 @@ func processLocalApis(dasquery dasql.DASQuery, dmaps []mongo.DASRecord, pkeys []
 
 	localApiMap := services.LocalAPIMap()
 	for _, dmap := range dmaps {
+		if Cancelled(dasquery.Qhash) {
+			return
+		}
 		urn := dasmaps.GetString(dmap, "urn")
 		system := dasmaps.GetString(dmap, "system")
 		expire := dasmaps.GetInt(dmap, "expire")
 		api := fmt.Sprintf("%s_%s", system, urn)
 		apiFunc := localApiMap[api]
-		if utils.VERBOSE > 0 {
-			log.Printf("DAS look-up: api %s, func %s\n", api, apiFunc)
-		}
+		span := utils.StartSpan(dasquery.Span, "LocalAPI")
+		span.SetAttr("das.system", system)
+		span.SetAttr("das.urn", urn)
+		dasquery.Logger().Debug("DAS look-up", "system", system, "urn", urn, "api", api, "func", apiFunc)
 		// we use reflection to look-up api from our services/localapis.go functions
 		// for details on reflection see
 		// http://stackoverflow.com/questions/12127585/go-lookup-function-by-name
@@ -432,7 +481,7 @@ func processLocalApis(dasquery dasql.DASQuery, dmaps []mongo.DASRecord, pkeys []
 		vals := m.Call(args)[0]                            // return value
 		records := vals.Interface().([]mongo.DASRecord)    // cast reflect value to its type
 		if utils.VERBOSE > 1 {
-			log.Printf("local apis, urn %v, system %v, expire %v, dmap %v, api %v, func %v, method %v, records %v\n", urn, system, expire, dmap, api, apiFunc, m, len(records))
+			dasquery.Logger().Debug("local api", "system", system, "urn", urn, "expire", expire, "map", dmap, "api", api, "func", apiFunc, "records", len(records))
 		}
 
 		records = services.AdjustRecords(dasquery, system, urn, records, expire, pkeys)
@@ -448,17 +497,29 @@ func processLocalApis(dasquery dasql.DASQuery, dmaps []mongo.DASRecord, pkeys []
 				dasexpire = recexpire
 			}
 		}
-		das := dasrecord["das"].(mongo.DASRecord)
-		das["expire"] = dasexpire
-		das["status"] = dasstatus
-		dasrecord["das"] = das
-		services.UpdateDASRecord(dasquery.Qhash, dasrecord)
+		update := bson.M{"$set": bson.M{"das.status": dasstatus}, "$max": bson.M{"das.expire": dasexpire}}
+		if err := services.ModifyDASRecord(dasquery.Qhash, update); err != nil {
+			dasquery.Logger().Error("unable to update DAS record", "error", err)
+		}
+		publishStatus(dasquery.Qhash, dasstatus, false)
 
 		// fix all records expire values based on lowest one
 		records = services.UpdateExpire(dasquery.Qhash, records, dasexpire)
 
 		// insert records into DAS cache collection
-		mongo.Insert("das", "cache", records)
+		span.SetAttr("das.records", len(records))
+		status := "ok"
+		if err := insertRecords(dasquery, "cache", records); err != nil {
+			services.AppendDASError(dasquery, fmt.Sprintf("%s:%s", system, urn), fmt.Errorf("unable to store %s:%s records, %v", system, urn, err))
+			span.SetError(err)
+			status = "fail"
+		}
+		services.SetServiceProgress(dasquery, fmt.Sprintf("%s:%s", system, urn), status, len(records))
+		dasquery.Debug.AddRecords(fmt.Sprintf("%s:%s", system, urn), len(records))
+		span.End()
+	}
+	if Cancelled(dasquery.Qhash) {
+		return
 	}
 	// initial expire timestamp is 1h
 	//     expire := utils.Expire(3600)
@@ -469,17 +530,43 @@ func processLocalApis(dasquery dasql.DASQuery, dmaps []mongo.DASRecord, pkeys []
 	if dasexpire < expire {
 		dasexpire = expire
 	}
-	das := dasrecord["das"].(mongo.DASRecord)
-	das["expire"] = dasexpire
-	das["status"] = "ok"
-	dasrecord["das"] = das
-	services.UpdateDASRecord(dasquery.Qhash, dasrecord)
+	update := bson.M{"$set": bson.M{"das.status": services.FinalStatus(dasrecord)}, "$max": bson.M{"das.expire": dasexpire}}
+	if err := services.ModifyDASRecord(dasquery.Qhash, update); err != nil {
+		dasquery.Logger().Error("unable to update DAS record", "error", err)
+	}
+}
+
+// helper function to find system, urn and expire of DAS map which
+// corresponds to given upstream url
+func urlMap(dasquery dasql.DASQuery, rurl string, maps []mongo.DASRecord) (string, string, int) {
+	system := ""
+	expire := 0
+	urn := ""
+	for _, dmap := range maps {
+		surl := dasmaps.GetString(dmap, "url")
+		// TMP fix, until we fix Phedex data to use JSON
+		if strings.Contains(surl, "phedex") {
+			surl = strings.Replace(surl, "xml", "json", -1)
+		}
+		// here we check that request Url match DAS map one either by splitting
+		// base from parameters or making a match for REST based urls
+		stm := dasmaps.GetString(dmap, "system")
+		if stm == "dbs3" {
+			surl = fixDBSinstance(dasquery.Instance, surl)
+		}
+		if strings.Split(rurl, "?")[0] == surl || strings.HasPrefix(rurl, surl) || rurl == surl {
+			urn = dasmaps.GetString(dmap, "urn")
+			system = dasmaps.GetString(dmap, "system")
+			expire = dasmaps.GetInt(dmap, "expire")
+		}
+	}
+	return system, urn, expire
 }
 
 // helper function to process given set of URLs associted with dasquery
 func processURLs(dasquery dasql.DASQuery, urls map[string]string, maps []mongo.DASRecord, dmaps dasmaps.DASMaps, pkeys []string) {
-	if utils.WEBSERVER > 0 && utils.VERBOSE > 0 {
-		log.Println("processURLs", urls)
+	if utils.WEBSERVER > 0 {
+		dasquery.Logger().Debug("processURLs", "urls", urls)
 	}
 	// defer function will propagate error message to higher level
 	//     defer utils.ErrPropagate("processUrls")
@@ -487,13 +574,21 @@ func processURLs(dasquery dasql.DASQuery, urls map[string]string, maps []mongo.D
 	// defer function profiler
 	defer utils.MeasureTime("das/processURLs")()
 
+	// keep track of memory held by decoded records of this query
+	tracker := &utils.MemoryTracker{}
+	defer utils.MeasureMemory("das/processURLs", dasquery.Qhash, tracker)
+
 	out := make(chan utils.ResponseType)
 	defer close(out)
 	umap := map[string]int{}
 	client := utils.HttpClient()
+	// upstream responses are streamed and decoded incrementally
+	ctx := dasquery.FetchContext()
+	ctx.Stream = true
 	for furl, args := range urls {
 		umap[furl] = 1 // keep track of processed urls below
-		go utils.Fetch(client, furl, args, out)
+		_, ctx.Urn, _ = urlMap(dasquery, furl, maps)
+		go utils.FetchWithContext(ctx, client, furl, args, out)
 	}
 
 	// collect all results from out channel
@@ -501,58 +596,62 @@ func processURLs(dasquery dasql.DASQuery, urls map[string]string, maps []mongo.D
 	for {
 		select {
 		case r := <-out:
-			system := ""
-			expire := 0
-			urn := ""
-			for _, dmap := range maps {
-				surl := dasmaps.GetString(dmap, "url")
-				// TMP fix, until we fix Phedex data to use JSON
-				if strings.Contains(surl, "phedex") {
-					surl = strings.Replace(surl, "xml", "json", -1)
-				}
-				// here we check that request Url match DAS map one either by splitting
-				// base from parameters or making a match for REST based urls
-				stm := dasmaps.GetString(dmap, "system")
-				if stm == "dbs3" {
-					surl = fixDBSinstance(dasquery.Instance, surl)
-				}
-				if strings.Split(r.Url, "?")[0] == surl || strings.HasPrefix(r.Url, surl) || r.Url == surl {
-					urn = dasmaps.GetString(dmap, "urn")
-					system = dasmaps.GetString(dmap, "system")
-					expire = dasmaps.GetInt(dmap, "expire")
-				}
+			// discard responses of cancelled query
+			if Cancelled(dasquery.Qhash) {
+				r.Close()
+				delete(umap, r.Url)
+				continue
 			}
-			// process data records
+			system, urn, expire := urlMap(dasquery, r.Url, maps)
+			// record upstream errors along with their class in DAS record
+			if r.Error != nil {
+				services.AppendDASError(dasquery, fmt.Sprintf("%s:%s", system, urn), fmt.Errorf("%s:%s %s error: %w", system, urn, utils.ErrorClass(r.Error), r.Error))
+			}
+			// process data records in batches, the first batch defines
+			// expire of DAS record and all records
 			notations := dmaps.FindNotations(system)
-			records := services.Unmarshal(dasquery, system, urn, r, notations, pkeys)
-			records = services.AdjustRecords(dasquery, system, urn, records, expire, pkeys)
-
-			// get DAS record and adjust its settings
-			dasrecord := services.GetDASRecord(dasquery)
-			dasstatus := fmt.Sprintf("process %s:%s", system, urn)
-			dasexpire := services.GetExpire(dasrecord)
-			if len(records) != 0 {
-				rec := records[0]
-				recexpire := services.GetExpire(rec)
-				if dasexpire < recexpire {
-					dasexpire = recexpire
+			processed := false
+			var dasexpire int64
+			var nrec int
+			span := utils.StartSpan(dasquery.Span, "Unmarshal")
+			span.SetAttr("das.system", system)
+			span.SetAttr("das.urn", urn)
+			process := func(records []mongo.DASRecord) error {
+				nrec += len(records)
+				records = services.AdjustRecords(dasquery, system, urn, records, expire, pkeys)
+				if !processed {
+					dasexpire = updateDASRecord(dasquery, system, urn, r.Endpoint, records)
+					processed = true
 				}
-			}
-			das := dasrecord["das"].(mongo.DASRecord)
-			das["expire"] = dasexpire
-			das["status"] = dasstatus
-			dasrecord["das"] = das
-			services.UpdateDASRecord(dasquery.Qhash, dasrecord)
+				// fix all records expire values based on lowest one
+				records = services.UpdateExpire(dasquery.Qhash, records, dasexpire)
 
-			// fix all records expire values based on lowest one
-			records = services.UpdateExpire(dasquery.Qhash, records, dasexpire)
-
-			// insert records into DAS cache collection
-			mongo.Insert("das", "cache", records)
+				// insert records into DAS cache collection
+				return insertRecords(dasquery, "cache", records)
+			}
+			err := services.StreamUnmarshal(dasquery, system, urn, r, notations, pkeys, tracker, process)
+			if err != nil {
+				services.AppendDASError(dasquery, fmt.Sprintf("%s:%s", system, urn), fmt.Errorf("unable to store %s:%s records, %v", system, urn, err))
+			}
+			span.SetAttr("das.records", nrec)
+			span.SetError(err)
+			span.End()
+			if !processed {
+				updateDASRecord(dasquery, system, urn, r.Endpoint, nil)
+			}
+			// not-found response is a valid answer without records
+			status := "ok"
+			if services.FailedService(r.Error) || err != nil {
+				status = "fail"
+			}
+			services.SetServiceProgress(dasquery, fmt.Sprintf("%s:%s", system, urn), status, nrec)
+			dasquery.Debug.AddRecords(fmt.Sprintf("%s:%s", system, urn), nrec)
 			// remove from umap, indicate that we processed it
 			delete(umap, r.Url) // remove Url from map
 		default:
-			if len(umap) == 0 { // no more requests, merge data records
+			if len(umap) == 0 && Cancelled(dasquery.Qhash) {
+				exit = true
+			} else if len(umap) == 0 { // no more requests, merge data records
 				expire := services.GetMinExpire(dasquery)
 				// get DAS record and adjust its settings
 				dasrecord := services.GetDASRecord(dasquery)
@@ -560,11 +659,10 @@ func processURLs(dasquery dasql.DASQuery, urls map[string]string, maps []mongo.D
 				if dasexpire < expire {
 					dasexpire = expire
 				}
-				das := dasrecord["das"].(mongo.DASRecord)
-				das["expire"] = dasexpire
-				das["status"] = "ok"
-				dasrecord["das"] = das
-				services.UpdateDASRecord(dasquery.Qhash, dasrecord)
+				update := bson.M{"$set": bson.M{"das.status": services.FinalStatus(dasrecord)}, "$max": bson.M{"das.expire": dasexpire}}
+				if err := services.ModifyDASRecord(dasquery.Qhash, update); err != nil {
+					dasquery.Logger().Error("unable to update DAS record", "error", err)
+				}
 				exit = true
 			}
 			time.Sleep(time.Duration(10) * time.Millisecond) // wait for response
@@ -701,6 +799,26 @@ func ProcessLogic(dasquery dasql.DASQuery, maps []mongo.DASRecord, selectedServi
 	return srvs, pkeys, urls, localApis
 }
 
+// number of DAS queries which are being processed
+var inFlightQueries int64
+
+// InFlightQueries returns number of DAS queries which are being processed
+func InFlightQueries() int64 {
+	return atomic.LoadInt64(&inFlightQueries)
+}
+
+// helper function to store debug trace of DAS query requested in debug mode
+// in given DAS record (das.record=0)
+func storeDebugTrace(dasquery dasql.DASQuery, dasrecord mongo.DASRecord) {
+	if dasquery.Debug == nil {
+		return
+	}
+	if das, ok := dasrecord["das"].(mongo.DASRecord); ok {
+		das["debug"] = dasquery.Debug.Copy()
+		dasrecord["das"] = das
+	}
+}
+
 // Process takes care of processing given DAS query
 func Process(dasquery dasql.DASQuery, dmaps dasmaps.DASMaps) {
 	// defer function will propagate error message to higher level
@@ -709,38 +827,81 @@ func Process(dasquery dasql.DASQuery, dmaps dasmaps.DASMaps) {
 	// defer function profiler
 	defer utils.MeasureTime("das/Process")()
 
+	atomic.AddInt64(&inFlightQueries, 1)
+	defer atomic.AddInt64(&inFlightQueries, -1)
+
+	// trace processing of DAS query as part of DAS request
+	span := utils.StartSpan(dasquery.Span, "Process")
+	defer span.End()
+	span.SetAttr("das.qhash", dasquery.Qhash)
+	dasquery.Span = span
+
+	// log lifecycle of DAS query, all records carry its qhash
+	time0 := time.Now()
+	logger := dasquery.Logger()
+	logger.Info("process DAS query", "query", dasquery.Query, "instance", dasquery.Instance)
+	status := "fail"
+	defer func() {
+		logger.Info("DAS query processed", "status", status, "duration", time.Since(time0))
+	}()
+
+	// new processing of the query resets its cancellation, functions waiting
+	// for the query are called when processing is finished
+	cancelled.Delete(dasquery.Qhash)
+	defer notifyDone(dasquery.Qhash)
+
 	// find out list of APIs/CMS services which can process this query request
+	fspan := utils.StartSpan(span, "FindServices")
 	maps := dmaps.FindServices(dasquery)
+	fspan.SetAttr("das.maps", len(maps))
+	fspan.End()
 
 	// get list of services, pkeys, urls and localApis we need to process
 	// but for das2go we don't need to use selectedServices, here we'll pass empty list
 	var selectedServices []string
 	srvs, pkeys, urls, localApis := ProcessLogic(dasquery, maps, selectedServices)
+	if dasquery.Debug != nil {
+		var names []string
+		for _, dmap := range maps {
+			names = append(names, fmt.Sprintf("%s:%s", dasmaps.GetString(dmap, "system"), dasmaps.GetString(dmap, "urn")))
+		}
+		dasquery.Debug.SetMaps(names, urls)
+	}
 
-	if utils.WEBSERVER > 0 && utils.VERBOSE > 0 {
-		log.Println("ProcessLogic, services", srvs, "pkeys", pkeys, "urls", urls, "localApis", localApis)
+	if utils.WEBSERVER > 0 {
+		logger.Debug("ProcessLogic", "services", srvs, "pkeys", pkeys, "urls", urls, "localApis", localApis)
 	}
 
 	if len(srvs) == 0 {
 		if utils.WEBSERVER > 0 {
-			log.Printf("unable to find any CMS service to fullfil this request, query: %s\n", dasquery.String())
+			logger.Warn("unable to find any CMS service to fullfil this request", "query", dasquery.Query, "instance", dasquery.Instance)
 		} else {
 			fmt.Println("DAS WARNING", dasquery, "unable to find any CMS service to fullfil this request")
 		}
 		dasrecord := services.CreateDASErrorRecord(dasquery, pkeys)
+		dasquery.Debug.AddMerge("no CMS service matches the query, store DAS error record")
+		storeDebugTrace(dasquery, dasrecord)
 		var records []mongo.DASRecord
 		records = append(records, dasrecord)
-		mongo.Insert("das", "cache", records)
-		mongo.Insert("das", "merge", records)
+		if err := insertRecords(dasquery, "cache", records); err != nil {
+			logger.Error("unable to insert DAS record", "error", err)
+		}
+		if err := insertRecords(dasquery, "merge", records); err != nil {
+			logger.Error("unable to insert DAS record", "error", err)
+		}
+		status = "ok"
+		publishStatus(dasquery.Qhash, status, true)
 		return
 	}
 	dasrecord := services.CreateDASRecord(dasquery, srvs, pkeys)
-	if utils.VERBOSE > 0 {
-		log.Printf("services.CreateDASRecord, record %v, services %v, pkeys %v\n", dasrecord, srvs, pkeys)
-	}
+	logger.Debug("services.CreateDASRecord", "record", dasrecord, "services", srvs, "pkeys", pkeys)
 	var records []mongo.DASRecord
 	records = append(records, dasrecord)
-	mongo.Insert("das", "cache", records)
+	if err := insertRecords(dasquery, "cache", records); err != nil {
+		// without DAS record we can't track the query, there is nothing else we can do
+		logger.Error("unable to insert DAS record", "error", err)
+		return
+	}
 
 	// process local_api calls, we use GoDeferFunc to run processLocalApis as goroutine in defer/silent mode
 	// errors will be captured in GoDeferFunc and passed again into this local function
@@ -752,55 +913,111 @@ func Process(dasquery dasql.DASQuery, dmaps dasmaps.DASMaps) {
 		utils.GoDeferFunc("go processURLs", func() { processURLs(dasquery, urls, maps, dmaps, pkeys) })
 	}
 
+	if Cancelled(dasquery.Qhash) {
+		span.SetAttr("das.cancelled", true)
+		status = "cancelled"
+		return
+	}
+
 	// merge DAS cache records
+	publishStatus(dasquery.Qhash, "merge", false)
+	mspan := utils.StartSpan(span, "MergeDASRecords")
 	records, _ = services.MergeDASRecords(dasquery)
-	mongo.Insert("das", "merge", records)
+	dasquery.Debug.AddMerge("store %d merged records", len(records))
+	mspan.SetAttr("das.records", len(records))
+	mspan.End()
+	if err := insertRecords(dasquery, "merge", records); err != nil {
+		services.AppendDASError(dasquery, "das", fmt.Errorf("unable to store merged records, %v", err))
+	}
 
 	// insert das.record=0 into DAS Merge collection to indicate that we done with request
 	spec := bson.M{"das.record": 0, "qhash": dasquery.Qhash}
-	recs := mongo.Get("das", "cache", spec, 0, 1)
-	mongo.Insert("das", "merge", recs)
+	gspan := mongoSpan(dasquery, "Get", "cache")
+	recs, err := mongo.Get("das", "cache", spec, 0, 1)
+	gspan.SetError(err)
+	gspan.End()
+	if err != nil {
+		logger.Error("unable to get DAS record", "error", err)
+		publishStatus(dasquery.Qhash, "fail", true)
+		return
+	}
+	if len(recs) > 0 {
+		status, _ = mongo.GetValue(recs[0], "das.status").(string)
+		dasquery.Debug.AddMerge("DAS query is processed with status %s", status)
+		storeDebugTrace(dasquery, recs[0])
+	}
+	if err := insertRecords(dasquery, "merge", recs); err != nil {
+		logger.Error("unable to insert DAS record into merge collection", "error", err)
+	}
+	publishStatus(dasquery.Qhash, QueryStatus(dasquery.Qhash, status), true)
 }
 
-// helper function to modify spec with given filter
-func modSpec(spec bson.M, filter string) {
-	var key, val, op string
-	var vals []string
-	if strings.Index(filter, "<") > 0 {
-		if strings.Index(filter, "<=") > 0 {
-			vals = strings.Split(filter, "<=")
-			op = "$le"
-		} else {
-			vals = strings.Split(filter, "<")
-			op = "$lt"
+// helper function to build spec for DAS data records of given query, it
+// returns spec with applied grep conditions and list of grep fields
+func dataSpec(dasquery dasql.DASQuery) (bson.M, []string) {
+	spec := bson.M{"qhash": dasquery.Qhash, "das.record": 1}
+	var afilters []string
+	var exprs []dasql.FilterExpr
+	for _, val := range dasquery.Filters["grep"] {
+		f, err := dasql.ParseFilterExpr(val)
+		if err != nil {
+			dasquery.Logger().Error("unable to parse grep filter", "filter", val, "error", err)
+			continue
 		}
-	} else if strings.Index(filter, "<") > 0 {
-		if strings.Index(filter, ">=") > 0 {
-			vals = strings.Split(filter, ">=")
-			op = "$ge"
-		} else {
-			vals = strings.Split(filter, ">")
-			op = "$gt"
+		if f.Op == "" {
+			afilters = append(afilters, f.Key)
+			continue
 		}
-	} else if strings.Index(filter, "!=") > 0 {
-		vals = strings.Split(filter, "!=")
-		op = "$ne"
-	} else if strings.Index(filter, "=") > 0 {
-		vals = strings.Split(filter, "=")
-		op = "$eq"
-	} else {
-		return
+		exprs = append(exprs, f)
 	}
-	key = vals[0]
-	val = vals[1]
-	var cond bson.M
-	if utils.IsInt(val) {
-		ival, _ := strconv.Atoi(val)
-		cond = bson.M{op: ival}
-	} else {
-		cond = bson.M{op: val}
+	if conds := dasql.FilterConditions(exprs); len(conds) > 0 {
+		spec["$and"] = conds
 	}
-	spec[key] = cond
+	return spec, afilters
+}
+
+// helper function to clean-up sort keys, e.g. "-file.size" stands for
+// descending order of file.size
+func sortKeys(keys []string) []string {
+	var out []string
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key == "" || key == "-" || key == "_NA_" {
+			continue
+		}
+		out = append(out, key)
+	}
+	return out
+}
+
+// helper function to get keys used by unique filter, i.e. grep fields or
+// DAS query selection keys
+func uniqueKeys(dasquery dasql.DASQuery, afilters []string) []string {
+	if len(afilters) > 0 {
+		return afilters
+	}
+	return dasquery.Fields
+}
+
+// CountData returns number of DAS data records for given DAS query taking into
+// account its filters
+func CountData(dasquery dasql.DASQuery, coll string) int {
+	spec, afilters := dataSpec(dasquery)
+	if _, ok := dasquery.Filters["unique"]; ok {
+		pipeline := uniquePipeline(spec, afilters, uniqueKeys(dasquery, afilters), nil, 0, -1)
+		pipeline = append(pipeline, bson.M{"$count": "nrec"})
+		records, err := mongo.Aggregate("das", coll, pipeline)
+		if err != nil || len(records) == 0 {
+			return 0
+		}
+		nrec, _ := toFloat(records[0]["nrec"])
+		return int(nrec)
+	}
+	nrec, err := mongo.Count("das", coll, spec)
+	if err != nil {
+		dasquery.Logger().Error("unable to count DAS records", "collection", coll, "error", err)
+	}
+	return nrec
 }
 
 // GetData for given pid (DAS Query qhash)
@@ -810,38 +1027,26 @@ func GetData(dasquery dasql.DASQuery, coll string, idx, limit int) (string, []mo
 	defer utils.MeasureTime("das/GetData")()
 
 	var emptyData, data []mongo.DASRecord
+	var err error
 	pid := dasquery.Qhash
 	filters := dasquery.Filters
 	aggrs := dasquery.Aggregators
-	if len(aggrs) > 0 { // if we need to aggregate we should ignore pagination
-		idx = 0
-		limit = -1
-	}
-	spec := bson.M{"qhash": pid, "das.record": 1}
-	skeys := filters["sort"]
-	if len(filters) > 0 {
-		var afilters []string
-		for key, vals := range filters {
-			if key == "grep" {
-				for _, val := range vals {
-					if strings.Index(val, "<") > 0 || strings.Index(val, "<") > 0 || strings.Index(val, "!") > 0 || strings.Index(val, "=") > 0 {
-						modSpec(spec, val)
-					} else {
-						afilters = append(afilters, val)
-					}
-				}
-			}
-		}
-		if len(afilters) > 0 {
-			data = mongo.GetFilteredSorted("das", coll, spec, afilters, skeys, idx, limit)
-		} else {
-			data = mongo.Get("das", coll, spec, idx, limit)
-		}
+	spec, afilters := dataSpec(dasquery)
+	skeys := sortKeys(filters["sort"])
+	span := mongoSpan(dasquery, "GetData", coll)
+	if len(aggrs) > 0 {
+		data, err = aggregateData(coll, spec, aggrs, dasquery.Logger())
+	} else if _, ok := filters["unique"]; ok {
+		pipeline := uniquePipeline(spec, afilters, uniqueKeys(dasquery, afilters), skeys, idx, limit)
+		data, err = mongo.Aggregate("das", coll, pipeline)
 	} else {
-		data = mongo.Get("das", coll, spec, idx, limit)
+		data, err = mongo.GetFilteredSorted("das", coll, spec, afilters, skeys, idx, limit)
 	}
-	if len(aggrs) > 0 {
-		data = aggregateAll(data, aggrs)
+	span.SetAttr("db.records", len(data))
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		return fmt.Sprintf("ERROR failed to get data from DAS cache: %s\n", err), emptyData
 	}
 
 	// perform post-processing of DAS records
@@ -849,7 +1054,10 @@ func GetData(dasquery dasql.DASQuery, coll string, idx, limit int) (string, []mo
 
 	// Get DAS status from merge collection
 	spec = bson.M{"qhash": pid, "das.record": 0}
-	dasData := mongo.Get("das", "merge", spec, 0, 1)
+	dasData, err := mongo.Get("das", "merge", spec, 0, 1)
+	if err != nil {
+		return fmt.Sprintf("ERROR failed to get DAS record from das.merge collection: %s\n", err), emptyData
+	}
 	if len(dasData) == 0 {
 		return fmt.Sprintf("ERROR no DAS record found in das.merge collection\n"), emptyData
 	}
@@ -921,83 +1129,14 @@ func PostProcessing(dasquery dasql.DASQuery, data []mongo.DASRecord) []mongo.DAS
 	return data
 }
 
-// helper function to aggregate results over provided aggregators
-// we'll use go routine to do this in parallel
-func aggregateAll(data []mongo.DASRecord, aggrs [][]string) []mongo.DASRecord {
-
-	// defer function profiler
-	defer utils.MeasureTime("das/aggregateAll")()
-
-	var out []mongo.DASRecord
-	ch := make(chan mongo.DASRecord)
-	defer close(ch)
-	for _, agg := range aggrs {
-		fagg := agg[0]
-		fval := agg[1]
-		go aggregate(data, fagg, fval, ch)
-	}
-	// collect results
-	for {
-		select {
-		case r := <-ch:
-			out = append(out, r)
-		default:
-			time.Sleep(time.Duration(10) * time.Millisecond) // wait for response
-		}
-		if len(out) == len(aggrs) {
-			break
-		}
-	}
-	return out
-}
-
-// helper function to aggregate results for given function and key and yield them to channel
-func aggregate(data []mongo.DASRecord, agg, key string, ch chan mongo.DASRecord) {
-	ch <- Aggregate(data, agg, key)
-}
-
-// Aggregate function aggregates results for given function and key
-func Aggregate(data []mongo.DASRecord, agg, key string) mongo.DASRecord {
-	var values []interface{}
-	for _, r := range data {
-		val := mongo.GetValue(r, key)
-		values = append(values, val)
-	}
-	var rec mongo.DASRecord
-	switch agg {
-	case "sum":
-		rec = mongo.DASRecord{"result": mongo.DASRecord{"value": utils.Sum(values)}, "function": "sum", "key": key}
-	case "min":
-		rec = mongo.DASRecord{"result": mongo.DASRecord{"value": utils.Min(values)}, "function": "min", "key": key}
-	case "max":
-		rec = mongo.DASRecord{"result": mongo.DASRecord{"value": utils.Max(values)}, "function": "max", "key": key}
-	case "mean":
-		rec = mongo.DASRecord{"result": mongo.DASRecord{"value": utils.Mean(values)}, "function": "mean", "key": key}
-	case "count":
-		rec = mongo.DASRecord{"result": mongo.DASRecord{"value": len(values)}, "function": "count", "key": key}
-	case "median":
-		rec = mongo.DASRecord{"result": mongo.DASRecord{"value": utils.Median(values)}, "function": "median", "key": key}
-	case "avg":
-		rec = mongo.DASRecord{"result": mongo.DASRecord{"value": utils.Avg(values)}, "function": "avg", "key": key}
-	default:
-		rec = make(mongo.DASRecord)
-	}
-	if len(data) > 0 {
-		rec["das"] = data[0]["das"]
-	} else {
-		rec["das"] = "Unable to aggregate"
-	}
-	return rec
-}
-
 // Count gets number of records for given DAS query qhash
-func Count(pid string) int {
+func Count(pid string) (int, error) {
 	spec := bson.M{"qhash": pid, "das.record": 1}
 	return mongo.Count("das", "merge", spec)
 }
 
 // Bytes gets size of records for given DAS query
-func Bytes(pid string) int {
+func Bytes(pid string) (int, error) {
 	spec := bson.M{"qhash": pid, "das.record": 1}
 	return mongo.Bytes("das", "merge", spec)
 }
@@ -1005,7 +1144,10 @@ func Bytes(pid string) int {
 // GetTimestamp gets initial timestamp of DAS query request
 func GetTimestamp(pid string) int64 {
 	spec := bson.M{"qhash": pid, "das.record": 0}
-	data := mongo.Get("das", "cache", spec, 0, 1)
+	data, err := mongo.Get("das", "cache", spec, 0, 1)
+	if err != nil || len(data) == 0 {
+		return time.Now().Unix()
+	}
 	ts, err := mongo.GetInt64Value(data[0], "das.ts")
 	if err != nil {
 		return time.Now().Unix()
@@ -1017,23 +1159,66 @@ func GetTimestamp(pid string) int64 {
 // we look-up DAS record (record=0) with status ok (merging step is done)
 func CheckDataReadiness(pid string) bool {
 	espec := bson.M{"$gt": time.Now().Unix()}
-	spec := bson.M{"qhash": pid, "das.expire": espec, "das.record": 0, "das.status": "ok"}
-	nrec := mongo.Count("das", "merge", spec)
-	if nrec == 1 {
-		return true
+	spec := bson.M{"qhash": pid, "das.expire": espec, "das.record": 0, "das.status": bson.M{"$in": []string{"ok", "fail"}}}
+	nrec, err := mongo.Count("das", "merge", spec)
+	return err == nil && nrec == 1
+}
+
+// Errors returns list of errors occurred during processing of DAS query
+func Errors(pid string) []string {
+	spec := bson.M{"qhash": pid, "das.record": 0}
+	recs, err := mongo.Get("das", "merge", spec, 0, 1)
+	if err != nil {
+		return []string{err.Error()}
 	}
-	return false
+	if len(recs) == 0 {
+		return []string{}
+	}
+	return services.DASErrors(recs[0])
+}
+
+// ServiceErrors returns errors occurred during processing of DAS query keyed
+// by service, e.g. dbs3:datasets
+func ServiceErrors(pid string) map[string][]string {
+	spec := bson.M{"qhash": pid, "das.record": 0}
+	recs, err := mongo.Get("das", "merge", spec, 0, 1)
+	if err != nil {
+		return map[string][]string{"das": {err.Error()}}
+	}
+	if len(recs) == 0 {
+		return map[string][]string{}
+	}
+	return services.DASServiceErrors(recs[0])
+}
+
+// Services returns list of services used to process DAS query
+func Services(pid string) []string {
+	spec := bson.M{"qhash": pid, "das.record": 0}
+	recs, err := mongo.Get("das", "cache", spec, 0, 1)
+	if err != nil || len(recs) == 0 {
+		return []string{}
+	}
+	return services.DASServices(recs[0])
+}
+
+// DebugInfo returns debug trace of DAS query with given pid processed in
+// debug mode, it returns false if query is not processed or has no trace
+func DebugInfo(pid string) (mongo.DASRecord, bool) {
+	spec := bson.M{"qhash": pid, "das.record": 0}
+	recs, err := mongo.Get("das", "merge", spec, 0, 1)
+	if err != nil || len(recs) == 0 {
+		return nil, false
+	}
+	trace, ok := mongo.GetValue(recs[0], "das.debug").(mongo.DASRecord)
+	return trace, ok
 }
 
 // CheckData checks if data exists in DAS cache for given query/pid
 func CheckData(pid string) bool {
 	espec := bson.M{"$gt": time.Now().Unix()}
 	spec := bson.M{"qhash": pid, "das.expire": espec}
-	nrec := mongo.Count("das", "cache", spec)
-	if nrec > 0 {
-		return true
-	}
-	return false
+	nrec, err := mongo.Count("das", "cache", spec)
+	return err == nil && nrec > 0
 }
 
 // RemoveExpired remove expired records
@@ -1047,14 +1232,14 @@ func RemoveExpired(pid string) {
 // TimeStamp returns list of DAS queries which are currently processing by the server
 func TimeStamp(dasquery dasql.DASQuery) int64 {
 	spec := bson.M{"das.record": 0, "qhash": dasquery.Qhash}
-	recs := mongo.Get("das", "cache", spec, 0, 1)
-	if len(recs) == 0 {
-		log.Printf("ERROR: unable to find das record, query: %s, spec %#v\n", dasquery.String(), spec)
+	recs, err := mongo.Get("das", "cache", spec, 0, 1)
+	if err != nil || len(recs) == 0 {
+		dasquery.Logger().Error("unable to find DAS record", "spec", spec)
 		return 0
 	}
 	ts, err := mongo.GetInt64Value(recs[0], "das.ts")
 	if err != nil {
-		log.Printf("ERROR: unable to find das record, query: %s, spec %#v\n", dasquery.String(), spec)
+		dasquery.Logger().Error("unable to find DAS record", "spec", spec)
 		return 0
 	}
 	return ts
@@ -1064,12 +1249,14 @@ func TimeStamp(dasquery dasql.DASQuery) int64 {
 func ProcessingQueries() []string {
 	var out []string
 	spec := bson.M{"das.record": 0, "das.status": "processing"}
-	for _, r := range mongo.Get("das", "cache", spec, 0, 0) {
+	records, _ := mongo.Get("das", "cache", spec, 0, 0)
+	for _, r := range records {
 		q := r["query"].(string)
 		out = append(out, q)
 	}
 	spec = bson.M{"das.record": 0, "das.status": "requested"}
-	for _, r := range mongo.Get("das", "cache", spec, 0, 0) {
+	records, _ = mongo.Get("das", "cache", spec, 0, 0)
+	for _, r := range records {
 		q := r["query"].(string)
 		out = append(out, q)
 	}
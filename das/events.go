@@ -0,0 +1,78 @@
+package das
+
+// DAS query status events module
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+// Status transitions of DAS record (das.record=0), e.g. "process dbs3:files",
+// "process rucio:site4file", "ok", are published to subscribers of the query
+// pid, e.g. Server-Sent Events stream of DAS web UI.
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dmwm/das2go/services"
+)
+
+// StatusEvent represents status transition of DAS query
+type StatusEvent struct {
+	Pid    string `json:"pid"`    // DAS query pid
+	Status string `json:"status"` // DAS record status
+	Done   bool   `json:"done"`   // processing of DAS query is finished
+	Time   int64  `json:"ts"`     // time of status transition
+}
+
+// StatusEventBuffer defines number of events buffered for every subscriber,
+// events of slow subscribers are dropped
+var StatusEventBuffer = 16
+
+// registry of status subscribers keyed by query pid
+var statusSubscribers = make(map[string]map[chan StatusEvent]struct{})
+var statusMutex sync.Mutex
+
+// SubscribeStatus subscribes to status events of DAS query with given pid,
+// it returns events channel and function to unsubscribe
+func SubscribeStatus(pid string) (<-chan StatusEvent, func()) {
+	ch := make(chan StatusEvent, StatusEventBuffer)
+	statusMutex.Lock()
+	subs, ok := statusSubscribers[pid]
+	if !ok {
+		subs = make(map[chan StatusEvent]struct{})
+		statusSubscribers[pid] = subs
+	}
+	subs[ch] = struct{}{}
+	statusMutex.Unlock()
+	unsubscribe := func() {
+		statusMutex.Lock()
+		defer statusMutex.Unlock()
+		delete(statusSubscribers[pid], ch)
+		if len(statusSubscribers[pid]) == 0 {
+			delete(statusSubscribers, pid)
+		}
+	}
+	return ch, unsubscribe
+}
+
+// QueryStatus returns final status of DAS query with given pid as it is
+// reported to clients, failed query which has data records is partial
+func QueryStatus(pid, status string) string {
+	if status != "fail" {
+		return status
+	}
+	nrec, _ := Count(pid)
+	return services.QueryStatus(status, nrec)
+}
+
+// helper function to publish status of DAS query to its subscribers
+func publishStatus(pid, status string, done bool) {
+	event := StatusEvent{Pid: pid, Status: status, Done: done, Time: time.Now().Unix()}
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	for ch := range statusSubscribers[pid] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
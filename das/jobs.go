@@ -0,0 +1,199 @@
+package das
+
+// DAS query jobs module
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+// Long running DAS queries can be submitted as jobs: clients follow
+// processing of a query by its pid using per-service progress stored in DAS
+// record (das.record=0), they may cancel processing and register functions
+// called when processing is finished.
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dmwm/das2go/dasmaps"
+	"github.com/dmwm/das2go/dasql"
+	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/services"
+	"github.com/dmwm/das2go/utils"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ServiceProgress represents processing status of DAS query by a service
+type ServiceProgress struct {
+	Service string   `json:"service"`          // service name, e.g. dbs3:datasets
+	Status  string   `json:"status"`           // pending, ok or fail
+	Records int64    `json:"records"`          // number of records provided by the service
+	Errors  []string `json:"errors,omitempty"` // service errors
+}
+
+// QueryProgress represents processing status of DAS query
+type QueryProgress struct {
+	Pid       string            `json:"pid"`       // DAS query pid
+	Query     string            `json:"query"`     // DAS query
+	Instance  string            `json:"instance"`  // DBS instance
+	Status    string            `json:"status"`    // processing, ok, partial, fail or cancelled
+	Nresults  int               `json:"nresults"`  // number of merged records
+	Timestamp int64             `json:"timestamp"` // time when DAS query was requested
+	Services  []ServiceProgress `json:"services"`  // progress of individual services
+}
+
+// Done returns true if processing of DAS query is finished
+func (p QueryProgress) Done() bool {
+	return p.Status == "ok" || p.Status == "partial" || p.Status == "fail" || p.Status == "cancelled"
+}
+
+// CancelTTL defines how long cancellation of DAS query is reported by
+// Progress, expired cancellations are pruned
+var CancelTTL = 10 * time.Minute
+
+// registry of cancelled DAS queries, values are times of cancellation
+var cancelled sync.Map
+
+// registry of users who submitted unfinished jobs keyed by query pid
+var jobOwners = make(map[string]map[string]struct{})
+var jobMutex sync.Mutex
+
+// registry of functions called when processing of DAS query is finished
+var doneHooks = make(map[string][]func())
+var doneMutex sync.Mutex
+
+// Cancelled returns true if processing of DAS query with given pid was cancelled
+func Cancelled(pid string) bool {
+	_, ok := cancelled.Load(pid)
+	return ok
+}
+
+// Cancel cancels processing of DAS query with given pid and removes its
+// records from DAS cache. Upstream requests which are in flight are
+// completed but their data is discarded.
+func Cancel(pid string) error {
+	pruneCancelled()
+	cancelled.Store(pid, time.Now())
+	if err := removeQueries([]string{pid}); err != nil {
+		return err
+	}
+	utils.QueryLogger(pid, "", "").Info("cancel DAS query")
+	publishStatus(pid, "cancelled", true)
+	notifyDone(pid)
+	return nil
+}
+
+// Submit starts processing of DAS query unless its data is already in DAS
+// cache or is being processed, previous cancellation of the query is reset.
+// User of DAS query is recorded as owner of the job until it is finished.
+func Submit(dasquery dasql.DASQuery, dmaps dasmaps.DASMaps) {
+	cancelled.Delete(dasquery.Qhash)
+	if CheckDataReadiness(dasquery.Qhash) {
+		return
+	}
+	jobMutex.Lock()
+	owners, ok := jobOwners[dasquery.Qhash]
+	if !ok {
+		owners = make(map[string]struct{})
+		jobOwners[dasquery.Qhash] = owners
+	}
+	owners[dasquery.User] = struct{}{}
+	jobMutex.Unlock()
+	if !CheckData(dasquery.Qhash) {
+		go Process(dasquery, dmaps)
+	}
+}
+
+// JobOwners returns users who submitted unfinished job of DAS query with
+// given pid
+func JobOwners(pid string) []string {
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	var out []string
+	for user := range jobOwners[pid] {
+		out = append(out, user)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// helper function to remove cancellations which are older than CancelTTL
+func pruneCancelled() {
+	cancelled.Range(func(key, value interface{}) bool {
+		if t, ok := value.(time.Time); ok && time.Since(t) > CancelTTL {
+			cancelled.Delete(key)
+		}
+		return true
+	})
+}
+
+// OnDone registers function which is called once when processing of DAS
+// query with given pid is finished or cancelled
+func OnDone(pid string, fn func()) {
+	doneMutex.Lock()
+	defer doneMutex.Unlock()
+	doneHooks[pid] = append(doneHooks[pid], fn)
+}
+
+// helper function to call functions registered for DAS query
+func notifyDone(pid string) {
+	doneMutex.Lock()
+	hooks := doneHooks[pid]
+	delete(doneHooks, pid)
+	doneMutex.Unlock()
+	jobMutex.Lock()
+	delete(jobOwners, pid)
+	jobMutex.Unlock()
+	pruneCancelled()
+	for _, fn := range hooks {
+		go fn()
+	}
+}
+
+// Progress returns processing status of DAS query with given pid, it
+// returns false if DAS query is unknown
+func Progress(pid string) (QueryProgress, bool) {
+
+	// defer function profiler
+	defer utils.MeasureTime("das/Progress")()
+
+	progress := QueryProgress{Pid: pid, Services: []ServiceProgress{}}
+	if Cancelled(pid) {
+		progress.Status = "cancelled"
+		return progress, true
+	}
+	spec := bson.M{"qhash": pid, "das.record": 0}
+	recs, err := mongo.Get("das", "cache", spec, 0, 1)
+	if err != nil || len(recs) == 0 {
+		return progress, false
+	}
+	dasrecord := recs[0]
+	progress.Query, _ = dasrecord["query"].(string)
+	progress.Instance, _ = mongo.GetValue(dasrecord, "das.instance").(string)
+	progress.Timestamp, _ = mongo.GetInt64Value(dasrecord, "das.ts")
+	errs := services.DASServiceErrors(dasrecord)
+	states := services.DASProgress(dasrecord)
+	for _, srv := range services.DASServices(dasrecord) {
+		sp := ServiceProgress{Service: srv, Status: "pending", Errors: errs[srv]}
+		if state, ok := states[srv]; ok {
+			sp.Status, _ = state["status"].(string)
+			sp.Records, _ = mongo.GetInt64Value(state, "records")
+		}
+		progress.Services = append(progress.Services, sp)
+	}
+	sort.Slice(progress.Services, func(i, j int) bool { return progress.Services[i].Service < progress.Services[j].Service })
+	if !CheckDataReadiness(pid) {
+		progress.Status = "processing"
+		return progress, true
+	}
+	nrec, err := Count(pid)
+	if err != nil {
+		utils.QueryLogger(pid, "", "").Error("unable to count DAS records", "error", err)
+	}
+	progress.Nresults = nrec
+	progress.Status = "ok"
+	if len(Errors(pid)) > 0 {
+		progress.Status = "fail"
+	}
+	progress.Status = services.QueryStatus(progress.Status, nrec)
+	return progress, true
+}
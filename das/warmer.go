@@ -0,0 +1,287 @@
+package das
+
+// DAS cache warmer module
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dmwm/das2go/dasmaps"
+	"github.com/dmwm/das2go/dasql"
+	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/utils"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// WarmQuery represents DAS query used by cache warmer
+type WarmQuery struct {
+	Query    string // DAS query
+	Instance string // DBS instance
+}
+
+// CacheWarmer periodically runs given DAS queries through Process ahead
+// of their expiration time
+type CacheWarmer struct {
+	Queries     []WarmQuery     // list of queries to warm up
+	Interval    time.Duration   // interval between warm up cycles
+	Lead        time.Duration   // refresh queries which expire within lead time
+	Concurrency int             // max number of concurrently processed queries
+	MaxRequests int             // max number of running upstream requests to start new query, 0 means half of UrlQueueLimit
+	DASMaps     dasmaps.DASMaps // DAS maps
+}
+
+// regex to extract DAS query and its instance from DAS server log lines
+var logQueryPattern = regexp.MustCompile(`DASQuery="([^"]+)" inst=(\S+)`)
+
+// regex to extract DAS query and its instance from "DAS request" records of
+// structured text logs, values are quoted when necessary
+var logRequestPattern = regexp.MustCompile(`msg="DAS request" .* query=("(?:[^"\\]|\\.)*"|\S+) instance=("(?:[^"\\]|\\.)*"|\S+)`)
+
+// logRecord represents "DAS request" record of structured JSON logs
+type logRecord struct {
+	Msg      string `json:"msg"`
+	Query    string `json:"query"`
+	Instance string `json:"instance"`
+}
+
+// helper function to extract DAS query from DAS server log line, it supports
+// structured (JSON and text) and plain log lines
+func logQuery(line string) (WarmQuery, bool) {
+	if strings.HasPrefix(line, "{") {
+		var rec logRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil || rec.Msg != "DAS request" {
+			return WarmQuery{}, false
+		}
+		return WarmQuery{Query: rec.Query, Instance: rec.Instance}, rec.Query != ""
+	}
+	if matches := logRequestPattern.FindStringSubmatch(line); len(matches) == 3 {
+		query, instance := matches[1], matches[2]
+		if v, err := strconv.Unquote(query); err == nil {
+			query = v
+		}
+		if v, err := strconv.Unquote(instance); err == nil {
+			instance = v
+		}
+		return WarmQuery{Query: query, Instance: instance}, query != ""
+	}
+	if matches := logQueryPattern.FindStringSubmatch(line); len(matches) == 3 {
+		return WarmQuery{Query: matches[1], Instance: matches[2]}, true
+	}
+	return WarmQuery{}, false
+}
+
+// ReadQueries parses given content (one query per line) into list of
+// WarmQuery objects, empty and comment (#) lines are skipped
+func ReadQueries(content, inst string) []WarmQuery {
+	var out []WarmQuery
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		out = append(out, WarmQuery{Query: line, Instance: inst})
+	}
+	return out
+}
+
+// TopQueries returns top N most frequent DAS queries found in given log files
+func TopQueries(files []string, n int) []WarmQuery {
+	counts := make(map[WarmQuery]int)
+	for _, fname := range files {
+		file, err := os.Open(fname)
+		if err != nil {
+			log.Printf("ERROR: unable to open log file %s, error %v\n", fname, err)
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			if q, ok := logQuery(scanner.Text()); ok {
+				counts[q]++
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Printf("ERROR: unable to read log file %s, error %v\n", fname, err)
+		}
+		file.Close()
+	}
+	var out []WarmQuery
+	for q := range counts {
+		out = append(out, q)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if counts[out[i]] == counts[out[j]] {
+			return out[i].Query < out[j].Query
+		}
+		return counts[out[i]] > counts[out[j]]
+	})
+	if n > 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// helper function to check if given query should be (re-)processed, i.e.
+// it is not in DAS cache or it will expire within given lead time
+func needWarmup(pid string, lead time.Duration) bool {
+	spec := bson.M{"qhash": pid, "das.record": 0}
+	recs, err := mongo.Get("das", "merge", spec, 0, 1)
+	if err != nil {
+		return false
+	}
+	if len(recs) == 0 {
+		// query is not in merge collection, skip it if it is processing now
+		return !CheckData(pid)
+	}
+	expire, err := mongo.GetInt64Value(recs[0], "das.expire")
+	if err != nil {
+		return true
+	}
+	return time.Unix(expire, 0).Before(time.Now().Add(lead))
+}
+
+// helper function to wait until URL fetch queue is not busy with
+// interactive requests. We wait while requests are queued by fetch scheduler,
+// i.e. upstream systems are at their limits, or while number of running
+// upstream requests reaches given limit or half of UrlQueueLimit
+func waitForQueue(maxRequests int) {
+	limit := int32(maxRequests)
+	if qlimit := atomic.LoadInt32(&utils.UrlQueueLimit); qlimit > 0 {
+		half := qlimit / 2
+		if half < 1 {
+			half = 1
+		}
+		if limit <= 0 || half < limit {
+			limit = half
+		}
+	}
+	for utils.FetchQueueLength() > 0 || (limit > 0 && atomic.LoadInt32(&utils.UrlQueueSize) >= limit) {
+		time.Sleep(time.Second)
+	}
+}
+
+// suffix of temporary hash of DAS query refreshed by cache warmer
+const warmupSuffix = "-warmup"
+
+// helper function to replace records of DAS query with refreshed records
+// stored under temporary hash, old records are removed only after refreshed
+// ones are in place, therefore the query is always served from DAS cache
+func swapRecords(qhash string) error {
+	for _, coll := range []string{"cache", "merge"} {
+		ids, err := mongo.RecordIDs("das", coll, bson.M{"qhash": qhash})
+		if err != nil {
+			return err
+		}
+		spec := bson.M{"qhash": qhash + warmupSuffix}
+		if _, err := mongo.UpdateAll("das", coll, spec, bson.M{"$set": bson.M{"qhash": qhash}}); err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			if err := mongo.Remove("das", coll, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// helper function to refresh DAS query, the query is processed under
+// temporary hash and its records replace old ones only if processing succeeds
+func (w *CacheWarmer) refresh(dasquery dasql.DASQuery) bool {
+	qhash := dasquery.Qhash
+	logger := dasquery.Logger()
+	tmpspec := bson.M{"qhash": qhash + warmupSuffix}
+	// remove leftovers of previous refresh, otherwise Process will duplicate them
+	if err := mongo.Remove("das", "cache", tmpspec); err != nil {
+		return false
+	}
+	if err := mongo.Remove("das", "merge", tmpspec); err != nil {
+		return false
+	}
+	dasquery.Qhash = qhash + warmupSuffix
+	Process(dasquery, w.DASMaps)
+	status := ""
+	spec := bson.M{"qhash": dasquery.Qhash, "das.record": 0}
+	if recs, err := mongo.Get("das", "merge", spec, 0, 1); err == nil && len(recs) > 0 {
+		status, _ = mongo.GetStringValue(recs[0], "das.status")
+	}
+	if status != "ok" {
+		logger.Warn("cache warmer keeps old records", "query", dasquery.Query, "status", status)
+		mongo.Remove("das", "cache", tmpspec)
+		mongo.Remove("das", "merge", tmpspec)
+		return false
+	}
+	if err := swapRecords(qhash); err != nil {
+		logger.Error("cache warmer unable to replace records", "query", dasquery.Query, "error", err)
+		return false
+	}
+	return true
+}
+
+// Warm performs single warm up cycle over all queries and returns number
+// of processed queries
+func (w *CacheWarmer) Warm() int {
+
+	// defer function profiler
+	defer utils.MeasureTime("das/CacheWarmer.Warm")()
+
+	concurrency := w.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var nproc int32
+	for _, q := range w.Queries {
+		dasquery, qlerr, _ := dasql.Parse(q.Query, q.Instance, w.DASMaps.DASKeys())
+		if qlerr != "" {
+			log.Printf("ERROR: cache warmer unable to parse query %s, error %s\n", q.Query, qlerr)
+			continue
+		}
+		if !needWarmup(dasquery.Qhash, w.Lead) {
+			continue
+		}
+		// warmer requests are scheduled as requests of its own user
+		dasquery.User = "das-cache-warmer"
+		sem <- struct{}{}
+		waitForQueue(w.MaxRequests)
+		wg.Add(1)
+		go func(dasquery dasql.DASQuery) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if utils.VERBOSE > 0 {
+				dasquery.Logger().Info("cache warmer", "query", dasquery.Query, "instance", dasquery.Instance)
+			}
+			if w.refresh(dasquery) {
+				atomic.AddInt32(&nproc, 1)
+			}
+		}(dasquery)
+	}
+	wg.Wait()
+	return int(nproc)
+}
+
+// Run starts cache warmer loop
+func (w *CacheWarmer) Run() {
+	log.Printf("cache warmer: %d queries, interval %v, lead %v, concurrency %d\n", len(w.Queries), w.Interval, w.Lead, w.Concurrency)
+	for {
+		time0 := time.Now()
+		nproc := w.Warm()
+		log.Printf("cache warmer processed %d queries in %v\n", nproc, time.Since(time0))
+		time.Sleep(w.Interval)
+	}
+}
@@ -114,6 +114,25 @@ func (m *DASMaps) DASKeys() []string {
 	return m.daskeys
 }
 
+// RecordKeys provides list of record keys of given DAS key, e.g. run.run_number
+// for run, DAS records store values of DAS key under these keys
+func (m *DASMaps) RecordKeys(daskey string) []string {
+	var out []string
+	for _, rec := range m.records {
+		if rtype, ok := rec["type"].(string); !ok || rtype != "service" {
+			continue
+		}
+		for _, dmap := range GetDASMaps(rec["das_map"]) {
+			dkey, _ := dmap["das_key"].(string)
+			rkey, _ := dmap["rec_key"].(string)
+			if dkey == daskey && rkey != "" && !utils.FindInList(rkey, out) {
+				out = append(out, rkey)
+			}
+		}
+	}
+	return out
+}
+
 // SystemApis provides map of DAS system and their apis
 func (m *DASMaps) SystemApis() map[string][]string {
 	if len(m.systemApis) != 0 {
@@ -509,7 +528,11 @@ func (m *DASMaps) FindServices(dasquery dasql.DASQuery) []mongo.DASRecord {
 
 // LoadMaps loads DAS maps from given database collection
 func (m *DASMaps) LoadMaps(dbname, dbcoll string) {
-	m.records = mongo.Get(dbname, dbcoll, bson.M{}, 0, -1) // index=0, limit=-1
+	records, err := mongo.Get(dbname, dbcoll, bson.M{}, 0, -1) // index=0, limit=-1
+	if err != nil {
+		log.Printf("ERROR: unable to load DAS maps from %s.%s, error %v\n", dbname, dbcoll, err)
+	}
+	m.records = records
 }
 
 // LoadMapsFromFile loads DAS maps from github or local file
@@ -633,6 +656,49 @@ func (m *DASMaps) ChangeUrl(old, pat string) {
 	m.records = records
 }
 
+// RewriteUrl rewrites given url according to rules which map url prefixes to
+// their replacements, e.g. {"https://cmsweb.cern.ch:8443": "http://localhost:8250"},
+// the longest matching prefix wins
+func RewriteUrl(rurl string, rules map[string]string) string {
+	var prefix string
+	for old := range rules {
+		if strings.HasPrefix(rurl, old) && len(old) > len(prefix) {
+			prefix = old
+		}
+	}
+	if prefix == "" {
+		return rurl
+	}
+	return rules[prefix] + strings.TrimPrefix(rurl, prefix)
+}
+
+// RewriteUrls rewrites urls of dasmaps, including urls of combined services,
+// according to given rules, see RewriteUrl
+func (m *DASMaps) RewriteUrls(rules map[string]string) {
+	if len(rules) == 0 {
+		return
+	}
+	for _, dmap := range m.records {
+		if url, ok := dmap["url"].(string); ok {
+			dmap["url"] = RewriteUrl(url, rules)
+		}
+		var services map[string]interface{}
+		switch v := dmap["services"].(type) {
+		case map[string]interface{}:
+			services = v
+		case bson.M:
+			services = v
+		case mongo.DASRecord:
+			services = v
+		}
+		for key, val := range services {
+			if url, ok := val.(string); ok {
+				services[key] = RewriteUrl(url, rules)
+			}
+		}
+	}
+}
+
 // GetString provides value from DAS map for a given key
 func GetString(dmap mongo.DASRecord, key string) string {
 	val, ok := dmap[key].(string)
@@ -11,7 +11,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"log"
+	"log/slog"
 	"strconv"
 	"strings"
 	"time"
@@ -36,6 +38,21 @@ type DASQuery struct {
 	Aggregators  [][]string          `json:"aggregators"`
 	Error        string              `json:"error"`
 	Time         int64               `json:"tstamp"`
+	User         string              `json:"user,omitempty"`
+	Client       string              `json:"-" bson:"-"`
+	Span         *utils.Span         `json:"-" bson:"-"`
+	Debug        *utils.DebugTrace   `json:"-" bson:"-"`
+}
+
+// FetchContext returns context of upstream requests made for DAS query
+func (q DASQuery) FetchContext() utils.FetchContext {
+	return utils.FetchContext{Qhash: q.Qhash, User: q.User, Client: q.Client, Span: q.Span, Debug: q.Debug}
+}
+
+// Logger returns logger whose records carry DAS query hash, user, client IP,
+// trace and request ids of DAS query
+func (q DASQuery) Logger() *slog.Logger {
+	return q.FetchContext().Logger()
 }
 
 // String method implements own formatter using DASQuery rather then *DASQuery, since
@@ -351,7 +368,13 @@ func Parse(query, inst string, daskeys []string) (DASQuery, string, string) {
 		}
 	}
 	fields = cleanFields
-	filters, aggregators, qlerror, pLine := parsePipe(relax(query), pipe)
+	// grep filters are parsed from original (not relaxed) pipe since their
+	// values, e.g. regex patterns, should be preserved as is
+	rawPipe := ""
+	if parts := strings.SplitN(query, "|", 2); len(parts) > 1 {
+		rawPipe = parts[1]
+	}
+	filters, aggregators, qlerror, pLine := parsePipe(relax(query), rawPipe)
 
 	// default DBS instance in case of CLI call
 	if inst == "" && utils.WEBSERVER == 0 {
@@ -405,6 +428,58 @@ func Parse(query, inst string, daskeys []string) (DASQuery, string, string) {
 	return rec, qlerror, pLine
 }
 
+// helper function to parse aggregator function starting at given index of
+// relaxed pipe tokens, e.g. sum ( file.size ) by block.name or
+// percentile ( file.size , 95 ). It returns aggregator in a form of
+// [function, key, parameter, group key], number of consumed tokens and error message
+func parseAggregator(arr []string, idx int) ([]string, int, string) {
+	msg := "Wrong aggregator representation, please check your query"
+	qlen := len(arr)
+	item := arr[idx]
+	if idx+3 >= qlen || arr[idx+1] != "(" || arr[idx+2] == ")" {
+		return nil, 0, msg
+	}
+	key := arr[idx+2]
+	param := ""
+	pos := idx + 3
+	if arr[pos] == "," {
+		if pos+2 >= qlen {
+			return nil, 0, msg
+		}
+		param = arr[pos+1]
+		pos += 2
+	}
+	if arr[pos] != ")" {
+		return nil, 0, msg
+	}
+	pos++
+	group := ""
+	if pos+1 < qlen && arr[pos] == "by" {
+		group = arr[pos+1]
+		pos += 2
+	}
+	switch item {
+	case "percentile":
+		p, err := strconv.ParseFloat(param, 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, 0, "percentile requires value between 0 and 100, e.g. percentile(file.size, 95)"
+		}
+	case "histogram":
+		if param == "" {
+			param = "10"
+		}
+		n, err := strconv.Atoi(param)
+		if err != nil || n <= 0 {
+			return nil, 0, "histogram requires positive number of bins, e.g. histogram(file.size, 10)"
+		}
+	default:
+		if param != "" {
+			return nil, 0, fmt.Sprintf("%s aggregator does not accept parameters", item)
+		}
+	}
+	return []string{item, key, param, group}, pos - idx, ""
+}
+
 func parsePipe(query, pipe string) (map[string][]string, [][]string, string, string) {
 	qlerr := ""
 	pLine := ""
@@ -413,14 +488,32 @@ func parsePipe(query, pipe string) (map[string][]string, [][]string, string, str
 	if !strings.Contains(query, "|") {
 		return filters, aggregators, qlerr, pLine
 	}
-	var item, next, nnext, nnnext, cfilter string
+	var item, next, cfilter string
 	nan := "_NA_"
-	aggrs := []string{"sum", "min", "max", "avg", "median", "count"}
-	opers := []string{">", "<", ">=", "<=", "=", "!="}
+	aggrs := []string{"sum", "min", "max", "avg", "mean", "median", "count", "count_distinct", "stddev", "percentile", "histogram"}
+	// parse grep filters and pass remaining pipe stages to the parser below
+	var stages []string
+	for _, stage := range splitTopLevel(html.UnescapeString(pipe), '|') {
+		stage = strings.TrimSpace(stage)
+		if stage == "grep" || strings.HasPrefix(stage, "grep ") {
+			exprs, err := ParseGrep(strings.TrimPrefix(stage, "grep"))
+			if err != nil {
+				qlerr = fmt.Sprintf("DAS QL ERROR, query=%v, msg=%v", query, err)
+				pLine = posLine(query, strings.Index(query, "grep")+len("grep")+1)
+				return filters, aggregators, qlerr, pLine
+			}
+			for _, f := range exprs {
+				filters["grep"] = append(filters["grep"], f.String())
+			}
+			continue
+		}
+		stages = append(stages, stage)
+	}
+	pipe = relax(strings.Join(stages, " | "))
 	idx := 0
 	arr := strings.Split(pipe, " ")
 	qlen := len(arr)
-	if arr == nil || (qlen == 1 && arr[0] == "") || qlen == 0 {
+	if len(filters) == 0 && (arr == nil || (qlen == 1 && arr[0] == "") || qlen == 0) {
 		msg := "No filter found"
 		qlerr = fmt.Sprintf("DAS QL ERROR, query=%v, idx=%v, msg=%v", query, len(query)+2, msg)
 		pLine = posLine(query, len(query)+2)
@@ -433,29 +526,9 @@ func parsePipe(query, pipe string) (map[string][]string, [][]string, string, str
 		} else {
 			next = nan
 		}
-		if idx+2 < qlen {
-			nnext = arr[idx+2]
-		} else {
-			nnext = nan
-		}
-		if idx+3 < qlen {
-			nnnext = arr[idx+3]
-		} else {
-			nnnext = nan
-		}
-		if item == "grep" {
-			cfilter = item
-			filters["grep"] = append(filters[item], next)
-			idx += 2
-		} else if item == "," {
-			if cfilter == "grep" {
-				if utils.InList(nnext, opers) {
-					val := fmt.Sprintf("%s%s%s", next, nnext, nnnext)
-					filters[cfilter] = append(filters[cfilter], val)
-					idx += 2
-				} else {
-					filters[cfilter] = append(filters[cfilter], next)
-				}
+		if item == "," {
+			if cfilter == "sort" {
+				filters[cfilter] = append(filters[cfilter], next)
 				idx += 2
 			} else {
 				idx += 1
@@ -470,17 +543,13 @@ func parsePipe(query, pipe string) (map[string][]string, [][]string, string, str
 			idx += 1
 		} else if utils.InList(item, aggrs) {
 			cfilter = item
-			left := next
-			val := nnext
-			right := nnnext
-			if left != "(" || right != ")" || idx+3 >= qlen {
-				msg := "Wrong aggregator representation, please check your query"
+			aggr, step, msg := parseAggregator(arr, idx)
+			if msg != "" {
 				qlerr, pLine = qlError(pipe, idx, msg)
 				return filters, aggregators, qlerr, pLine
 			}
-			pair := []string{item, val}
-			aggregators = append(aggregators, pair)
-			idx += 3
+			aggregators = append(aggregators, aggr)
+			idx += step
 		} else {
 			idx += 1
 		}
@@ -0,0 +1,310 @@
+package dasql
+
+// DAS Query Language (DAS-QL) filter expressions
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+// grep filter supports the following expressions:
+//   key                     select given key, e.g. file.name
+//   key = value             equality, value may contain * wildcards
+//   key != value            inequality
+//   key <, <=, >, >= value  comparison, e.g. file.size > 2GB
+//   key ~ pattern           regular expression match
+//   key in [v1, v2, ...]    key matches one of the values
+//   key between [v1, v2]    v1 <= key <= v2
+// Keys are dotted paths into DAS records, e.g. file.size, and conditions
+// apply to any element of nested lists. Range (between) and multiple
+// conditions on the same key must be met by the same element of the list.
+// Values are numbers, sizes (e.g. 2GB, power of 10 as in utils.SizeFormat),
+// dates (YYYY-MM-DD or YYYY-MM-DD HH:MM:SS) or strings (optionally quoted).
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// FilterExpr represents single grep filter expression, e.g. file.size > 2GB
+type FilterExpr struct {
+	Key    string   // DAS key path, e.g. file.size
+	Op     string   // operator, empty for key selection
+	Values []string // operator values
+}
+
+// String returns string representation of filter expression
+func (f FilterExpr) String() string {
+	switch f.Op {
+	case "":
+		return f.Key
+	case "in", "between":
+		var values []string
+		for _, v := range f.Values {
+			if strings.ContainsAny(v, ",[]") {
+				v = fmt.Sprintf("\"%s\"", v)
+			}
+			values = append(values, v)
+		}
+		return fmt.Sprintf("%s %s [%s]", f.Key, f.Op, strings.Join(values, ", "))
+	}
+	return fmt.Sprintf("%s %s %s", f.Key, f.Op, strings.Join(f.Values, ""))
+}
+
+// list of supported filter operators, longest first
+var filterOps = []string{"!=", "<=", ">=", "=", "<", ">", "~"}
+
+// regex to match DAS key path
+var filterKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z0-9_]+)*`)
+
+// regex to match size values, e.g. 2GB
+var sizePattern = regexp.MustCompile(`^([0-9]*\.?[0-9]+)\s*([KMGTP]?B)$`)
+
+// size multipliers, CMS convention is to use power of 10
+var sizeUnits = map[string]float64{"B": 1, "KB": 1e3, "MB": 1e6, "GB": 1e9, "TB": 1e12, "PB": 1e15}
+
+// supported date formats
+var dateFormats = []string{"2006-01-02", "2006-01-02 15:04:05", "2006-01-02T15:04:05"}
+
+// helper function to split given string on separator which is not enclosed
+// in quotes or square brackets
+func splitTopLevel(s string, sep rune) []string {
+	var out []string
+	var quote rune
+	depth := 0
+	start := 0
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == sep && depth == 0:
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	out = append(out, s[start:])
+	return out
+}
+
+// helper function to remove quotes around given value
+func unquote(val string) string {
+	val = strings.TrimSpace(val)
+	if len(val) > 1 {
+		if (val[0] == '"' && val[len(val)-1] == '"') || (val[0] == '\'' && val[len(val)-1] == '\'') {
+			return val[1 : len(val)-1]
+		}
+	}
+	return val
+}
+
+// helper function to parse list of values, e.g. [1, 2, 3]
+func parseList(val string) ([]string, error) {
+	val = strings.TrimSpace(val)
+	if !strings.HasPrefix(val, "[") || !strings.HasSuffix(val, "]") {
+		return nil, fmt.Errorf("values should be enclosed in square brackets, got %s", val)
+	}
+	var out []string
+	for _, v := range splitTopLevel(val[1:len(val)-1], ',') {
+		v = unquote(v)
+		if v == "" {
+			return nil, fmt.Errorf("empty value in %s", val)
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// ParseFilterExpr parses given filter expression
+func ParseFilterExpr(expr string) (FilterExpr, error) {
+	var f FilterExpr
+	expr = strings.TrimSpace(expr)
+	f.Key = filterKeyPattern.FindString(expr)
+	if f.Key == "" {
+		return f, fmt.Errorf("invalid filter expression '%s', it should start with DAS key", expr)
+	}
+	rest := strings.TrimSpace(expr[len(f.Key):])
+	if rest == "" {
+		return f, nil
+	}
+	for _, op := range []string{"in", "between"} {
+		if strings.HasPrefix(rest, op+" ") || strings.HasPrefix(rest, op+"[") {
+			values, err := parseList(rest[len(op):])
+			if err != nil {
+				return f, fmt.Errorf("invalid filter expression '%s', %v", expr, err)
+			}
+			if op == "between" && len(values) != 2 {
+				return f, fmt.Errorf("invalid filter expression '%s', between requires two values", expr)
+			}
+			f.Op = op
+			f.Values = values
+			return f, nil
+		}
+	}
+	for _, op := range filterOps {
+		if strings.HasPrefix(rest, op) {
+			val := unquote(rest[len(op):])
+			if val == "" {
+				return f, fmt.Errorf("invalid filter expression '%s', no value for operator %s", expr, op)
+			}
+			if op == "~" {
+				if _, err := regexp.Compile(val); err != nil {
+					return f, fmt.Errorf("invalid filter expression '%s', %v", expr, err)
+				}
+			}
+			f.Op = op
+			f.Values = []string{val}
+			return f, nil
+		}
+	}
+	return f, fmt.Errorf("invalid filter expression '%s', unknown operator", expr)
+}
+
+// ParseGrep parses comma separated list of grep filter expressions
+func ParseGrep(text string) ([]FilterExpr, error) {
+	var out []FilterExpr
+	for _, expr := range splitTopLevel(text, ',') {
+		if strings.TrimSpace(expr) == "" {
+			return out, errors.New("empty grep filter expression")
+		}
+		f, err := ParseFilterExpr(expr)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// FilterValue converts filter value into number, size (in bytes), date
+// (unix seconds) or string
+func FilterValue(val string) interface{} {
+	if v, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return v
+	}
+	if v, err := strconv.ParseFloat(val, 64); err == nil {
+		return v
+	}
+	if m := sizePattern.FindStringSubmatch(strings.ToUpper(val)); len(m) == 3 {
+		v, err := strconv.ParseFloat(m[1], 64)
+		if err == nil {
+			return int64(v * sizeUnits[m[2]])
+		}
+	}
+	for _, layout := range dateFormats {
+		if t, err := time.Parse(layout, val); err == nil {
+			return t.Unix()
+		}
+	}
+	return val
+}
+
+// helper function to convert wildcard pattern into anchored regex
+func wildcardPattern(val string) string {
+	parts := strings.Split(val, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	return fmt.Sprintf("^%s$", strings.Join(parts, ".*"))
+}
+
+// Condition returns MongoDB condition for filter expression key, it returns
+// nil for key selection expressions
+func (f FilterExpr) Condition() interface{} {
+	switch f.Op {
+	case "=":
+		if strings.Contains(f.Values[0], "*") {
+			return bson.RegEx{Pattern: wildcardPattern(f.Values[0])}
+		}
+		return FilterValue(f.Values[0])
+	case "!=":
+		if strings.Contains(f.Values[0], "*") {
+			return bson.M{"$not": bson.RegEx{Pattern: wildcardPattern(f.Values[0])}}
+		}
+		return bson.M{"$ne": FilterValue(f.Values[0])}
+	case "<":
+		return bson.M{"$lt": FilterValue(f.Values[0])}
+	case "<=":
+		return bson.M{"$lte": FilterValue(f.Values[0])}
+	case ">":
+		return bson.M{"$gt": FilterValue(f.Values[0])}
+	case ">=":
+		return bson.M{"$gte": FilterValue(f.Values[0])}
+	case "~":
+		return bson.RegEx{Pattern: f.Values[0]}
+	case "in":
+		var values []interface{}
+		for _, v := range f.Values {
+			values = append(values, FilterValue(v))
+		}
+		return bson.M{"$in": values}
+	case "between":
+		return bson.M{"$gte": FilterValue(f.Values[0]), "$lte": FilterValue(f.Values[1])}
+	}
+	return nil
+}
+
+// helper function to build MongoDB condition which requires all given
+// conditions of given key to be met by the same element of list of records.
+// Top level keys of DAS records are lists, e.g. {"file": [{"size": 1}, ...]},
+// where bare range condition on file.size would be met by different files.
+// Records whose top level key is not a list are matched by plain conditions.
+func elemMatch(key string, conds []interface{}) bson.M {
+	var plain []interface{}
+	for _, cond := range conds {
+		plain = append(plain, bson.M{key: cond})
+	}
+	idx := strings.Index(key, ".")
+	if idx < 0 {
+		return bson.M{"$and": plain}
+	}
+	top, rest := key[:idx], key[idx+1:]
+	var inner []interface{}
+	for _, cond := range conds {
+		inner = append(inner, bson.M{rest: cond})
+	}
+	list := bson.M{top: bson.M{"$elemMatch": bson.M{"$and": inner}}}
+	// top.0 does not exist if top level key is not a (non-empty) list
+	single := bson.M{"$and": append(plain, bson.M{top + ".0": bson.M{"$exists": false}})}
+	return bson.M{"$or": []interface{}{list, single}}
+}
+
+// FilterConditions returns MongoDB conditions of given filter expressions,
+// key selection expressions are skipped. Range (between) and multiple
+// conditions on the same key are wrapped in $elemMatch.
+func FilterConditions(exprs []FilterExpr) []bson.M {
+	var keys []string
+	conds := make(map[string][]interface{})
+	ranges := make(map[string]bool)
+	for _, f := range exprs {
+		if f.Op == "" {
+			continue
+		}
+		if _, ok := conds[f.Key]; !ok {
+			keys = append(keys, f.Key)
+		}
+		conds[f.Key] = append(conds[f.Key], f.Condition())
+		if f.Op == "between" {
+			ranges[f.Key] = true
+		}
+	}
+	var out []bson.M
+	for _, key := range keys {
+		if len(conds[key]) == 1 && !ranges[key] {
+			out = append(out, bson.M{key: conds[key][0]})
+		} else {
+			out = append(out, elemMatch(key, conds[key]))
+		}
+	}
+	return out
+}
@@ -0,0 +1,513 @@
+package fakeupstream
+
+// DAS fake upstream services module: DBS reader APIs
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// dbsArgs represents DBS API arguments, query parameters and JSON body of
+// POST requests are merged together
+type dbsArgs map[string][]string
+
+// helper function to parse DBS API arguments
+func parseDBSArgs(r *http.Request) (dbsArgs, error) {
+	args := make(dbsArgs)
+	for k, v := range r.URL.Query() {
+		args[k] = v
+	}
+	if r.Method != "POST" {
+		return args, nil
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil || len(data) == 0 {
+		return args, err
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return args, err
+	}
+	for k, v := range body {
+		switch val := v.(type) {
+		case []interface{}:
+			for _, item := range val {
+				args[k] = append(args[k], str(item))
+			}
+		default:
+			args[k] = append(args[k], str(val))
+		}
+	}
+	return args, nil
+}
+
+// get returns first value of given argument
+func (a dbsArgs) get(key string) string {
+	if v, ok := a[key]; ok && len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// detail returns true if detailed output is requested
+func (a dbsArgs) detail() bool {
+	d := strings.ToLower(a.get("detail"))
+	return d == "true" || d == "1"
+}
+
+// runs returns list of requested runs, run ranges like 1-10 and lists
+// like [1,2,3] are supported
+func (a dbsArgs) runs() []string {
+	var out []string
+	for _, v := range a["run_num"] {
+		v = strings.Trim(v, "[]")
+		for _, r := range strings.Split(v, ",") {
+			if r = strings.Trim(strings.TrimSpace(r), "'\""); r != "" {
+				out = append(out, r)
+			}
+		}
+	}
+	return out
+}
+
+// helper function to check if run matches list of requested runs
+func matchRun(runs []string, run int64) bool {
+	if len(runs) == 0 {
+		return true
+	}
+	for _, r := range runs {
+		if arr := strings.SplitN(r, "-", 2); len(arr) == 2 {
+			minRun, err1 := strconv.ParseInt(arr[0], 10, 64)
+			maxRun, err2 := strconv.ParseInt(arr[1], 10, 64)
+			if err1 == nil && err2 == nil && run >= minRun && run <= maxRun {
+				return true
+			}
+			continue
+		}
+		if v, err := strconv.ParseInt(r, 10, 64); err == nil && v == run {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to check if dataset matches DBS arguments
+func (m *Model) matchDataset(d *Dataset, args dbsArgs) bool {
+	status := args.get("dataset_access_type")
+	if status == "" {
+		status = "VALID"
+	}
+	if !match(status, d.Status) {
+		return false
+	}
+	if !matchAny(args["dataset"], d.Name) ||
+		!match(args.get("primary_ds_name"), d.Primary) ||
+		!match(args.get("processed_ds_name"), d.Processed) ||
+		!match(args.get("data_tier_name"), d.Tier) ||
+		!match(args.get("acquisition_era_name"), d.Era) ||
+		!match(args.get("release_version"), d.Release) ||
+		!match(args.get("physics_group_name"), d.PhysicsGroup) ||
+		!match(args.get("prep_id"), d.PrepID) ||
+		!match(args.get("parent_dataset"), d.Parent) {
+		return false
+	}
+	if args.get("parent_dataset") != "" && d.Parent == "" {
+		return false
+	}
+	if blk := args.get("block_name"); blk != "" {
+		if b, ok := m.Block(blk); !ok || b.Dataset != d {
+			return false
+		}
+	}
+	if lfn := args.get("logical_file_name"); lfn != "" {
+		if f, ok := m.File(lfn); !ok || f.Block.Dataset != d {
+			return false
+		}
+	}
+	if runs := args.runs(); len(runs) > 0 {
+		found := false
+		for _, run := range d.Runs() {
+			if matchRun(runs, run) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// helper function to select files matching DBS arguments
+func (m *Model) selectFiles(args dbsArgs) []*File {
+	var files []*File
+	if lfns, ok := args["logical_file_name"]; ok {
+		for _, d := range m.Datasets {
+			for _, f := range d.Files() {
+				if matchAny(lfns, f.Name) {
+					files = append(files, f)
+				}
+			}
+		}
+	} else if blk := args.get("block_name"); blk != "" {
+		for _, d := range m.Datasets {
+			for _, b := range d.Blocks {
+				if match(blk, b.Name) {
+					files = append(files, b.Files...)
+				}
+			}
+		}
+	} else if dataset := args.get("dataset"); dataset != "" {
+		for _, d := range m.Datasets {
+			if match(dataset, d.Name) {
+				files = append(files, d.Files()...)
+			}
+		}
+	}
+	runs := args.runs()
+	var out []*File
+	for _, f := range files {
+		if matchRun(runs, f.Run) && match(args.get("release_version"), f.Block.Dataset.Release) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// helper function to select blocks matching DBS arguments
+func (m *Model) selectBlocks(args dbsArgs) []*Block {
+	var out []*Block
+	for _, d := range m.Datasets {
+		if !matchAny(args["dataset"], d.Name) {
+			continue
+		}
+		for _, b := range d.Blocks {
+			if !match(args.get("block_name"), b.Name) {
+				continue
+			}
+			if args.get("dataset") == "" && args.get("block_name") == "" && args.get("logical_file_name") == "" {
+				continue
+			}
+			keep := false
+			for _, f := range b.Files {
+				if match(args.get("logical_file_name"), f.Name) && matchRun(args.runs(), f.Run) {
+					keep = true
+					break
+				}
+			}
+			if keep {
+				out = append(out, b)
+			}
+		}
+	}
+	return out
+}
+
+// helper function to create DBS dataset record
+func datasetRecord(d *Dataset, detail bool) map[string]interface{} {
+	if !detail {
+		return map[string]interface{}{"dataset": d.Name}
+	}
+	return map[string]interface{}{
+		"dataset":                d.Name,
+		"dataset_id":             hash(d.Name, 8),
+		"primary_ds_name":        d.Primary,
+		"primary_ds_type":        "mc",
+		"processed_ds_name":      d.Processed,
+		"data_tier_name":         d.Tier,
+		"acquisition_era_name":   d.Era,
+		"processing_version":     d.ProcVersion,
+		"physics_group_name":     d.PhysicsGroup,
+		"dataset_access_type":    d.Status,
+		"prep_id":                d.PrepID,
+		"xtcrosssection":         nil,
+		"creation_date":          d.CreationDate,
+		"create_by":              "das-fakeupstream",
+		"last_modification_date": d.CreationDate,
+		"last_modified_by":       "das-fakeupstream",
+	}
+}
+
+// helper function to create DBS block record
+func blockRecord(b *Block, detail bool) map[string]interface{} {
+	if !detail {
+		return map[string]interface{}{"block_name": b.Name}
+	}
+	return map[string]interface{}{
+		"block_name":             b.Name,
+		"dataset":                b.Dataset.Name,
+		"origin_site_name":       b.Origin,
+		"block_size":             b.Size(),
+		"file_count":             len(b.Files),
+		"open_for_writing":       0,
+		"creation_date":          b.Dataset.CreationDate,
+		"create_by":              "das-fakeupstream",
+		"last_modification_date": b.Dataset.CreationDate,
+		"last_modified_by":       "das-fakeupstream",
+	}
+}
+
+// helper function to create DBS file record
+func fileRecord(f *File, detail bool) map[string]interface{} {
+	if !detail {
+		return map[string]interface{}{"logical_file_name": f.Name}
+	}
+	return map[string]interface{}{
+		"logical_file_name":      f.Name,
+		"block_name":             f.Block.Name,
+		"dataset":                f.Block.Dataset.Name,
+		"file_size":              f.Size,
+		"event_count":            f.Events,
+		"file_type":              "EDM",
+		"adler32":                f.Adler32,
+		"check_sum":              hash(f.Name, 10),
+		"md5":                    nil,
+		"is_file_valid":          1,
+		"run_num":                f.Run,
+		"creation_date":          f.Block.Dataset.CreationDate,
+		"last_modification_date": f.Block.Dataset.CreationDate,
+		"last_modified_by":       "das-fakeupstream",
+	}
+}
+
+// helper function to create DBS summary record for given files
+func summaryRecord(files []*File) map[string]interface{} {
+	var size, events int64
+	var lumis int
+	blocks := make(map[string]bool)
+	for _, f := range files {
+		size += f.Size
+		events += f.Events
+		lumis += len(f.Lumis)
+		blocks[f.Block.Name] = true
+	}
+	return map[string]interface{}{
+		"file_size": size,
+		"num_block": len(blocks),
+		"num_event": events,
+		"num_file":  len(files),
+		"num_lumi":  lumis,
+	}
+}
+
+// helper function to collect unique values of datasets
+func uniqueValues(datasets []*Dataset, key string, value func(*Dataset) string) []map[string]interface{} {
+	seen := make(map[string]bool)
+	var out []map[string]interface{}
+	for _, d := range datasets {
+		v := value(d)
+		if v == "" || seen[v] {
+			continue
+		}
+		seen[v] = true
+		out = append(out, map[string]interface{}{key: v})
+	}
+	return out
+}
+
+// dbsHandler serves /dbs/<instance>/DBSReader/<api> requests
+func (s *Server) dbsHandler(w http.ResponseWriter, r *http.Request) {
+	arr := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(arr) < 3 || arr[len(arr)-2] != "DBSReader" {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown DBS path %s", r.URL.Path))
+		return
+	}
+	api := arr[len(arr)-1]
+	args, err := parseDBSArgs(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unable to parse request, error %v", err))
+		return
+	}
+	records, err := s.dbsRecords(api, args)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if records == nil {
+		records = []map[string]interface{}{}
+	}
+	writeJSON(w, records)
+}
+
+// helper function to produce records of given DBS API
+func (s *Server) dbsRecords(api string, args dbsArgs) ([]map[string]interface{}, error) {
+	m := s.Model
+	var out []map[string]interface{}
+	switch api {
+	case "datasets", "datasetlist":
+		for _, d := range m.Datasets {
+			if m.matchDataset(d, args) {
+				out = append(out, datasetRecord(d, args.detail() || api == "datasetlist"))
+			}
+		}
+	case "blocks":
+		for _, b := range m.selectBlocks(args) {
+			out = append(out, blockRecord(b, args.detail()))
+		}
+	case "blockorigin":
+		for _, b := range m.selectBlocks(args) {
+			if match(args.get("origin_site_name"), b.Origin) {
+				out = append(out, map[string]interface{}{"block_name": b.Name, "dataset": b.Dataset.Name, "origin_site_name": b.Origin})
+			}
+		}
+	case "blocksummaries":
+		var files []*File
+		for _, b := range m.selectBlocks(args) {
+			files = append(files, b.Files...)
+		}
+		rec := summaryRecord(files)
+		out = append(out, map[string]interface{}{"file_size": rec["file_size"], "num_event": rec["num_event"], "num_file": rec["num_file"]})
+	case "blockparents":
+		if b, ok := m.Block(args.get("block_name")); ok {
+			for _, p := range b.Parents {
+				out = append(out, map[string]interface{}{"this_block_name": b.Name, "parent_block_name": p})
+			}
+		}
+	case "blockchildren":
+		for _, c := range m.BlockChildren(args.get("block_name")) {
+			out = append(out, map[string]interface{}{"block_name": args.get("block_name"), "child_block_name": c})
+		}
+	case "files":
+		for _, f := range m.selectFiles(args) {
+			out = append(out, fileRecord(f, args.detail()))
+		}
+	case "filelumis":
+		for _, f := range m.selectFiles(args) {
+			events := make([]int64, len(f.Lumis))
+			for i := range events {
+				events[i] = f.Events / int64(len(f.Lumis))
+			}
+			out = append(out, map[string]interface{}{
+				"logical_file_name": f.Name,
+				"run_num":           f.Run,
+				"lumi_section_num":  f.Lumis,
+				"event_count":       events,
+			})
+		}
+	case "fileparents":
+		for _, lfn := range args["logical_file_name"] {
+			if f, ok := m.File(lfn); ok && len(f.Parents) > 0 {
+				out = append(out, map[string]interface{}{"logical_file_name": f.Name, "parent_logical_file_name": f.Parents})
+			}
+		}
+	case "filechildren":
+		for _, lfn := range args["logical_file_name"] {
+			if children := m.FileChildren(lfn); len(children) > 0 {
+				out = append(out, map[string]interface{}{"logical_file_name": lfn, "child_logical_file_name": children})
+			}
+		}
+	case "filesummaries":
+		out = append(out, summaryRecord(m.selectFiles(args)))
+	case "runs":
+		var runs []int64
+		seen := make(map[int64]bool)
+		for _, f := range m.runFiles(args) {
+			if !seen[f.Run] {
+				seen[f.Run] = true
+				runs = append(runs, f.Run)
+			}
+		}
+		if len(runs) > 0 {
+			out = append(out, map[string]interface{}{"run_num": runs})
+		}
+	case "runsummaries":
+		maxLumi := make(map[int64]int64)
+		for _, f := range m.runFiles(args) {
+			for _, l := range f.Lumis {
+				if l > maxLumi[f.Run] {
+					maxLumi[f.Run] = l
+				}
+			}
+		}
+		for run, lumi := range maxLumi {
+			out = append(out, map[string]interface{}{"run_num": run, "max_lumi": lumi, "num_run": 1})
+		}
+	case "datasetparents":
+		if d, ok := m.Dataset(args.get("dataset")); ok && d.Parent != "" {
+			out = append(out, map[string]interface{}{"this_dataset": d.Name, "parent_dataset": d.Parent, "parent_dataset_id": hash(d.Parent, 8)})
+		}
+	case "datasetchildren":
+		for _, c := range m.Children(args.get("dataset")) {
+			out = append(out, map[string]interface{}{"dataset": args.get("dataset"), "child_dataset": c.Name, "child_dataset_id": hash(c.Name, 8)})
+		}
+	case "outputconfigs":
+		for _, d := range m.Datasets {
+			if args.get("dataset") != "" && m.matchDataset(d, args) {
+				out = append(out, map[string]interface{}{
+					"app_name":            "cmsRun",
+					"release_version":     d.Release,
+					"pset_hash":           hash("pset#"+d.Name, 32),
+					"global_tag":          "DESIGN_V1::All",
+					"output_module_label": "RAWSIMoutput",
+				})
+			}
+		}
+	case "releaseversions":
+		var releases []string
+		for _, rec := range uniqueValues(m.filterDatasets(args), "release_version", func(d *Dataset) string { return d.Release }) {
+			releases = append(releases, rec["release_version"].(string))
+		}
+		out = append(out, map[string]interface{}{"release_version": releases})
+	case "datatiers":
+		out = uniqueValues(m.filterDatasets(args), "data_tier_name", func(d *Dataset) string { return d.Tier })
+	case "acquisitioneras":
+		out = uniqueValues(m.filterDatasets(args), "acquisition_era_name", func(d *Dataset) string { return d.Era })
+	case "primarydatasets":
+		for _, rec := range uniqueValues(m.filterDatasets(args), "primary_ds_name", func(d *Dataset) string { return d.Primary }) {
+			rec["primary_ds_type"] = "mc"
+			out = append(out, rec)
+		}
+	case "physicsgroups":
+		out = uniqueValues(m.filterDatasets(args), "physics_group_name", func(d *Dataset) string { return d.PhysicsGroup })
+	case "datasetaccesstypes":
+		out = append(out, map[string]interface{}{"dataset_access_type": []string{"VALID", "INVALID", "PRODUCTION", "DEPRECATED", "DELETED"}})
+	case "datatypes":
+		out = append(out, map[string]interface{}{"data_type": "mc", "datatype_id": 1}, map[string]interface{}{"data_type": "data", "datatype_id": 2})
+	default:
+		return nil, fmt.Errorf("unsupported DBS API %s", api)
+	}
+	return out, nil
+}
+
+// helper function to select datasets matching name based DBS arguments,
+// e.g. used by releaseversions, datatiers APIs
+func (m *Model) filterDatasets(args dbsArgs) []*Dataset {
+	var out []*Dataset
+	for _, d := range m.Datasets {
+		if matchAny(args["dataset"], d.Name) &&
+			match(args.get("release_version"), d.Release) &&
+			match(args.get("data_tier_name"), d.Tier) &&
+			match(args.get("acquisition_era_name"), d.Era) &&
+			match(args.get("primary_ds_name"), d.Primary) &&
+			match(args.get("physics_group_name"), d.PhysicsGroup) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// helper function to select files for runs APIs, run only queries
+// look-up all files
+func (m *Model) runFiles(args dbsArgs) []*File {
+	if args.get("dataset") != "" || args.get("block_name") != "" || args.get("logical_file_name") != "" {
+		return m.selectFiles(args)
+	}
+	runs := args.runs()
+	var out []*File
+	for _, d := range m.Datasets {
+		for _, f := range d.Files() {
+			if len(runs) > 0 && matchRun(runs, f.Run) {
+				out = append(out, f)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,239 @@
+package fakeupstream
+
+// DAS fake upstream services module
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+// This module implements subset of CMS data-services (DBS reader, Rucio,
+// ReqMgr2, McM and CRIC) used by DAS maps and services. All services serve
+// synthetic datasets, blocks, files, runs and lumis generated from Config
+// and are available from a single HTTP server, e.g.
+//   /dbs/<instance>/DBSReader/<api>
+//   /rucio/replicas, /rucio/dids, /rucio/rses, /rucio/accounts, /rucio/auth/x509
+//   /reqmgr2/data/request, /couchdb/reqmgr_config_cache
+//   /mcm/public/restapi/requests
+//   /cric/api/cms/site/query, /cric/api/accounts/user/query
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// DatasetConfig describes synthetic dataset
+type DatasetConfig struct {
+	Name          string   `json:"name"`            // dataset name, e.g. /Prim/Era-Proc-v1/TIER
+	Blocks        int      `json:"blocks"`          // number of blocks
+	FilesPerBlock int      `json:"files_per_block"` // number of files in every block
+	LumisPerFile  int      `json:"lumis_per_file"`  // number of lumis in every file
+	EventsPerLumi int64    `json:"events_per_lumi"` // number of events in every lumi
+	FileSize      int64    `json:"file_size"`       // file size in bytes
+	Runs          []int64  `json:"runs"`            // run numbers, files are distributed among runs
+	Sites         []string `json:"sites"`           // sites (RSEs) which host dataset blocks
+	Release       string   `json:"release"`         // CMSSW release
+	Parent        string   `json:"parent"`          // parent dataset
+	PrepID        string   `json:"prep_id"`         // McM/ReqMgr2 prep id
+	Status        string   `json:"status"`          // dataset access type, default VALID
+	PhysicsGroup  string   `json:"physics_group"`   // physics group
+	CreationDate  int64    `json:"creation_date"`   // creation date (unix seconds)
+}
+
+// Config represents configuration of fake upstream services
+type Config struct {
+	Datasets []DatasetConfig `json:"datasets"` // synthetic datasets
+	Sites    []string        `json:"sites"`    // all known sites (RSEs)
+	Users    []string        `json:"users"`    // user names known to CRIC
+	Token    string          `json:"token"`    // Rucio auth token
+	Verbose  int             `json:"verbose"`  // verbosity level
+}
+
+// DefaultConfig returns configuration with a few small datasets
+func DefaultConfig() Config {
+	return Config{
+		Datasets: []DatasetConfig{
+			{
+				Name:          "/ZMM/Summer11-DESIGN42_V11_428_SLHC1-v1/GEN-SIM",
+				Blocks:        2,
+				FilesPerBlock: 3,
+				LumisPerFile:  4,
+				EventsPerLumi: 100,
+				FileSize:      2000000000,
+				Runs:          []int64{1},
+				Sites:         []string{"T1_US_FNAL_Disk", "T2_CH_CERN"},
+				Release:       "CMSSW_4_2_8_SLHC1",
+				PrepID:        "SUS-Summer11-00001",
+				CreationDate:  1309000000,
+			},
+			{
+				Name:          "/ZMM/Summer11-DESIGN42_V11_428_SLHC1-v1/GEN-SIM-RECO",
+				Blocks:        1,
+				FilesPerBlock: 2,
+				LumisPerFile:  4,
+				EventsPerLumi: 100,
+				FileSize:      1000000000,
+				Runs:          []int64{1},
+				Sites:         []string{"T1_US_FNAL_Disk"},
+				Release:       "CMSSW_4_2_8_SLHC1",
+				Parent:        "/ZMM/Summer11-DESIGN42_V11_428_SLHC1-v1/GEN-SIM",
+				PrepID:        "SUS-Summer11-00002",
+				CreationDate:  1309100000,
+			},
+			{
+				Name:          "/SingleMuon/Run2018A-v1/RAW",
+				Blocks:        2,
+				FilesPerBlock: 2,
+				LumisPerFile:  10,
+				EventsPerLumi: 1000,
+				FileSize:      4000000000,
+				Runs:          []int64{315252, 315255},
+				Sites:         []string{"T0_CH_CERN_Disk", "T1_US_FNAL_Disk"},
+				Release:       "CMSSW_10_1_1",
+				CreationDate:  1525000000,
+			},
+		},
+		Sites: []string{"T0_CH_CERN_Disk", "T1_US_FNAL_Disk", "T2_CH_CERN"},
+		Users: []string{"das"},
+		Token: "fake-rucio-token",
+	}
+}
+
+// UrlRewrite returns DAS urlRewrite configuration which redirects CMS
+// data-services used in DAS maps to fake upstream server at given base url
+func UrlRewrite(base string) map[string]string {
+	return map[string]string{
+		"https://cmsweb.cern.ch:8443": base,
+		"https://cmsweb.cern.ch":      base,
+		"http://cms-rucio.cern.ch":    base + "/rucio",
+		"https://cms-rucio.cern.ch":   base + "/rucio",
+		"https://cms-pdmv.cern.ch":    base,
+		"https://cms-cric.cern.ch":    base + "/cric",
+	}
+}
+
+// route represents handler of requests with given path prefix
+type route struct {
+	prefix  string
+	handler http.HandlerFunc
+}
+
+// Server represents fake upstream services server
+type Server struct {
+	Config Config
+	Model  *Model
+	routes []route
+}
+
+// NewServer creates fake upstream server for given configuration
+func NewServer(cfg Config) *Server {
+	s := &Server{Config: cfg, Model: NewModel(cfg)}
+	// we do not use http.ServeMux since it cleans up request paths, e.g.
+	// /replicas/cms//Prim/Proc/TIER, which is used by Rucio clients
+	s.routes = []route{
+		{"/dbs/", s.dbsHandler},
+		{"/auth/x509", s.rucioAuthHandler},
+		{"/replicas/", s.rucioReplicasHandler},
+		{"/dids/", s.rucioDidsHandler},
+		{"/rses", s.rucioRsesHandler},
+		{"/accounts", s.rucioAccountsHandler},
+		{"/reqmgr2/data/request", s.reqmgrHandler},
+		{"/couchdb/reqmgr_config_cache/", s.configCacheHandler},
+		{"/mcm/public/restapi/requests/", s.mcmHandler},
+		{"/api/cms/site/query", s.cricSitesHandler},
+		{"/api/accounts/user/query", s.cricUsersHandler},
+	}
+	return s
+}
+
+// ServeHTTP implements http.Handler interface. DAS recognizes Rucio and CRIC
+// services by their names in URL, therefore Rucio and CRIC APIs are also
+// available under /rucio and /cric prefixes, e.g. /rucio/replicas/cms/...
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Config.Verbose > 0 {
+		log.Printf("%s %s\n", r.Method, r.URL.String())
+	}
+	for _, prefix := range []string{"/rucio/", "/cric/"} {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			r.URL.Path = r.URL.Path[len(prefix)-1:]
+		}
+	}
+	for _, rt := range s.routes {
+		if strings.HasPrefix(r.URL.Path, rt.prefix) {
+			rt.handler(w, r)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Sprintf("unknown path %s", r.URL.Path))
+}
+
+// helper function to write JSON response
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Printf("ERROR: unable to encode response, error %v\n", err)
+	}
+}
+
+// helper function to write error response
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": msg, "code": code})
+}
+
+// helper function to write records as JSON stream (one record per line)
+// used by Rucio
+func writeStream(w http.ResponseWriter, records []map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/x-json-stream")
+	for _, rec := range records {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			log.Printf("ERROR: unable to encode record, error %v\n", err)
+			continue
+		}
+		w.Write(data)
+		w.Write([]byte("\n"))
+	}
+}
+
+// helper function to match value against pattern with * wildcards, empty
+// pattern matches everything
+func match(pattern, value string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	if !strings.Contains(pattern, "*") {
+		return pattern == value
+	}
+	pat := "^" + strings.Replace(regexp.QuoteMeta(pattern), "\\*", ".*", -1) + "$"
+	matched, _ := regexp.MatchString(pat, value)
+	return matched
+}
+
+// helper function to match value against any of given patterns
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if match(p, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to convert any value to string
+func str(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case nil:
+		return ""
+	case float64:
+		return fmt.Sprintf("%d", int64(val))
+	}
+	return fmt.Sprintf("%v", v)
+}
@@ -0,0 +1,317 @@
+package fakeupstream
+
+// DAS fake upstream services module: synthetic data model
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash/adler32"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Dataset represents synthetic dataset
+type Dataset struct {
+	Name         string
+	Primary      string
+	Processed    string
+	Tier         string
+	Era          string
+	ProcVersion  int64
+	Release      string
+	Parent       string
+	PrepID       string
+	Status       string
+	PhysicsGroup string
+	CreationDate int64
+	Sites        []string
+	Blocks       []*Block
+}
+
+// Block represents synthetic block
+type Block struct {
+	Name    string
+	Dataset *Dataset
+	Origin  string
+	Files   []*File
+	Parents []string
+}
+
+// File represents synthetic file
+type File struct {
+	Name    string
+	Block   *Block
+	Size    int64
+	Events  int64
+	Run     int64
+	Lumis   []int64
+	Adler32 string
+	Parents []string
+}
+
+// Model represents synthetic CMS data served by fake upstream services
+type Model struct {
+	Datasets []*Dataset
+	Sites    []string
+	Users    []string
+	datasets map[string]*Dataset
+	blocks   map[string]*Block
+	files    map[string]*File
+}
+
+// helper function to generate deterministic hex string of given length
+func hash(value string, size int) string {
+	sum := md5.Sum([]byte(value))
+	return hex.EncodeToString(sum[:])[:size]
+}
+
+// NewModel generates synthetic data from given configuration, generated
+// names are deterministic and do not change between server runs
+func NewModel(cfg Config) *Model {
+	m := &Model{
+		datasets: make(map[string]*Dataset),
+		blocks:   make(map[string]*Block),
+		files:    make(map[string]*File),
+		Users:    cfg.Users,
+	}
+	sites := make(map[string]bool)
+	for _, s := range cfg.Sites {
+		sites[s] = true
+	}
+	for _, dcfg := range cfg.Datasets {
+		d := newDataset(dcfg)
+		m.Datasets = append(m.Datasets, d)
+		m.datasets[d.Name] = d
+		for _, s := range d.Sites {
+			sites[s] = true
+		}
+	}
+	for s := range sites {
+		m.Sites = append(m.Sites, s)
+	}
+	sort.Strings(m.Sites)
+	for _, d := range m.Datasets {
+		for _, b := range d.Blocks {
+			m.blocks[b.Name] = b
+			for _, f := range b.Files {
+				m.files[f.Name] = f
+			}
+		}
+	}
+	// assign block and file parents from parent dataset
+	for _, d := range m.Datasets {
+		parent, ok := m.datasets[d.Parent]
+		if !ok || len(parent.Blocks) == 0 {
+			continue
+		}
+		var pfiles []*File
+		for _, b := range parent.Blocks {
+			pfiles = append(pfiles, b.Files...)
+		}
+		for i, b := range d.Blocks {
+			b.Parents = []string{parent.Blocks[i%len(parent.Blocks)].Name}
+			for j, f := range b.Files {
+				if len(pfiles) > 0 {
+					f.Parents = []string{pfiles[(i*len(b.Files)+j)%len(pfiles)].Name}
+				}
+			}
+		}
+	}
+	return m
+}
+
+// helper function to generate synthetic dataset from its configuration
+func newDataset(cfg DatasetConfig) *Dataset {
+	d := &Dataset{
+		Name:         cfg.Name,
+		Release:      cfg.Release,
+		Parent:       cfg.Parent,
+		PrepID:       cfg.PrepID,
+		Status:       cfg.Status,
+		PhysicsGroup: cfg.PhysicsGroup,
+		CreationDate: cfg.CreationDate,
+		Sites:        cfg.Sites,
+	}
+	arr := strings.Split(strings.Trim(cfg.Name, "/"), "/")
+	if len(arr) == 3 {
+		d.Primary, d.Processed, d.Tier = arr[0], arr[1], arr[2]
+	}
+	d.Era = strings.Split(d.Processed, "-")[0]
+	if idx := strings.LastIndex(d.Processed, "-v"); idx != -1 {
+		d.ProcVersion, _ = strconv.ParseInt(d.Processed[idx+2:], 10, 64)
+	}
+	if d.Status == "" {
+		d.Status = "VALID"
+	}
+	if d.PhysicsGroup == "" {
+		d.PhysicsGroup = "NoGroup"
+	}
+	if d.Release == "" {
+		d.Release = "CMSSW_10_6_0"
+	}
+	if len(d.Sites) == 0 {
+		d.Sites = []string{"T2_CH_CERN"}
+	}
+	runs := cfg.Runs
+	if len(runs) == 0 {
+		runs = []int64{1}
+	}
+	lumiPerFile := int64(cfg.LumisPerFile)
+	if lumiPerFile == 0 {
+		lumiPerFile = 1
+	}
+	eventsPerLumi := cfg.EventsPerLumi
+	if eventsPerLumi == 0 {
+		eventsPerLumi = 100
+	}
+	fileSize := cfg.FileSize
+	if fileSize == 0 {
+		fileSize = 1000000
+	}
+	nextLumi := make(map[int64]int64)
+	nfile := 0
+	for i := 0; i < cfg.Blocks; i++ {
+		h := hash(fmt.Sprintf("%s#%d", d.Name, i), 32)
+		b := &Block{
+			Name:    fmt.Sprintf("%s#%s-%s-%s-%s-%s", d.Name, h[:8], h[8:12], h[12:16], h[16:20], h[20:]),
+			Dataset: d,
+			Origin:  d.Sites[i%len(d.Sites)],
+		}
+		for j := 0; j < cfg.FilesPerBlock; j++ {
+			run := runs[nfile%len(runs)]
+			f := &File{
+				Name:   fmt.Sprintf("/store/data/%s/%s/%s/%s/%04d/%s.root", d.Era, d.Primary, d.Tier, d.Processed, i, strings.ToUpper(hash(fmt.Sprintf("%s#%d#%d", d.Name, i, j), 32))),
+				Block:  b,
+				Size:   fileSize,
+				Events: lumiPerFile * eventsPerLumi,
+				Run:    run,
+			}
+			for k := int64(0); k < lumiPerFile; k++ {
+				nextLumi[run]++
+				f.Lumis = append(f.Lumis, nextLumi[run])
+			}
+			f.Adler32 = fmt.Sprintf("%08x", adler32.Checksum([]byte(f.Name)))
+			b.Files = append(b.Files, f)
+			nfile++
+		}
+		d.Blocks = append(d.Blocks, b)
+	}
+	return d
+}
+
+// Dataset returns dataset with given name
+func (m *Model) Dataset(name string) (*Dataset, bool) {
+	d, ok := m.datasets[name]
+	return d, ok
+}
+
+// Block returns block with given name
+func (m *Model) Block(name string) (*Block, bool) {
+	b, ok := m.blocks[name]
+	return b, ok
+}
+
+// File returns file with given name
+func (m *Model) File(name string) (*File, bool) {
+	f, ok := m.files[name]
+	return f, ok
+}
+
+// Files returns all files of the dataset
+func (d *Dataset) Files() []*File {
+	var out []*File
+	for _, b := range d.Blocks {
+		out = append(out, b.Files...)
+	}
+	return out
+}
+
+// Size returns size of the block
+func (b *Block) Size() int64 {
+	var size int64
+	for _, f := range b.Files {
+		size += f.Size
+	}
+	return size
+}
+
+// Events returns number of events in the block
+func (b *Block) Events() int64 {
+	var events int64
+	for _, f := range b.Files {
+		events += f.Events
+	}
+	return events
+}
+
+// Runs returns run numbers of the dataset
+func (d *Dataset) Runs() []int64 {
+	seen := make(map[int64]bool)
+	var out []int64
+	for _, f := range d.Files() {
+		if !seen[f.Run] {
+			seen[f.Run] = true
+			out = append(out, f.Run)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// Children returns datasets which have given dataset as parent
+func (m *Model) Children(dataset string) []*Dataset {
+	var out []*Dataset
+	for _, d := range m.Datasets {
+		if d.Parent == dataset {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// helper function to find names which have given name as parent
+func childNames(name string, parents map[string][]string) []string {
+	var out []string
+	for child, names := range parents {
+		for _, p := range names {
+			if p == name {
+				out = append(out, child)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// BlockChildren returns children of given block
+func (m *Model) BlockChildren(block string) []string {
+	parents := make(map[string][]string)
+	for name, b := range m.blocks {
+		parents[name] = b.Parents
+	}
+	return childNames(block, parents)
+}
+
+// FileChildren returns children of given file
+func (m *Model) FileChildren(lfn string) []string {
+	parents := make(map[string][]string)
+	for name, f := range m.files {
+		parents[name] = f.Parents
+	}
+	return childNames(lfn, parents)
+}
+
+// ConfigID returns ReqMgr2 config cache id of given dataset
+func (d *Dataset) ConfigID() string {
+	return hash("config#"+d.Name, 32)
+}
+
+// RequestName returns ReqMgr2 request name of given dataset
+func (d *Dataset) RequestName() string {
+	return fmt.Sprintf("das_%s_%s_%s", d.Primary, d.Era, hash("request#"+d.Name, 8))
+}
@@ -0,0 +1,272 @@
+package fakeupstream
+
+// DAS fake upstream services module: Rucio APIs
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TokenLifetime defines lifetime of Rucio tokens issued by fake server
+var TokenLifetime = time.Hour
+
+// rucioAuthHandler serves /auth/x509 requests, it issues Rucio token
+func (s *Server) rucioAuthHandler(w http.ResponseWriter, r *http.Request) {
+	expires := time.Now().Add(TokenLifetime).UTC().Format(http.TimeFormat)
+	w.Header().Set("X-Rucio-Auth-Token", s.token())
+	w.Header().Set("X-Rucio-Auth-Token-Expires", expires)
+	w.WriteHeader(http.StatusOK)
+}
+
+// helper function to return Rucio token
+func (s *Server) token() string {
+	if s.Config.Token == "" {
+		return "fake-rucio-token"
+	}
+	return s.Config.Token
+}
+
+// helper function to check Rucio token of the request
+func (s *Server) rucioAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("X-Rucio-Auth-Token") == s.token() {
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{
+		"ExceptionClass":   "CannotAuthenticate",
+		"ExceptionMessage": "Cannot authenticate with given credentials",
+	})
+	return false
+}
+
+// helper function to extract DID name from Rucio URL path, e.g.
+// /replicas/cms/<name>/datasets, DBS names always start with slash
+func didName(path, prefix, suffix string) string {
+	name := strings.TrimPrefix(path, prefix)
+	name = strings.TrimSuffix(name, suffix)
+	return "/" + strings.TrimLeft(name, "/")
+}
+
+// helper function to resolve DID name into list of blocks
+func (m *Model) didBlocks(name string) []*Block {
+	if d, ok := m.Dataset(name); ok {
+		return d.Blocks
+	}
+	if b, ok := m.Block(name); ok {
+		return []*Block{b}
+	}
+	return nil
+}
+
+// helper function to resolve DID name into list of files
+func (m *Model) didFiles(name string) []*File {
+	if f, ok := m.File(name); ok {
+		return []*File{f}
+	}
+	var out []*File
+	for _, b := range m.didBlocks(name) {
+		out = append(out, b.Files...)
+	}
+	return out
+}
+
+// helper function to create Rucio block replica record
+func blockReplica(b *Block, rse string) map[string]interface{} {
+	return map[string]interface{}{
+		"scope":            "cms",
+		"name":             b.Name,
+		"rse":              rse,
+		"rse_id":           hash(rse, 32),
+		"bytes":            b.Size(),
+		"length":           len(b.Files),
+		"available_bytes":  b.Size(),
+		"available_length": len(b.Files),
+		"state":            "AVAILABLE",
+		"created_at":       time.Unix(b.Dataset.CreationDate, 0).UTC().Format(http.TimeFormat),
+		"updated_at":       time.Unix(b.Dataset.CreationDate, 0).UTC().Format(http.TimeFormat),
+	}
+}
+
+// helper function to create Rucio file replica record for given RSE
+// expression, empty expression matches all RSEs
+func fileReplica(f *File, rseExpr string) (map[string]interface{}, bool) {
+	rses := make(map[string]interface{})
+	states := make(map[string]interface{})
+	for _, rse := range f.Block.Dataset.Sites {
+		if !match(rseExpr, rse) {
+			continue
+		}
+		rses[rse] = []string{fmt.Sprintf("davs://%s.example.com:1094%s", strings.ToLower(rse), f.Name)}
+		states[rse] = "AVAILABLE"
+	}
+	if len(rses) == 0 {
+		return nil, false
+	}
+	rec := map[string]interface{}{
+		"scope":   "cms",
+		"name":    f.Name,
+		"bytes":   f.Size,
+		"adler32": f.Adler32,
+		"md5":     nil,
+		"rses":    rses,
+		"states":  states,
+	}
+	return rec, true
+}
+
+// rucioReplicasHandler serves /replicas requests
+func (s *Server) rucioReplicasHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.rucioAuthorized(w, r) {
+		return
+	}
+	m := s.Model
+	path := r.URL.Path
+	var records []map[string]interface{}
+	switch {
+	case path == "/replicas/list":
+		var spec struct {
+			DIDs []map[string]string `json:"dids"`
+			RSE  string              `json:"rse_expression"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unable to parse request, error %v", err))
+			return
+		}
+		for _, did := range spec.DIDs {
+			for _, f := range m.didFiles(did["name"]) {
+				if rec, ok := fileReplica(f, spec.RSE); ok {
+					records = append(records, rec)
+				}
+			}
+		}
+	case strings.HasPrefix(path, "/replicas/rse/"):
+		rse := strings.TrimPrefix(path, "/replicas/rse/")
+		for _, d := range m.Datasets {
+			for _, site := range d.Sites {
+				if site != rse {
+					continue
+				}
+				for _, b := range d.Blocks {
+					records = append(records, blockReplica(b, site))
+				}
+			}
+		}
+	case strings.HasPrefix(path, "/replicas/cms/") && strings.HasSuffix(path, "/datasets"):
+		for _, b := range m.didBlocks(didName(path, "/replicas/cms/", "/datasets")) {
+			for _, site := range b.Dataset.Sites {
+				records = append(records, blockReplica(b, site))
+			}
+		}
+	case strings.HasPrefix(path, "/replicas/cms/"):
+		for _, f := range m.didFiles(didName(path, "/replicas/cms/", "")) {
+			if rec, ok := fileReplica(f, ""); ok {
+				records = append(records, rec)
+			}
+		}
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown Rucio path %s", path))
+		return
+	}
+	writeStream(w, records)
+}
+
+// rucioDidsHandler serves /dids requests
+func (s *Server) rucioDidsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.rucioAuthorized(w, r) {
+		return
+	}
+	m := s.Model
+	path := r.URL.Path
+	var records []map[string]interface{}
+	switch {
+	case strings.HasSuffix(path, "/dids"):
+		name := didName(path, "/dids/cms/", "/dids")
+		if d, ok := m.Dataset(name); ok {
+			for _, b := range d.Blocks {
+				records = append(records, map[string]interface{}{
+					"scope": "cms", "name": b.Name, "type": "DATASET", "bytes": b.Size(), "length": len(b.Files),
+				})
+			}
+		} else if b, ok := m.Block(name); ok {
+			for _, f := range b.Files {
+				records = append(records, map[string]interface{}{
+					"scope": "cms", "name": f.Name, "type": "FILE", "bytes": f.Size, "adler32": f.Adler32,
+				})
+			}
+		}
+	case strings.HasSuffix(path, "/rules"):
+		name := didName(path, "/dids/cms/", "/rules")
+		var sites []string
+		var created int64
+		if f, ok := m.File(name); ok {
+			sites, created = f.Block.Dataset.Sites, f.Block.Dataset.CreationDate
+		} else if blocks := m.didBlocks(name); len(blocks) > 0 {
+			sites, created = blocks[0].Dataset.Sites, blocks[0].Dataset.CreationDate
+		}
+		nfiles := len(m.didFiles(name))
+		for _, site := range sites {
+			records = append(records, map[string]interface{}{
+				"id":             hash("rule#"+name+site, 32),
+				"scope":          "cms",
+				"name":           name,
+				"did_type":       didType(m, name),
+				"account":        "transfer_ops",
+				"rse_expression": site,
+				"copies":         1,
+				"state":          "OK",
+				"locks_ok_cnt":   nfiles,
+				"created_at":     time.Unix(created, 0).UTC().Format(http.TimeFormat),
+			})
+		}
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown Rucio path %s", path))
+		return
+	}
+	writeStream(w, records)
+}
+
+// helper function to return Rucio DID type of given name
+func didType(m *Model, name string) string {
+	if _, ok := m.Dataset(name); ok {
+		return "CONTAINER"
+	}
+	if _, ok := m.Block(name); ok {
+		return "DATASET"
+	}
+	return "FILE"
+}
+
+// rucioRsesHandler serves /rses requests
+func (s *Server) rucioRsesHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.rucioAuthorized(w, r) {
+		return
+	}
+	var records []map[string]interface{}
+	for _, rse := range s.Model.Sites {
+		records = append(records, map[string]interface{}{
+			"rse": rse, "id": hash(rse, 32), "rse_type": "DISK", "deterministic": true, "volatile": false,
+		})
+	}
+	writeStream(w, records)
+}
+
+// rucioAccountsHandler serves /accounts requests
+func (s *Server) rucioAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.rucioAuthorized(w, r) {
+		return
+	}
+	var records []map[string]interface{}
+	for _, user := range s.Model.Users {
+		records = append(records, map[string]interface{}{
+			"account": user, "type": "USER", "email": fmt.Sprintf("%s@example.com", user),
+		})
+	}
+	writeStream(w, records)
+}
@@ -0,0 +1,191 @@
+package fakeupstream
+
+// DAS fake upstream services module: ReqMgr2, McM and CRIC APIs
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// helper function to create ReqMgr2 request record of given dataset
+func requestRecord(d *Dataset) map[string]interface{} {
+	inputs := []string{}
+	if d.Parent != "" {
+		inputs = append(inputs, d.Parent)
+	}
+	return map[string]interface{}{
+		d.RequestName(): map[string]interface{}{
+			"RequestName":    d.RequestName(),
+			"RequestStatus":  "announced",
+			"RequestType":    "TaskChain",
+			"PrepID":         d.PrepID,
+			"CMSSWVersion":   d.Release,
+			"OutputDatasets": []string{d.Name},
+			"InputDatasets":  inputs,
+			"ConfigCacheID":  d.ConfigID(),
+		},
+	}
+}
+
+// reqmgrHandler serves /reqmgr2/data/request requests
+func (s *Server) reqmgrHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	result := []map[string]interface{}{}
+	for _, d := range s.Model.Datasets {
+		if v := query.Get("outputdataset"); v != "" && v != d.Name {
+			continue
+		}
+		if v := query.Get("inputdataset"); v != "" && (v != d.Parent || d.Parent == "") {
+			continue
+		}
+		if v := query.Get("prep_id"); v != "" && (v != d.PrepID || d.PrepID == "") {
+			continue
+		}
+		if v := query.Get("name"); v != "" && v != d.RequestName() {
+			continue
+		}
+		result = append(result, requestRecord(d))
+	}
+	writeJSON(w, map[string]interface{}{"result": result})
+}
+
+// configCacheHandler serves /couchdb/reqmgr_config_cache/<id>[/configFile]
+// requests
+func (s *Server) configCacheHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/couchdb/reqmgr_config_cache/")
+	arr := strings.Split(path, "/")
+	for _, d := range s.Model.Datasets {
+		if d.ConfigID() != arr[0] {
+			continue
+		}
+		if len(arr) > 1 && arr[1] == "configFile" {
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprintf(w, "import FWCore.ParameterSet.Config as cms\n")
+			fmt.Fprintf(w, "# auto-generated configuration for %s\n", d.Name)
+			fmt.Fprintf(w, "process = cms.Process(\"%s\")\n", strings.Replace(d.Tier, "-", "", -1))
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"_id":         d.ConfigID(),
+			"_rev":        "1-" + hash("rev#"+d.Name, 32),
+			"md5_hash":    hash("md5#"+d.Name, 32),
+			"pset_hash":   hash("pset#"+d.Name, 32),
+			"owner":       map[string]string{"group": "DATAOPS", "user": "das"},
+			"description": map[string]string{"config_desc": fmt.Sprintf("configuration of %s", d.Name)},
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintln(w, `{"error":"not_found","reason":"missing"}`)
+}
+
+// helper function to create McM request record of given dataset
+func mcmRecord(d *Dataset) map[string]interface{} {
+	return map[string]interface{}{
+		"prepid":             d.PrepID,
+		"dataset_name":       d.Primary,
+		"member_of_campaign": d.Era,
+		"cmssw_release":      d.Release,
+		"output_dataset":     []string{d.Name},
+		"input_dataset":      d.Parent,
+		"status":             "done",
+		"total_events":       d.events(),
+	}
+}
+
+// helper function to count events of the dataset
+func (d *Dataset) events() int64 {
+	var events int64
+	for _, b := range d.Blocks {
+		events += b.Events()
+	}
+	return events
+}
+
+// mcmHandler serves /mcm/public/restapi/requests/{get,produces,output}
+// requests
+func (s *Server) mcmHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/mcm/public/restapi/requests/")
+	arr := strings.SplitN(path, "/", 2)
+	if len(arr) != 2 {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown McM path %s", r.URL.Path))
+		return
+	}
+	api, value := arr[0], arr[1]
+	switch api {
+	case "produces":
+		if d, ok := s.Model.Dataset("/" + strings.TrimLeft(value, "/")); ok && d.PrepID != "" {
+			writeJSON(w, map[string]interface{}{"results": mcmRecord(d)})
+			return
+		}
+		writeJSON(w, map[string]interface{}{"results": map[string]interface{}{}})
+	case "get":
+		for _, d := range s.Model.Datasets {
+			if d.PrepID != "" && d.PrepID == value {
+				writeJSON(w, map[string]interface{}{"results": mcmRecord(d)})
+				return
+			}
+		}
+		writeJSON(w, map[string]interface{}{"results": map[string]interface{}{}})
+	case "output":
+		datasets := []string{}
+		for _, d := range s.Model.Datasets {
+			if d.PrepID != "" && d.PrepID == value {
+				datasets = append(datasets, d.Name)
+			}
+		}
+		writeJSON(w, map[string]interface{}{"results": datasets})
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown McM API %s", api))
+	}
+}
+
+// helper function to write CRIC response
+func writeCRIC(w http.ResponseWriter, columns []string, rows [][]interface{}) {
+	if rows == nil {
+		rows = [][]interface{}{}
+	}
+	writeJSON(w, map[string]interface{}{
+		"desc":   map[string]interface{}{"columns": columns},
+		"result": rows,
+	})
+}
+
+// cricSitesHandler serves /api/cms/site/query requests
+func (s *Server) cricSitesHandler(w http.ResponseWriter, r *http.Request) {
+	var rows [][]interface{}
+	for _, rse := range s.Model.Sites {
+		// CMS site name is RSE name without _Disk/_Tape suffix
+		site := strings.TrimSuffix(strings.TrimSuffix(rse, "_Disk"), "_Tape")
+		rows = append(rows, []interface{}{"phedex", "ACTIVE", site, rse})
+		rows = append(rows, []interface{}{"cms", "ACTIVE", site, site})
+	}
+	writeCRIC(w, []string{"type", "rcsite_state", "site", "alias"}, rows)
+}
+
+// cricUsersHandler serves /api/accounts/user/query requests
+func (s *Server) cricUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var rows [][]interface{}
+	switch r.URL.Query().Get("preset") {
+	case "group-responsibilities":
+		for _, user := range s.Model.Users {
+			rows = append(rows, []interface{}{"DataOps", user, "DataOps", "Data Manager"})
+		}
+		writeCRIC(w, []string{"name", "user_name", "user_group", "role"}, rows)
+	case "roles":
+		rows = append(rows, []interface{}{"Data Manager", s.Model.Users})
+		writeCRIC(w, []string{"title", "users"}, rows)
+	default:
+		for _, user := range s.Model.Users {
+			email := fmt.Sprintf("%s@example.com", user)
+			dn := fmt.Sprintf("/DC=org/DC=example/OU=Users/CN=%s", user)
+			rows = append(rows, []interface{}{user, user, "User", email, dn})
+		}
+		writeCRIC(w, []string{"username", "forename", "surname", "email", "dn"}, rows)
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/dmwm/das2go
 
-go 1.20
+go 1.21
 
 require (
 	github.com/dmwm/cmsauth v0.0.0-20230224144745-c57dbeca74a3
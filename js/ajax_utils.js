@@ -43,6 +43,32 @@ function ajaxCheckPid(base, method, input, inst, pid, view, interval) {
     });
 }
 
+function sseCheckPid(base, method, input, inst, pid, view) {
+    // follow DAS query status via Server-Sent Events and load request page
+    // once it is processed, old browsers fall back to polling
+    if (typeof(EventSource) == "undefined") {
+        setTimeout('ajaxCheckPid("'+base+'","'+method+'","'+input+'","'+inst+'","'+pid+'","'+view+'","2500")', 2500);
+        return;
+    }
+    var source = new EventSource(base+'/events?pid='+pid);
+    source.addEventListener('status', function(e) {
+        var event = JSON.parse(e.data);
+        var tag = document.getElementById('das_status');
+        if (tag) {
+            tag.innerHTML = event.status.escapeHTML();
+        }
+        if (event.done) {
+            source.close();
+            ajaxCheckPid(base, method, input, inst, pid, view, 0);
+        }
+    });
+    source.onerror = function() {
+        // stream is interrupted or timed out, poll the server
+        source.close();
+        ajaxCheckPid(base, method, input, inst, pid, view, 2500);
+    };
+}
+
 // workaround/bug-fix in prototype to make same-origin ajax easily
 Ajax.Responders.register({
   onCreate: function(response) {
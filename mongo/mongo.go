@@ -12,8 +12,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"html"
+	"io"
 	"log"
+	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dmwm/das2go/config"
@@ -164,85 +167,208 @@ func GetInt64Value(rec DASRecord, key string) (int64, error) {
 // MongoConnection defines connection to MongoDB
 type MongoConnection struct {
 	Session *mgo.Session
+	mutex   sync.Mutex
 }
 
-// Connect provides connection to MongoDB
-func (m *MongoConnection) Connect() *mgo.Session {
+// DialRetries defines number of attempts to (re-)connect to MongoDB
+var DialRetries = 5
+
+// DialBackoff defines initial back-off interval between connection attempts,
+// it is doubled after every failed attempt
+var DialBackoff = time.Second
+
+// DialTimeout defines timeout of single connection attempt
+var DialTimeout = 10 * time.Second
+
+// Connect provides connection to MongoDB, if connection can't be established
+// it retries with exponential back-off and returns an error afterwards
+func (m *MongoConnection) Connect() (*mgo.Session, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.Session != nil {
+		return m.Session.Clone(), nil
+	}
 	var err error
-	if m.Session == nil {
-		m.Session, err = mgo.Dial(config.Config.Uri)
-		if err != nil {
-			log.Fatal("ERROR ", err)
+	var session *mgo.Session
+	delay := DialBackoff
+	for i := 0; i < DialRetries; i++ {
+		session, err = mgo.DialWithTimeout(config.Config.Uri, DialTimeout)
+		if err == nil {
+			//             session.SetMode(mgo.Monotonic, true)
+			session.SetMode(mgo.Strong, true)
+			m.Session = session
+			return m.Session.Clone(), nil
+		}
+		log.Printf("ERROR: unable to connect to MongoDB, attempt %d/%d, retry in %v, error %v\n", i+1, DialRetries, delay, err)
+		if i < DialRetries-1 {
+			time.Sleep(delay)
+			delay *= 2
 		}
-		//         m.Session.SetMode(mgo.Monotonic, true)
-		m.Session.SetMode(mgo.Strong, true)
 	}
-	return m.Session.Clone()
+	return nil, err
+}
+
+// Reset closes MongoDB session, it should be used when connection is lost.
+// Next Connect call dials MongoDB again with exponential back-off.
+func (m *MongoConnection) Reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.Session != nil {
+		m.Session.Close()
+		m.Session = nil
+	}
 }
 
 // global object which holds MongoDB connection
 var _Mongo MongoConnection
 
-// Insert records into MongoDB
-func Insert(dbname, collname string, records []DASRecord) {
+// Close closes global MongoDB session, next MongoDB operation connects to
+// MongoDB at config.Config.Uri again
+func Close() {
+	_Mongo.Reset()
+}
+
+// helper function to check if given update can be repeated, e.g. $push or
+// $inc applied twice change the record twice
+func idempotent(update bson.M) bool {
+	for _, op := range []string{"$push", "$inc", "$mul", "$pop"} {
+		if _, ok := update[op]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// helper function to check if given error is caused by lost connection
+func connectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	msg := err.Error()
+	for _, pat := range []string{"no reachable servers", "Closed explicitly", "connection reset", "broken pipe", "EOF"} {
+		if strings.Contains(msg, pat) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to run given function over MongoDB collection. In case of
+// connection loss the session is dropped and, if retry is set, the function
+// is called once again over new session dialed with back-off
+func withCollection(op, dbname, collname string, retry bool, f func(c *mgo.Collection) error) (err error) {
+	start := time.Now()
+	defer func() {
+		utils.ObserveDuration("das_mongo_operation_duration_seconds", start, "op", op, "collection", collname)
+		if err != nil && err != mgo.ErrNotFound {
+			utils.AddCounter("das_mongo_errors_total", 1, "op", op, "collection", collname)
+		}
+	}()
+	for attempt := 0; ; attempt++ {
+		s, err := _Mongo.Connect()
+		if err != nil {
+			return err
+		}
+		err = f(s.DB(dbname).C(collname))
+		s.Close()
+		if !connectionError(err) {
+			return err
+		}
+		utils.Logger.Warn("lost connection to MongoDB", "db", dbname, "collection", collname, "op", op, "retry", retry && attempt == 0, "error", err)
+		_Mongo.Reset()
+		if !retry || attempt > 0 {
+			return err
+		}
+	}
+}
+
+// Insert records into MongoDB using unordered bulk insert, i.e. failure of
+// one record does not prevent insertion of others. Records get their ids
+// before insertion, therefore in case of connection loss the insert is
+// repeated and records which were already inserted are skipped as duplicates.
+func Insert(dbname, collname string, records []DASRecord) error {
 
 	// defer function profiler
 	defer utils.MeasureTime("mongo/Insert")()
 
-	s := _Mongo.Connect()
-	defer s.Close()
-	c := s.DB(dbname).C(collname)
+	if len(records) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, 0, len(records))
 	for _, rec := range records {
-		if err := c.Insert(&rec); err != nil {
-			log.Println("Fail to insert DAS record", err)
-			break
+		if _, ok := rec["_id"]; !ok {
+			r := make(DASRecord, len(rec)+1)
+			for k, v := range rec {
+				r[k] = v
+			}
+			r["_id"] = bson.NewObjectId()
+			rec = r
+		}
+		docs = append(docs, rec)
+	}
+	attempt := 0
+	err := withCollection("Insert", dbname, collname, true, func(c *mgo.Collection) error {
+		attempt++
+		bulk := c.Bulk()
+		bulk.Unordered()
+		bulk.Insert(docs...)
+		_, err := bulk.Run()
+		if attempt > 1 && err != nil && mgo.IsDup(err) {
+			return nil
 		}
+		return err
+	})
+	if err != nil {
+		log.Printf("ERROR: unable to insert %d records into %s.%s, error %v\n", len(records), dbname, collname, err)
 	}
+	return err
 }
 
 // Get records from MongoDB
-func Get(dbname, collname string, spec bson.M, idx, limit int) []DASRecord {
+func Get(dbname, collname string, spec bson.M, idx, limit int) ([]DASRecord, error) {
 
 	// defer function profiler
 	defer utils.MeasureTime("mongo/Get")()
 
 	out := []DASRecord{}
-	s := _Mongo.Connect()
-	defer s.Close()
-	c := s.DB(dbname).C(collname)
-	var err error
-	if limit > 0 {
-		err = c.Find(spec).Skip(idx).Limit(limit).All(&out)
-	} else {
-		err = c.Find(spec).Skip(idx).All(&out)
-	}
+	err := withCollection("Get", dbname, collname, true, func(c *mgo.Collection) error {
+		if limit > 0 {
+			return c.Find(spec).Skip(idx).Limit(limit).All(&out)
+		}
+		return c.Find(spec).Skip(idx).All(&out)
+	})
 	if err != nil {
-		log.Println("ERROR: unable to get records", err)
+		log.Printf("ERROR: unable to get records, spec %+v, error %v\n", spec, err)
 	}
-	return out
+	return out, err
 }
 
 // GetSorted records from MongoDB sorted by given key
-func GetSorted(dbname, collname string, spec bson.M, skeys []string) []DASRecord {
+func GetSorted(dbname, collname string, spec bson.M, skeys []string) ([]DASRecord, error) {
 
 	// defer function profiler
 	defer utils.MeasureTime("mongo/GetSorted")()
 
 	out := []DASRecord{}
-	s := _Mongo.Connect()
-	defer s.Close()
-	c := s.DB(dbname).C(collname)
-	err := c.Find(spec).Sort(skeys...).All(&out)
-	if err != nil {
-		log.Println("unable to sort records", err)
-		// try to fetch all unsorted data
-		err = c.Find(spec).All(&out)
-		if err != nil {
-			log.Println("ERROR: unable to find records", err)
-			out = append(out, DASErrorRecord(fmt.Sprintf("%v", err), utils.MongoDBErrorName, utils.MongoDBError))
+	err := withCollection("GetSorted", dbname, collname, true, func(c *mgo.Collection) error {
+		err := c.Find(spec).Sort(skeys...).All(&out)
+		if err != nil && !connectionError(err) {
+			log.Println("unable to sort records", err)
+			// try to fetch all unsorted data
+			err = c.Find(spec).All(&out)
 		}
+		return err
+	})
+	if err != nil {
+		log.Println("ERROR: unable to find records", err)
 	}
-	return out
+	return out, err
 }
 
 // helper function to present in bson selected fields
@@ -254,106 +380,195 @@ func sel(q ...string) (r bson.M) {
 	return
 }
 
-// GetFilteredSorted get records from MongoDB filtered and sorted by given key
-func GetFilteredSorted(dbname, collname string, spec bson.M, fields, skeys []string, idx, limit int) []DASRecord {
+// GetFilteredSorted get records from MongoDB filtered and sorted by given key,
+// if no fields are provided the whole records are returned
+func GetFilteredSorted(dbname, collname string, spec bson.M, fields, skeys []string, idx, limit int) ([]DASRecord, error) {
 
 	// defer function profiler
 	defer utils.MeasureTime("mongo/GetFiltered/Sorted")()
 
 	out := []DASRecord{}
-	s := _Mongo.Connect()
-	defer s.Close()
-	c := s.DB(dbname).C(collname)
-	var err error
-	fields = append(fields, "das") // always extract das part of the record
-	if limit > 0 {
-		if len(skeys) > 0 {
-			err = c.Find(spec).Skip(idx).Limit(limit).Select(sel(fields...)).Sort(skeys...).All(&out)
-		} else {
-			err = c.Find(spec).Skip(idx).Limit(limit).Select(sel(fields...)).All(&out)
+	err := withCollection("GetFilteredSorted", dbname, collname, true, func(c *mgo.Collection) error {
+		query := c.Find(spec)
+		if len(fields) > 0 {
+			fields = append(fields, "das") // always extract das part of the record
+			query = query.Select(sel(fields...))
 		}
-	} else {
 		if len(skeys) > 0 {
-			err = c.Find(spec).Select(sel(fields...)).Sort(skeys...).All(&out)
-		} else {
-			err = c.Find(spec).Select(sel(fields...)).All(&out)
+			query = query.Sort(skeys...)
 		}
-	}
+		query = query.Skip(idx)
+		if limit > 0 {
+			query = query.Limit(limit)
+		}
+		return query.All(&out)
+	})
 	if err != nil {
 		log.Println("ERROR: unable to fetch from MOngoDB", time.Now(), err)
 	}
-	return out
+	return out, err
+}
+
+// Aggregate runs MongoDB aggregation pipeline over given collection
+func Aggregate(dbname, collname string, pipeline []bson.M) ([]DASRecord, error) {
+
+	// defer function profiler
+	defer utils.MeasureTime("mongo/Aggregate")()
+
+	out := []DASRecord{}
+	err := withCollection("Aggregate", dbname, collname, true, func(c *mgo.Collection) error {
+		return c.Pipe(pipeline).AllowDiskUse().All(&out)
+	})
+	if err != nil {
+		log.Printf("ERROR: unable to aggregate records, pipeline %+v, error %v\n", pipeline, err)
+	}
+	return out, err
+}
+
+// Distinct gets distinct values of given key from MongoDB records matching given spec
+func Distinct(dbname, collname, key string, spec bson.M) ([]string, error) {
+
+	// defer function profiler
+	defer utils.MeasureTime("mongo/Distinct")()
+
+	var out []string
+	err := withCollection("Distinct", dbname, collname, true, func(c *mgo.Collection) error {
+		return c.Find(spec).Distinct(key, &out)
+	})
+	if err != nil {
+		log.Printf("ERROR: unable to get distinct values, key %s, spec %+v, error %v\n", key, spec, err)
+	}
+	return out, err
 }
 
 // Update inplace for given spec
-func Update(dbname, collname string, spec, newdata bson.M) {
+func Update(dbname, collname string, spec, newdata bson.M) error {
 
 	// defer function profiler
 	defer utils.MeasureTime("mongo/Update")()
 
-	s := _Mongo.Connect()
-	defer s.Close()
-	c := s.DB(dbname).C(collname)
-	err := c.Update(spec, newdata)
+	err := withCollection("Update", dbname, collname, idempotent(newdata), func(c *mgo.Collection) error {
+		return c.Update(spec, newdata)
+	})
 	if err != nil {
 		log.Printf("ERROR: unable to update record, spec %v, data %+v, error %v\n", spec, newdata, err)
 	}
+	return err
+}
+
+// UpdateAll updates all records matched by given spec and returns number of
+// updated records. Updates which can't be repeated, e.g. $push or $inc, are
+// not retried on connection loss
+func UpdateAll(dbname, collname string, spec, newdata bson.M) (int, error) {
+
+	// defer function profiler
+	defer utils.MeasureTime("mongo/UpdateAll")()
+
+	var nrec int
+	err := withCollection("UpdateAll", dbname, collname, idempotent(newdata), func(c *mgo.Collection) error {
+		info, err := c.UpdateAll(spec, newdata)
+		if info != nil {
+			nrec = info.Updated
+		}
+		return err
+	})
+	if err != nil {
+		log.Printf("ERROR: unable to update records, spec %v, data %+v, error %v\n", spec, newdata, err)
+	}
+	return nrec, err
+}
+
+// RecordIDs returns ids of records matched by given spec
+func RecordIDs(dbname, collname string, spec bson.M) ([]bson.ObjectId, error) {
+
+	// defer function profiler
+	defer utils.MeasureTime("mongo/RecordIDs")()
+
+	var out []bson.ObjectId
+	err := withCollection("RecordIDs", dbname, collname, true, func(c *mgo.Collection) error {
+		var recs []struct {
+			ID bson.ObjectId `bson:"_id"`
+		}
+		if err := c.Find(spec).Select(bson.M{"_id": 1}).All(&recs); err != nil {
+			return err
+		}
+		out = out[:0]
+		for _, r := range recs {
+			out = append(out, r.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: unable to get record ids, spec %+v, error %v\n", spec, err)
+	}
+	return out, err
 }
 
 // Count gets number records from MongoDB
-func Count(dbname, collname string, spec bson.M) int {
+func Count(dbname, collname string, spec bson.M) (int, error) {
 
 	// defer function profiler
 	defer utils.MeasureTime("mongo/Count")()
 
-	s := _Mongo.Connect()
-	defer s.Close()
-	c := s.DB(dbname).C(collname)
-	nrec, err := c.Find(spec).Count()
+	var nrec int
+	err := withCollection("Count", dbname, collname, true, func(c *mgo.Collection) error {
+		var err error
+		nrec, err = c.Find(spec).Count()
+		return err
+	})
 	if err != nil {
 		log.Printf("ERROR: unable to count records, spec %+v, error %v\n", spec, err)
 	}
-	return nrec
+	return nrec, err
 }
 
-// Bytes gets number records from MongoDB
-func Bytes(dbname, collname string, spec bson.M) int {
+// Bytes gets size of records from MongoDB, it is estimated from size of
+// the first matched record
+func Bytes(dbname, collname string, spec bson.M) (int, error) {
 
 	// defer function profiler
 	defer utils.MeasureTime("mongo/Bytes")()
 
-	s := _Mongo.Connect()
-	defer s.Close()
-	c := s.DB(dbname).C(collname)
 	var rec DASRecord
-	err := c.Find(spec).One(&rec)
+	err := withCollection("Bytes", dbname, collname, true, func(c *mgo.Collection) error {
+		return c.Find(spec).One(&rec)
+	})
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
 	if err != nil {
 		log.Printf("ERROR: unable to find record spec=%+v error=%v\n", spec, err)
+		return 0, err
 	}
 	data, err := json.Marshal(rec)
 	if err != nil {
 		log.Printf("ERROR: unable to marshl DASRecord error=%v\n", err)
+		return 0, err
 	}
 	// find total number of records
-	nrec := Count(dbname, collname, spec)
+	nrec, err := Count(dbname, collname, spec)
 
 	// return total size of all DAS records for given spec
-	return nrec * len(data)
+	return nrec * len(data), err
 }
 
 // Remove records from MongoDB
-func Remove(dbname, collname string, spec bson.M) {
+func Remove(dbname, collname string, spec bson.M) error {
 
 	// defer function profiler
 	defer utils.MeasureTime("mongo/Remove")()
 
-	s := _Mongo.Connect()
-	defer s.Close()
-	c := s.DB(dbname).C(collname)
-	_, err := c.RemoveAll(spec)
-	if err != nil && err != mgo.ErrNotFound {
+	err := withCollection("Remove", dbname, collname, true, func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(spec)
+		return err
+	})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
 		log.Printf("ERROR: untable to remove records, spec %+v, error %v\n", spec, err)
 	}
+	return err
 }
 
 // LoadJsonData stream from series of bytes
@@ -368,7 +583,11 @@ func LoadJsonData(data []byte) DASRecord {
 
 // CreateIndexes creates DAS cache indexes
 func CreateIndexes(dbname, collname string, keys []string) {
-	s := _Mongo.Connect()
+	s, err := _Mongo.Connect()
+	if err != nil {
+		log.Printf("ERROR: unable to create indexes, error %v\n", err)
+		return
+	}
 	defer s.Close()
 	c := s.DB(dbname).C(collname)
 	for _, key := range keys {
@@ -83,8 +83,8 @@ func monitor(port int64, config string) {
 		start(config, pw)
 	}
 	// check running process, it should respond on localhost
-	endpoint := fmt.Sprintf("http://localhost:%d/das/status", port)
-	pat = "DAS server status"
+	endpoint := fmt.Sprintf("http://localhost:%d/das/metrics", port)
+	pat = "das_uptime_seconds"
 	for {
 		status = checkHttpEndpoint(endpoint, pat)
 		if !status {
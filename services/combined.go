@@ -236,7 +236,7 @@ func rucioInfo(dasquery dasql.DASQuery, blockNames []string) (mongo.DASRecord, m
 		// http://cms-rucio.cern.ch/replicas/cms/{block['name']}/datasets
 		furl = fmt.Sprintf("%s/replicas/cms/%s/datasets?deep=True", RucioUrl(), url.QueryEscape(blkName))
 		umap[furl] = 1 // keep track of processed urls below
-		go utils.Fetch(client, furl, "", chout)
+		go utils.FetchWithContext(dasquery.FetchContext(), client, furl, "", chout)
 	}
 
 	// collect results from block URL calls
@@ -340,12 +340,12 @@ func rucioInfoMID(dasquery dasql.DASQuery, blockNames []string) (mongo.DASRecord
 		// http://cms-rucio.cern.ch/replicas/cms/{block['name']}/datasets
 		furl = fmt.Sprintf("%s/replicas/cms/%s/datasets", RucioUrl(), url.QueryEscape(blkName))
 		umap[furl] = 1 // keep track of processed urls below
-		go utils.Fetch(client, furl, "", chout)
+		go utils.FetchWithContext(dasquery.FetchContext(), client, furl, "", chout)
 
 		// http://cms-rucio.cern.ch/dids/cms/{block['name']}/dids
 		furl = fmt.Sprintf("%s/dids/cms/%s/dids", RucioUrl(), url.QueryEscape(blkName))
 		umap[furl] = 1 // keep track of processed urls below
-		go utils.Fetch(client, furl, "", chout)
+		go utils.FetchWithContext(dasquery.FetchContext(), client, furl, "", chout)
 	}
 
 	// collect results from block URL calls
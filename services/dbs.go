@@ -45,7 +45,11 @@ func loadDBSData(api string, data []byte) []mongo.DASRecord {
 
 // DBSUnmarshal unmarshals DBS data stream and return DAS records based on api
 func DBSUnmarshal(api string, data []byte) []mongo.DASRecord {
-	records := loadDBSData(api, data)
+	return dbsRecords(api, loadDBSData(api, data))
+}
+
+// helper function to convert DBS records into DAS records based on api
+func dbsRecords(api string, records []mongo.DASRecord) []mongo.DASRecord {
 	var out []mongo.DASRecord
 	if api == "dataset_info" || api == "datasets" || api == "datasetlist" {
 		for _, rec := range records {
@@ -176,14 +176,23 @@ func processUrls(dasquery dasql.DASQuery, system, api string, urls []string) []m
 	umap := map[string]int{}
 	client := utils.HttpClient()
 	for _, furl := range urls {
-		umap[furl] = 1                        // keep track of processed urls below
-		go utils.Fetch(client, furl, "", out) // "" specify optional args
+		umap[furl] = 1                                                            // keep track of processed urls below
+		go utils.FetchWithContext(dasquery.FetchContext(), client, furl, "", out) // "" specify optional args
 	}
 	// collect all results from out channel
 	exit := false
 	for {
 		select {
 		case r := <-out:
+			if r.Error != nil {
+				if utils.WEBSERVER > 0 {
+					AppendDASError(dasquery, fmt.Sprintf("%s:%s", system, api), fmt.Errorf("%s:%s %s error: %w", system, api, utils.ErrorClass(r.Error), r.Error))
+				} else {
+					log.Printf("ERROR: %s:%s %s error: %v\n", system, api, utils.ErrorClass(r.Error), r.Error)
+				}
+				delete(umap, r.Url)
+				continue
+			}
 			// process data
 			var records []mongo.DASRecord
 			if system == "dbs3" || system == "dbs" {
@@ -165,7 +165,7 @@ func findReqMgrIds(dasquery dasql.DASQuery, base, dataset string) ([]ReqMgrInfo,
 	client := utils.HttpClient()
 	for _, u := range urls {
 		umap[u] = 1 // keep track of processed urls below
-		go utils.Fetch(client, u, "", ch)
+		go utils.FetchWithContext(dasquery.FetchContext(), client, u, "", ch)
 	}
 	exit := false
 	for {
@@ -290,7 +290,7 @@ func reqmgrConfigs(dasquery dasql.DASQuery) []mongo.DASRecord {
 	client := utils.HttpClient()
 	for _, u := range rurls {
 		umap[u] = 1 // keep track of processed urls below
-		go utils.Fetch(client, u, "", ch)
+		go utils.FetchWithContext(dasquery.FetchContext(), client, u, "", ch)
 	}
 	for {
 		select {
@@ -60,8 +60,12 @@ func loadRucioData(api string, data []byte) []mongo.DASRecord {
 
 // RucioUnmarshal unmarshals Rucio data stream and return DAS records based on api
 func RucioUnmarshal(dasquery dasql.DASQuery, api string, data []byte) []mongo.DASRecord {
+	return rucioRecords(dasquery, api, loadRucioData(api, data))
+}
+
+// helper function to convert Rucio records into DAS records based on api
+func rucioRecords(dasquery dasql.DASQuery, api string, records []mongo.DASRecord) []mongo.DASRecord {
 	var out []mongo.DASRecord
-	records := loadRucioData(api, data)
 	specs := dasquery.Spec
 	rmap := make(mongo.DASRecord)
 	if api == "block4block" {
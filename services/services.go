@@ -7,6 +7,8 @@ package services
 //
 
 import (
+	"fmt"
+	"io"
 	"strings"
 	"time"
 
@@ -61,6 +63,14 @@ func Unmarshal(dasquery dasql.DASQuery, system, api string, r utils.ResponseType
 		return out
 	}
 	data := r.Data
+	if r.Body != nil {
+		var err error
+		data, err = io.ReadAll(r.Body)
+		r.Close()
+		if err != nil {
+			return []mongo.DASRecord{CreateDASErrorRecord(dasquery, pkeys)}
+		}
+	}
 	switch {
 	case system == "rucio":
 		out = RucioUnmarshal(dasquery, api, data)
@@ -187,8 +197,8 @@ func CreateDASErrorRecord(dasquery dasql.DASQuery, pkeys []string) mongo.DASReco
 // GetDASRecord gets DAS record from das cache
 func GetDASRecord(dasquery dasql.DASQuery) mongo.DASRecord {
 	spec := bson.M{"qhash": dasquery.Qhash, "das.record": 0}
-	rec := mongo.Get("das", "cache", spec, 0, 1)
-	if len(rec) > 0 {
+	rec, err := mongo.Get("das", "cache", spec, 0, 1)
+	if err == nil && len(rec) > 0 {
 		return rec[0]
 	}
 	return CreateDASErrorRecord(dasquery, []string{})
@@ -198,7 +208,10 @@ func GetDASRecord(dasquery dasql.DASQuery) mongo.DASRecord {
 func GetMinExpire(dasquery dasql.DASQuery) int64 {
 	expire := utils.Expire(3600)
 	spec := bson.M{"qhash": dasquery.Qhash}
-	records := mongo.Get("das", "cache", spec, 0, -1) // get all records
+	records, err := mongo.Get("das", "cache", spec, 0, -1) // get all records
+	if err != nil {
+		return expire
+	}
 	for _, rec := range records {
 		dasExpire := GetExpire(rec)
 		if dasExpire < expire {
@@ -209,10 +222,176 @@ func GetMinExpire(dasquery dasql.DASQuery) int64 {
 }
 
 // UpdateDASRecord updates DAS record in das cache
-func UpdateDASRecord(qhash string, dasrecord mongo.DASRecord) {
+func UpdateDASRecord(qhash string, dasrecord mongo.DASRecord) error {
 	spec := bson.M{"qhash": qhash, "das.record": 0}
 	newdata := bson.M{"query": dasrecord["query"], "qhash": dasrecord["qhash"], "instance": dasrecord["instance"], "das": dasrecord["das"]}
-	mongo.Update("das", "cache", spec, newdata)
+	return mongo.Update("das", "cache", spec, newdata)
+}
+
+// ModifyDASRecord applies given update operators, e.g. $set or $push, to
+// DAS record in das cache. Unlike UpdateDASRecord it does not replace the
+// record, therefore concurrent updates of different fields are not lost.
+func ModifyDASRecord(qhash string, update bson.M) error {
+	spec := bson.M{"qhash": qhash, "das.record": 0}
+	_, err := mongo.UpdateAll("das", "cache", spec, update)
+	return err
+}
+
+// DASErrors returns list of errors stored in DAS record
+func DASErrors(dasrecord mongo.DASRecord) []string {
+	var out []string
+	das, ok := dasrecord["das"].(mongo.DASRecord)
+	if !ok {
+		return out
+	}
+	switch errs := das["errors"].(type) {
+	case []string:
+		out = append(out, errs...)
+	case []interface{}:
+		for _, e := range errs {
+			out = append(out, fmt.Sprintf("%v", e))
+		}
+	}
+	return out
+}
+
+// DASEndpoints returns upstream endpoints stored in DAS record, i.e. base
+// urls which served requests of DAS query, keyed by system
+func DASEndpoints(dasrecord mongo.DASRecord) mongo.DASRecord {
+	out := make(mongo.DASRecord)
+	das, ok := dasrecord["das"].(mongo.DASRecord)
+	if !ok {
+		return out
+	}
+	switch endpoints := das["endpoints"].(type) {
+	case mongo.DASRecord:
+		for k, v := range endpoints {
+			out[k] = v
+		}
+	case map[string]interface{}:
+		for k, v := range endpoints {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// DASServiceErrors returns errors stored in DAS record keyed by service,
+// e.g. dbs3:datasets, errors of DAS itself are stored under das key
+func DASServiceErrors(dasrecord mongo.DASRecord) map[string][]string {
+	out := make(map[string][]string)
+	das, ok := dasrecord["das"].(mongo.DASRecord)
+	if !ok {
+		return out
+	}
+	var errs map[string]interface{}
+	switch v := das["service_errors"].(type) {
+	case mongo.DASRecord:
+		errs = v
+	case map[string]interface{}:
+		errs = v
+	}
+	for srv, val := range errs {
+		switch v := val.(type) {
+		case []string:
+			out[srv] = append(out[srv], v...)
+		case []interface{}:
+			for _, e := range v {
+				out[srv] = append(out[srv], fmt.Sprintf("%v", e))
+			}
+		}
+	}
+	return out
+}
+
+// FailedService checks if given error of service means its failure, e.g.
+// not-found response of upstream system is a valid (empty) answer
+func FailedService(err error) bool {
+	return err != nil && utils.ErrorClass(err) != utils.ErrorNotFound
+}
+
+// AppendDASError stores given error of service (system:urn or das) in DAS
+// record of given query and marks it as failed. Errors which do not mean
+// failure of service (see FailedService) are only reported per service.
+func AppendDASError(dasquery dasql.DASQuery, service string, err error) {
+	push := bson.M{"das.service_errors." + service: err.Error()}
+	update := bson.M{"$push": push}
+	if FailedService(err) {
+		dasquery.Logger().Error("service error", "service", service, "error", err)
+		push["das.errors"] = err.Error()
+		update["$set"] = bson.M{"das.status": "fail"}
+	} else {
+		dasquery.Logger().Info("service error", "service", service, "error", err)
+	}
+	if e := ModifyDASRecord(dasquery.Qhash, update); e != nil {
+		dasquery.Logger().Error("unable to store error in DAS record", "service", service, "error", e)
+	}
+}
+
+// DASProgress returns processing status of services stored in DAS record,
+// i.e. {"dbs3:datasets": {"status": "ok", "records": 10}}
+func DASProgress(dasrecord mongo.DASRecord) map[string]mongo.DASRecord {
+	out := make(map[string]mongo.DASRecord)
+	das, ok := dasrecord["das"].(mongo.DASRecord)
+	if !ok {
+		return out
+	}
+	var progress map[string]interface{}
+	switch v := das["progress"].(type) {
+	case mongo.DASRecord:
+		progress = v
+	case map[string]interface{}:
+		progress = v
+	}
+	for srv, val := range progress {
+		switch v := val.(type) {
+		case mongo.DASRecord:
+			out[srv] = v
+		case map[string]interface{}:
+			out[srv] = mongo.DASRecord(v)
+		}
+	}
+	return out
+}
+
+// SetServiceProgress stores processing status (ok or fail) and number of
+// records of service (system:urn) in DAS record of given query, service
+// with several upstream urls accumulates its records
+func SetServiceProgress(dasquery dasql.DASQuery, service, status string, nrec int) {
+	dasquery.Logger().Info("service processed", "service", service, "status", status, "records", nrec)
+	key := "das.progress." + service
+	update := bson.M{"$inc": bson.M{key + ".records": int64(nrec)}}
+	if status == "fail" {
+		update["$set"] = bson.M{key + ".status": status}
+	}
+	err := ModifyDASRecord(dasquery.Qhash, update)
+	if err == nil && status != "fail" {
+		// failed service keeps its status
+		spec := bson.M{"qhash": dasquery.Qhash, "das.record": 0, key + ".status": bson.M{"$ne": "fail"}}
+		_, err = mongo.UpdateAll("das", "cache", spec, bson.M{"$set": bson.M{key + ".status": status}})
+	}
+	if err != nil {
+		dasquery.Logger().Error("unable to store progress in DAS record", "service", service, "error", err)
+	}
+}
+
+// FinalStatus returns final status of DAS record: ok or fail when errors
+// occurred during query processing
+func FinalStatus(dasrecord mongo.DASRecord) string {
+	if len(DASErrors(dasrecord)) > 0 {
+		return "fail"
+	}
+	return "ok"
+}
+
+// QueryStatus returns status of processed DAS query presented to clients
+// for given status of DAS record and number of results: ok, fail or partial
+// when some services failed but results are available
+func QueryStatus(status string, nrec int) string {
+	if status == "fail" && nrec > 0 {
+		return "partial"
+	}
+	return status
 }
 
 // GetExpire helper function to get expire value from DAS/data record
@@ -226,8 +405,8 @@ func GetExpire(rec mongo.DASRecord) int64 {
 func MergeDASRecords(dasquery dasql.DASQuery) ([]mongo.DASRecord, int64) {
 	// get DAS record and extract primary key
 	spec := bson.M{"qhash": dasquery.Qhash, "das.record": 0}
-	records := mongo.Get("das", "cache", spec, 0, 1)
-	if len(records) == 0 {
+	records, err := mongo.Get("das", "cache", spec, 0, 1)
+	if err != nil || len(records) == 0 {
 		return records, time.Now().Unix() + 1
 	}
 	dasrecord := records[0]
@@ -240,7 +419,7 @@ func MergeDASRecords(dasquery dasql.DASQuery) ([]mongo.DASRecord, int64) {
 	var skeys []string
 	skeys = append(skeys, pkey)
 	if len(lkeys) > 1 {
-		records = mongo.Get("das", "cache", spec, 0, -1) // get all unsorted records
+		records, _ = mongo.Get("das", "cache", spec, 0, -1) // get all unsorted records
 		status := das["status"].(string)
 		expire := das["expire"].(int64)
 		for _, rec := range records {
@@ -248,6 +427,7 @@ func MergeDASRecords(dasquery dasql.DASQuery) ([]mongo.DASRecord, int64) {
 			das["status"] = status
 			rec["das"] = das
 		}
+		dasquery.Debug.AddMerge("query selects %d fields, keep %d records unmerged", len(lkeys), len(records))
 		return records, expire
 	}
 
@@ -257,9 +437,15 @@ func MergeDASRecords(dasquery dasql.DASQuery) ([]mongo.DASRecord, int64) {
 	var out []mongo.DASRecord
 	var oldrec, rec mongo.DASRecord
 	if len(skeys) > 0 {
-		records = mongo.GetSorted("das", "cache", spec, skeys)
+		records, err = mongo.GetSorted("das", "cache", spec, skeys)
+		if err != nil {
+			dasquery.Logger().Error("unable to get sorted records", "error", err)
+			records = []mongo.DASRecord{mongo.DASErrorRecord(err.Error(), utils.MongoDBErrorName, utils.MongoDBError)}
+			return records, time.Now().Unix() + 1
+		}
 	} else {
-		records = mongo.Get("das", "cache", spec, 0, -1) // get all unsorted records
+		records, _ = mongo.Get("das", "cache", spec, 0, -1) // get all unsorted records
+		dasquery.Debug.AddMerge("no sort keys, keep %d records unmerged", len(records))
 		return records, time.Now().Unix() + 300
 	}
 	for idx, rec := range records {
@@ -285,6 +471,7 @@ func MergeDASRecords(dasquery dasql.DASQuery) ([]mongo.DASRecord, int64) {
 	if rec[mkey] == nil {
 		out = append(out, oldrec)
 	}
+	dasquery.Debug.AddMerge("merge %d records on primary key %s into %d records, expire %d", len(records), pkey, len(out), expire)
 	return out, expire
 }
 
@@ -339,6 +526,15 @@ func services(das mongo.DASRecord) []string {
 	return srvs
 }
 
+// DASServices returns list of services stored in DAS record
+func DASServices(dasrecord mongo.DASRecord) []string {
+	das, ok := dasrecord["das"].(mongo.DASRecord)
+	if !ok {
+		return []string{}
+	}
+	return services(das)
+}
+
 // helper function to merge das parts of DAS records
 func mergeDASparts(das1, das2 mongo.DASRecord) mongo.DASRecord {
 	das := make(mongo.DASRecord)
@@ -0,0 +1,198 @@
+package services
+
+// DAS service module
+// streaming decoding of upstream responses
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/dmwm/das2go/dasql"
+	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/utils"
+)
+
+// UnmarshalBatchSize defines max number of records StreamUnmarshal passes
+// for further processing at once
+var UnmarshalBatchSize = 1000
+
+// DBS and Rucio APIs whose records are aggregated across whole response and
+// therefore can't be processed in batches
+var dbsAggregateAPIs = []string{"site4dataset", "site4block"}
+var rucioAggregateAPIs = []string{"block4block", "dataset4dataset", "dataset4dataset_site", "dataset4site"}
+
+// recordDecoder decodes upstream records one by one, it returns io.EOF when
+// there are no more records
+type recordDecoder interface {
+	Next() (mongo.DASRecord, error)
+	Offset() int64 // number of consumed bytes
+}
+
+// listDecoder decodes JSON list of records, e.g. DBS response
+type listDecoder struct {
+	dec     *json.Decoder
+	started bool
+}
+
+// helper function to create listDecoder, numbers are kept as is, see loadDBSData
+func newListDecoder(r io.Reader) *listDecoder {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return &listDecoder{dec: dec}
+}
+
+// Next implements recordDecoder interface
+func (d *listDecoder) Next() (mongo.DASRecord, error) {
+	if !d.started {
+		tok, err := d.dec.Token()
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if tok == nil { // null response
+			return nil, io.EOF
+		}
+		if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+			return nil, fmt.Errorf("expected list of records, got %v", tok)
+		}
+		d.started = true
+	}
+	if !d.dec.More() {
+		return nil, io.EOF
+	}
+	var rec mongo.DASRecord
+	err := d.dec.Decode(&rec)
+	return rec, err
+}
+
+// Offset implements recordDecoder interface
+func (d *listDecoder) Offset() int64 {
+	return d.dec.InputOffset()
+}
+
+// streamDecoder decodes stream of JSON records, e.g. Rucio
+// application/x-json-stream response
+type streamDecoder struct {
+	dec *json.Decoder
+}
+
+// Next implements recordDecoder interface
+func (d *streamDecoder) Next() (mongo.DASRecord, error) {
+	var rec mongo.DASRecord
+	err := d.dec.Decode(&rec)
+	return rec, err
+}
+
+// Offset implements recordDecoder interface
+func (d *streamDecoder) Offset() int64 {
+	return d.dec.InputOffset()
+}
+
+// StreamUnmarshal decodes upstream response incrementally and passes DAS
+// records to given function in batches of at most UnmarshalBatchSize records.
+// DBS and Rucio responses are decoded record by record, responses of other
+// systems and APIs which aggregate records are processed as a whole.
+// Size of decoded records held in memory is accounted in given tracker.
+// Response body is closed when function returns.
+func StreamUnmarshal(dasquery dasql.DASQuery, system, api string, r utils.ResponseType, notations []mongo.DASRecord, pkeys []string, tracker *utils.MemoryTracker, fn func([]mongo.DASRecord) error) error {
+	// defer function profiler
+	defer utils.MeasureTime("services/StreamUnmarshal")()
+
+	defer r.Close()
+	if tracker == nil {
+		tracker = &utils.MemoryTracker{}
+	}
+	var dec recordDecoder
+	var convert func([]mongo.DASRecord) []mongo.DASRecord
+	var errorRecord func(error) mongo.DASRecord
+	if r.Error == nil {
+		if (system == "dbs3" || system == "dbs") && !utils.InList(api, dbsAggregateAPIs) {
+			dec = newListDecoder(r.Reader())
+			convert = func(records []mongo.DASRecord) []mongo.DASRecord {
+				return dbsRecords(api, records)
+			}
+			errorRecord = func(err error) mongo.DASRecord {
+				msg := fmt.Sprintf("DBS unable to unmarshal the data into DAS record, api=%s, error=%v", api, err)
+				return mongo.DASErrorRecord(msg, utils.DBSErrorName, utils.DBSError)
+			}
+		} else if system == "rucio" && !utils.InList(api, rucioAggregateAPIs) {
+			dec = &streamDecoder{dec: json.NewDecoder(r.Reader())}
+			convert = func(records []mongo.DASRecord) []mongo.DASRecord {
+				return rucioRecords(dasquery, api, records)
+			}
+			errorRecord = func(err error) mongo.DASRecord {
+				msg := fmt.Sprintf("Rucio unable to unmarshal the data into DAS record, api=%s, error=%v", api, err)
+				return mongo.DASErrorRecord(msg, utils.RucioErrorName, utils.RucioError)
+			}
+		}
+	}
+
+	// process response as a whole
+	if dec == nil {
+		if r.Body != nil {
+			data, err := io.ReadAll(r.Body)
+			r.Close()
+			r.Body, r.Data = nil, data
+			if err != nil {
+				r.Error = err
+			}
+		}
+		size := int64(len(r.Data))
+		tracker.Add(size)
+		defer tracker.Release(size)
+		records := Unmarshal(dasquery, system, api, r, notations, pkeys)
+		for len(records) > 0 {
+			n := UnmarshalBatchSize
+			if n <= 0 || n > len(records) {
+				n = len(records)
+			}
+			if err := fn(records[:n]); err != nil {
+				return err
+			}
+			records = records[n:]
+		}
+		return nil
+	}
+
+	// decode and process records in batches
+	var batch []mongo.DASRecord
+	var offset int64
+	flush := func() error {
+		size := dec.Offset() - offset
+		offset = dec.Offset()
+		tracker.Add(size)
+		defer tracker.Release(size)
+		records := remap(api, convert(batch), notations)
+		batch = nil
+		if len(records) == 0 {
+			return nil
+		}
+		return fn(records)
+	}
+	for {
+		rec, err := dec.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			batch = append(batch, errorRecord(err))
+			break
+		}
+		batch = append(batch, rec)
+		if len(batch) >= UnmarshalBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if len(batch) > 0 {
+		return flush()
+	}
+	return nil
+}
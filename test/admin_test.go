@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dmwm/das2go/config"
+	"github.com/dmwm/das2go/das"
+	"github.com/dmwm/das2go/dasmaps"
+	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/web"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DN of test admin user
+const adminDN = "/DC=ch/DC=cern/OU=Organic Units/OU=Users/CN=admin/CN=123/CN=Admin User"
+
+// helper function to create request to admin API, the request carries
+// client certificate of test admin user if admin flag is set
+func adminRequest(method, target, body string, admin bool) *http.Request {
+	var r *http.Request
+	if body != "" {
+		r = httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+	} else {
+		r = httptest.NewRequest(method, target, nil)
+	}
+	if admin {
+		var names []pkix.AttributeTypeAndValue
+		for _, v := range []string{"ch", "cern", "Organic Units", "Users", "admin", "123", "Admin User"} {
+			names = append(names, pkix.AttributeTypeAndValue{Value: v})
+		}
+		cert := &x509.Certificate{Subject: pkix.Name{Names: names}}
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	}
+	return r
+}
+
+// TestAdminHandler checks access and validation of admin APIs
+func TestAdminHandler(t *testing.T) {
+	dns := config.Config.AdminDNs
+	defer func() { config.Config.AdminDNs = dns }()
+	config.Config.AdminDNs = []string{adminDN}
+
+	tests := []struct {
+		method, target, body string
+		admin                bool
+		code                 int
+	}{
+		{"GET", "/das/admin/cache", "", false, http.StatusForbidden},
+		{"POST", "/das/admin/invalidate", `{"qhash":"123"}`, false, http.StatusForbidden},
+		{"GET", "/das/admin/cache?key=dataset", "", true, http.StatusBadRequest},
+		{"GET", "/das/admin/cache?query=[a-", "", true, http.StatusBadRequest},
+		{"POST", "/das/admin/invalidate", `{"qhash":`, true, http.StatusBadRequest},
+		{"POST", "/das/admin/invalidate", `{}`, true, http.StatusBadRequest},
+		{"POST", "/das/admin/refresh", `{}`, true, http.StatusBadRequest},
+		{"GET", "/das/admin/invalidate?qhash=123", "", true, http.StatusMethodNotAllowed},
+		{"POST", "/das/admin/cache", `{"qhash":"123"}`, true, http.StatusMethodNotAllowed},
+		{"GET", "/das/admin/unknown", "", true, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		web.AdminHandler(w, adminRequest(tt.method, tt.target, tt.body, tt.admin))
+		if w.Code != tt.code {
+			t.Errorf("Fail TestAdminHandler, %s %s %s, code %d, expect %d", tt.method, tt.target, tt.body, w.Code, tt.code)
+		}
+	}
+}
+
+// TestAdminCache checks selection of cached queries by DAS key value which is
+// matched on record keys of DAS maps, e.g. run.run_number, and invalidation
+// of selected queries via admin API
+func TestAdminCache(t *testing.T) {
+	useMongo(t)
+	dns := config.Config.AdminDNs
+	defer func() { config.Config.AdminDNs = dns }()
+	config.Config.AdminDNs = []string{adminDN}
+
+	dmaps := readDASMaps(t, `{"hash":"1", "type":"service", "system":"runregistry", "urn":"runs", "das_map":[{"das_key":"run", "rec_key":"run.run_number", "api_arg":"run"}]}`)
+	if keys := dmaps.RecordKeys("run"); len(keys) != 1 || keys[0] != "run.run_number" {
+		t.Fatalf("Fail TestAdminCache, wrong record keys %v", keys)
+	}
+
+	qhash := "0123456789abcdef0123456789abcdef"
+	spec := bson.M{"qhash": qhash}
+	defer mongo.Remove("das", "cache", spec)
+	mongo.Remove("das", "cache", spec)
+	records := []mongo.DASRecord{
+		{"qhash": qhash, "query": "run dataset=/a/b/c", "das": mongo.DASRecord{"record": 0, "status": "ok", "services": []string{"runregistry:runs"}}},
+		{"qhash": qhash, "run": []interface{}{mongo.DASRecord{"run_number": int64(123)}}, "das": mongo.DASRecord{"record": 1}},
+	}
+	if err := mongo.Insert("das", "cache", records); err != nil {
+		t.Fatalf("Fail TestAdminCache, insert error %v", err)
+	}
+
+	// run number is matched on record key of DAS maps
+	sel := das.CacheSelection{Key: "run=123"}
+	if queries, err := das.CachedQueries(sel, dmaps); err != nil || len(queries) != 1 || queries[0].Qhash != qhash {
+		t.Errorf("Fail TestAdminCache, wrong cached queries %v, error %v", queries, err)
+	}
+	if qhashes, err := das.FindCachedQueries(das.CacheSelection{Key: "run=124"}, dmaps); err != nil || len(qhashes) != 0 {
+		t.Errorf("Fail TestAdminCache, wrong qhashes %v, error %v", qhashes, err)
+	}
+	// without DAS maps key value is matched on <key>.name
+	if qhashes, err := das.FindCachedQueries(sel, dasmaps.DASMaps{}); err != nil || len(qhashes) != 0 {
+		t.Errorf("Fail TestAdminCache, wrong qhashes without DAS maps %v, error %v", qhashes, err)
+	}
+
+	w := httptest.NewRecorder()
+	web.AdminHandler(w, adminRequest("GET", "/das/admin/cache?system=runregistry", "", true))
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp["nresults"] != 1.0 {
+		t.Errorf("Fail TestAdminCache, cache API code %d, response %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	web.AdminHandler(w, adminRequest("POST", "/das/admin/invalidate", `{"qhash":"`+qhash+`"}`, true))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), qhash) {
+		t.Errorf("Fail TestAdminCache, invalidate API code %d, response %s", w.Code, w.Body.String())
+	}
+	if nrec, err := mongo.Count("das", "cache", spec); err != nil || nrec != 0 {
+		t.Errorf("Fail TestAdminCache, %d records left after invalidation, error %v", nrec, err)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dmwm/das2go/das"
+	"github.com/dmwm/das2go/dasql"
+	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/utils"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TestParseAggregators
+func TestParseAggregators(t *testing.T) {
+	daskeys := []string{"file", "dataset"}
+	query := "file dataset=/a/b/c | sum(file.size) by block.name, percentile(file.size, 95), histogram(file.size), mean(file.size)"
+	dasquery, qlerr, _ := dasql.Parse(query, "prod/global", daskeys)
+	if qlerr != "" {
+		t.Fatalf("Fail TestParseAggregators, error %s", qlerr)
+	}
+	aggrs := dasquery.Aggregators
+	if len(aggrs) != 4 {
+		t.Fatalf("Fail TestParseAggregators, wrong aggregators %v", aggrs)
+	}
+	if aggrs[0][0] != "sum" || aggrs[0][1] != "file.size" || aggrs[0][3] != "block.name" {
+		t.Errorf("Fail TestParseAggregators, wrong grouped aggregator %v", aggrs[0])
+	}
+	if aggrs[1][2] != "95" || aggrs[2][2] != "10" || aggrs[3][0] != "mean" {
+		t.Errorf("Fail TestParseAggregators, wrong aggregators %v", aggrs)
+	}
+	_, qlerr, _ = dasql.Parse("file dataset=/a/b/c | percentile(file.size, 120)", "prod/global", daskeys)
+	if qlerr == "" {
+		t.Error("Fail TestParseAggregators, no error for wrong percentile")
+	}
+}
+
+// TestAggregateRecords
+func TestAggregateRecords(t *testing.T) {
+	var records []mongo.DASRecord
+	for i, blk := range []string{"b1", "b1", "b2", "b3"} {
+		rec := mongo.DASRecord{
+			"file":  []interface{}{mongo.DASRecord{"name": "f", "size": int64(i + 1)}},
+			"block": []interface{}{mongo.DASRecord{"name": blk}},
+			"das":   mongo.DASRecord{},
+		}
+		records = append(records, rec)
+	}
+	rec := das.AggregateRecords(records, []string{"sum", "file.size", "", "block.name"})
+	groups := rec["result"].(mongo.DASRecord)["groups"].([]mongo.DASRecord)
+	if len(groups) != 3 || groups[0]["group"] != "b1" || groups[0]["value"] != 3.0 {
+		t.Errorf("Fail TestAggregateRecords, wrong groups %v", groups)
+	}
+	rec = das.AggregateRecords(records, []string{"count_distinct", "block.name"})
+	if rec["result"].(mongo.DASRecord)["value"] != 3 {
+		t.Errorf("Fail TestAggregateRecords, wrong count_distinct %v", rec)
+	}
+	rec = das.AggregateRecords(records, []string{"percentile", "file.size", "50"})
+	if rec["result"].(mongo.DASRecord)["value"] != 2.5 {
+		t.Errorf("Fail TestAggregateRecords, wrong percentile %v", rec)
+	}
+	rec = das.AggregateRecords(records, []string{"histogram", "file.size", "3"})
+	bins := rec["result"].(mongo.DASRecord)["value"].([]utils.HistogramBin)
+	if len(bins) != 3 || bins[0].Count+bins[1].Count+bins[2].Count != 4 {
+		t.Errorf("Fail TestAggregateRecords, wrong histogram %v", bins)
+	}
+}
+
+// helper function to compare aggregator results, floating point values may
+// differ in rounding since MongoDB accumulates them in different order
+func sameAggregate(r1, r2 interface{}) bool {
+	rec1, ok1 := r1.(mongo.DASRecord)
+	rec2, ok2 := r2.(mongo.DASRecord)
+	if ok1 && ok2 {
+		if len(rec1) != len(rec2) {
+			return false
+		}
+		for key, val := range rec1 {
+			if !sameAggregate(val, rec2[key]) {
+				return false
+			}
+		}
+		return true
+	}
+	groups1, ok1 := r1.([]mongo.DASRecord)
+	groups2, ok2 := r2.([]mongo.DASRecord)
+	if ok1 && ok2 {
+		if len(groups1) != len(groups2) {
+			return false
+		}
+		for i := range groups1 {
+			if !sameAggregate(groups1[i], groups2[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	v1, ok1 := r1.(float64)
+	v2, ok2 := r2.(float64)
+	if ok1 && ok2 {
+		return fmt.Sprintf("%.9g", v1) == fmt.Sprintf("%.9g", v2)
+	}
+	return fmt.Sprintf("%T %v", r1, r1) == fmt.Sprintf("%T %v", r2, r2)
+}
+
+// TestAggregatePipeline checks that aggregators computed by MongoDB pipeline
+// yield the same results as their Go implementation, including empty input
+// and non-numeric values
+func TestAggregatePipeline(t *testing.T) {
+	useMongo(t)
+
+	query := "file dataset=/a/b/c | sum(file.size)"
+	dasquery, qlerr, _ := dasql.Parse(query, "prod/global", []string{"file", "dataset"})
+	if qlerr != "" {
+		t.Fatalf("Fail TestAggregatePipeline, error %s", qlerr)
+	}
+	coll := "aggregate_test"
+	spec := bson.M{"qhash": dasquery.Qhash}
+	defer mongo.Remove("das", coll, spec)
+	defer mongo.Remove("das", "merge", spec)
+	mongo.Remove("das", coll, spec)
+	mongo.Remove("das", "merge", spec)
+	merge := mongo.DASRecord{"qhash": dasquery.Qhash, "das": mongo.DASRecord{"record": 0, "status": "ok"}}
+	if err := mongo.Insert("das", "merge", []mongo.DASRecord{merge}); err != nil {
+		t.Fatalf("Fail TestAggregatePipeline, insert error %v", err)
+	}
+
+	var aggrs [][]string
+	for _, fagg := range []string{"sum", "min", "max", "avg", "mean", "count", "count_distinct", "stddev"} {
+		aggrs = append(aggrs, []string{fagg, "file.size"}, []string{fagg, "file.size", "", "block.name"})
+	}
+	dasquery.Aggregators = aggrs
+
+	// helper function to compare results of MongoDB pipeline and Go implementation
+	compare := func(label string) {
+		_, data := das.GetData(dasquery, coll, 0, 0)
+		records, err := mongo.Get("das", coll, bson.M{"qhash": dasquery.Qhash, "das.record": 1}, 0, -1)
+		if err != nil {
+			t.Fatalf("Fail TestAggregatePipeline, %s, error %v", label, err)
+		}
+		if len(data) != len(aggrs) {
+			t.Fatalf("Fail TestAggregatePipeline, %s, wrong number of aggregators %v", label, data)
+		}
+		for idx, agg := range aggrs {
+			expect := das.AggregateRecords(records, agg)["result"]
+			result := data[idx]["result"]
+			if !sameAggregate(result, expect) {
+				t.Errorf("Fail TestAggregatePipeline, %s, aggregator %v, MongoDB %v, Go %v", label, agg, result, expect)
+			}
+		}
+	}
+	compare("empty input")
+
+	var records []mongo.DASRecord
+	sizes := []interface{}{int64(3), 1.5, int64(10), "n/a", nil, int64(3)}
+	for i, size := range sizes {
+		file := mongo.DASRecord{"name": fmt.Sprintf("f%d", i)}
+		if size != nil {
+			file["size"] = size
+		}
+		rec := mongo.DASRecord{
+			"qhash": dasquery.Qhash,
+			"file":  []interface{}{file},
+			"block": []interface{}{mongo.DASRecord{"name": fmt.Sprintf("b%d", i%2)}},
+			"das":   mongo.DASRecord{"record": 1},
+		}
+		records = append(records, rec)
+	}
+	if err := mongo.Insert("das", coll, records); err != nil {
+		t.Fatalf("Fail TestAggregatePipeline, insert error %v", err)
+	}
+	compare("mixed values")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmwm/das2go/dasmaps"
+	"github.com/dmwm/das2go/dasql"
+	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/web"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DAS map of dbs3 datasets API used by web handler tests
+const datasetsMap = `{"hash":"2", "type":"service", "system":"dbs3", "urn":"datasets", "url":"https://cmsweb.cern.ch/dbs/prod/global/DBSReader/datasets/", "das_map":[{"das_key":"dataset", "rec_key":"dataset.name", "api_arg":"dataset"}]}`
+
+// helper function to read DAS maps from given map records
+func readDASMaps(t *testing.T, records ...string) dasmaps.DASMaps {
+	fname := filepath.Join(t.TempDir(), "maps.js")
+	if err := os.WriteFile(fname, []byte(strings.Join(records, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var dmaps dasmaps.DASMaps
+	dmaps.ReadMapFile(fname)
+	return dmaps
+}
+
+// helper function to call query API with given parameters
+func queryAPI(params url.Values) (int, web.QueryResponse) {
+	r := httptest.NewRequest("GET", "/api/v1/query?"+params.Encode(), nil)
+	w := httptest.NewRecorder()
+	web.APIHandler(w, r)
+	var resp web.QueryResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+// TestQueryAPIParams checks validation of query API parameters
+func TestQueryAPIParams(t *testing.T) {
+	web.SetDASMaps(readDASMaps(t, datasetsMap))
+	cursor := base64.RawURLEncoding.EncodeToString([]byte(`{"q":"dataset=/a/b/c","i":"prod/global","x":-1,"l":10}`))
+	tests := []struct {
+		params url.Values
+		code   int
+	}{
+		{url.Values{}, http.StatusBadRequest},
+		{url.Values{"query": {"dataset=/a/b/c"}, "limit": {"0"}}, http.StatusBadRequest},
+		{url.Values{"query": {"dataset=/a/b/c"}, "idx": {"x"}}, http.StatusBadRequest},
+		{url.Values{"query": {"dataset=/a/b/c"}, "pid": {"123"}}, http.StatusBadRequest},
+		{url.Values{"cursor": {"not a cursor"}}, http.StatusBadRequest},
+		{url.Values{"cursor": {cursor}}, http.StatusBadRequest},
+		{url.Values{"query": {"foo=1"}, "instance": {"prod/global"}}, http.StatusBadRequest},
+		{url.Values{"query": {"dataset=/a/b/c"}, "instance": {"prod/global"}, "debug": {"1"}}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		code, resp := queryAPI(tt.params)
+		if code != tt.code || resp.Status != "fail" {
+			t.Errorf("Fail TestQueryAPIParams, params %v, code %d status %s, expect %d", tt.params, code, resp.Status, tt.code)
+		}
+	}
+	w := httptest.NewRecorder()
+	web.APIHandler(w, httptest.NewRequest("DELETE", "/api/v1/query", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Fail TestQueryAPIParams, DELETE code %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	web.APIHandler(w, httptest.NewRequest("GET", "/api/v1/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Fail TestQueryAPIParams, unknown API code %d", w.Code)
+	}
+}
+
+// helper function to store DAS records of processed query with given status
+// and number of data records in DAS cache
+func storeQuery(t *testing.T, query, status string, nrec int, errs []string) string {
+	dasquery, qlerr, _ := dasql.Parse(query, "prod/global", []string{"dataset"})
+	if qlerr != "" {
+		t.Fatalf("Fail storeQuery, error %s", qlerr)
+	}
+	pid := dasquery.Qhash
+	spec := bson.M{"qhash": pid}
+	mongo.Remove("das", "cache", spec)
+	mongo.Remove("das", "merge", spec)
+	t.Cleanup(func() {
+		mongo.Remove("das", "cache", spec)
+		mongo.Remove("das", "merge", spec)
+	})
+	now := time.Now().Unix()
+	das := mongo.DASRecord{"record": 0, "status": status, "ts": now, "expire": now + 600, "services": []string{"dbs3:datasets"}}
+	if err := mongo.Insert("das", "cache", []mongo.DASRecord{{"qhash": pid, "query": dasquery.Query, "das": das}}); err != nil {
+		t.Fatalf("Fail storeQuery, insert error %v", err)
+	}
+	if status == "processing" {
+		return pid
+	}
+	das = mongo.DASRecord{"record": 0, "status": status, "expire": now + 600, "errors": errs}
+	if len(errs) > 0 {
+		das["service_errors"] = mongo.DASRecord{"dbs3:datasets": errs}
+	}
+	records := []mongo.DASRecord{{"qhash": pid, "das": das}}
+	for i := 0; i < nrec; i++ {
+		name := strings.Replace(query, "dataset=", "", 1) + string(rune('0'+i))
+		rec := mongo.DASRecord{
+			"qhash":   pid,
+			"dataset": []interface{}{mongo.DASRecord{"name": name}},
+			"das":     mongo.DASRecord{"record": 1, "expire": now + 600},
+		}
+		records = append(records, rec)
+	}
+	if err := mongo.Insert("das", "merge", records); err != nil {
+		t.Fatalf("Fail storeQuery, insert error %v", err)
+	}
+	return pid
+}
+
+// TestQueryAPI checks HTTP status codes of query API for processed,
+// partially processed, failed and processing DAS queries and pagination via
+// cursors
+func TestQueryAPI(t *testing.T) {
+	useMongo(t)
+	web.SetDASMaps(readDASMaps(t, datasetsMap))
+
+	// processed query, results are paginated via cursors
+	pid := storeQuery(t, "dataset=/a/b/c", "ok", 3, nil)
+	params := url.Values{"query": {"dataset=/a/b/c"}, "instance": {"prod/global"}, "limit": {"2"}}
+	code, resp := queryAPI(params)
+	if code != http.StatusOK || resp.Status != "ok" || resp.Pid != pid || resp.Nresults != 3 || len(resp.Data) != 2 || resp.Next == "" {
+		t.Fatalf("Fail TestQueryAPI, first page code %d response %+v", code, resp)
+	}
+	code, page := queryAPI(url.Values{"cursor": {resp.Cursor}})
+	if code != http.StatusOK || page.Idx != 0 || len(page.Data) != 2 || page.Cursor != resp.Cursor {
+		t.Errorf("Fail TestQueryAPI, cursor round-trip code %d response %+v", code, page)
+	}
+	code, page = queryAPI(url.Values{"cursor": {resp.Next}})
+	if code != http.StatusOK || page.Idx != 2 || page.Limit != 2 || len(page.Data) != 1 || page.Next != "" {
+		t.Errorf("Fail TestQueryAPI, next page code %d response %+v", code, page)
+	}
+
+	// failed services with results
+	errs := []string{"dbs3:datasets fatal error: boom"}
+	storeQuery(t, "dataset=/p/q/r", "fail", 1, errs)
+	code, resp = queryAPI(url.Values{"query": {"dataset=/p/q/r"}, "instance": {"prod/global"}})
+	if code != http.StatusOK || resp.Status != "partial" || len(resp.Data) != 1 || len(resp.Errors["dbs3:datasets"]) != 1 {
+		t.Errorf("Fail TestQueryAPI, partial results code %d response %+v", code, resp)
+	}
+	// failed services without results
+	storeQuery(t, "dataset=/x/y/z", "fail", 0, errs)
+	code, resp = queryAPI(url.Values{"query": {"dataset=/x/y/z"}, "instance": {"prod/global"}})
+	if code != http.StatusInternalServerError || resp.Status != "fail" || len(resp.Errors["dbs3:datasets"]) != 1 {
+		t.Errorf("Fail TestQueryAPI, failed query code %d response %+v", code, resp)
+	}
+	// query is being processed, client should poll
+	storeQuery(t, "dataset=/m/n/o", "processing", 0, nil)
+	r := httptest.NewRequest("GET", "/api/v1/query?query=dataset=/m/n/o&instance=prod/global", nil)
+	w := httptest.NewRecorder()
+	web.APIHandler(w, r)
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusAccepted || resp.Status != "processing" || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Fail TestQueryAPI, processing query code %d response %+v", w.Code, resp)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dmwm/das2go/utils"
+)
+
+// TestOAuth2Provider
+func TestOAuth2Provider(t *testing.T) {
+	var calls int32
+	expiresIn := 3600
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, secret, ok := r.BasicAuth()
+		if !ok || user != "das" || secret != "secret" || r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		n := atomic.AddInt32(&calls, 1)
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"bearer","expires_in":%d}`, n, expiresIn)
+	}))
+	defer server.Close()
+
+	cfg := utils.AuthConfig{Type: "oauth2", TokenUrl: server.URL, ClientID: "das", ClientSecret: "secret"}
+	provider, err := utils.NewAuthProvider(cfg)
+	if err != nil {
+		t.Fatalf("Fail TestOAuth2Provider, error %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "https://cmsweb.cern.ch/dbs/prod/global/DBSReader/datasets", nil)
+		if err := provider.Authorize(req); err != nil {
+			t.Fatalf("Fail TestOAuth2Provider, error %v", err)
+		}
+		if v := req.Header.Get("Authorization"); v != "Bearer token-1" {
+			t.Errorf("Fail TestOAuth2Provider, cached token %s", v)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Fail TestOAuth2Provider, token endpoint called %d times", calls)
+	}
+
+	// tokens which expire within refresh margin are refreshed
+	expiresIn = int(utils.AuthRefreshMargin / time.Second / 2)
+	provider, _ = utils.NewAuthProvider(cfg)
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "https://cmsweb.cern.ch/dbs/prod/global/DBSReader/datasets", nil)
+		provider.Authorize(req)
+	}
+	if calls != 3 {
+		t.Errorf("Fail TestOAuth2Provider, token endpoint called %d times", calls)
+	}
+}
+
+// TestTokenProvider
+func TestTokenProvider(t *testing.T) {
+	fname := fmt.Sprintf("%s/token", t.TempDir())
+	os.WriteFile(fname, []byte("token-1\n"), 0600)
+	provider, err := utils.NewAuthProvider(utils.AuthConfig{Type: "token", TokenFile: fname})
+	if err != nil {
+		t.Fatalf("Fail TestTokenProvider, error %v", err)
+	}
+	req, _ := http.NewRequest("GET", "https://cmsweb.cern.ch/reqmgr2/data/request", nil)
+	provider.Authorize(req)
+	if v := req.Header.Get("Authorization"); v != "Bearer token-1" {
+		t.Errorf("Fail TestTokenProvider, token %s", v)
+	}
+	// token file is re-read when it changes
+	os.WriteFile(fname, []byte("token-2\n"), 0600)
+	os.Chtimes(fname, time.Now(), time.Now().Add(time.Minute))
+	provider.Authorize(req)
+	if v := req.Header.Get("Authorization"); v != "Bearer token-2" {
+		t.Errorf("Fail TestTokenProvider, token %s", v)
+	}
+	if _, err := utils.NewAuthProvider(utils.AuthConfig{Type: "kerberos"}); err == nil {
+		t.Errorf("Fail TestTokenProvider, unknown provider type is accepted")
+	}
+}
+
+// TestRedactDump
+func TestRedactDump(t *testing.T) {
+	dump := "GET /dbs HTTP/1.1\r\nAuthorization: Bearer secret\r\nX-Rucio-Auth-Token: secret\r\nAccept: */*\r\n"
+	out := utils.RedactDump([]byte(dump))
+	if strings.Contains(out, "secret") || !strings.Contains(out, "Accept: */*") {
+		t.Errorf("Fail TestRedactDump, %s", out)
+	}
+}
+
+// TestRucioToken
+func TestRucioToken(t *testing.T) {
+	var calls int32
+	expire := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("X-Rucio-Auth-Token", fmt.Sprintf("token-%d", n))
+		w.Header().Set("X-Rucio-Auth-Token-Expires", expire.Format(time.RFC1123))
+	}))
+	defer server.Close()
+	t.Setenv("RUCIO_AUTH_URL", server.URL)
+
+	// concurrent requests share single token request
+	auth := &utils.RucioAuthModule{}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := auth.Token(); err != nil || token != "token-1" {
+				t.Errorf("Fail TestRucioToken, token %s error %v", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+	info := auth.Info()
+	if calls != 1 || !info.Valid || info.Expire != expire.Local().Format(time.RFC3339) {
+		t.Errorf("Fail TestRucioToken, calls %d info %+v", calls, info)
+	}
+	// rejected token is renewed once
+	auth.Renew("token-1")
+	auth.Renew("token-1")
+	if token, _ := auth.Token(); token != "token-2" || calls != 2 {
+		t.Errorf("Fail TestRucioToken, token %s calls %d", token, calls)
+	}
+}
+
+// TestOAuth2Renew checks that request rejected by upstream system is retried
+// once with renewed OAuth2 token
+func TestOAuth2Renew(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			n := atomic.AddInt32(&calls, 1)
+			fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"bearer","expires_in":3600}`, n)
+			return
+		}
+		// upstream system revoked first token
+		if r.Header.Get("Authorization") != "Bearer token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`[{"dataset":"/a/b/c"}]`))
+	}))
+	defer server.Close()
+
+	cfg := utils.AuthConfig{Type: "oauth2", TokenUrl: server.URL + "/token", ClientID: "das"}
+	if err := utils.InitAuthProviders(map[string]utils.AuthConfig{"dbs": cfg}); err != nil {
+		t.Fatalf("Fail TestOAuth2Renew, error %v", err)
+	}
+	defer utils.InitAuthProviders(nil)
+	for i := 0; i < 2; i++ {
+		resp := utils.FetchResponse(&http.Client{}, server.URL+"/dbs/datasets", "")
+		if resp.Error != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("Fail TestOAuth2Renew, status %d error %v", resp.StatusCode, resp.Error)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("Fail TestOAuth2Renew, token endpoint called %d times", calls)
+	}
+}
+
+// helper function to write self-signed client certificate and its key into
+// given directory
+func writeClientCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "das"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, ckey := dir+"/cert.pem", dir+"/key.pem"
+	os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(ckey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600)
+	return cert, ckey
+}
+
+// TestX509Systems checks that client certificates are sent only to upstream
+// systems whose auth providers use X509 authentication
+func TestX509Systems(t *testing.T) {
+	if _, err := os.Stat(fmt.Sprintf("/tmp/x509up_u%d", os.Getuid())); err == nil {
+		t.Skip("user proxy is present")
+	}
+	cert, ckey := writeClientCert(t, t.TempDir())
+	t.Setenv("X509_USER_PROXY", "")
+	t.Setenv("X509_USER_CERT", cert)
+	t.Setenv("X509_USER_KEY", ckey)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%d", len(r.TLS.PeerCertificates))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	configs := map[string]utils.AuthConfig{"dbs": {Type: "x509"}, "reqmgr": {Type: "token", TokenFile: "token"}}
+	if err := utils.InitAuthProviders(configs); err != nil {
+		t.Fatalf("Fail TestX509Systems, error %v", err)
+	}
+	defer utils.InitAuthProviders(nil)
+	client := utils.HttpClient()
+	for path, expect := range map[string]string{"/dbs/datasets": "1", "/reqmgr2/data/request": "0"} {
+		resp := utils.FetchResponse(client, server.URL+path, "")
+		if resp.Error != nil || string(resp.Data) != expect {
+			t.Errorf("Fail TestX509Systems, %s, client certificates %s, error %v", path, resp.Data, resp.Error)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dmwm/das2go/utils"
+)
+
+// TestCircuitBreaker
+func TestCircuitBreaker(t *testing.T) {
+	threshold, timeout := utils.BreakerThreshold, utils.BreakerTimeout
+	defer func() {
+		utils.BreakerThreshold, utils.BreakerTimeout = threshold, timeout
+	}()
+	utils.BreakerThreshold = 2
+	utils.BreakerTimeout = 50 * time.Millisecond
+
+	b := utils.GetBreaker("test-breaker")
+	for i := 0; i < 2; i++ {
+		if err := b.Allow(utils.Logger); err != nil {
+			t.Fatalf("Fail TestCircuitBreaker, closed breaker rejects request: %v", err)
+		}
+		b.Failure(utils.Logger, errors.New("upstream failure"))
+	}
+	var berr *utils.BreakerError
+	if err := b.Allow(utils.Logger); !errors.As(err, &berr) {
+		t.Fatalf("Fail TestCircuitBreaker, open breaker allows request")
+	}
+	time.Sleep(60 * time.Millisecond)
+	// single half-open probe request is allowed
+	if err := b.Allow(utils.Logger); err != nil {
+		t.Fatalf("Fail TestCircuitBreaker, no half-open probe: %v", err)
+	}
+	if err := b.Allow(utils.Logger); err == nil {
+		t.Fatalf("Fail TestCircuitBreaker, second probe allowed in half-open state")
+	}
+	b.Failure(utils.Logger, errors.New("upstream failure"))
+	if b.Info().State != utils.BreakerOpen {
+		t.Fatalf("Fail TestCircuitBreaker, failed probe should re-open breaker, %+v", b.Info())
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := b.Allow(utils.Logger); err != nil {
+		t.Fatalf("Fail TestCircuitBreaker, no half-open probe: %v", err)
+	}
+	b.Success(utils.Logger)
+	if info := b.Info(); info.State != utils.BreakerClosed || info.Failures != 0 {
+		t.Errorf("Fail TestCircuitBreaker, successful probe should close breaker, %+v", info)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/dmwm/das2go/das"
+)
+
+// TestTopQueries
+func TestTopQueries(t *testing.T) {
+	lines := `2017/01/01 00:00:01 handlers.go:505: input="dataset=/a/b/c" DASQuery="dataset=/a/b/c" inst=prod/global hash=1 time="1s"
+2017/01/01 00:00:02 handlers.go:505: input="file dataset=/a/b/c" DASQuery="file dataset=/a/b/c" inst=prod/global hash=2 time="1s"
+2017/01/01 00:00:03 handlers.go:505: input="dataset=/a/b/c" DASQuery="dataset=/a/b/c" inst=prod/global hash=1 time="1s"
+2017/01/01 00:00:04 handlers.go:505: input="dataset=/a/b/c" DASQuery="dataset=/a/b/c" inst=prod/phys03 hash=3 time="1s"
+`
+	fname := t.TempDir() + "/das.log"
+	if err := os.WriteFile(fname, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	queries := das.TopQueries([]string{fname}, 2)
+	if len(queries) != 2 {
+		t.Fatalf("Fail TestTopQueries, wrong number of queries %v", queries)
+	}
+	if queries[0].Query != "dataset=/a/b/c" || queries[0].Instance != "prod/global" {
+		t.Errorf("Fail TestTopQueries, wrong top query %v", queries[0])
+	}
+}
+
+// TestReadQueries
+func TestReadQueries(t *testing.T) {
+	content := "# comment\ndataset=/a/b/c\n\nfile dataset=/a/b/c\n"
+	queries := das.ReadQueries(content, "prod/global")
+	if len(queries) != 2 {
+		t.Errorf("Fail TestReadQueries, wrong number of queries %v", queries)
+	}
+}
+
+// TestTopQueriesStructured
+func TestTopQueriesStructured(t *testing.T) {
+	lines := `{"time":"2017-01-01T00:00:01Z","level":"INFO","msg":"DAS request","qhash":"1","input":"dataset=/a/b/c","query":"dataset=/a/b/c","instance":"prod/global"}
+{"time":"2017-01-01T00:00:02Z","level":"INFO","msg":"DAS query result","qhash":"1","query":"dataset=/a/b/c","instance":"prod/global"}
+time=2017-01-01T00:00:03Z level=INFO msg="DAS request" qhash=1 input="dataset=/a/b/c" query="dataset=/a/b/c" instance=prod/global
+time=2017-01-01T00:00:04Z level=INFO msg="DAS request" qhash=2 input=site query=site instance=prod/global
+`
+	fname := t.TempDir() + "/das.log"
+	if err := os.WriteFile(fname, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	queries := das.TopQueries([]string{fname}, 0)
+	if len(queries) != 2 {
+		t.Fatalf("Fail TestTopQueriesStructured, wrong number of queries %v", queries)
+	}
+	if queries[0].Query != "dataset=/a/b/c" || queries[0].Instance != "prod/global" {
+		t.Errorf("Fail TestTopQueriesStructured, wrong top query %v", queries[0])
+	}
+	if queries[1].Query != "site" {
+		t.Errorf("Fail TestTopQueriesStructured, wrong query %v", queries[1])
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dmwm/das2go/dasql"
+)
+
+// TestParsePipeSort
+func TestParsePipeSort(t *testing.T) {
+	daskeys := []string{"file", "dataset"}
+	query := "file dataset=/a/b/c | sort -file.size, file.name | unique"
+	dasquery, qlerr, _ := dasql.Parse(query, "prod/global", daskeys)
+	if qlerr != "" {
+		t.Fatalf("Fail TestParsePipeSort, error %s", qlerr)
+	}
+	skeys := dasquery.Filters["sort"]
+	if len(skeys) != 2 || skeys[0] != "-file.size" || skeys[1] != "file.name" {
+		t.Errorf("Fail TestParsePipeSort, wrong sort keys %v", skeys)
+	}
+	if _, ok := dasquery.Filters["unique"]; !ok {
+		t.Errorf("Fail TestParsePipeSort, no unique filter %v", dasquery.Filters)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dmwm/das2go/utils"
+)
+
+// TestDebugTrace
+func TestDebugTrace(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"dataset":"/a/b/c"}]`))
+	}))
+	defer server.Close()
+
+	// methods of nil trace are no-op outside of debug mode
+	var trace *utils.DebugTrace
+	trace.AddRecords("dbs3:blocks", 1)
+	if trace.Copy() != nil {
+		t.Errorf("Fail TestDebugTrace, copy of nil trace")
+	}
+
+	trace = utils.NewDebugTrace()
+	rurl := server.URL + "/dbs/blocks"
+	trace.SetMaps([]string{"dbs3:blocks"}, map[string]string{rurl: ""})
+	out := make(chan utils.ResponseType)
+	go utils.FetchWithContext(utils.FetchContext{Urn: "blocks", Debug: trace}, &http.Client{}, rurl, "", out)
+	if r := <-out; r.Error != nil {
+		t.Fatalf("Fail TestDebugTrace, error %v", r.Error)
+	}
+	trace.AddRecords("dbs3:blocks", 1)
+	trace.AddMerge("merge %d records", 1)
+
+	dump := trace.Copy()
+	if len(dump.Maps) != 1 || len(dump.Urls) != 1 || dump.Urls[0].Url != rurl {
+		t.Errorf("Fail TestDebugTrace, wrong maps %v or urls %v", dump.Maps, dump.Urls)
+	}
+	if len(dump.Calls) != 1 {
+		t.Fatalf("Fail TestDebugTrace, wrong calls %v", dump.Calls)
+	}
+	call := dump.Calls[0]
+	if call.Url != rurl || call.Urn != "blocks" || call.Code != 200 || call.RecvBytes != 22 || call.Method != "GET" {
+		t.Errorf("Fail TestDebugTrace, wrong call %+v", call)
+	}
+	if dump.Records["dbs3:blocks"] != 1 || len(dump.Merge) != 1 {
+		t.Errorf("Fail TestDebugTrace, wrong records %v or merge %v", dump.Records, dump.Merge)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dmwm/das2go/utils"
+)
+
+// TestEndpointFailover
+func TestEndpointFailover(t *testing.T) {
+	var primaryCalls, mirrorCalls int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&primaryCalls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&mirrorCalls, 1)
+		w.Write([]byte(`[{"dataset":"/a/b/c"}]`))
+	}))
+	defer mirror.Close()
+	utils.Endpoints = map[string][]string{"dbs3": {primary.URL, mirror.URL}}
+	defer func() { utils.Endpoints = nil }()
+
+	rurl := primary.URL + "/dbs/prod/global/DBSReader/datasets?dataset=/a/b/c"
+	for i := 0; i < 2; i++ {
+		out := make(chan utils.ResponseType)
+		go utils.FetchWithContext(utils.FetchContext{}, &http.Client{}, rurl, "", out)
+		r := <-out
+		if r.Error != nil || r.Url != rurl || r.Endpoint != mirror.URL {
+			t.Fatalf("Fail TestEndpointFailover, url %s endpoint %s error %v", r.Url, r.Endpoint, r.Error)
+		}
+	}
+	// failed endpoint is not used until it recovers
+	if primaryCalls != 1 || mirrorCalls != 2 {
+		t.Errorf("Fail TestEndpointFailover, primary calls %d mirror calls %d", primaryCalls, mirrorCalls)
+	}
+	for _, info := range utils.EndpointStatus() {
+		if info.Endpoint == primary.URL && info.Healthy {
+			t.Errorf("Fail TestEndpointFailover, failed endpoint is healthy %+v", info)
+		}
+	}
+}
+
+// TestEndpointFailoverBreaker
+func TestEndpointFailoverBreaker(t *testing.T) {
+	failed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failed.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("block") != "/a/b/c#123" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`[{"block":"/a/b/c#123"}]`))
+	}))
+	defer mirror.Close()
+	threshold, retry := utils.BreakerThreshold, utils.UrlRetry
+	utils.Endpoints = map[string][]string{"dbs3": {failed.URL + "/a", failed.URL + "/b", mirror.URL}}
+	breaker := utils.GetBreaker("dbs")
+	defer func() {
+		utils.Endpoints = nil
+		utils.BreakerThreshold, utils.UrlRetry = threshold, retry
+		breaker.Success(utils.Logger)
+	}()
+	utils.BreakerThreshold, utils.UrlRetry = 3, 0
+
+	// url of the mirror is rewritten (pound sign is escaped) but response
+	// should still be attributed to it
+	rurl := failed.URL + "/a/dbs/prod/global/DBSReader/blocks?block=/a/b/c#123"
+	fetch := func() utils.ResponseType {
+		out := make(chan utils.ResponseType)
+		go utils.FetchWithContext(utils.FetchContext{}, &http.Client{}, rurl, "", out)
+		return <-out
+	}
+	r := fetch()
+	if r.Error != nil || r.Url != strings.Replace(rurl, "#", "%23", -1) || r.Endpoint != mirror.URL {
+		t.Fatalf("Fail TestEndpointFailoverBreaker, url %s endpoint %s error %v", r.Url, r.Endpoint, r.Error)
+	}
+	// every failed endpoint is recorded in circuit breaker, success resets it
+	if info := breaker.Info(); info.Failures != 0 || info.State != utils.BreakerClosed {
+		t.Errorf("Fail TestEndpointFailoverBreaker, breaker %+v", info)
+	}
+	mirror.Close()
+	fetch()
+	if info := breaker.Info(); info.Failures != 3 || info.State != utils.BreakerOpen {
+		t.Errorf("Fail TestEndpointFailoverBreaker, breaker %+v", info)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmwm/das2go/das"
+	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/web"
+)
+
+// TestEventsHandler checks validation of events stream requests
+func TestEventsHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	web.EventsHandler(w, httptest.NewRequest("POST", "/das/events", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Fail TestEventsHandler, POST code %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	web.EventsHandler(w, httptest.NewRequest("GET", "/das/events?pid=123", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Fail TestEventsHandler, invalid pid code %d", w.Code)
+	}
+}
+
+// helper function to read status events of given stream until it is closed
+func readEvents(t *testing.T, server *httptest.Server, pid string, events chan<- das.StatusEvent) {
+	defer close(events)
+	resp, err := http.Get(server.URL + "?pid=" + pid)
+	if err != nil {
+		t.Errorf("Fail TestEventsStream, error %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if ctype := resp.Header.Get("Content-Type"); ctype != "text/event-stream" {
+		t.Errorf("Fail TestEventsStream, content type %s", ctype)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var event das.StatusEvent
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+			t.Errorf("Fail TestEventsStream, event %s error %v", line, err)
+			continue
+		}
+		events <- event
+	}
+}
+
+// helper function to get next event of the stream, it returns false when
+// stream is closed
+func nextEvent(t *testing.T, events <-chan das.StatusEvent) (das.StatusEvent, bool) {
+	select {
+	case event, ok := <-events:
+		return event, ok
+	case <-time.After(5 * time.Second):
+		t.Fatal("Fail TestEventsStream, no event within 5 seconds")
+	}
+	return das.StatusEvent{}, false
+}
+
+// TestEventsStream checks status events of DAS queries and termination of
+// events stream when processing is finished, cancelled or stream times out
+func TestEventsStream(t *testing.T) {
+	useMongo(t)
+	interval, timeout := web.EventsCheckInterval, web.EventsTimeout
+	defer func() { web.EventsCheckInterval, web.EventsTimeout = interval, timeout }()
+	web.EventsCheckInterval = 50 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(web.EventsHandler))
+	defer server.Close()
+
+	// stream of processed query has single event
+	pid := storeQuery(t, "dataset=/a/b/c", "ok", 1, nil)
+	events := make(chan das.StatusEvent)
+	go readEvents(t, server, pid, events)
+	if event, _ := nextEvent(t, events); event.Pid != pid || event.Status != "ok" || !event.Done {
+		t.Errorf("Fail TestEventsStream, processed query event %+v", event)
+	}
+	if _, ok := nextEvent(t, events); ok {
+		t.Error("Fail TestEventsStream, stream of processed query is not closed")
+	}
+
+	// stream of partially processed query ends with the same status which
+	// is reported by query API, while failed query without records fails
+	errs := []string{"dbs3:datasets fatal error: boom"}
+	pid = storeQuery(t, "dataset=/p/q/r", "fail", 2, errs)
+	if status := das.QueryStatus(pid, "fail"); status != "partial" {
+		t.Errorf("Fail TestEventsStream, status of partially processed query %s", status)
+	}
+	events = make(chan das.StatusEvent)
+	go readEvents(t, server, pid, events)
+	if event, _ := nextEvent(t, events); event.Status != "partial" || !event.Done {
+		t.Errorf("Fail TestEventsStream, partially processed query event %+v", event)
+	}
+	pid = storeQuery(t, "dataset=/x/y/z", "fail", 0, errs)
+	if status := das.QueryStatus(pid, "fail"); status != "fail" {
+		t.Errorf("Fail TestEventsStream, status of failed query %s", status)
+	}
+
+	// stream is closed when processing of query is finished
+	pid = storeQuery(t, "dataset=/h/i/j", "processing", 0, nil)
+	events = make(chan das.StatusEvent)
+	go readEvents(t, server, pid, events)
+	if event, _ := nextEvent(t, events); event.Status != "processing" || event.Done {
+		t.Errorf("Fail TestEventsStream, processing query event %+v", event)
+	}
+	now := time.Now().Unix()
+	merge := mongo.DASRecord{"qhash": pid, "das": mongo.DASRecord{"record": 0, "status": "ok", "expire": now + 600}}
+	if err := mongo.Insert("das", "merge", []mongo.DASRecord{merge}); err != nil {
+		t.Fatalf("Fail TestEventsStream, insert error %v", err)
+	}
+	if event, _ := nextEvent(t, events); event.Status != "ok" || !event.Done {
+		t.Errorf("Fail TestEventsStream, finished query event %+v", event)
+	}
+	if _, ok := nextEvent(t, events); ok {
+		t.Error("Fail TestEventsStream, stream of finished query is not closed")
+	}
+
+	// stream is closed when query is cancelled
+	pid = storeQuery(t, "dataset=/e/f/g", "processing", 0, nil)
+	events = make(chan das.StatusEvent)
+	go readEvents(t, server, pid, events)
+	nextEvent(t, events)
+	if err := das.Cancel(pid); err != nil {
+		t.Fatalf("Fail TestEventsStream, cancel error %v", err)
+	}
+	if event, _ := nextEvent(t, events); event.Status != "cancelled" || !event.Done {
+		t.Errorf("Fail TestEventsStream, cancelled query event %+v", event)
+	}
+	if _, ok := nextEvent(t, events); ok {
+		t.Error("Fail TestEventsStream, stream of cancelled query is not closed")
+	}
+
+	// stream is closed on timeout, clients fall back to polling
+	web.EventsTimeout = 200 * time.Millisecond
+	pid = storeQuery(t, "dataset=/k/l/m", "processing", 0, nil)
+	events = make(chan das.StatusEvent)
+	go readEvents(t, server, pid, events)
+	nextEvent(t, events)
+	if event, ok := nextEvent(t, events); ok {
+		t.Errorf("Fail TestEventsStream, unexpected event %+v before timeout", event)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/dmwm/das2go/dasmaps"
+	"github.com/dmwm/das2go/dasql"
+	"github.com/dmwm/das2go/fakeupstream"
+	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/services"
+	"github.com/dmwm/das2go/utils"
+)
+
+// TestFakeUpstream
+func TestFakeUpstream(t *testing.T) {
+	cfg := fakeupstream.DefaultConfig()
+	server := httptest.NewServer(fakeupstream.NewServer(cfg))
+	defer server.Close()
+	rules := fakeupstream.UrlRewrite(server.URL)
+	dbsUrl := dasmaps.RewriteUrl("https://cmsweb.cern.ch:8443/dbs/prod/global/DBSReader", rules)
+	rucioUrl := dasmaps.RewriteUrl("http://cms-rucio.cern.ch", rules)
+	client := &http.Client{}
+	dataset := cfg.Datasets[0].Name
+
+	// DBS APIs
+	resp := utils.FetchResponse(client, fmt.Sprintf("%s/blocks?dataset=%s", dbsUrl, dataset), "")
+	blocks := services.DBSUnmarshal("blocks", resp.Data)
+	if resp.Error != nil || len(blocks) != cfg.Datasets[0].Blocks {
+		t.Fatalf("Fail TestFakeUpstream, blocks %v error %v", blocks, resp.Error)
+	}
+	block := blocks[0]["block_name"].(string)
+	resp = utils.FetchResponse(client, fmt.Sprintf("%s/filelumis?block_name=%s", dbsUrl, url.QueryEscape(block)), "")
+	lumis := services.DBSUnmarshal("filelumis", resp.Data)
+	if len(lumis) != cfg.Datasets[0].FilesPerBlock {
+		t.Errorf("Fail TestFakeUpstream, filelumis %v", lumis)
+	}
+	args := fmt.Sprintf(`{"dataset":["%s"],"detail":1}`, dataset)
+	resp = utils.FetchResponse(client, dbsUrl+"/datasetlist", args)
+	datasets := services.DBSUnmarshal("datasetlist", resp.Data)
+	if len(datasets) != 1 || datasets[0]["name"] != dataset {
+		t.Errorf("Fail TestFakeUpstream, datasetlist %v", datasets)
+	}
+
+	// Rucio APIs require auth token
+	resp = utils.FetchResponse(client, rucioUrl+"/auth/x509", "")
+	token := resp.Header.Get("X-Rucio-Auth-Token")
+	if token != cfg.Token {
+		t.Fatalf("Fail TestFakeUpstream, rucio token %v", token)
+	}
+	furl := fmt.Sprintf("%s/replicas/cms/%s/datasets?deep=True", rucioUrl, url.QueryEscape(block))
+	req, _ := http.NewRequest("GET", furl, nil)
+	req.Header.Set("X-Rucio-Auth-Token", token)
+	rresp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Fail TestFakeUpstream, rucio error %v", err)
+	}
+	defer rresp.Body.Close()
+	data, err := io.ReadAll(rresp.Body)
+	if err != nil {
+		t.Fatalf("Fail TestFakeUpstream, rucio error %v", err)
+	}
+	dasquery := dasql.DASQuery{Spec: map[string]interface{}{"block": block}}
+	records := services.RucioUnmarshal(dasquery, "block4block", data)
+	if len(records) != 1 || len(records[0]["replicas"].([]mongo.DASRecord)) != len(cfg.Datasets[0].Sites) {
+		t.Errorf("Fail TestFakeUpstream, rucio block replicas %v", records)
+	}
+	resp = utils.FetchResponse(client, rucioUrl+"/rses/", "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Fail TestFakeUpstream, rucio request without token %+v", resp)
+	}
+}
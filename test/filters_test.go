@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dmwm/das2go/dasql"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TestParseGrep
+func TestParseGrep(t *testing.T) {
+	exprs, err := dasql.ParseGrep("file.name, file.size > 2GB, file.name ~ .*RAW.*, run.run_number in [1, 2], file.nevents between [10,20], block.is_open=n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exprs) != 6 {
+		t.Fatalf("Fail TestParseGrep, wrong number of expressions %v", exprs)
+	}
+	if exprs[0].Op != "" || exprs[0].Key != "file.name" {
+		t.Errorf("Fail TestParseGrep, wrong key selection %+v", exprs[0])
+	}
+	cond := exprs[1].Condition().(bson.M)
+	if cond["$gt"] != int64(2000000000) {
+		t.Errorf("Fail TestParseGrep, wrong size condition %v", cond)
+	}
+	if _, ok := exprs[2].Condition().(bson.RegEx); !ok {
+		t.Errorf("Fail TestParseGrep, wrong regex condition %v", exprs[2].Condition())
+	}
+	if len(exprs[3].Values) != 2 || exprs[4].Op != "between" {
+		t.Errorf("Fail TestParseGrep, wrong list values %+v %+v", exprs[3], exprs[4])
+	}
+	if exprs[5].Condition() != "n" {
+		t.Errorf("Fail TestParseGrep, wrong equality condition %v", exprs[5].Condition())
+	}
+	// string representation should be parsed back into the same expression
+	for _, f := range exprs {
+		expr, err := dasql.ParseFilterExpr(f.String())
+		if err != nil || expr.String() != f.String() {
+			t.Errorf("Fail TestParseGrep, %s != %s, error %v", expr, f, err)
+		}
+	}
+	if _, err := dasql.ParseGrep("file.size >"); err == nil {
+		t.Error("Fail TestParseGrep, no error for missing value")
+	}
+	if _, err := dasql.ParseGrep("file.run between [1]"); err == nil {
+		t.Error("Fail TestParseGrep, no error for wrong between values")
+	}
+}
+
+// TestParsePipeGrep
+func TestParsePipeGrep(t *testing.T) {
+	daskeys := []string{"file", "dataset"}
+	query := "file dataset=/a/b/c | grep file.name, file.size&gt;1 | grep file.name ~ 'RAW|AOD' | sort file.name"
+	dasquery, qlerr, _ := dasql.Parse(query, "prod/global", daskeys)
+	if qlerr != "" {
+		t.Fatalf("Fail TestParsePipeGrep, error %s", qlerr)
+	}
+	grep := dasquery.Filters["grep"]
+	if len(grep) != 3 || grep[1] != "file.size > 1" || grep[2] != "file.name ~ RAW|AOD" {
+		t.Errorf("Fail TestParsePipeGrep, wrong grep filters %q", grep)
+	}
+	if len(dasquery.Filters["sort"]) != 1 {
+		t.Errorf("Fail TestParsePipeGrep, wrong sort filters %v", dasquery.Filters)
+	}
+}
+
+// TestFilterConditions
+func TestFilterConditions(t *testing.T) {
+	exprs, err := dasql.ParseGrep("file.name, file.name ~ RAW, file.nevents between [10, 20], file.size > 1, file.size < 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conds := dasql.FilterConditions(exprs)
+	if len(conds) != 3 {
+		t.Fatalf("Fail TestFilterConditions, wrong number of conditions %v", conds)
+	}
+	if _, ok := conds[0]["file.name"].(bson.RegEx); !ok {
+		t.Errorf("Fail TestFilterConditions, wrong regex condition %v", conds[0])
+	}
+	// range and several conditions on the same key should be met by the
+	// same element of the list
+	for _, cond := range conds[1:] {
+		alts, ok := cond["$or"].([]interface{})
+		if !ok || len(alts) != 2 {
+			t.Fatalf("Fail TestFilterConditions, wrong range condition %v", cond)
+		}
+		list := alts[0].(bson.M)["file"].(bson.M)
+		if _, ok := list["$elemMatch"]; !ok {
+			t.Errorf("Fail TestFilterConditions, no $elemMatch in %v", cond)
+		}
+	}
+	match := conds[1]["$or"].([]interface{})[0].(bson.M)["file"].(bson.M)["$elemMatch"].(bson.M)
+	inner := match["$and"].([]interface{})
+	rng := inner[0].(bson.M)["nevents"].(bson.M)
+	if len(inner) != 1 || rng["$gte"] != int64(10) || rng["$lte"] != int64(20) {
+		t.Errorf("Fail TestFilterConditions, wrong between condition %v", match)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dmwm/das2go/utils"
+)
+
+// TestHedgedFetch
+func TestHedgedFetch(t *testing.T) {
+	var slow, cancelled int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&slow) == 1 {
+			select {
+			case <-r.Context().Done():
+				atomic.StoreInt32(&cancelled, 1)
+				return
+			case <-time.After(2 * time.Second):
+			}
+		}
+		w.Write([]byte(`[{"dataset":"/a/b/c"}]`))
+	}))
+	defer primary.Close()
+	var mirrorCalls int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&mirrorCalls, 1)
+		w.Write([]byte(`[{"dataset":"/a/b/c"}]`))
+	}))
+	defer mirror.Close()
+	utils.Endpoints = map[string][]string{"dbs3": {primary.URL, mirror.URL}}
+	utils.HedgeBudget = 0.05
+	defer func() { utils.Endpoints = nil; utils.HedgeBudget = 0 }()
+
+	rurl := primary.URL + "/dbs/prod/global/DBSReader/datasets?dataset=/a/b/c"
+	fetch := func() utils.ResponseType {
+		out := make(chan utils.ResponseType)
+		go utils.FetchWithContext(utils.FetchContext{}, &http.Client{}, rurl, "", out)
+		return <-out
+	}
+	// learn p95 latency of the system
+	for i := 0; i < utils.HedgeMinSamples; i++ {
+		fetch()
+	}
+	atomic.StoreInt32(&slow, 1)
+	start := time.Now()
+	r := fetch()
+	if r.Error != nil || r.Url != rurl || r.Endpoint != mirror.URL {
+		t.Fatalf("Fail TestHedgedFetch, url %s endpoint %s error %v", r.Url, r.Endpoint, r.Error)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Fail TestHedgedFetch, hedged request took %v", time.Since(start))
+	}
+	// slower primary request should be cancelled once hedged one answered
+	for i := 0; i < 50 && atomic.LoadInt32(&cancelled) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&cancelled) != 1 {
+		t.Errorf("Fail TestHedgedFetch, slower request is not cancelled")
+	}
+	// budget allows 5% of requests to be hedged, i.e. one of 22 requests
+	fetch()
+	if calls := atomic.LoadInt32(&mirrorCalls); calls != 1 {
+		t.Errorf("Fail TestHedgedFetch, hedging budget is exceeded, mirror calls %d", calls)
+	}
+}
@@ -3,12 +3,48 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/dmwm/das2go/config"
 	"github.com/dmwm/das2go/mongo"
 	"github.com/dmwm/das2go/services"
 )
 
+// helper function to get address of MongoDB used by tests, DAS_TEST_MONGO
+// or localhost:27017, tests are skipped if MongoDB is not reachable
+func mongoAddr(t *testing.T) string {
+	addr := os.Getenv("DAS_TEST_MONGO")
+	if addr == "" {
+		addr = "localhost:27017"
+	}
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Skipf("MongoDB is not reachable at %s", addr)
+	}
+	conn.Close()
+	return addr
+}
+
+// helper function to connect MongoDB helpers to given uri, global MongoDB
+// session is closed before and after the test
+func useMongoUri(t *testing.T, uri string) {
+	orig := config.Config.Uri
+	mongo.Close()
+	config.Config.Uri = uri
+	t.Cleanup(func() {
+		mongo.Close()
+		config.Config.Uri = orig
+	})
+}
+
+// helper function to connect MongoDB helpers to test MongoDB
+func useMongo(t *testing.T) {
+	useMongoUri(t, "mongodb://"+mongoAddr(t)+"/?connect=direct")
+}
+
 func TestOrderByRunLumis(t *testing.T) {
 	var records []mongo.DASRecord
 	var vals []interface{}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dmwm/das2go/utils"
+)
+
+// TestHTTPCacheConditional checks that cached response is re-used on 304
+func TestHTTPCacheConditional(t *testing.T) {
+	data := []byte(`[{"data_tier_name":"RAW"}]`)
+	var conditional int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	cache := utils.ResponseCache
+	defer func() { utils.ResponseCache = cache }()
+	utils.ResponseCache = utils.NewHTTPCache(1024*1024, 0, "")
+
+	rurl := server.URL + "/datatiers"
+	resp := utils.FetchResponse(&http.Client{}, rurl, "")
+	if resp.Error != nil || !bytes.Equal(resp.Data, data) {
+		t.Fatalf("Fail TestHTTPCacheConditional, response %+v", resp)
+	}
+	resp = utils.FetchResponse(&http.Client{}, rurl, "")
+	if resp.Error != nil || resp.StatusCode != http.StatusNotModified || !bytes.Equal(resp.Data, data) {
+		t.Fatalf("Fail TestHTTPCacheConditional, cached response %+v", resp)
+	}
+	stats := utils.ResponseCache.Stats()
+	if conditional != 1 || stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("Fail TestHTTPCacheConditional, conditional requests %d, stats %+v", conditional, stats)
+	}
+}
+
+// TestHTTPCacheBounds checks that cache moves responses to disk and evicts
+// them within its bounds
+func TestHTTPCacheBounds(t *testing.T) {
+	dir := t.TempDir()
+	cache := utils.NewHTTPCache(150, 400, dir)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		data := bytes.Repeat([]byte(key), 100)
+		cache.Put(key, &utils.CachedResponse{Url: key, ETag: key, Data: data})
+	}
+	stats := cache.Stats()
+	if stats.MemoryBytes > 150 || stats.DiskBytes > 400 || stats.DiskBytes == 0 {
+		t.Fatalf("Fail TestHTTPCacheBounds, cache exceeds its bounds %+v", stats)
+	}
+	resp, ok := cache.Get("c")
+	if !ok || !bytes.Equal(resp.Data, bytes.Repeat([]byte("c"), 100)) {
+		t.Errorf("Fail TestHTTPCacheBounds, unable to read response from disk")
+	}
+	// disk cache is re-used by new cache instance
+	cache = utils.NewHTTPCache(150, 400, dir)
+	if cache.Stats().Entries == 0 {
+		t.Errorf("Fail TestHTTPCacheBounds, disk cache is not re-used")
+	}
+}
+
+// TestHTTPCacheCounters checks that only responses which could be served
+// from cache are counted as cache misses
+func TestHTTPCacheCounters(t *testing.T) {
+	var version string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/versioned" {
+			if version != "" && r.Header.Get("If-None-Match") == version {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			if version != "" {
+				w.Header().Set("ETag", version)
+			}
+		}
+		w.Write([]byte(`[{"data_tier_name":"RAW"}]`))
+	}))
+	defer server.Close()
+
+	cache := utils.ResponseCache
+	defer func() { utils.ResponseCache = cache }()
+	utils.ResponseCache = utils.NewHTTPCache(1024*1024, 0, "")
+
+	tests := []struct {
+		path    string
+		version string
+		hits    uint64
+		misses  uint64
+	}{
+		{"/plain", "", 0, 0},         // uncacheable response
+		{"/plain", "", 0, 0},         // still uncacheable
+		{"/versioned", `"v1"`, 0, 1}, // cacheable response
+		{"/versioned", `"v1"`, 1, 1}, // not modified
+		{"/versioned", `"v2"`, 1, 2}, // modified
+		{"/versioned", "", 1, 3},     // conditional request, uncacheable response
+	}
+	for _, tt := range tests {
+		version = tt.version
+		resp := utils.FetchResponse(&http.Client{}, server.URL+tt.path, "")
+		stats := utils.ResponseCache.Stats()
+		if resp.Error != nil || stats.Hits != tt.hits || stats.Misses != tt.misses {
+			t.Errorf("Fail TestHTTPCacheCounters, %s %s, error %v, stats %+v, expect hits %d misses %d", tt.path, tt.version, resp.Error, stats, tt.hits, tt.misses)
+		}
+	}
+}
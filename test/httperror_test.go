@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dmwm/das2go/utils"
+)
+
+// TestStatusClass
+func TestStatusClass(t *testing.T) {
+	classes := map[int]string{
+		400: utils.ErrorFatal,
+		401: utils.ErrorAuth,
+		403: utils.ErrorAuth,
+		404: utils.ErrorNotFound,
+		429: utils.ErrorRetryable,
+		500: utils.ErrorRetryable,
+		501: utils.ErrorFatal,
+		503: utils.ErrorRetryable,
+	}
+	for code, class := range classes {
+		if c := utils.StatusClass(code); c != class {
+			t.Errorf("Fail TestStatusClass, code %d class %s, expect %s", code, c, class)
+		}
+	}
+}
+
+// helper function to fetch given url via fetch queue
+func fetchOne(rurl string) utils.ResponseType {
+	out := make(chan utils.ResponseType)
+	go utils.Fetch(&http.Client{}, rurl, "", out)
+	return <-out
+}
+
+// TestFetchRetry checks that only retryable errors are retried and that
+// Retry-After is honoured
+func TestFetchRetry(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		switch {
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case n == 1:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write([]byte("[]"))
+		}
+	}))
+	defer server.Close()
+
+	retry, limit := utils.UrlRetry, atomic.LoadInt32(&utils.UrlQueueLimit)
+	defer func() {
+		utils.UrlRetry = retry
+		atomic.StoreInt32(&utils.UrlQueueLimit, limit)
+	}()
+	utils.UrlRetry = 3
+	atomic.StoreInt32(&utils.UrlQueueLimit, 0)
+
+	time0 := time.Now()
+	resp := fetchOne(server.URL + "/data")
+	if resp.Error != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Fail TestFetchRetry, response %+v", resp)
+	}
+	if atomic.LoadInt32(&hits) != 2 || time.Since(time0) < time.Second {
+		t.Errorf("Fail TestFetchRetry, Retry-After is not honoured, hits %d time %v", hits, time.Since(time0))
+	}
+
+	atomic.StoreInt32(&hits, 0)
+	resp = fetchOne(server.URL + "/missing")
+	if utils.ErrorClass(resp.Error) != utils.ErrorNotFound || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Fail TestFetchRetry, wrong error %v", resp.Error)
+	}
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Errorf("Fail TestFetchRetry, not-found error is retried %d times", hits)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dmwm/das2go/dasql"
+	"github.com/dmwm/das2go/utils"
+)
+
+// TestLogger
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	if err := utils.InitLogger(&buf, "json"); err != nil {
+		t.Fatal(err)
+	}
+	defer utils.InitLogger(os.Stderr, "text")
+
+	dasquery := dasql.DASQuery{Query: "dataset=/a/b/c", Qhash: "123", User: "/DC=ch/CN=user", Client: "1.2.3.4"}
+	dasquery.Logger().Info("DAS request", "query", dasquery.Query)
+	dasquery.Logger().Debug("debug record is not logged")
+	log.Printf("ERROR: plain log line\n")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Fail TestLogger, wrong number of records %v", lines)
+	}
+	var rec map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["qhash"] != "123" || rec["user"] != "/DC=ch/CN=user" || rec["client"] != "1.2.3.4" || rec["msg"] != "DAS request" {
+		t.Errorf("Fail TestLogger, wrong query record %v", rec)
+	}
+	if src, _ := rec["source"].(string); !strings.HasPrefix(src, "logger_test.go:") {
+		t.Errorf("Fail TestLogger, wrong source %v", rec["source"])
+	}
+	rec = nil
+	if err := json.Unmarshal([]byte(lines[1]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["level"] != "ERROR" || rec["msg"] != "ERROR: plain log line" {
+		t.Errorf("Fail TestLogger, wrong plain log record %v", rec)
+	}
+	if src, _ := rec["source"].(string); !strings.HasPrefix(src, "logger_test.go:") {
+		t.Errorf("Fail TestLogger, wrong source of plain log record %v", rec["source"])
+	}
+}
+
+// TestLogLevel checks that level of log records is independent of VERBOSE
+func TestLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	if err := utils.InitLogger(&buf, "json"); err != nil {
+		t.Fatal(err)
+	}
+	verbose := utils.VERBOSE
+	defer func() {
+		utils.VERBOSE = verbose
+		utils.SetLogLevel("info")
+		utils.InitLogger(os.Stderr, "text")
+	}()
+
+	utils.VERBOSE = 2
+	utils.Logger.Debug("debug record is not logged with verbose level")
+	if err := utils.SetLogLevel("debug"); err != nil {
+		t.Fatal(err)
+	}
+	utils.VERBOSE = 0
+	utils.Logger.Debug("debug record")
+	if err := utils.SetLogLevel("error"); err != nil {
+		t.Fatal(err)
+	}
+	utils.Logger.Warn("warning record is not logged")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `"msg":"debug record"`) {
+		t.Errorf("Fail TestLogLevel, wrong records %v", lines)
+	}
+	if err := utils.SetLogLevel("trace"); err == nil {
+		t.Error("Fail TestLogLevel, no error for unsupported level")
+	}
+}
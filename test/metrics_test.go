@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dmwm/das2go/utils"
+)
+
+// TestMetrics
+func TestMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"dataset":"/a/b/c"}]`))
+	}))
+	defer server.Close()
+	out := make(chan utils.ResponseType)
+	go utils.FetchWithContext(utils.FetchContext{Urn: "datasets"}, &http.Client{}, server.URL+"/dbs/datasets", "", out)
+	if r := <-out; r.Error != nil {
+		t.Fatalf("Fail TestMetrics, error %v", r.Error)
+	}
+	utils.ObserveHistogram("test_duration_seconds", 0.3, "op", "get")
+
+	var buf bytes.Buffer
+	utils.WriteMetrics(&buf)
+	metrics := buf.String()
+	expect := []string{
+		"# TYPE das_upstream_requests_total counter",
+		`das_upstream_requests_total{system="dbs",urn="datasets",code="200"} 1`,
+		`das_upstream_received_bytes_total{system="dbs",urn="datasets"} 22`,
+		`das_upstream_request_duration_seconds_count{system="dbs",urn="datasets"} 1`,
+		`test_duration_seconds_bucket{op="get",le="0.25"} 0`,
+		`test_duration_seconds_bucket{op="get",le="0.5"} 1`,
+		`test_duration_seconds_bucket{op="get",le="+Inf"} 1`,
+		`test_duration_seconds_sum{op="get"} 0.3`,
+	}
+	for _, line := range expect {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("Fail TestMetrics, no %s in\n%s", line, metrics)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dmwm/das2go/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TestMongoBackoff checks that connection to unreachable MongoDB is retried
+// with exponential back-off and errors are returned to the caller
+func TestMongoBackoff(t *testing.T) {
+	retries, backoff, timeout := mongo.DialRetries, mongo.DialBackoff, mongo.DialTimeout
+	defer func() {
+		mongo.DialRetries, mongo.DialBackoff, mongo.DialTimeout = retries, backoff, timeout
+	}()
+	useMongoUri(t, "mongodb://127.0.0.1:1/?connect=direct")
+	mongo.DialRetries, mongo.DialBackoff, mongo.DialTimeout = 2, 50*time.Millisecond, 50*time.Millisecond
+
+	time0 := time.Now()
+	if _, err := mongo.Count("das", "cache", bson.M{}); err == nil {
+		t.Error("Fail TestMongoBackoff, no error from Count")
+	}
+	if elapsed := time.Since(time0); elapsed < mongo.DialBackoff {
+		t.Errorf("Fail TestMongoBackoff, connection attempts took %v", elapsed)
+	}
+	// connection errors are returned by all operations
+	mongo.DialRetries = 1
+	if _, err := mongo.GetSorted("das", "cache", bson.M{}, []string{"qhash"}); err == nil {
+		t.Error("Fail TestMongoBackoff, no error from GetSorted")
+	}
+	if err := mongo.Insert("das", "cache", []mongo.DASRecord{{"qhash": "123"}}); err == nil {
+		t.Error("Fail TestMongoBackoff, no error from Insert")
+	}
+}
+
+// mongoProxy forwards connections to MongoDB and can drop them to simulate
+// connection loss
+type mongoProxy struct {
+	listener net.Listener
+	backend  string
+	conns    []net.Conn
+	mutex    sync.Mutex
+}
+
+// helper function to start proxy of given MongoDB address
+func newMongoProxy(t *testing.T, backend string) *mongoProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mongoProxy{listener: listener, backend: backend}
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", backend)
+			if err != nil {
+				client.Close()
+				continue
+			}
+			p.mutex.Lock()
+			p.conns = append(p.conns, client, server)
+			p.mutex.Unlock()
+			go io.Copy(server, client)
+			go io.Copy(client, server)
+		}
+	}()
+	return p
+}
+
+// drop closes all proxied connections
+func (p *mongoProxy) drop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+// TestMongoReconnect checks that lost connection is re-established and
+// operations are retried, as well as error path of bulk insert
+func TestMongoReconnect(t *testing.T) {
+	proxy := newMongoProxy(t, mongoAddr(t))
+	defer proxy.listener.Close()
+	retries, backoff := mongo.DialRetries, mongo.DialBackoff
+	defer func() { mongo.DialRetries, mongo.DialBackoff = retries, backoff }()
+	mongo.DialRetries, mongo.DialBackoff = 3, 10*time.Millisecond
+	useMongoUri(t, "mongodb://"+proxy.listener.Addr().String()+"/?connect=direct")
+
+	dbname, collname := "das_test", "reconnect"
+	defer mongo.Remove(dbname, collname, bson.M{})
+	mongo.Remove(dbname, collname, bson.M{})
+
+	records := []mongo.DASRecord{{"qhash": "1"}, {"qhash": "2"}, {"qhash": "3"}}
+	if err := mongo.Insert(dbname, collname, records); err != nil {
+		t.Fatalf("Fail TestMongoReconnect, insert error %v", err)
+	}
+	proxy.drop()
+	if nrec, err := mongo.Count(dbname, collname, bson.M{}); err != nil || nrec != 3 {
+		t.Errorf("Fail TestMongoReconnect, count after connection loss %d, error %v", nrec, err)
+	}
+	proxy.drop()
+	if err := mongo.Insert(dbname, collname, []mongo.DASRecord{{"qhash": "4"}}); err != nil {
+		t.Errorf("Fail TestMongoReconnect, insert after connection loss, error %v", err)
+	}
+	if nrec, _ := mongo.Count(dbname, collname, bson.M{}); nrec != 4 {
+		t.Errorf("Fail TestMongoReconnect, wrong number of records %d", nrec)
+	}
+
+	// non-idempotent update is not repeated after connection loss
+	proxy.drop()
+	mongo.UpdateAll(dbname, collname, bson.M{}, bson.M{"$inc": bson.M{"n": 1}})
+	if nrec, _ := mongo.Count(dbname, collname, bson.M{"n": 2}); nrec != 0 {
+		t.Errorf("Fail TestMongoReconnect, $inc update applied twice to %d records", nrec)
+	}
+
+	// failure of one record in bulk insert is reported and does not prevent
+	// insertion of others
+	mongo.Remove(dbname, collname, bson.M{})
+	id := bson.NewObjectId()
+	if err := mongo.Insert(dbname, collname, []mongo.DASRecord{{"_id": id, "qhash": "1"}}); err != nil {
+		t.Fatalf("Fail TestMongoReconnect, insert error %v", err)
+	}
+	records = []mongo.DASRecord{{"qhash": "2"}, {"_id": id, "qhash": "3"}, {"qhash": "4"}}
+	if err := mongo.Insert(dbname, collname, records); err == nil {
+		t.Error("Fail TestMongoReconnect, no error for duplicate record in bulk insert")
+	}
+	if nrec, err := mongo.Count(dbname, collname, bson.M{}); err != nil || nrec != 3 {
+		t.Errorf("Fail TestMongoReconnect, wrong number of records after bulk insert %d, error %v", nrec, err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dmwm/das2go/utils"
+)
+
+// TestRecordReplay
+func TestRecordReplay(t *testing.T) {
+	data := `[{"rse":"T1_US_FNAL_Disk"}]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/denied" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(data))
+	}))
+	mode, dir := utils.FetchMode, utils.FixtureDir
+	defer func() { utils.FetchMode, utils.FixtureDir = mode, dir }()
+	utils.FixtureDir = t.TempDir()
+
+	// record responses
+	utils.FetchMode = utils.FetchRecord
+	rurl := server.URL + "/rses"
+	resp := utils.FetchResponse(&http.Client{}, rurl, "")
+	if resp.Error != nil || string(resp.Data) != data {
+		t.Fatalf("Fail TestRecordReplay, record response %+v", resp)
+	}
+	utils.FetchResponse(&http.Client{}, server.URL+"/denied", "")
+	server.Close()
+
+	// replay them without upstream server
+	utils.FetchMode = utils.FetchReplay
+	resp = utils.FetchResponse(&http.Client{}, rurl, "")
+	if resp.Error != nil || string(resp.Data) != data || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Fail TestRecordReplay, replay response %+v", resp)
+	}
+	resp = utils.FetchResponse(&http.Client{}, server.URL+"/denied", "")
+	if resp.StatusCode != http.StatusForbidden || utils.ErrorClass(resp.Error) != utils.ErrorAuth {
+		t.Errorf("Fail TestRecordReplay, replayed error %v", resp.Error)
+	}
+	resp = utils.FetchResponse(&http.Client{}, rurl, `{"rse":"T2"}`)
+	var ferr *utils.FixtureError
+	if !errors.As(resp.Error, &ferr) || utils.ErrorClass(resp.Error) != utils.ErrorFatal {
+		t.Errorf("Fail TestRecordReplay, no error for missing fixture %v", resp.Error)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dmwm/das2go/utils"
+)
+
+// TestFairFetchQueue checks that small query is not starved by large one
+func TestFairFetchQueue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	limit := atomic.LoadInt32(&utils.UrlQueueLimit)
+	defer atomic.StoreInt32(&utils.UrlQueueLimit, limit)
+	atomic.StoreInt32(&utils.UrlQueueLimit, 1)
+	utils.Init()
+
+	out := make(chan utils.ResponseType)
+	client := &http.Client{}
+	nbig := 10
+	big := utils.FetchContext{Qhash: "big", User: "user1"}
+	for i := 0; i < nbig; i++ {
+		go utils.FetchWithContext(big, client, fmt.Sprintf("%s/big/%d", server.URL, i), "", out)
+	}
+	time.Sleep(30 * time.Millisecond)
+	small := utils.FetchContext{Qhash: "small", User: "user2"}
+	go utils.FetchWithContext(small, client, server.URL+"/small", "", out)
+
+	pos := -1
+	for i := 0; i <= nbig; i++ {
+		r := <-out
+		if r.Url == server.URL+"/small" {
+			pos = i
+		}
+	}
+	if pos < 0 || pos > 3 {
+		t.Errorf("Fail TestFairFetchQueue, small query is processed at position %d", pos)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dmwm/das2go/dasmaps"
+	"github.com/dmwm/das2go/dasql"
+	"github.com/dmwm/das2go/fakeupstream"
+	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/services"
+	"github.com/dmwm/das2go/utils"
+)
+
+// TestStreamUnmarshal
+func TestStreamUnmarshal(t *testing.T) {
+	cfg := fakeupstream.DefaultConfig()
+	cfg.Datasets[0].Blocks = 3
+	cfg.Datasets[0].FilesPerBlock = 5
+	server := httptest.NewServer(fakeupstream.NewServer(cfg))
+	defer server.Close()
+	rules := fakeupstream.UrlRewrite(server.URL)
+	dbsUrl := dasmaps.RewriteUrl("https://cmsweb.cern.ch:8443/dbs/prod/global/DBSReader", rules)
+	furl := fmt.Sprintf("%s/files?dataset=%s&detail=1", dbsUrl, cfg.Datasets[0].Name)
+
+	batchSize := services.UnmarshalBatchSize
+	services.UnmarshalBatchSize = 4
+	defer func() { services.UnmarshalBatchSize = batchSize }()
+
+	out := make(chan utils.ResponseType)
+	ctx := utils.FetchContext{Stream: true}
+	go utils.FetchWithContext(ctx, &http.Client{}, furl, "", out)
+	r := <-out
+	if r.Error != nil || r.Body == nil {
+		t.Fatalf("Fail TestStreamUnmarshal, expected streamed response, error %v", r.Error)
+	}
+	var batches, nrec int
+	tracker := &utils.MemoryTracker{}
+	process := func(records []mongo.DASRecord) error {
+		batches++
+		nrec += len(records)
+		if len(records) > services.UnmarshalBatchSize {
+			t.Errorf("Fail TestStreamUnmarshal, batch of %d records", len(records))
+		}
+		return nil
+	}
+	err := services.StreamUnmarshal(dasql.DASQuery{}, "dbs3", "files", r, nil, nil, tracker, process)
+	if err != nil {
+		t.Fatalf("Fail TestStreamUnmarshal, error %v", err)
+	}
+	if nrec != 15 || batches != 4 {
+		t.Errorf("Fail TestStreamUnmarshal, records %d batches %d", nrec, batches)
+	}
+	if tracker.Peak() <= 0 {
+		t.Errorf("Fail TestStreamUnmarshal, peak memory %d", tracker.Peak())
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmwm/das2go/utils"
+)
+
+// TestTrace
+func TestTrace(t *testing.T) {
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		w.Write([]byte(`[{"dataset":"/a/b/c"}]`))
+	}))
+	defer server.Close()
+	fname := fmt.Sprintf("%s/traces.json", t.TempDir())
+	utils.TraceFlushInterval = 100 * time.Millisecond
+	utils.InitTracer(fname, "")
+
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	root := utils.NewTrace("RequestHandler", parent, "req-123")
+	if root.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || root.ParentID != "00f067aa0ba902b7" {
+		t.Fatalf("Fail TestTrace, incoming trace context is not used, %+v", root)
+	}
+	out := make(chan utils.ResponseType)
+	ctx := utils.FetchContext{Urn: "datasets", Span: root}
+	go utils.FetchWithContext(ctx, &http.Client{}, server.URL+"/dbs/datasets", "", out)
+	r := <-out
+	root.End()
+	if r.Error != nil {
+		t.Fatalf("Fail TestTrace, error %v", r.Error)
+	}
+	if headers.Get("X-Request-ID") != "req-123" || !strings.Contains(headers.Get("traceparent"), root.TraceID) {
+		t.Errorf("Fail TestTrace, trace context is not propagated, headers %v", headers)
+	}
+
+	// wait for exporter and check exported spans
+	time.Sleep(300 * time.Millisecond)
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatalf("Fail TestTrace, error %v", err)
+	}
+	names := make(map[string]string)
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct {
+						TraceID      string `json:"traceId"`
+						ParentSpanID string `json:"parentSpanId"`
+						Name         string `json:"name"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.Unmarshal(line, &req); err != nil {
+			t.Fatalf("Fail TestTrace, unable to parse %s, error %v", line, err)
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					if s.TraceID == root.TraceID {
+						names[s.Name] = s.ParentSpanID
+					}
+				}
+			}
+		}
+	}
+	if names["FetchResponse"] != root.SpanID || names["RequestHandler"] != root.ParentID {
+		t.Errorf("Fail TestTrace, exported spans %v", names)
+	}
+}
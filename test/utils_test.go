@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -176,3 +177,34 @@ func TestCerts(t *testing.T) {
 		t.Errorf("Fail TestCerts: current certificate expired in 600 seconds\n")
 	}
 }
+
+// TestFunctionProfiler
+func TestFunctionProfiler(t *testing.T) {
+	fname := fmt.Sprintf("%s/profile/das-profile.log", t.TempDir())
+	utils.InitFunctionProfiler(fname)
+	defer utils.CloseFunctionProfiler()
+
+	pid := "0123456789abcdef0123456789abcdef"
+	tracker := &utils.MemoryTracker{}
+	tracker.Add(1024)
+	tracker.Release(1024)
+	done := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func() {
+			utils.MeasureTime("das/processURLs")()
+			done <- true
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	utils.MeasureMemory("das/processURLs", pid, tracker)
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatalf("Fail TestFunctionProfiler, error %v", err)
+	}
+	expect := fmt.Sprintf("das/processURLs qhash=%s peakMemory=1024", pid)
+	if !strings.Contains(string(data), expect) || strings.Count(string(data), "\n") != 11 {
+		t.Errorf("Fail TestFunctionProfiler, profiler output\n%s", data)
+	}
+}
@@ -0,0 +1,426 @@
+package utils
+
+// DAS outbound authentication module
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+// Requests to upstream systems are authorized by AuthProvider selected per
+// upstream system (AuthProviders). Supported providers are:
+// - x509, client X509 certificates (proxy or user cert/key), default
+// - token, static bearer token read from a file, re-read when file changes
+// - oauth2, OAuth2 client credentials flow, e.g. CMS IAM or SciTokens issuer
+// - rucio, Rucio token obtained via Rucio auth server (RucioAuth)
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthRefreshMargin defines how long before expiry tokens are refreshed
+var AuthRefreshMargin = time.Minute
+
+// AuthConfig represents configuration of outbound authentication provider
+type AuthConfig struct {
+	Type         string `json:"type"`         // provider type: x509, token, oauth2 or rucio
+	TokenFile    string `json:"tokenFile"`    // file with bearer token (or token itself) used by token provider
+	TokenUrl     string `json:"tokenUrl"`     // OAuth2 token endpoint
+	ClientID     string `json:"clientId"`     // OAuth2 client id
+	ClientSecret string `json:"clientSecret"` // OAuth2 client secret or file with it
+	Scope        string `json:"scope"`        // OAuth2 scopes, e.g. "storage.read:/ compute.read"
+	Audience     string `json:"audience"`     // OAuth2 token audience
+}
+
+// AuthProvider represents authentication of requests to upstream system
+type AuthProvider interface {
+	Name() string                      // provider name, e.g. x509
+	Authorize(req *http.Request) error // add credentials to upstream request
+	UseCerts() bool                    // provider requires client X509 certificates
+}
+
+// AuthRenewer is implemented by auth providers which can renew credentials
+// rejected by upstream system
+type AuthRenewer interface {
+	Renew(req *http.Request) error // renew credentials of rejected request
+}
+
+// NewAuthProvider creates auth provider for given configuration
+func NewAuthProvider(cfg AuthConfig) (AuthProvider, error) {
+	switch strings.ToLower(cfg.Type) {
+	case "", "x509":
+		return &X509Provider{}, nil
+	case "token":
+		if cfg.TokenFile == "" {
+			return nil, errors.New("token auth provider requires tokenFile")
+		}
+		return &TokenProvider{Source: cfg.TokenFile}, nil
+	case "oauth2":
+		if cfg.TokenUrl == "" || cfg.ClientID == "" {
+			return nil, errors.New("oauth2 auth provider requires tokenUrl and clientId")
+		}
+		return &OAuth2Provider{Config: cfg}, nil
+	case "rucio":
+		return &RucioProvider{Auth: &RucioAuth}, nil
+	}
+	return nil, fmt.Errorf("unknown auth provider type %s", cfg.Type)
+}
+
+// auth providers of upstream systems
+var authProviders map[string]AuthProvider
+var authLock sync.RWMutex
+
+// InitAuthProviders creates auth providers of upstream systems from given
+// configuration keyed by DAS map system name, e.g. dbs3, rucio; "default"
+// provider applies to all other systems
+func InitAuthProviders(configs map[string]AuthConfig) error {
+	providers := make(map[string]AuthProvider)
+	for key, cfg := range configs {
+		provider, err := NewAuthProvider(cfg)
+		if err != nil {
+			return fmt.Errorf("system %s, %v", key, err)
+		}
+		if key != "default" {
+			key = limitSystem(key)
+		}
+		providers[key] = provider
+		if WEBSERVER > 0 {
+			log.Printf("auth provider system=%s provider=%s\n", key, provider.Name())
+		}
+	}
+	authLock.Lock()
+	authProviders = providers
+	authLock.Unlock()
+	return nil
+}
+
+// legacy auth providers used when AuthProviders are not configured
+var legacyX509 = &X509Provider{}
+var legacyRucio = &RucioProvider{Auth: &RucioAuth}
+var legacyTokens sync.Map
+
+// helper function to find auth provider of given url
+func authProvider(rurl string) AuthProvider {
+	name := system(rurl)
+	authLock.RLock()
+	defer authLock.RUnlock()
+	if len(authProviders) > 0 {
+		if provider, ok := authProviders[name]; ok {
+			return provider
+		}
+		if provider, ok := authProviders["default"]; ok {
+			return provider
+		}
+		return legacyX509
+	}
+	// use Token and RucioAuth when auth providers are not configured
+	if name == "rucio" {
+		return legacyRucio
+	}
+	if Token != "" {
+		provider, _ := legacyTokens.LoadOrStore(Token, &TokenProvider{Source: Token})
+		return provider.(*TokenProvider)
+	}
+	return legacyX509
+}
+
+// helper function to check if any of auth providers requires client certs
+func useCerts() bool {
+	authLock.RLock()
+	defer authLock.RUnlock()
+	if len(authProviders) == 0 {
+		return Token == "" // if there is no token back auth we fall back to x509
+	}
+	for _, provider := range authProviders {
+		if provider.UseCerts() {
+			return true
+		}
+	}
+	return false
+}
+
+// authTransport sends requests to upstream systems whose auth providers
+// require client X509 certificates via transport with certificates and
+// all other requests via transport without them
+type authTransport struct {
+	certs *http.Transport // transport with client X509 certificates
+	plain *http.Transport // transport without client certificates
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if authProvider(req.URL.String()).UseCerts() {
+		return t.certs.RoundTrip(req)
+	}
+	return t.plain.RoundTrip(req)
+}
+
+// X509Provider authorizes requests with client X509 certificates which are
+// provided by HTTP client transport, see HttpClient
+type X509Provider struct{}
+
+// Name implements AuthProvider interface
+func (p *X509Provider) Name() string {
+	return "x509"
+}
+
+// Authorize implements AuthProvider interface
+func (p *X509Provider) Authorize(req *http.Request) error {
+	return nil
+}
+
+// UseCerts implements AuthProvider interface
+func (p *X509Provider) UseCerts() bool {
+	return true
+}
+
+// TokenProvider authorizes requests with static bearer token, the token is
+// read from a file and re-read when file modification time changes
+type TokenProvider struct {
+	Source string // token file or token itself
+	token  string
+	mtime  time.Time
+	mutex  sync.Mutex
+}
+
+// Name implements AuthProvider interface
+func (p *TokenProvider) Name() string {
+	return "token"
+}
+
+// Token returns bearer token
+func (p *TokenProvider) Token() (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	info, err := os.Stat(p.Source)
+	if err != nil { // source is the token itself
+		return p.Source, nil
+	}
+	if p.token != "" && info.ModTime().Equal(p.mtime) {
+		return p.token, nil
+	}
+	data, err := os.ReadFile(p.Source)
+	if err != nil {
+		return "", fmt.Errorf("unable to read token file %s, error %v", p.Source, err)
+	}
+	p.token = strings.TrimSpace(string(data))
+	p.mtime = info.ModTime()
+	return p.token, nil
+}
+
+// Authorize implements AuthProvider interface
+func (p *TokenProvider) Authorize(req *http.Request) error {
+	token, err := p.Token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	return nil
+}
+
+// UseCerts implements AuthProvider interface
+func (p *TokenProvider) UseCerts() bool {
+	return false
+}
+
+// OAuth2Provider authorizes requests with tokens obtained via OAuth2 client
+// credentials flow, tokens are cached and refreshed AuthRefreshMargin before
+// their expiry
+type OAuth2Provider struct {
+	Config AuthConfig
+	token  string
+	expire time.Time
+	mutex  sync.Mutex
+}
+
+// oauth2Token represents response of OAuth2 token endpoint
+type oauth2Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Name implements AuthProvider interface
+func (p *OAuth2Provider) Name() string {
+	return "oauth2"
+}
+
+// Token returns valid access token, it obtains new token if necessary
+func (p *OAuth2Provider) Token() (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.token != "" && time.Until(p.expire) > AuthRefreshMargin {
+		return p.token, nil
+	}
+	token, expire, err := p.fetchToken()
+	if err != nil {
+		return "", err
+	}
+	p.token, p.expire = token, expire
+	if VERBOSE > 1 {
+		log.Printf("new oauth2 token from %s expire=%v\n", p.Config.TokenUrl, expire)
+	}
+	return p.token, nil
+}
+
+// helper function to obtain new token from OAuth2 token endpoint
+func (p *OAuth2Provider) fetchToken() (string, time.Time, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if p.Config.Scope != "" {
+		form.Set("scope", p.Config.Scope)
+	}
+	if p.Config.Audience != "" {
+		form.Set("audience", p.Config.Audience)
+	}
+	req, err := http.NewRequest("POST", p.Config.TokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.Config.ClientID), url.QueryEscape(readToken(p.Config.ClientSecret)))
+	client := &http.Client{}
+	if TIMEOUT > 0 {
+		client.Timeout = time.Duration(TIMEOUT) * time.Second
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("oauth2 token endpoint %s, status %d", p.Config.TokenUrl, resp.StatusCode)
+	}
+	var rec oauth2Token
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return "", time.Time{}, err
+	}
+	if rec.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("oauth2 token endpoint %s, no access token", p.Config.TokenUrl)
+	}
+	expire := time.Now().Add(time.Duration(rec.ExpiresIn) * time.Second)
+	if rec.ExpiresIn == 0 { // token without expiry, refresh it periodically
+		expire = time.Now().Add(AuthRefreshMargin + 10*time.Minute)
+	}
+	return rec.AccessToken, expire, nil
+}
+
+// Authorize implements AuthProvider interface
+func (p *OAuth2Provider) Authorize(req *http.Request) error {
+	token, err := p.Token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	return nil
+}
+
+// Renew implements AuthRenewer interface, token rejected by upstream system
+// is dropped and new one is obtained, token is renewed only once for all
+// requests rejected with the same token
+func (p *OAuth2Provider) Renew(req *http.Request) error {
+	rejected := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	p.mutex.Lock()
+	if p.token == rejected {
+		p.token = ""
+	}
+	p.mutex.Unlock()
+	_, err := p.Token()
+	return err
+}
+
+// UseCerts implements AuthProvider interface
+func (p *OAuth2Provider) UseCerts() bool {
+	return false
+}
+
+// RucioProvider authorizes requests with Rucio token
+type RucioProvider struct {
+	Auth *RucioAuthModule
+}
+
+// Name implements AuthProvider interface
+func (p *RucioProvider) Name() string {
+	return "rucio"
+}
+
+// Authorize implements AuthProvider interface
+func (p *RucioProvider) Authorize(req *http.Request) error {
+	if WEBSERVER > 0 {
+		req.Header.Set("X-Rucio-Account", p.Auth.Account())
+	}
+	token, err := p.Auth.Token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Rucio-Auth-Token", token)
+	return nil
+}
+
+// Renew implements AuthRenewer interface, token is renewed only once for
+// all requests rejected with the same token
+func (p *RucioProvider) Renew(req *http.Request) error {
+	return p.Auth.Renew(req.Header.Get("X-Rucio-Auth-Token"))
+}
+
+// UseCerts implements AuthProvider interface, Rucio auth server uses X509
+// authentication
+func (p *RucioProvider) UseCerts() bool {
+	return true
+}
+
+// helper function to retry request rejected by upstream system with 401
+// status once with renewed credentials of given auth provider
+func retryUnauthorized(client *http.Client, req *http.Request, resp *http.Response, provider AuthProvider, ctx FetchContext) (*http.Response, error) {
+	renewer, ok := provider.(AuthRenewer)
+	if !ok || resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	if err := renewer.Renew(req); err != nil {
+		ctx.Logger().Error("unable to renew credentials", "system", system(req.URL.String()), "provider", provider.Name(), "url", req.URL.String(), "error", err)
+		return resp, nil
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry.Body = body
+	}
+	if err := provider.Authorize(retry); err != nil {
+		return resp, nil
+	}
+	ctx.Logger().Debug("retry with renewed credentials", "system", system(req.URL.String()), "provider", provider.Name(), "url", req.URL.String())
+	resp.Body.Close()
+	return client.Do(retry)
+}
+
+// regular expression to match credentials in HTTP request/response dumps
+var credentialsPattern = regexp.MustCompile(`(?mi)^(Authorization|Proxy-Authorization|X-Rucio-Auth-Token|Cookie|Set-Cookie):.*$`)
+
+// RedactDump hides credentials in given HTTP request or response dump
+func RedactDump(dump []byte) string {
+	return credentialsPattern.ReplaceAllString(string(dump), "$1: <redacted>")
+}
+
+// RedactToken hides given token in log messages
+func RedactToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	return "<redacted>"
+}
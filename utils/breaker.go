@@ -0,0 +1,169 @@
+package utils
+
+// DAS circuit breaker module
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+// Every upstream system (classified by system function) has its own circuit
+// breaker. The breaker opens after BreakerThreshold consecutive failures and
+// fails requests fast for BreakerTimeout. After that it allows a single
+// half-open probe request, if it succeeds the breaker is closed again,
+// otherwise it re-opens for another BreakerTimeout.
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BreakerThreshold defines number of consecutive failures which opens
+// circuit breaker of upstream system, zero value disables circuit breakers
+var BreakerThreshold = 5
+
+// BreakerTimeout defines how long circuit breaker stays open before it
+// allows half-open probe request
+var BreakerTimeout = 30 * time.Second
+
+// circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// BreakerError is returned for requests rejected by open circuit breaker
+type BreakerError struct {
+	System string    // upstream system name
+	Until  time.Time // time when breaker will allow probe request
+}
+
+// Error implements error interface
+func (e *BreakerError) Error() string {
+	return fmt.Sprintf("%s is unavailable, circuit breaker is open until %s", e.System, e.Until.Format(time.RFC3339))
+}
+
+// CircuitBreaker represents circuit breaker of upstream system
+type CircuitBreaker struct {
+	System   string    // upstream system name
+	state    string    // breaker state
+	failures int       // number of consecutive failures
+	openedAt time.Time // time when breaker was opened
+	probing  bool      // half-open probe request is in flight
+	lastErr  string    // last seen error
+	mutex    sync.Mutex
+}
+
+// BreakerInfo represents state of circuit breaker
+type BreakerInfo struct {
+	System    string `json:"system"`
+	State     string `json:"state"`
+	Failures  int    `json:"failures"`
+	OpenUntil string `json:"open_until,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Allow checks if request to upstream system is allowed, it returns
+// BreakerError if breaker is open. State changes are logged by given logger.
+func (b *CircuitBreaker) Allow(logger *slog.Logger) error {
+	if BreakerThreshold <= 0 {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		until := b.openedAt.Add(BreakerTimeout)
+		if time.Now().Before(until) {
+			return &BreakerError{System: b.System, Until: until}
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		logger.Debug("circuit breaker", "system", b.System, "state", b.state)
+		return nil
+	case BreakerHalfOpen:
+		// only one probe request is allowed at a time
+		if b.probing {
+			return &BreakerError{System: b.System, Until: time.Now().Add(BreakerTimeout)}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Success records successful request to upstream system
+func (b *CircuitBreaker) Success(logger *slog.Logger) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state != BreakerClosed {
+		logger.Info("circuit breaker", "system", b.System, "state", BreakerClosed)
+	}
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure records failed request to upstream system
+func (b *CircuitBreaker) Failure(logger *slog.Logger, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	b.probing = false
+	if err != nil {
+		b.lastErr = err.Error()
+	}
+	if b.state == BreakerHalfOpen || (BreakerThreshold > 0 && b.failures >= BreakerThreshold) {
+		if b.state != BreakerOpen {
+			logger.Warn("circuit breaker", "system", b.System, "state", BreakerOpen, "failures", b.failures, "error", err)
+		}
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// IsOpen returns true if breaker is open and rejects requests
+func (b *CircuitBreaker) IsOpen() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state == BreakerOpen && time.Since(b.openedAt) < BreakerTimeout
+}
+
+// Info returns current state of circuit breaker
+func (b *CircuitBreaker) Info() BreakerInfo {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	info := BreakerInfo{System: b.System, State: b.state, Failures: b.failures, LastError: b.lastErr}
+	if b.state == BreakerOpen {
+		info.OpenUntil = b.openedAt.Add(BreakerTimeout).Format(time.RFC3339)
+	}
+	return info
+}
+
+// global registry of circuit breakers
+var breakers = make(map[string]*CircuitBreaker)
+var breakersMutex sync.Mutex
+
+// GetBreaker returns circuit breaker for given upstream system
+func GetBreaker(system string) *CircuitBreaker {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+	b, ok := breakers[system]
+	if !ok {
+		b = &CircuitBreaker{System: system, state: BreakerClosed}
+		breakers[system] = b
+	}
+	return b
+}
+
+// BreakerStatus returns states of all known circuit breakers
+func BreakerStatus() []BreakerInfo {
+	breakersMutex.Lock()
+	var out []BreakerInfo
+	for _, b := range breakers {
+		out = append(out, b.Info())
+	}
+	breakersMutex.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].System < out[j].System })
+	return out
+}
@@ -0,0 +1,128 @@
+package utils
+
+// DAS debug trace module
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+// Admins may request a DAS query in debug mode. Processing of such query
+// collects matched DAS maps, upstream URLs, timings of upstream calls,
+// number of unmarshalled records and merge decisions in DebugTrace which is
+// stored along with DAS record of the query (das.debug). Other queries are
+// not affected, i.e. debug mode does not change VERBOSE level of the server.
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DebugCall represents upstream call made for DAS query in debug mode
+type DebugCall struct {
+	Method    string  `json:"method" bson:"method"`                   // HTTP method
+	Url       string  `json:"url" bson:"url"`                         // upstream url, including endpoint which served the call
+	Args      string  `json:"args,omitempty" bson:"args,omitempty"`   // POST arguments
+	Urn       string  `json:"urn" bson:"urn"`                         // DAS map urn of the url
+	Code      int     `json:"code" bson:"code"`                       // HTTP status code
+	Duration  float64 `json:"duration" bson:"duration"`               // time to response (headers of streamed response) in seconds
+	RecvBytes int     `json:"recvBytes" bson:"recvBytes"`             // size of response, it is zero for streamed response
+	Hedge     bool    `json:"hedge,omitempty" bson:"hedge,omitempty"` // hedged call
+	Error     string  `json:"error,omitempty" bson:"error,omitempty"` // error of the call
+}
+
+// DebugURL represents upstream url matched by DAS query in debug mode
+type DebugURL struct {
+	Url  string `json:"url" bson:"url"`                       // upstream url
+	Args string `json:"args,omitempty" bson:"args,omitempty"` // POST arguments
+}
+
+// DebugTrace collects processing details of DAS query requested in debug mode
+type DebugTrace struct {
+	Maps    []string       `json:"maps" bson:"maps"`       // DAS maps matched by the query, system:urn
+	Urls    []DebugURL     `json:"urls" bson:"urls"`       // upstream urls and their arguments
+	Calls   []DebugCall    `json:"calls" bson:"calls"`     // upstream calls with their timings
+	Records map[string]int `json:"records" bson:"records"` // number of unmarshalled records by service
+	Merge   []string       `json:"merge" bson:"merge"`     // merge decisions
+	mutex   sync.Mutex
+}
+
+// NewDebugTrace creates new debug trace
+func NewDebugTrace() *DebugTrace {
+	return &DebugTrace{Maps: []string{}, Urls: []DebugURL{}, Calls: []DebugCall{}, Records: make(map[string]int), Merge: []string{}}
+}
+
+// SetMaps records DAS maps and upstream urls matched by DAS query, all
+// DebugTrace methods can be called on nil trace, i.e. outside of debug mode
+func (t *DebugTrace) SetMaps(maps []string, urls map[string]string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.Maps = append(t.Maps, maps...)
+	for rurl, args := range urls {
+		t.Urls = append(t.Urls, DebugURL{Url: rurl, Args: args})
+	}
+	sort.Slice(t.Urls, func(i, j int) bool { return t.Urls[i].Url < t.Urls[j].Url })
+}
+
+// AddCall records upstream call of given context
+func (t *DebugTrace) AddCall(ctx FetchContext, args string, start time.Time, response ResponseType) {
+	if t == nil {
+		return
+	}
+	call := DebugCall{
+		Method:    response.Method,
+		Url:       response.Url,
+		Args:      args,
+		Urn:       ctx.Urn,
+		Code:      response.StatusCode,
+		Duration:  time.Since(start).Seconds(),
+		RecvBytes: response.RecvBytes,
+		Hedge:     ctx.Hedge,
+	}
+	if response.Error != nil {
+		call.Error = response.Error.Error()
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.Calls = append(t.Calls, call)
+}
+
+// AddRecords adds number of records unmarshalled from given service
+func (t *DebugTrace) AddRecords(service string, nrec int) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.Records[service] += nrec
+}
+
+// AddMerge records merge decision
+func (t *DebugTrace) AddMerge(format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.Merge = append(t.Merge, fmt.Sprintf(format, args...))
+}
+
+// Copy returns copy of debug trace which can be safely stored
+func (t *DebugTrace) Copy() *DebugTrace {
+	if t == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	out := NewDebugTrace()
+	out.Maps = append(out.Maps, t.Maps...)
+	out.Urls = append(out.Urls, t.Urls...)
+	out.Calls = append(out.Calls, t.Calls...)
+	for k, v := range t.Records {
+		out.Records[k] = v
+	}
+	out.Merge = append(out.Merge, t.Merge...)
+	return out
+}
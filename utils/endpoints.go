@@ -0,0 +1,192 @@
+package utils
+
+// DAS upstream endpoints module
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+// Upstream systems may be available via several frontends, e.g. cmsweb-prod
+// and cmsweb-k8s, or Rucio mirrors. Endpoints holds ordered list of base urls
+// of such systems. Requests are sent to the first healthy endpoint, when it
+// fails with retryable error (transport error, 5xx, 429) the endpoint is
+// marked as down for EndpointTimeout and request is repeated with the next
+// endpoint. When all endpoints are down the one which went down first is
+// probed.
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoints holds ordered lists of base urls of upstream systems keyed by DAS
+// map system name, e.g. {"dbs3": ["https://cmsweb.cern.ch:8443", "https://cmsweb-k8s-prodsrv.cern.ch:8443"]}
+var Endpoints map[string][]string
+
+// EndpointTimeout defines how long failed endpoint is not used
+var EndpointTimeout = time.Minute
+
+// endpointState represents health of upstream endpoint
+type endpointState struct {
+	failures  int
+	downUntil time.Time
+	lastErr   string
+}
+
+// EndpointInfo represents health of upstream endpoint
+type EndpointInfo struct {
+	System    string `json:"system"`
+	Endpoint  string `json:"endpoint"`
+	Healthy   bool   `json:"healthy"`
+	Failures  int    `json:"failures"`
+	DownUntil string `json:"down_until,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// global registry of endpoint states
+var endpointStates = make(map[string]*endpointState)
+var endpointsMutex sync.Mutex
+
+// helper function to find endpoint list of given url, it returns the list
+// and its endpoint which is used by the url
+func failoverEndpoints(rurl string) ([]string, string) {
+	name := system(rurl)
+	var list []string
+	var base string
+	for key, endpoints := range Endpoints {
+		if limitSystem(key) != name {
+			continue
+		}
+		for _, e := range endpoints {
+			if strings.HasPrefix(rurl, e) && len(e) > len(base) {
+				list, base = endpoints, e
+			}
+		}
+	}
+	return list, base
+}
+
+// helper function to order endpoints by their health: healthy endpoints in
+// configured order followed by failed ones ordered by their recovery time
+func endpointOrder(endpoints []string) []string {
+	endpointsMutex.Lock()
+	defer endpointsMutex.Unlock()
+	now := time.Now()
+	var healthy, down []string
+	for _, e := range endpoints {
+		if s, ok := endpointStates[e]; ok && now.Before(s.downUntil) {
+			down = append(down, e)
+		} else {
+			healthy = append(healthy, e)
+		}
+	}
+	sort.SliceStable(down, func(i, j int) bool {
+		return endpointStates[down[i]].downUntil.Before(endpointStates[down[j]].downUntil)
+	})
+	return append(healthy, down...)
+}
+
+// helper function to record outcome of request to given endpoint
+func endpointResult(endpoint string, err error) {
+	endpointsMutex.Lock()
+	defer endpointsMutex.Unlock()
+	s, ok := endpointStates[endpoint]
+	if !ok {
+		s = &endpointState{}
+		endpointStates[endpoint] = s
+	}
+	if err == nil {
+		s.failures = 0
+		s.downUntil = time.Time{}
+		return
+	}
+	s.failures++
+	s.downUntil = time.Now().Add(EndpointTimeout)
+	s.lastErr = err.Error()
+}
+
+// helper function to return scheme and host of given url
+func urlEndpoint(rurl string) string {
+	u, err := url.Parse(rurl)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// helper function to record outcome of upstream request in circuit breaker
+// of its system
+func breakerResult(breaker *CircuitBreaker, err error, ctx FetchContext) {
+	if err != nil {
+		breaker.Failure(ctx.Logger(), err)
+	} else {
+		breaker.Success(ctx.Logger())
+	}
+}
+
+// helper function to fetch given url from healthy endpoint of its system,
+// response Url is always the original one and Endpoint is the used endpoint.
+// Outcome of request to every endpoint is recorded in given circuit breaker.
+func failoverFetch(breaker *CircuitBreaker, httpClient *http.Client, rurl, args string, ctx FetchContext) ResponseType {
+	// fetchResponse escapes pound sign of the url, we do the same for
+	// responses of alternate endpoints
+	origUrl := strings.Replace(rurl, "#", "%23", -1)
+	endpoints, base := failoverEndpoints(rurl)
+	if len(endpoints) == 0 {
+		resp, _ := hedgedFetch(httpClient, rurl, rurl, args, ctx)
+		resp.Endpoint = urlEndpoint(resp.Url)
+		breakerResult(breaker, upstreamFailure(resp), ctx)
+		return resp
+	}
+	var resp ResponseType
+	order := endpointOrder(endpoints)
+	path := strings.TrimPrefix(rurl, base)
+	for i, endpoint := range order {
+		// slow request is hedged to the next endpoint (if any)
+		alternate := endpoint
+		if i+1 < len(order) {
+			alternate = order[i+1]
+		}
+		var hedged bool
+		resp, hedged = hedgedFetch(httpClient, endpoint+path, alternate+path, args, ctx)
+		if hedged {
+			endpoint = alternate
+		}
+		resp.Url = origUrl
+		resp.Endpoint = endpoint
+		err := upstreamFailure(resp)
+		endpointResult(endpoint, err)
+		breakerResult(breaker, err, ctx)
+		if err == nil {
+			return resp
+		}
+		ctx.Logger().Debug("upstream endpoint failed", "system", system(rurl), "endpoint", endpoint, "error", err)
+	}
+	return resp
+}
+
+// EndpointStatus returns health of all configured endpoints
+func EndpointStatus() []EndpointInfo {
+	var out []EndpointInfo
+	endpointsMutex.Lock()
+	defer endpointsMutex.Unlock()
+	now := time.Now()
+	for key, endpoints := range Endpoints {
+		for _, e := range endpoints {
+			info := EndpointInfo{System: key, Endpoint: e, Healthy: true}
+			if s, ok := endpointStates[e]; ok {
+				info.Failures = s.failures
+				info.LastError = s.lastErr
+				if now.Before(s.downUntil) {
+					info.Healthy = false
+					info.DownUntil = s.downUntil.Format(time.RFC3339)
+				}
+			}
+			out = append(out, info)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].System < out[j].System })
+	return out
+}
@@ -12,12 +12,11 @@ package utils
 import (
 	"bytes"
 	"compress/gzip"
-	"container/heap"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httputil"
@@ -76,7 +75,7 @@ func (t *TLSCertsManager) GetCerts() ([]tls.Certificate, error) {
 	if t.Certs == nil || time.Since(t.Expire) > TLSCertsRenewInterval {
 		t.Expire = time.Now()
 		if WEBSERVER > 0 {
-			log.Printf("read new certs expire=\"%v\" renewal_interval=%v\n", t.Expire, TLSCertsRenewInterval)
+			Logger.Info("read new certs", "expire", t.Expire, "renewal_interval", TLSCertsRenewInterval)
 		}
 		certs, err := tlsCerts()
 		if err == nil {
@@ -138,7 +137,7 @@ func tlsCerts() ([]tls.Certificate, error) {
 	}
 
 	if WEBSERVER == 1 {
-		log.Printf("tls certs, X509_USER_PROXY=%v, X509_USER_KEY=%v, X509_USER_CERT=%v\n", uproxy, uckey, ucert)
+		Logger.Info("tls certs", "X509_USER_PROXY", uproxy, "X509_USER_KEY", uckey, "X509_USER_CERT", ucert)
 	}
 
 	if uproxy == "" && uckey == "" { // user doesn't have neither proxy or user certs
@@ -151,7 +150,7 @@ func tlsCerts() ([]tls.Certificate, error) {
 			return nil, fmt.Errorf("failed to parse X509 proxy: %v", err)
 		}
 		if WEBSERVER == 1 {
-			log.Println("use proxy", uproxy)
+			Logger.Info("use proxy", "proxy", uproxy)
 		}
 		certs := []tls.Certificate{x509cert}
 		return certs, nil
@@ -161,7 +160,7 @@ func tlsCerts() ([]tls.Certificate, error) {
 		return nil, fmt.Errorf("failed to parse user X509 certificate: %v", err)
 	}
 	if WEBSERVER == 1 {
-		log.Println("user key", uckey, "cert", ucert)
+		Logger.Info("use user certificate", "key", uckey, "cert", ucert)
 	}
 	certs := []tls.Certificate{x509cert}
 	return certs, nil
@@ -183,7 +182,7 @@ func readToken(r string) string {
 func HttpClient() *http.Client {
 	var certs []tls.Certificate
 	var err error
-	if Token == "" { // if there is no token back auth we fall back to x509
+	if useCerts() { // token based auth providers do not require x509 certs
 		// get X509 certs
 		certs, err = tlsManager.GetCerts()
 		if err != nil {
@@ -197,9 +196,15 @@ func HttpClient() *http.Client {
 		}
 		return &http.Client{}
 	}
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{Certificates: certs,
-			InsecureSkipVerify: true},
+	// client certificates are sent only to systems whose auth providers use them
+	tr := &authTransport{
+		certs: &http.Transport{
+			TLSClientConfig: &tls.Config{Certificates: certs,
+				InsecureSkipVerify: true},
+		},
+		plain: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
 	}
 	if TIMEOUT > 0 {
 		return &http.Client{Transport: tr, Timeout: timeout}
@@ -210,14 +215,18 @@ func HttpClient() *http.Client {
 // ResponseType structure is what we expect to get for our URL call.
 // It contains a request URL, the data chunk and possible error from remote
 type ResponseType struct {
-	Url       string
-	Data      []byte
-	Error     error
-	Time      time.Duration
-	Params    string
-	Method    string
-	SendBytes int
-	RecvBytes int
+	Url        string
+	Data       []byte
+	Body       io.ReadCloser // streamed response body, see FetchContext.Stream
+	Endpoint   string        // upstream endpoint which served the request, see Endpoints
+	Error      error
+	StatusCode int
+	Header     http.Header
+	Time       time.Duration
+	Params     string
+	Method     string
+	SendBytes  int
+	RecvBytes  int
 }
 
 // String returns ResponseType representation
@@ -239,39 +248,14 @@ type UrlRequest struct {
 	out    chan<- ResponseType
 	ts     int64
 	client *http.Client
-}
-
-// A UrlFetchQueue implements heap.Interface and holds UrlRequests
-type UrlFetchQueue []*UrlRequest
-
-// Len provides len implemenation for UrlFetchQueue
-func (q UrlFetchQueue) Len() int { return len(q) }
-
-// Less provides Less implemenation for UrlFetchQueue
-func (q UrlFetchQueue) Less(i, j int) bool { return q[i].ts < q[j].ts }
-
-// Swap provides swap implemenation for UrlFetchQueue
-func (q UrlFetchQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
-
-// Push provides push implemenation for UrlFetchQueue
-func (q *UrlFetchQueue) Push(x interface{}) {
-	item := x.(*UrlRequest)
-	*q = append(*q, item)
-}
-
-// Pop provides Pop implemenation for UrlFetchQueue
-func (q *UrlFetchQueue) Pop() interface{} {
-	old := *q
-	n := len(old)
-	item := old[n-1]
-	*q = old[0 : n-1]
-	return item
+	ctx    FetchContext
 }
 
 var (
 	// UrlQueueSize keeps track of running URL requests
 	UrlQueueSize int32
-	// UrlQueueLimit knows how many URL requests we can handle at a time, 0 means no limit
+	// UrlQueueLimit knows how many URL requests we can handle at a time, 0 means no limit,
+	// it should be changed via atomic.StoreInt32 once URLFetchWorker is running
 	UrlQueueLimit int32
 	// UrlRetry knows  how many times we'll retry given url call
 	UrlRetry int
@@ -279,38 +263,34 @@ var (
 	UrlRequestChannel = make(chan UrlRequest)
 )
 
+// guard of URLFetchWorker start
+var initOnce sync.Once
+
+// Init starts URLFetchWorker, subsequent calls are no-op
 func Init() {
-	if WEBSERVER > 0 {
-		log.Println("DAS URLFetchWorker")
-	}
-	go URLFetchWorker(UrlRequestChannel)
+	initOnce.Do(func() {
+		if WEBSERVER > 0 {
+			Logger.Info("start DAS URLFetchWorker")
+		}
+		go URLFetchWorker(UrlRequestChannel)
+	})
 }
 
 // URLFetchWorker has three channels: in channel for incoming requests
 // (in a form of URL strings), out channel for outgoing responses in a form of
 // ResponseType structure and quit channel
 func URLFetchWorker(in <-chan UrlRequest) {
-	urlRequests := &UrlFetchQueue{}
-	heap.Init(urlRequests)
-	//     log.Println("URLFetchWorker queue size", UrlQueueSize, "queue limit", UrlQueueLimit)
 	// loop forever to accept url requests
-	// a given request will be placed in internal Queue and we'll process it
-	// only in a limited queueSize. Every request is processed via fetch
-	// function which will decrement queueSize once it's done with request.
+	// a given request will be placed in the queue of its upstream system and
+	// we'll process it only within global UrlQueueLimit and system limits,
+	// see fetchScheduler for details
 	for {
 		select {
 		case request := <-in:
-			// put new request to urlRequests queue and increment queueSize
-			heap.Push(urlRequests, &request)
-			//             log.Println("URLFetchWorker push new request", request, "queue size", urlRequests.Len())
+			scheduler.push(&request)
 		default:
 			time.Sleep(time.Duration(10) * time.Millisecond)
-			if urlRequests.Len() > 0 && UrlQueueSize < UrlQueueLimit {
-				r := heap.Pop(urlRequests)
-				request := r.(*UrlRequest)
-				//                 log.Println("URLFetchWorker process request", request, "queue size", urlRequests.Len(), "current", UrlQueueSize)
-				go fetch(request.client, request.rurl, request.args, request.out)
-			}
+			scheduler.dispatch()
 		}
 	}
 }
@@ -320,14 +300,26 @@ func URLFetchWorker(in <-chan UrlRequest) {
 
 // FetchResponse fetches data for provided URL, args is a json dump of arguments
 func FetchResponse(httpClient *http.Client, rurl, args string) ResponseType {
+	return fetchResponse(httpClient, rurl, args, FetchContext{})
+}
+
+// helper function to fetch data for provided URL, if ctx.Stream is set
+// successful response body is not read but passed to the caller as
+// ResponseType.Body
+func fetchResponse(httpClient *http.Client, rurl, args string, ctx FetchContext) (response ResponseType) {
 	startTime := time.Now()
+	span := StartSpan(ctx.Span, "FetchResponse")
+	defer func() {
+		observeUpstream(ctx, startTime, response)
+		ctx.Debug.AddCall(ctx, args, startTime, response)
+		endFetchSpan(span, ctx, response)
+	}()
 	// increment UrlQueueSize since we'll process request
 	atomic.AddInt32(&UrlQueueSize, 1)
 	defer atomic.AddInt32(&UrlQueueSize, -1) // decrement UrlQueueSize since we done with this request
 	if VERBOSE > 1 {
-		log.Printf("http request, UrlQueueSize %v, UrlQueueLimit %v\n", UrlQueueSize, UrlQueueLimit)
+		ctx.Logger().Debug("http request", "url", rurl, "queue_size", atomic.LoadInt32(&UrlQueueSize), "queue_limit", atomic.LoadInt32(&UrlQueueLimit))
 	}
-	var response ResponseType
 	if strings.Contains(rurl, "#") {
 		rurl = strings.Replace(rurl, "#", "%23", -1)
 	}
@@ -336,11 +328,18 @@ func FetchResponse(httpClient *http.Client, rurl, args string) ResponseType {
 		response.Error = errors.New("Invalid URL")
 		return response
 	}
+	if FetchMode == FetchReplay {
+		method := "GET"
+		if len(args) > 0 {
+			method = "POST"
+		}
+		return replayFixture(method, rurl, args)
+	}
 	if UseDNSCache {
 		if DNSCacheMgr == nil {
 			DNSCacheMgr = dcr.NewDNSManager(300) // 300 seconds TTL
 			if VERBOSE > 1 {
-				log.Printf("init DNSCacheMgr %+v\n", DNSCacheMgr)
+				ctx.Logger().Debug("init DNSCacheMgr", "manager", fmt.Sprintf("%+v", DNSCacheMgr))
 			}
 		}
 		if strings.Contains(rurl, "cmsweb") || strings.Contains(rurl, "cms-rucio.cern.ch") {
@@ -364,6 +363,9 @@ func FetchResponse(httpClient *http.Client, rurl, args string) ResponseType {
 		atomic.AddUint64(&TotalGetCalls, 1)
 		response.Method = "GET"
 	}
+	if ctx.Context != nil {
+		req = req.WithContext(ctx.Context)
+	}
 	if KEEP_ALIVE {
 		req.Header.Add("Connection", "Keep-Alive")
 		req.Header.Add("Keep-Alive", "timeout=5, max=1000")
@@ -372,19 +374,16 @@ func FetchResponse(httpClient *http.Client, rurl, args string) ResponseType {
 	if strings.Contains(rurl, "dbs") {
 		req.Header.Add("Accept-Encoding", "gzip")
 	}
-	if Token != "" {
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", readToken(Token)))
+	// propagate trace context and request id to upstream system
+	span.Inject(req)
+	// add credentials of upstream system
+	provider := authProvider(rurl)
+	if err := provider.Authorize(req); err != nil {
+		ctx.Logger().Error("unable to authorize upstream request", "url", rurl, "provider", provider.Name(), "error", err)
 	}
-	if strings.Contains(rurl, "rucio") { // we need to fetch auth token
-		token, err := RucioAuth.Token()
-		if err == nil {
-			req.Header.Add("X-Rucio-Auth-Token", token)
-		}
+	if strings.Contains(rurl, "rucio") {
 		req.Header.Add("Accept", "application/x-json-stream")
 		req.Header.Add("Connection", "Keep-Alive")
-		if WEBSERVER > 0 {
-			req.Header.Add("X-Rucio-Account", RucioAuth.Account())
-		}
 	}
 	if CLIENT_VERSION != "" {
 		req.Header.Set("User-Agent", fmt.Sprintf("dasgoclient/%s", CLIENT_VERSION))
@@ -393,7 +392,22 @@ func FetchResponse(httpClient *http.Client, rurl, args string) ResponseType {
 	}
 	if VERBOSE > 2 {
 		dump, err := httputil.DumpRequestOut(req, true)
-		log.Printf("http request %+v, rurl %v, dump %v, error %v\n", req, rurl, string(dump), err)
+		ctx.Logger().Debug("http request", "method", req.Method, "url", rurl, "dump", RedactDump(dump), "error", err)
+	}
+	// use conditional request if we have cached response for this url
+	var cached *CachedResponse
+	var ckey string
+	if ResponseCache != nil && response.Method == "GET" {
+		ckey = CacheKey(response.Url, args)
+		if c, ok := ResponseCache.Get(ckey); ok {
+			cached = c
+			if c.ETag != "" {
+				req.Header.Set("If-None-Match", c.ETag)
+			}
+			if c.LastModified != "" {
+				req.Header.Set("If-Modified-Since", c.LastModified)
+			}
+		}
 	}
 	if httpClient == nil {
 		httpClient = HttpClient()
@@ -401,29 +415,48 @@ func FetchResponse(httpClient *http.Client, rurl, args string) ResponseType {
 	client := httpClient
 	//     client := HttpClient()
 	resp, err := client.Do(req)
+	if err == nil {
+		// renew expired or revoked credentials and retry the request once
+		resp, err = retryUnauthorized(client, req, resp, provider, ctx)
+	}
 	if err != nil {
 		response.Error = err
 		return response
 	}
-	defer resp.Body.Close()
+	streamed := false
+	defer func() {
+		if !streamed {
+			resp.Body.Close()
+		}
+	}()
+	response.StatusCode = resp.StatusCode
+	response.Header = resp.Header
 	if VERBOSE > 2 {
 		if resp != nil {
 			dump, err := httputil.DumpResponse(resp, true)
-			log.Printf("http response rurl %v, dump %v, error %v\n", rurl, string(dump), err)
+			ctx.Logger().Debug("http response", "url", rurl, "dump", RedactDump(dump), "error", err)
 		}
 	}
-	// check if we got gzipped content
-	if resp.Header.Get("Content-Encoding") == "gzip" {
+	// pass body of successful response to the caller, responses which should
+	// be cached or recorded are read in full
+	if ctx.Stream && resp.StatusCode == http.StatusOK && FetchMode != FetchRecord && !cacheable(ckey, resp.Header) {
+		var body *streamBody
+		body, err = newStreamBody(response.Url, resp)
+		if err == nil {
+			response.Body = body
+			streamed = true
+		}
+	} else if resp.Header.Get("Content-Encoding") == "gzip" { // check if we got gzipped content
 		var gz *gzip.Reader
 		gz, err = gzip.NewReader(resp.Body)
 		if err != nil {
 			response.Data = []byte("Unable to read gzipped content")
 		} else {
 			defer gz.Close()
-			response.Data, err = ioutil.ReadAll(gz)
+			response.Data, err = io.ReadAll(gz)
 		}
 	} else {
-		response.Data, err = ioutil.ReadAll(resp.Body)
+		response.Data, err = io.ReadAll(resp.Body)
 	}
 
 	//     response.Data, err = ioutil.ReadAll(resp.Body)
@@ -431,6 +464,15 @@ func FetchResponse(httpClient *http.Client, rurl, args string) ResponseType {
 	response.RecvBytes = len(response.Data)
 	if err != nil {
 		response.Error = err
+	} else {
+		// classify upstream error responses, e.g. 403, 429 or 503
+		response.Error = httpError(response.Url, resp.StatusCode, resp.Header, response.Data)
+	}
+	if err == nil && ckey != "" {
+		cacheResponse(ckey, cached, &response)
+	}
+	if err == nil && FetchMode == FetchRecord {
+		recordFixture(response.Method, response.Url, args, response)
 	}
 	if VERBOSE > 0 {
 		if args == "" {
@@ -442,7 +484,7 @@ func FetchResponse(httpClient *http.Client, rurl, args string) ResponseType {
 					fmt.Printf("DAS GET %s %v\n", rurl, time.Now().Sub(startTime))
 				}
 			} else {
-				log.Printf("DAS GET system=%s url=\"%s\" time=%v\n", system(rurl), rurl, time.Now().Sub(startTime))
+				ctx.Logger().Debug("DAS GET", "system", system(rurl), "url", rurl, "code", response.StatusCode, "duration", time.Since(startTime))
 			}
 		} else {
 			if WEBSERVER == 0 {
@@ -453,13 +495,45 @@ func FetchResponse(httpClient *http.Client, rurl, args string) ResponseType {
 					fmt.Printf("DAS POST %s args %v, %v\n", rurl, args, time.Now().Sub(startTime))
 				}
 			} else {
-				log.Printf("DAS POST system=%s url=\"%s\" args=\"%v\" time=%v\n", system(rurl), rurl, args, time.Now().Sub(startTime))
+				ctx.Logger().Debug("DAS POST", "system", system(rurl), "url", rurl, "args", args, "code", response.StatusCode, "duration", time.Since(startTime))
 			}
 		}
 	}
 	return response
 }
 
+// helper function to serve 304 Not Modified response from cache or store
+// cacheable response in cache. Miss is counted only for responses which
+// could be served from cache, i.e. conditional request was sent or response
+// is cacheable.
+func cacheResponse(key string, cached *CachedResponse, response *ResponseType) {
+	if response.StatusCode == http.StatusNotModified && cached != nil {
+		ResponseCache.Hit()
+		response.Data = cached.Data
+		return
+	}
+	if response.StatusCode != http.StatusOK {
+		return
+	}
+	if !cacheable(key, response.Header) {
+		if cached != nil {
+			ResponseCache.Miss()
+		}
+		return
+	}
+	ResponseCache.Miss()
+	etag := response.Header.Get("ETag")
+	modified := response.Header.Get("Last-Modified")
+	c := &CachedResponse{Url: response.Url, ETag: etag, LastModified: modified, Data: response.Data}
+	ResponseCache.Put(key, c)
+}
+
+// helper function to check if response with given headers will be stored
+// in HTTP cache under given key
+func cacheable(key string, header http.Header) bool {
+	return key != "" && (header.Get("ETag") != "" || header.Get("Last-Modified") != "")
+}
+
 // helper function to extract cmsweb system
 func system(rurl string) string {
 	if strings.Contains(rurl, "dbs") {
@@ -478,51 +552,84 @@ func system(rurl string) string {
 		return "runregistry"
 	} else if strings.Contains(rurl, "dashboard") {
 		return "dashboard"
+	} else if strings.Contains(rurl, "cric") {
+		return "cric"
 	}
 	return "combined"
 }
 
 // Fetch data for provided URL and redirect results to given channel
-// This wrapper function look-up UrlQueueLimit and either redirect to
-// URULFetchWorker go-routine or pass the call to local fetch function
+// This wrapper function look-up UrlQueueLimit and SystemLimits and either
+// redirect to URLFetchWorker go-routine or pass the call to local fetch function
 func Fetch(httpClient *http.Client, rurl string, args string, out chan<- ResponseType) {
-	if UrlQueueLimit > 0 {
-		request := UrlRequest{rurl: rurl, args: args, out: out, ts: time.Now().Unix(), client: httpClient}
+	FetchWithContext(FetchContext{}, httpClient, rurl, args, out)
+}
+
+// FetchWithContext is the same as Fetch but provides query and user of the
+// request for fair scheduling in URLFetchWorker
+func FetchWithContext(ctx FetchContext, httpClient *http.Client, rurl string, args string, out chan<- ResponseType) {
+	if atomic.LoadInt32(&UrlQueueLimit) > 0 || len(SystemLimits) > 0 {
+		request := UrlRequest{rurl: rurl, args: args, out: out, ts: time.Now().Unix(), client: httpClient, ctx: ctx}
 		UrlRequestChannel <- request
 	} else {
-		fetch(httpClient, rurl, args, out)
+		fetch(httpClient, rurl, args, ctx, out)
 	}
 }
 
+// helper function to check if given response indicates upstream failure,
+// i.e. transport error or retryable HTTP error, while auth, not-found and
+// other client errors mean that upstream system is alive
+func upstreamFailure(resp ResponseType) error {
+	if ErrorClass(resp.Error) == ErrorRetryable {
+		return resp.Error
+	}
+	return nil
+}
+
+// helper function to fetch given url/args and record its outcome in circuit
+// breaker of upstream system
+func breakerFetch(breaker *CircuitBreaker, httpClient *http.Client, rurl, args string, ctx FetchContext) ResponseType {
+	if err := breaker.Allow(ctx.Logger()); err != nil {
+		return ResponseType{Url: rurl, Error: err}
+	}
+	return failoverFetch(breaker, httpClient, rurl, args, ctx)
+}
+
 // local function which fetch response for given url/args and place it into response channel
 // By defat
-func fetch(httpClient *http.Client, rurl string, args string, ch chan<- ResponseType) {
+func fetch(httpClient *http.Client, rurl string, args string, ctx FetchContext, ch chan<- ResponseType) {
 	var resp ResponseType
-	resp = FetchResponse(httpClient, rurl, args)
+	breaker := GetBreaker(system(rurl))
+	resp = breakerFetch(breaker, httpClient, rurl, args, ctx)
 	if resp.Error == nil {
-		ch <- resp
+		deliver(resp, ch)
 		return
 	}
 	if VERBOSE > 0 {
 		if WEBSERVER == 1 {
-			log.Printf("fail to fetch data %s, error %v\n", rurl, resp.Error)
+			ctx.Logger().Debug("fail to fetch data", "system", system(rurl), "url", rurl, "error", resp.Error)
 		} else {
 			fmt.Printf("fail to fetch data %s, error %v\n", rurl, resp.Error)
 		}
 	}
 	for i := 1; i <= UrlRetry; i++ {
-		sleep := time.Duration(i) * time.Second
+		// retry only retryable errors and do not wait when upstream system
+		// is known to be down
+		sleep, retry := RetryDelay(i, resp.Error)
+		if !retry || breaker.IsOpen() {
+			break
+		}
 		time.Sleep(sleep)
-		resp = FetchResponse(httpClient, rurl, args)
+		resp = breakerFetch(breaker, httpClient, rurl, args, ctx)
 		if resp.Error == nil {
-			ch <- resp
+			deliver(resp, ch)
 			return
 		}
 	}
 	if resp.Error != nil {
 		if VERBOSE > 0 {
 			if WEBSERVER == 1 {
-				log.Printf("ERROR: fail to fetch %s, retries %v, error %v\n", rurl, UrlRetry, resp.Error)
+				ctx.Logger().Error("fail to fetch data", "system", system(rurl), "url", rurl, "retries", UrlRetry, "error", resp.Error)
 			} else {
 				fmt.Printf("ERROR: fail to fetch %s, retries %v, error %v\n", rurl, UrlRetry, resp.Error)
 			}
@@ -537,7 +644,7 @@ func validateUrl(rurl string) bool {
 		if PatternUrl.MatchString(rurl) {
 			return true
 		}
-		log.Println("ERROR, invalid URL", rurl)
+		Logger.Error("invalid URL", "url", rurl)
 	}
 	return false
 }
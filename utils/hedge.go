@@ -0,0 +1,231 @@
+package utils
+
+// DAS request hedging module
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+// Tail latency of DAS queries is dominated by rare slow upstream calls. When
+// hedging is enabled (HedgeBudget > 0) and GET request to upstream system is
+// not answered within p95 latency of recent requests to this system, a
+// duplicate request is sent to the same or alternate endpoint (see Endpoints)
+// and the first successful answer is used, the slower request is cancelled.
+// Number of hedged requests never exceeds HedgeBudget fraction of requests
+// to the system.
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HedgeBudget defines max fraction of upstream GET requests which can be
+// hedged, e.g. 0.05, zero disables hedging
+var HedgeBudget float64
+
+// HedgeWindow defines number of recent requests used to learn p95 latency
+var HedgeWindow = 200
+
+// HedgeMinSamples defines min number of requests to learn p95 latency of the
+// system before we start hedging its requests
+var HedgeMinSamples = 20
+
+// hedgeStats holds latency and hedging statistics of upstream system
+type hedgeStats struct {
+	latencies []time.Duration // ring buffer of recent latencies
+	next      int             // next position in ring buffer
+	requests  int64           // number of requests
+	hedged    int64           // number of hedged requests
+	wins      int64           // number of hedged requests which answered first
+}
+
+// HedgeInfo represents hedging statistics of upstream system
+type HedgeInfo struct {
+	System   string `json:"system"`
+	P95      string `json:"p95"`
+	Samples  int    `json:"samples"`
+	Requests int64  `json:"requests"`
+	Hedged   int64  `json:"hedged"`
+	Wins     int64  `json:"wins"`
+}
+
+// hedgeResult represents response of primary or hedged request
+type hedgeResult struct {
+	resp   ResponseType
+	hedged bool
+}
+
+// global registry of hedging statistics
+var hedges = make(map[string]*hedgeStats)
+var hedgesMutex sync.Mutex
+
+// helper function to get stats of given system, must be called under lock
+func hedgeStatsOf(name string) *hedgeStats {
+	s, ok := hedges[name]
+	if !ok {
+		s = &hedgeStats{}
+		hedges[name] = s
+	}
+	return s
+}
+
+// helper function to compute p95 of recorded latencies
+func (s *hedgeStats) p95() time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	values := make([]time.Duration, len(s.latencies))
+	copy(values, s.latencies)
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return values[(len(values)*95)/100]
+}
+
+// helper function to record latency of successful request of given system
+func recordLatency(name string, latency time.Duration) {
+	hedgesMutex.Lock()
+	defer hedgesMutex.Unlock()
+	s := hedgeStatsOf(name)
+	if len(s.latencies) < HedgeWindow {
+		s.latencies = append(s.latencies, latency)
+	} else {
+		s.latencies[s.next%len(s.latencies)] = latency
+	}
+	s.next++
+}
+
+// helper function to count request of given system, it returns hedging
+// delay, i.e. p95 latency, and false if system does not have enough samples
+func hedgeDelay(name string) (time.Duration, bool) {
+	hedgesMutex.Lock()
+	defer hedgesMutex.Unlock()
+	s := hedgeStatsOf(name)
+	s.requests++
+	if len(s.latencies) < HedgeMinSamples {
+		return 0, false
+	}
+	return s.p95(), true
+}
+
+// helper function to check hedging budget of given system, it reserves
+// hedged request if budget allows it
+func hedgeAllowed(name string) bool {
+	hedgesMutex.Lock()
+	defer hedgesMutex.Unlock()
+	s := hedgeStatsOf(name)
+	if float64(s.hedged+1) > HedgeBudget*float64(s.requests) {
+		return false
+	}
+	s.hedged++
+	return true
+}
+
+// helper function to count hedged request which answered first
+func hedgeWin(name string) {
+	hedgesMutex.Lock()
+	defer hedgesMutex.Unlock()
+	hedgeStatsOf(name).wins++
+}
+
+// helper function to release context of given response, context of streamed
+// response is cancelled when consumer closes its body
+func releaseContext(resp ResponseType, cancel context.CancelFunc) {
+	if body, ok := resp.Body.(*streamBody); ok {
+		go func() {
+			<-body.done
+			cancel()
+		}()
+		return
+	}
+	cancel()
+}
+
+// helper function to fetch given url, if the request is slow a duplicate
+// request is sent to hedge url and the first successful answer is returned
+// along with flag which tells if the answer came from hedge url
+func hedgedFetch(httpClient *http.Client, rurl, hedgeUrl, args string, ctx FetchContext) (ResponseType, bool) {
+	name := system(rurl)
+	if HedgeBudget <= 0 || args != "" || FetchMode == FetchReplay {
+		return fetchResponse(httpClient, rurl, args, ctx), false
+	}
+	delay, ok := hedgeDelay(name)
+	if !ok {
+		resp := fetchResponse(httpClient, rurl, args, ctx)
+		if resp.Error == nil {
+			recordLatency(name, resp.Time)
+		}
+		return resp, false
+	}
+	// every request has its own context, therefore the slower one can be
+	// cancelled as soon as we have an answer
+	parent := ctx.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	cancels := make(map[bool]context.CancelFunc)
+	pctx := ctx
+	pctx.Context, cancels[false] = context.WithCancel(parent)
+	results := make(chan hedgeResult, 2)
+	go func() {
+		results <- hedgeResult{resp: fetchResponse(httpClient, rurl, args, pctx)}
+	}()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var res hedgeResult
+	select {
+	case res = <-results:
+	case <-timer.C:
+		if !hedgeAllowed(name) {
+			res = <-results
+			break
+		}
+		hctx := ctx
+		hctx.Hedge = true
+		hctx.Context, cancels[true] = context.WithCancel(parent)
+		go func() {
+			results <- hedgeResult{resp: fetchResponse(httpClient, hedgeUrl, args, hctx), hedged: true}
+		}()
+		// take the first successful answer, otherwise wait for the other one
+		res = <-results
+		if res.resp.Error != nil {
+			other := <-results
+			if other.resp.Error == nil {
+				res, other = other, res
+			}
+			other.resp.Close()
+			cancels[other.hedged]()
+		} else {
+			// cancel the slower request and release it, e.g. its streamed body
+			cancels[!res.hedged]()
+			go func() {
+				other := <-results
+				other.resp.Close()
+			}()
+		}
+		if res.hedged && res.resp.Error == nil {
+			hedgeWin(name)
+		}
+	}
+	releaseContext(res.resp, cancels[res.hedged])
+	if res.resp.Error == nil {
+		recordLatency(name, res.resp.Time)
+	}
+	return res.resp, res.hedged
+}
+
+// HedgeStatus returns hedging statistics of upstream systems
+func HedgeStatus() []HedgeInfo {
+	var out []HedgeInfo
+	if HedgeBudget <= 0 {
+		return out
+	}
+	hedgesMutex.Lock()
+	for name, s := range hedges {
+		info := HedgeInfo{System: name, Samples: len(s.latencies), Requests: s.requests, Hedged: s.hedged, Wins: s.wins}
+		info.P95 = s.p95().String()
+		out = append(out, info)
+	}
+	hedgesMutex.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].System < out[j].System })
+	return out
+}
@@ -0,0 +1,264 @@
+package utils
+
+// DAS HTTP response cache module
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+// HTTPCache keeps upstream responses which carry ETag or Last-Modified
+// headers. When the same URL is fetched again we send conditional request
+// (If-None-Match/If-Modified-Since) and, if upstream replies with 304 Not
+// Modified, we use cached response body. Responses are kept in memory up to
+// MaxMemory bytes, least recently used ones are moved to disk (if Dir is set)
+// up to MaxDisk bytes.
+
+import (
+	"container/list"
+	"crypto/md5"
+	"encoding/gob"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ResponseCache represents HTTP response cache used by FetchResponse,
+// nil value disables caching
+var ResponseCache *HTTPCache
+
+// CachedResponse represents cached upstream response
+type CachedResponse struct {
+	Url          string // request URL
+	ETag         string // ETag header of the response
+	LastModified string // Last-Modified header of the response
+	Data         []byte // response body
+}
+
+// size returns size of cached response
+func (c *CachedResponse) size() int64 {
+	return int64(len(c.Data) + len(c.Url) + len(c.ETag) + len(c.LastModified))
+}
+
+// cacheItem represents element of LRU lists
+type cacheItem struct {
+	key  string
+	size int64
+	resp *CachedResponse // nil for items stored on disk
+}
+
+// HTTPCache represents HTTP response cache with memory and disk bounds
+type HTTPCache struct {
+	MaxMemory int64  // max size of responses kept in memory
+	MaxDisk   int64  // max size of responses kept on disk
+	Dir       string // directory to store responses, empty disables disk cache
+
+	memory     *list.List               // LRU list of in-memory items
+	disk       *list.List               // LRU list of on-disk items
+	items      map[string]*list.Element // all items
+	memorySize int64
+	diskSize   int64
+	mutex      sync.Mutex
+
+	hits      uint64 // number of 304 responses served from cache
+	misses    uint64 // number of full responses for cacheable requests
+	evictions uint64 // number of responses removed from cache
+}
+
+// HTTPCacheStats represents HTTP cache counters
+type HTTPCacheStats struct {
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Evictions   uint64 `json:"evictions"`
+	Entries     int    `json:"entries"`
+	MemoryBytes int64  `json:"memory_bytes"`
+	DiskBytes   int64  `json:"disk_bytes"`
+}
+
+// NewHTTPCache creates new HTTP cache, responses stored in given directory
+// by previous server runs are re-used
+func NewHTTPCache(maxMemory, maxDisk int64, dir string) *HTTPCache {
+	c := &HTTPCache{MaxMemory: maxMemory, MaxDisk: maxDisk, Dir: dir}
+	c.memory = list.New()
+	c.disk = list.New()
+	c.items = make(map[string]*list.Element)
+	if dir == "" {
+		return c
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("ERROR: unable to create HTTP cache area %s, error %v\n", dir, err)
+		c.Dir = ""
+		return c
+	}
+	// index existing files, oldest first
+	files, _ := filepath.Glob(filepath.Join(dir, "*.cache"))
+	var infos []os.FileInfo
+	for _, fname := range files {
+		if info, err := os.Stat(fname); err == nil {
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	for _, info := range infos {
+		key := strings.TrimSuffix(info.Name(), ".cache")
+		item := &cacheItem{key: key, size: info.Size()}
+		c.items[key] = c.disk.PushFront(item)
+		c.diskSize += item.size
+	}
+	c.shrink()
+	return c
+}
+
+// CacheKey returns cache key for given URL and request arguments
+func CacheKey(rurl, args string) string {
+	sum := md5.Sum([]byte(rurl + "\n" + args))
+	return hex.EncodeToString(sum[:])
+}
+
+// helper function to get file name of disk item
+func (c *HTTPCache) fileName(key string) string {
+	return filepath.Join(c.Dir, key+".cache")
+}
+
+// Get returns cached response for given key
+func (c *HTTPCache) Get(key string) (*CachedResponse, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := elem.Value.(*cacheItem)
+	if item.resp != nil {
+		c.memory.MoveToFront(elem)
+		return item.resp, true
+	}
+	// item is on disk, load it and promote to memory
+	resp, err := c.readFile(key)
+	c.remove(elem)
+	if err != nil {
+		log.Printf("ERROR: unable to read HTTP cache file %s, error %v\n", c.fileName(key), err)
+		return nil, false
+	}
+	c.add(key, resp)
+	return resp, true
+}
+
+// Put stores given response in cache
+func (c *HTTPCache) Put(key string, resp *CachedResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.remove(elem)
+	}
+	c.add(key, resp)
+}
+
+// Hit increments number of cache hits
+func (c *HTTPCache) Hit() {
+	atomic.AddUint64(&c.hits, 1)
+}
+
+// Miss increments number of cache misses
+func (c *HTTPCache) Miss() {
+	atomic.AddUint64(&c.misses, 1)
+}
+
+// Stats returns HTTP cache counters
+func (c *HTTPCache) Stats() HTTPCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return HTTPCacheStats{
+		Hits:        atomic.LoadUint64(&c.hits),
+		Misses:      atomic.LoadUint64(&c.misses),
+		Evictions:   atomic.LoadUint64(&c.evictions),
+		Entries:     len(c.items),
+		MemoryBytes: c.memorySize,
+		DiskBytes:   c.diskSize,
+	}
+}
+
+// helper function to add response to memory, must be called under lock
+func (c *HTTPCache) add(key string, resp *CachedResponse) {
+	item := &cacheItem{key: key, size: resp.size(), resp: resp}
+	c.items[key] = c.memory.PushFront(item)
+	c.memorySize += item.size
+	c.shrink()
+}
+
+// helper function to remove item from cache, must be called under lock
+func (c *HTTPCache) remove(elem *list.Element) {
+	item := elem.Value.(*cacheItem)
+	if item.resp != nil {
+		c.memory.Remove(elem)
+		c.memorySize -= item.size
+	} else {
+		c.disk.Remove(elem)
+		c.diskSize -= item.size
+		os.Remove(c.fileName(item.key))
+	}
+	delete(c.items, item.key)
+}
+
+// helper function to keep cache within its bounds, least recently used
+// in-memory items are moved to disk and least recently used disk items are
+// removed, must be called under lock
+func (c *HTTPCache) shrink() {
+	for c.memorySize > c.MaxMemory && c.memory.Len() > 0 {
+		elem := c.memory.Back()
+		item := elem.Value.(*cacheItem)
+		c.memory.Remove(elem)
+		c.memorySize -= item.size
+		delete(c.items, item.key)
+		if c.Dir == "" || item.size > c.MaxDisk {
+			atomic.AddUint64(&c.evictions, 1)
+			continue
+		}
+		size, err := c.writeFile(item.key, item.resp)
+		if err != nil {
+			log.Printf("ERROR: unable to write HTTP cache file %s, error %v\n", c.fileName(item.key), err)
+			atomic.AddUint64(&c.evictions, 1)
+			continue
+		}
+		ditem := &cacheItem{key: item.key, size: size}
+		c.items[item.key] = c.disk.PushFront(ditem)
+		c.diskSize += size
+	}
+	for c.diskSize > c.MaxDisk && c.disk.Len() > 0 {
+		c.remove(c.disk.Back())
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
+// helper function to write cached response to disk
+func (c *HTTPCache) writeFile(key string, resp *CachedResponse) (int64, error) {
+	fname := c.fileName(key)
+	file, err := os.Create(fname)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if err := gob.NewEncoder(file).Encode(resp); err != nil {
+		os.Remove(fname)
+		return 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// helper function to read cached response from disk
+func (c *HTTPCache) readFile(key string) (*CachedResponse, error) {
+	file, err := os.Open(c.fileName(key))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var resp CachedResponse
+	err = gob.NewDecoder(file).Decode(&resp)
+	return &resp, err
+}
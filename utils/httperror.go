@@ -0,0 +1,147 @@
+package utils
+
+// DAS upstream HTTP errors module
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// classes of upstream errors
+const (
+	ErrorRetryable   = "retryable"   // transient error, request can be retried
+	ErrorFatal       = "fatal"       // request will not succeed if retried
+	ErrorAuth        = "auth"        // authentication or authorization failure
+	ErrorNotFound    = "not-found"   // requested resource does not exist
+	ErrorUnavailable = "unavailable" // request is rejected by circuit breaker
+)
+
+// BackoffBase defines initial interval of exponential backoff between retries
+var BackoffBase = time.Second
+
+// BackoffMax defines maximum interval between retries, it also limits
+// Retry-After intervals we are willing to wait
+var BackoffMax = 30 * time.Second
+
+// HTTPError represents upstream HTTP error response
+type HTTPError struct {
+	Url        string        // request URL
+	StatusCode int           // HTTP status code
+	Class      string        // error class
+	RetryAfter time.Duration // Retry-After interval provided by upstream
+	Body       string        // beginning of response body
+}
+
+// Error implements error interface
+func (e *HTTPError) Error() string {
+	msg := fmt.Sprintf("HTTP %d %s from %s", e.StatusCode, http.StatusText(e.StatusCode), e.Url)
+	if e.Body != "" {
+		msg = fmt.Sprintf("%s: %s", msg, e.Body)
+	}
+	return msg
+}
+
+// StatusClass classifies given HTTP status code
+func StatusClass(code int) string {
+	switch code {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrorAuth
+	case http.StatusNotFound, http.StatusGone:
+		return ErrorNotFound
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return ErrorRetryable
+	}
+	if code >= 500 && code != http.StatusNotImplemented && code != http.StatusHTTPVersionNotSupported {
+		return ErrorRetryable
+	}
+	return ErrorFatal
+}
+
+// ErrorClass returns class of given fetch error, transport errors are
+// considered retryable
+func ErrorClass(err error) string {
+	if err == nil {
+		return ""
+	}
+	var herr *HTTPError
+	if errors.As(err, &herr) {
+		return herr.Class
+	}
+	var berr *BreakerError
+	if errors.As(err, &berr) {
+		return ErrorUnavailable
+	}
+	var ferr *FixtureError
+	if errors.As(err, &ferr) {
+		return ErrorFatal
+	}
+	if err.Error() == "Invalid URL" {
+		return ErrorFatal
+	}
+	return ErrorRetryable
+}
+
+// helper function to create HTTPError for given response, it returns nil
+// for successful responses
+func httpError(rurl string, code int, header http.Header, body []byte) error {
+	if code < 400 {
+		return nil
+	}
+	herr := &HTTPError{Url: rurl, StatusCode: code, Class: StatusClass(code)}
+	herr.RetryAfter = retryAfter(header.Get("Retry-After"))
+	msg := strings.TrimSpace(string(body))
+	if len(msg) > 256 {
+		msg = msg[:256] + "..."
+	}
+	herr.Body = msg
+	return herr
+}
+
+// helper function to parse Retry-After header value, either number of
+// seconds or HTTP date
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(value); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// RetryDelay returns delay before given retry attempt (starting from 1) for
+// given error. It uses exponential backoff with jitter or Retry-After
+// interval provided by upstream. It returns false if request should not be
+// retried.
+func RetryDelay(attempt int, err error) (time.Duration, bool) {
+	if ErrorClass(err) != ErrorRetryable {
+		return 0, false
+	}
+	var herr *HTTPError
+	if errors.As(err, &herr) && herr.RetryAfter > 0 {
+		if herr.RetryAfter > BackoffMax {
+			return 0, false
+		}
+		return herr.RetryAfter, true
+	}
+	delay := BackoffBase << uint(attempt-1)
+	if delay <= 0 || delay > BackoffMax {
+		delay = BackoffMax
+	}
+	// add up to 50% of jitter to spread retries of concurrent requests
+	delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+	return delay, true
+}
@@ -0,0 +1,147 @@
+package utils
+
+// DAS logger module
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+// DAS server logs structured records (log/slog) in text or JSON format.
+// Records emitted while processing a DAS query carry its qhash, user DN and
+// client IP, therefore the whole lifecycle of a query can be extracted from
+// logs, e.g. jq 'select(.qhash=="<pid>")' das.log
+// Lines written via standard log package are passed to structured logger,
+// lines starting with ERROR or WARNING get corresponding levels.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LogFormat defines format of DAS server logs: text or json
+var LogFormat = "text"
+
+// Logger represents structured logger of DAS server
+var Logger = slog.New(newLogHandler(os.Stderr, "text"))
+
+// LogLevel defines minimum level of log records, it is independent of
+// VERBOSE level which controls amount of details DAS collects
+var LogLevel = new(slog.LevelVar)
+
+// SetLogLevel sets minimum level of log records: debug, info (default),
+// warn or error
+func SetLogLevel(level string) error {
+	if level == "" {
+		level = "info"
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unsupported log level %s, should be debug, info, warn or error", level)
+	}
+	LogLevel.Set(l)
+	return nil
+}
+
+// helper function to shorten source of log records to file:line, similar
+// to log.Lshortfile flag
+func replaceLogAttr(groups []string, a slog.Attr) slog.Attr {
+	if src, ok := a.Value.Any().(*slog.Source); ok && len(groups) == 0 {
+		if src.File == "" {
+			return slog.Attr{}
+		}
+		return slog.String(a.Key, fmt.Sprintf("%s:%d", filepath.Base(src.File), src.Line))
+	}
+	return a
+}
+
+// helper function to create log handler of given format, it returns nil
+// for unsupported format
+func newLogHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{AddSource: true, Level: LogLevel, ReplaceAttr: replaceLogAttr}
+	switch format {
+	case "", "text":
+		return slog.NewTextHandler(w, opts)
+	case "json":
+		return slog.NewJSONHandler(w, opts)
+	}
+	return nil
+}
+
+// InitLogger initializes structured logger with given output and format
+func InitLogger(w io.Writer, format string) error {
+	handler := newLogHandler(w, format)
+	if handler == nil {
+		return fmt.Errorf("unsupported log format %s, should be text or json", format)
+	}
+	LogFormat = format
+	Logger = slog.New(handler)
+	slog.SetDefault(Logger)
+	// pass lines of standard logger to structured logger, the source of
+	// the line is provided by log.Lshortfile flag
+	log.SetFlags(log.Lshortfile)
+	log.SetOutput(logWriter{})
+	return nil
+}
+
+// logWriter passes lines of standard logger to structured logger
+type logWriter struct{}
+
+// Write implements io.Writer interface
+func (w logWriter) Write(data []byte) (int, error) {
+	msg := strings.TrimSpace(string(data))
+	source := ""
+	if idx := strings.Index(msg, ": "); idx > 0 && strings.Contains(msg[:idx], ".go:") {
+		source = msg[:idx]
+		msg = msg[idx+2:]
+	}
+	level := slog.LevelInfo
+	if strings.HasPrefix(msg, "ERROR") {
+		level = slog.LevelError
+	} else if strings.HasPrefix(msg, "WARNING") {
+		level = slog.LevelWarn
+	}
+	ctx := context.Background()
+	handler := Logger.Handler()
+	if !handler.Enabled(ctx, level) {
+		return len(data), nil
+	}
+	r := slog.NewRecord(time.Now(), level, msg, 0)
+	if source != "" {
+		r.AddAttrs(slog.String(slog.SourceKey, source))
+	}
+	return len(data), handler.Handle(ctx, r)
+}
+
+// QueryLogger returns logger whose records carry given DAS query hash, user
+// and client IP, empty values are omitted
+func QueryLogger(qhash, user, client string) *slog.Logger {
+	var attrs []any
+	if qhash != "" {
+		attrs = append(attrs, "qhash", qhash)
+	}
+	if user != "" {
+		attrs = append(attrs, "user", user)
+	}
+	if client != "" {
+		attrs = append(attrs, "client", client)
+	}
+	return Logger.With(attrs...)
+}
+
+// Logger returns logger of upstream request whose records carry fields of
+// DAS query, trace and request ids and urn of the request
+func (c FetchContext) Logger() *slog.Logger {
+	logger := QueryLogger(c.Qhash, c.User, c.Client)
+	if c.Span != nil {
+		logger = logger.With("trace", c.Span.TraceID, "request_id", c.Span.RequestID)
+	}
+	if c.Urn != "" {
+		logger = logger.With("urn", c.Urn)
+	}
+	return logger
+}
@@ -0,0 +1,227 @@
+package utils
+
+// DAS metrics module
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+// Counters and histograms of DAS server are kept in memory and exposed in
+// Prometheus text format, see
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+// Metrics are identified by name and label pairs, e.g.
+// AddCounter("das_upstream_requests_total", 1, "system", "dbs", "code", "200")
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricBuckets defines upper bounds of latency histograms in seconds
+var MetricBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// histogram represents cumulative histogram of observed values
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// metricFamily represents metric with its samples keyed by labels
+type metricFamily struct {
+	help       string
+	kind       string // counter or histogram
+	counters   map[string]float64
+	histograms map[string]*histogram
+}
+
+// MetricSample represents single sample of metric computed at scrape time,
+// labels are pairs of label names and values
+type MetricSample struct {
+	Labels []string
+	Value  float64
+}
+
+// global registry of metrics
+var metrics = make(map[string]*metricFamily)
+var metricsMutex sync.Mutex
+
+// help of metrics provided by DAS server
+var metricHelp = map[string]string{
+	"das_http_requests_total":                "Number of DAS server requests by path, method and status code",
+	"das_http_request_duration_seconds":      "Latency of DAS server requests by path and status code",
+	"das_upstream_requests_total":            "Number of upstream requests by system, urn and status code",
+	"das_upstream_request_duration_seconds":  "Latency of upstream requests (time to response headers of streamed responses) by system and urn",
+	"das_upstream_sent_bytes_total":          "Bytes sent to upstream systems by system and urn",
+	"das_upstream_received_bytes_total":      "Bytes received from upstream systems by system and urn",
+	"das_upstream_errors_total":              "Number of failed upstream requests by system, urn and error class",
+	"das_mongo_operation_duration_seconds":   "Latency of MongoDB operations by operation and collection",
+	"das_mongo_errors_total":                 "Number of failed MongoDB operations by operation and collection",
+	"das_query_cache_requests_total":         "Number of DAS queries by DAS cache result: hit, processing or miss",
+	"das_rucio_token_refresh_failures_total": "Number of failed Rucio token refreshes",
+}
+
+// helper function to render label pairs, e.g. system="dbs",urn="datasets"
+func metricLabels(pairs ...string) string {
+	var out []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		out = append(out, fmt.Sprintf("%s=\"%s\"", pairs[i], value))
+	}
+	return strings.Join(out, ",")
+}
+
+// helper function to get metric family of given name and kind, must be
+// called under lock
+func metricFamilyOf(name, kind string) *metricFamily {
+	m, ok := metrics[name]
+	if !ok {
+		m = &metricFamily{help: metricHelp[name], kind: kind, counters: make(map[string]float64), histograms: make(map[string]*histogram)}
+		metrics[name] = m
+	}
+	return m
+}
+
+// AddCounter adds given value to counter metric, labels are pairs of label
+// names and values
+func AddCounter(name string, value float64, labels ...string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	metricFamilyOf(name, "counter").counters[metricLabels(labels...)] += value
+}
+
+// CounterValue returns value of counter metric with given labels
+func CounterValue(name string, labels ...string) float64 {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	if m, ok := metrics[name]; ok {
+		return m.counters[metricLabels(labels...)]
+	}
+	return 0
+}
+
+// ObserveHistogram adds given value to histogram metric, labels are pairs of
+// label names and values
+func ObserveHistogram(name string, value float64, labels ...string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	m := metricFamilyOf(name, "histogram")
+	key := metricLabels(labels...)
+	h, ok := m.histograms[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(MetricBuckets))}
+		m.histograms[key] = h
+	}
+	for i, bound := range MetricBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// ObserveDuration adds duration since given time in seconds to histogram
+// metric
+func ObserveDuration(name string, start time.Time, labels ...string) {
+	ObserveHistogram(name, time.Since(start).Seconds(), labels...)
+}
+
+// helper function to format metric value
+func metricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// helper function to format metric name with its labels
+func metricName(name, labels string) string {
+	if labels == "" {
+		return name
+	}
+	return fmt.Sprintf("%s{%s}", name, labels)
+}
+
+// helper function to join labels with additional label
+func withLabel(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+// helper function to write metric header
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	if help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// WriteMetrics writes counters and histograms in Prometheus text format
+func WriteMetrics(w io.Writer) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	var names []string
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := metrics[name]
+		writeMetricHeader(w, name, m.kind, m.help)
+		var keys []string
+		if m.kind == "counter" {
+			for key := range m.counters {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				fmt.Fprintf(w, "%s %s\n", metricName(name, key), metricValue(m.counters[key]))
+			}
+			continue
+		}
+		for key := range m.histograms {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			h := m.histograms[key]
+			for i, bound := range MetricBuckets {
+				le := fmt.Sprintf("le=\"%s\"", metricValue(bound))
+				fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, withLabel(key, le), h.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, withLabel(key, "le=\"+Inf\""), h.count)
+			fmt.Fprintf(w, "%s %s\n", metricName(name+"_sum", key), metricValue(h.sum))
+			fmt.Fprintf(w, "%s %d\n", metricName(name+"_count", key), h.count)
+		}
+	}
+}
+
+// WriteSamples writes metric computed at scrape time, e.g. gauge of queue
+// depth, in Prometheus text format
+func WriteSamples(w io.Writer, name, kind, help string, samples ...MetricSample) {
+	writeMetricHeader(w, name, kind, help)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s %s\n", metricName(name, metricLabels(s.Labels...)), metricValue(s.Value))
+	}
+}
+
+// helper function to record metrics of upstream request, received bytes of
+// streamed response are recorded when its body is closed
+func observeUpstream(ctx FetchContext, start time.Time, response ResponseType) {
+	name := system(response.Url)
+	code := strconv.Itoa(response.StatusCode)
+	AddCounter("das_upstream_requests_total", 1, "system", name, "urn", ctx.Urn, "code", code)
+	ObserveDuration("das_upstream_request_duration_seconds", start, "system", name, "urn", ctx.Urn)
+	AddCounter("das_upstream_sent_bytes_total", float64(response.SendBytes), "system", name, "urn", ctx.Urn)
+	if response.Error != nil {
+		AddCounter("das_upstream_errors_total", 1, "system", name, "urn", ctx.Urn, "class", ErrorClass(response.Error))
+	}
+	if body, ok := response.Body.(*streamBody); ok {
+		body.ctx = ctx
+		return
+	}
+	AddCounter("das_upstream_received_bytes_total", float64(response.RecvBytes), "system", name, "urn", ctx.Urn)
+}
@@ -5,46 +5,73 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"strings"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// global variable
+// Profiler holds writer of function profiler output, see InitFunctionProfiler
 var Profiler *bufio.Writer
 
+// profiler file is kept open for the life of the process, its writer is
+// shared by all goroutines
+var profilerFile *os.File
+var profilerMutex sync.Mutex
+
+// InitFunctionProfiler opens given file (das-profile.log by default) for
+// function profiler output, previously opened profiler file is closed
 func InitFunctionProfiler(fname string) {
-	// extract path from given file name
-	path, err := os.Getwd()
-	if err != nil {
-		log.Printf("ERROR: fail to read from %v, error %v\n", path, err)
-		return
-	}
 	if fname == "" {
 		fname = "das-profile.log"
-	} else {
-		arr := strings.Split(fname, "/")
-		path = strings.Join(arr[:len(arr)-1], "/")
-		fname = arr[len(arr)-1]
 	}
 	// create the log directory
+	path := filepath.Dir(fname)
 	if err := os.MkdirAll(path, 0755); err != nil {
 		log.Printf("ERROR: fail to make %s, error %v\n", path, err)
 		return
 	}
 	// open the log file
-	fname = fmt.Sprintf("%s/%s", path, fname)
 	file, err := os.OpenFile(fname, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
 		log.Printf("ERROR: fail to open %s, error %v\n", fname, err)
 		return
 	}
-	defer file.Close()
+	CloseFunctionProfiler()
+	profilerMutex.Lock()
+	profilerFile = file
 	Profiler = bufio.NewWriter(file)
+	profilerMutex.Unlock()
 	if WEBSERVER != 0 {
 		log.Println("DAS profiler", fname)
 	}
 }
 
+// CloseFunctionProfiler stops function profiler and closes its file
+func CloseFunctionProfiler() {
+	profilerMutex.Lock()
+	defer profilerMutex.Unlock()
+	if Profiler != nil {
+		Profiler.Flush()
+	}
+	if profilerFile != nil {
+		profilerFile.Close()
+	}
+	Profiler = nil
+	profilerFile = nil
+}
+
+// helper function to write line into profiler output
+func writeProfile(format string, args ...interface{}) {
+	profilerMutex.Lock()
+	defer profilerMutex.Unlock()
+	if Profiler == nil {
+		return
+	}
+	fmt.Fprintf(Profiler, format, args...)
+	Profiler.Flush()
+}
+
 // Latency Measurement of individual component of the codebase
 // https://medium.com/swlh/easy-guide-to-latency-measurement-in-golang-38c3297ebbd2
 // Usage, put the following statement in any function we need to measure:
@@ -52,9 +79,41 @@ func InitFunctionProfiler(fname string) {
 func MeasureTime(funcName string) func() {
 	start := time.Now()
 	return func() {
-		if Profiler != nil {
-			fmt.Fprintf(Profiler, "%s %s %v \n", start.Format("20060102150405"), funcName, time.Since(start))
-			Profiler.Flush()
+		writeProfile("%s %s %v \n", start.Format("20060102150405"), funcName, time.Since(start))
+	}
+}
+
+// MemoryTracker keeps track of memory held by records of a single query,
+// i.e. size of decoded upstream records which are not yet stored in DAS cache
+type MemoryTracker struct {
+	current int64
+	peak    int64
+}
+
+// Add accounts given number of bytes
+func (m *MemoryTracker) Add(size int64) {
+	current := atomic.AddInt64(&m.current, size)
+	for {
+		peak := atomic.LoadInt64(&m.peak)
+		if current <= peak || atomic.CompareAndSwapInt64(&m.peak, peak, current) {
+			return
 		}
 	}
 }
+
+// Release releases given number of bytes
+func (m *MemoryTracker) Release(size int64) {
+	atomic.AddInt64(&m.current, -size)
+}
+
+// Peak returns peak number of bytes
+func (m *MemoryTracker) Peak() int64 {
+	return atomic.LoadInt64(&m.peak)
+}
+
+// MeasureMemory reports peak memory of given tracker in profiler output.
+// Usage, put the following statement in function which processes query:
+// defer MeasureMemory("funcName", qhash, tracker)
+func MeasureMemory(funcName, qhash string, m *MemoryTracker) {
+	writeProfile("%s %s qhash=%s peakMemory=%d \n", time.Now().Format("20060102150405"), funcName, qhash, m.Peak())
+}
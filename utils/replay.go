@@ -0,0 +1,118 @@
+package utils
+
+// DAS record/replay module for upstream traffic
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+// In record mode every upstream request (method, URL, args) and its response
+// (status, headers, body) is saved as JSON fixture in FixtureDir. In replay
+// mode FetchResponse serves requests only from these fixtures and fails
+// loudly when fixture is not found, i.e. DAS does not use network at all.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fetch modes
+const (
+	FetchLive   = ""       // fetch data from upstream systems
+	FetchRecord = "record" // fetch data from upstream systems and record fixtures
+	FetchReplay = "replay" // serve data only from recorded fixtures
+)
+
+// FetchMode defines how FetchResponse talks to upstream systems
+var FetchMode string
+
+// FixtureDir defines location of recorded fixtures
+var FixtureDir string
+
+// Fixture represents recorded upstream request and its response
+type Fixture struct {
+	Method     string      `json:"method"`
+	Url        string      `json:"url"`
+	Args       string      `json:"args,omitempty"`
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body"`
+}
+
+// FixtureError is returned in replay mode when fixture is not found
+type FixtureError struct {
+	Method string
+	Url    string
+	Args   string
+	File   string
+}
+
+// Error implements error interface
+func (e *FixtureError) Error() string {
+	return fmt.Sprintf("replay mode: no fixture %s for %s %s args=%q", e.File, e.Method, e.Url, e.Args)
+}
+
+// protects fixture files from concurrent writes of the same request
+var fixtureMutex sync.Mutex
+
+// FixtureFile returns fixture file name for given request
+func FixtureFile(method, rurl, args string) string {
+	return filepath.Join(FixtureDir, CacheKey(method+" "+rurl, args)+".json")
+}
+
+// helper function to record response of given request
+func recordFixture(method, rurl, args string, response ResponseType) {
+	fixture := Fixture{
+		Method:     method,
+		Url:        rurl,
+		Args:       args,
+		StatusCode: response.StatusCode,
+		Header:     response.Header,
+		Body:       string(response.Data),
+	}
+	data, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		log.Printf("ERROR: unable to marshal fixture for %s, error %v\n", rurl, err)
+		return
+	}
+	fixtureMutex.Lock()
+	defer fixtureMutex.Unlock()
+	if err := os.MkdirAll(FixtureDir, 0755); err != nil {
+		log.Printf("ERROR: unable to create fixture area %s, error %v\n", FixtureDir, err)
+		return
+	}
+	fname := FixtureFile(method, rurl, args)
+	if err := os.WriteFile(fname, data, 0644); err != nil {
+		log.Printf("ERROR: unable to write fixture %s, error %v\n", fname, err)
+	}
+}
+
+// helper function to serve given request from recorded fixture
+func replayFixture(method, rurl, args string) ResponseType {
+	response := ResponseType{Url: rurl, Method: method, SendBytes: len(args)}
+	fname := FixtureFile(method, rurl, args)
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		response.Error = &FixtureError{Method: method, Url: rurl, Args: args, File: fname}
+		log.Printf("ERROR: %v\n", response.Error)
+		return response
+	}
+	var fixture Fixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		response.Error = fmt.Errorf("replay mode: unable to parse fixture %s, error %v", fname, err)
+		log.Printf("ERROR: %v\n", response.Error)
+		return response
+	}
+	response.StatusCode = fixture.StatusCode
+	response.Header = fixture.Header
+	response.Data = []byte(fixture.Body)
+	response.RecvBytes = len(response.Data)
+	response.Error = httpError(rurl, fixture.StatusCode, fixture.Header, response.Data)
+	if VERBOSE > 0 {
+		log.Printf("DAS replay method=%s url=\"%s\" fixture=%s\n", method, rurl, fname)
+	}
+	return response
+}
@@ -5,6 +5,7 @@ package utils
 // Copyright (c) 2018 - Valentin Kuznetsov <vkuznet AT gmail dot com>
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -13,6 +14,7 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -22,32 +24,102 @@ var RucioValidity int64
 // RucioTokenCurl
 var RucioTokenCurl bool
 
+// RucioRefreshRetry defines interval to retry failed background refresh of
+// Rucio token
+var RucioRefreshRetry = 30 * time.Second
+
 // RucioAuth represents instance of rucio authentication module
 var RucioAuth RucioAuthModule
 
 // RucioAuthModule structure holds all information about Rucio authentication
 type RucioAuthModule struct {
-	account string
-	agent   string
-	token   string
-	url     string
-	ts      int64
+	account   string
+	agent     string
+	token     string
+	url       string
+	ts        int64      // token expire time (unix seconds)
+	refresh   int64      // next refresh time of the token (unix seconds)
+	renewals  int        // number of obtained tokens
+	lastErr   string     // last error of token acquisition
+	lock      sync.Mutex // protects account, agent and url
+	tokenLock sync.Mutex // protects token state
+	fetchLock sync.Mutex // makes token acquisition single-flight
+}
+
+// RucioTokenInfo represents state of Rucio token
+type RucioTokenInfo struct {
+	Account     string `json:"account"`
+	Url         string `json:"url"`
+	Valid       bool   `json:"valid"`
+	Expire      string `json:"expire,omitempty"`
+	NextRefresh string `json:"next_refresh,omitempty"`
+	Renewals    int    `json:"renewals"`
+	LastError   string `json:"last_error,omitempty"`
 }
 
 // String provides string representation of RucioAuthModule
 func (r *RucioAuthModule) String() string {
-	s := fmt.Sprintf("<RucioAuth account=%s agent=%s url=%s token=%s expire=%v>", r.account, r.agent, r.url, r.token, r.ts)
+	r.tokenLock.Lock()
+	defer r.tokenLock.Unlock()
+	s := fmt.Sprintf("<RucioAuth account=%s agent=%s url=%s token=%s expire=%v>", r.Account(), r.Agent(), r.Url(), RedactToken(r.token), r.ts)
 	return s
 }
 
-// Token returns Rucio authentication token
-func (r *RucioAuthModule) Token() (string, error) {
+// Info returns state of Rucio token
+func (r *RucioAuthModule) Info() RucioTokenInfo {
+	r.tokenLock.Lock()
+	defer r.tokenLock.Unlock()
+	info := RucioTokenInfo{Account: r.Account(), Url: r.Url(), Renewals: r.renewals, LastError: r.lastErr}
+	info.Valid = r.token != "" && time.Now().Unix() < r.ts
+	if r.ts > 0 {
+		info.Expire = time.Unix(r.ts, 0).Format(time.RFC3339)
+	}
+	if r.refresh > 0 {
+		info.NextRefresh = time.Unix(r.refresh, 0).Format(time.RFC3339)
+	}
+	return info
+}
+
+// helper function to return cached token if it is still valid
+func (r *RucioAuthModule) cached() (string, bool) {
+	r.tokenLock.Lock()
+	defer r.tokenLock.Unlock()
 	t := time.Now().Unix()
 	if r.token != "" && t < r.ts {
 		if VERBOSE > 1 {
-			log.Println("use cached token", r.String(), "current time", t)
+			log.Println("use cached rucio token, expire", r.ts, "current time", t)
 		}
-		return r.token, nil
+		return r.token, true
+	}
+	return "", false
+}
+
+// Token returns Rucio authentication token, concurrent callers share single
+// token request to Rucio auth server
+func (r *RucioAuthModule) Token() (string, error) {
+	if FetchMode == FetchReplay { // upstream requests are served from fixtures
+		return "replay", nil
+	}
+	if token, ok := r.cached(); ok {
+		return token, nil
+	}
+	return r.renew("")
+}
+
+// Renew obtains new token if given (rejected) token is still in use, empty
+// token forces renewal
+func (r *RucioAuthModule) Renew(token string) error {
+	_, err := r.renew(token)
+	return err
+}
+
+// helper function to obtain new Rucio token
+func (r *RucioAuthModule) renew(rejected string) (string, error) {
+	r.fetchLock.Lock()
+	defer r.fetchLock.Unlock()
+	// another go-routine may already obtain new token while we waited
+	if token, ok := r.cached(); ok && (rejected == "" || token != rejected) {
+		return token, nil
 	}
 	if VERBOSE > 1 {
 		log.Println("get new token", r.String())
@@ -60,16 +132,61 @@ func (r *RucioAuthModule) Token() (string, error) {
 	} else {
 		token, expire, err = FetchRucioToken(r.Url())
 	}
+	if err == nil && token == "" {
+		err = errors.New("no token in Rucio auth server response")
+	}
+	r.tokenLock.Lock()
+	defer r.tokenLock.Unlock()
 	if err != nil {
+		r.lastErr = err.Error()
+		AddCounter("das_rucio_token_refresh_failures_total", 1)
 		return "", err
 	}
-	r.ts = expire
+	now := time.Now().Unix()
 	r.token = token
+	r.ts = expire
+	r.renewals++
+	r.lastErr = ""
+	// refresh token before its expiry but not earlier than half of its lifetime
+	r.refresh = expire - int64(AuthRefreshMargin/time.Second)
+	if half := now + (expire-now)/2; r.refresh < half {
+		r.refresh = half
+	}
 	return r.token, nil
 }
 
+// helper function to return next refresh time of the token
+func (r *RucioAuthModule) nextRefresh() time.Time {
+	r.tokenLock.Lock()
+	defer r.tokenLock.Unlock()
+	if r.token == "" || r.refresh == 0 {
+		return time.Now()
+	}
+	return time.Unix(r.refresh, 0)
+}
+
+// Refresher refreshes Rucio token in background before its expiry, it
+// should run as go-routine
+func (r *RucioAuthModule) Refresher() {
+	for {
+		time.Sleep(time.Until(r.nextRefresh()))
+		if FetchMode == FetchReplay {
+			time.Sleep(RucioRefreshRetry)
+			continue
+		}
+		if err := r.Renew(""); err != nil {
+			log.Printf("ERROR: unable to refresh rucio token, error %v\n", err)
+			time.Sleep(RucioRefreshRetry)
+		} else if VERBOSE > 0 {
+			log.Println("refreshed rucio token, next refresh", r.nextRefresh())
+		}
+	}
+}
+
 // Account returns Rucio authentication account
 func (r *RucioAuthModule) Account() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	if r.account == "" {
 		r.account = "das"
 		v := GetEnv("RUCIO_ACCOUNT")
@@ -82,6 +199,8 @@ func (r *RucioAuthModule) Account() string {
 
 // Agent returns Rucio authentication agent
 func (r *RucioAuthModule) Agent() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	if r.agent == "" {
 		r.agent = "dasgoserver"
 	}
@@ -90,6 +209,8 @@ func (r *RucioAuthModule) Agent() string {
 
 // Url returns Rucio authentication url
 func (r *RucioAuthModule) Url() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	if r.url == "" {
 		v := GetEnv("RUCIO_AUTH_URL")
 		if v != "" {
@@ -104,8 +225,6 @@ func (r *RucioAuthModule) Url() string {
 // run go-routine to periodically obtain rucio token
 // FetchRucioToken request new Rucio token
 func FetchRucioToken(rurl string) (string, int64, error) {
-	// I need to replace expire with time provided by Rucio auth server
-	expire := time.Now().Add(time.Minute * 5).Unix()
 	req, _ := http.NewRequest("GET", rurl, nil)
 	req.Header.Add("Accept-Encoding", "identity")
 	racc := GetEnv("RUCIO_ACCOUNT")
@@ -125,7 +244,7 @@ func FetchRucioToken(rurl string) (string, int64, error) {
 	req.Header.Add("Connection", "keep-alive")
 	if VERBOSE > 1 {
 		dump, err := httputil.DumpRequestOut(req, true)
-		log.Printf("http request %+v, rurl %v, dump %v, error %v\n", req, rurl, string(dump), err)
+		log.Printf("http request %s %v, rurl %v, dump %v, error %v\n", req.Method, req.URL, rurl, RedactDump(dump), err)
 	}
 	client := HttpClient()
 	resp, err := client.Do(req)
@@ -138,7 +257,7 @@ func FetchRucioToken(rurl string) (string, int64, error) {
 	defer resp.Body.Close()
 	if VERBOSE > 1 {
 		dump, err := httputil.DumpResponse(resp, true)
-		log.Printf("http response rurl %v, dump %v, error %v\n", rurl, string(dump), err)
+		log.Printf("http response rurl %v, dump %v, error %v\n", rurl, RedactDump(dump), err)
 	}
 	_, err = io.ReadAll(resp.Body)
 	if err != nil {
@@ -147,16 +266,17 @@ func FetchRucioToken(rurl string) (string, int64, error) {
 		}
 		return "", 0, err
 	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, httpError(rurl, resp.StatusCode, resp.Header, nil)
+	}
 	if v, ok := resp.Header["X-Rucio-Auth-Token"]; ok {
-		return v[0], expire, nil
+		return v[0], rucioExpire(resp.Header.Get("X-Rucio-Auth-Token-Expires")), nil
 	}
 	return "", 0, err
 }
 
 // FetchRucioTokenViaCurl is a helper function to get Rucio token by using curl command
 func FetchRucioTokenViaCurl(rurl string) (string, int64, error) {
-	// I need to replace expire with time provided by Rucio auth server
-	expire := time.Now().Add(time.Minute * 5).Unix()
 	proxy := os.Getenv("X509_USER_PROXY")
 	account := GetEnv("RUCIO_ACCOUNT")
 	if account == "" {
@@ -173,14 +293,34 @@ func FetchRucioTokenViaCurl(rurl string) (string, int64, error) {
 		log.Println("ERROR: unable to execute command", cmd, "error", err)
 		return "", 0, err
 	}
-	var token string
+	var token, expires string
 	for _, v := range strings.Split(string(out), "\n") {
-		if strings.Contains(strings.ToLower(v), "x-rucio-auth-token:") {
-			arr := strings.Split(v, "X-Rucio-Auth-Token: ")
-			token = strings.Replace(arr[len(arr)-1], "\n", "", -1)
-			token = strings.Replace(token, "\r", "", -1)
-			return token, expire, nil
+		v = strings.TrimSpace(v)
+		arr := strings.SplitN(v, ":", 2)
+		if len(arr) != 2 {
+			continue
+		}
+		switch strings.ToLower(arr[0]) {
+		case "x-rucio-auth-token":
+			token = strings.TrimSpace(arr[1])
+		case "x-rucio-auth-token-expires":
+			expires = strings.TrimSpace(arr[1])
+		}
+	}
+	return token, rucioExpire(expires), nil
+}
+
+// helper function to parse X-Rucio-Auth-Token-Expires header, e.g.
+// "Mon, 19 Oct 2026 16:00:00 UTC", if header is missing or malformed we
+// assume default token validity of 5 minutes
+func rucioExpire(value string) int64 {
+	if value != "" {
+		for _, layout := range []string{time.RFC1123, http.TimeFormat, time.RFC3339} {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t.Unix()
+			}
 		}
+		log.Printf("ERROR: unable to parse X-Rucio-Auth-Token-Expires %s\n", value)
 	}
-	return token, expire, nil
+	return time.Now().Add(time.Minute * 5).Unix()
 }
@@ -0,0 +1,285 @@
+package utils
+
+// DAS URL fetch scheduler module
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+// URL requests are queued per upstream system. Every system has optional
+// concurrency cap and token bucket rate limit (SystemLimits). Within a system
+// requests are scheduled round-robin across users and, for every user,
+// round-robin across their queries, therefore a single query which fans out
+// to thousands of upstream calls does not starve other queries and users.
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FetchContext describes origin of URL request, it is used for fair
+// scheduling of requests across queries and users
+type FetchContext struct {
+	Qhash   string          // DAS query hash
+	User    string          // user who placed DAS query
+	Client  string          // IP address of client which placed DAS query
+	Stream  bool            // pass successful response body as stream, see ResponseType.Body
+	Urn     string          // DAS map urn of requested url
+	Span    *Span           // trace span of DAS query
+	Hedge   bool            // duplicate (hedged) request of slow upstream call
+	Debug   *DebugTrace     // debug trace of DAS query requested in debug mode
+	Context context.Context // context of upstream request, it aborts request in flight when cancelled
+}
+
+// SystemLimit represents concurrency and rate limits of upstream system
+type SystemLimit struct {
+	Concurrency int     `json:"concurrency"` // max number of concurrent requests, 0 means no limit
+	Rate        float64 `json:"rate"`        // max number of requests per second, 0 means no limit
+	Burst       int     `json:"burst"`       // token bucket size, default is max(1, rate)
+}
+
+// SystemLimits holds limits of upstream systems keyed by DAS map system
+// name, e.g. dbs3, rucio; "default" limit applies to all other systems
+var SystemLimits map[string]SystemLimit
+
+// helper function to normalize system name, DAS maps use versioned names,
+// e.g. dbs3 or reqmgr2, while URLs are classified as dbs or reqmgr
+func limitSystem(name string) string {
+	return strings.TrimRight(strings.ToLower(name), "0123456789")
+}
+
+// helper function to find limit of given system
+func systemLimit(name string) SystemLimit {
+	for key, limit := range SystemLimits {
+		if limitSystem(key) == name {
+			return limit
+		}
+	}
+	return SystemLimits["default"]
+}
+
+// tokenBucket implements token bucket rate limiter
+type tokenBucket struct {
+	rate   float64   // tokens per second
+	burst  float64   // bucket size
+	tokens float64   // available tokens
+	last   time.Time // last refill time
+}
+
+// helper function to create new token bucket
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	size := float64(burst)
+	if size < 1 {
+		size = math.Max(1, rate)
+	}
+	return &tokenBucket{rate: rate, burst: size, tokens: size, last: time.Now()}
+}
+
+// take takes a token from the bucket, it returns false if bucket is empty
+func (b *tokenBucket) take() bool {
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// userQueue holds requests of single user grouped by query
+type userQueue struct {
+	queries []string                 // round-robin list of query hashes
+	byQuery map[string][]*UrlRequest // FIFO of requests for every query
+}
+
+// fairQueue holds requests scheduled round-robin across users and queries
+type fairQueue struct {
+	users  []string              // round-robin list of users
+	byUser map[string]*userQueue // user queues
+	size   int                   // total number of requests
+}
+
+// push adds request to the queue
+func (q *fairQueue) push(r *UrlRequest) {
+	if q.byUser == nil {
+		q.byUser = make(map[string]*userQueue)
+	}
+	uq, ok := q.byUser[r.ctx.User]
+	if !ok {
+		uq = &userQueue{byQuery: make(map[string][]*UrlRequest)}
+		q.byUser[r.ctx.User] = uq
+		q.users = append(q.users, r.ctx.User)
+	}
+	if _, ok := uq.byQuery[r.ctx.Qhash]; !ok {
+		uq.queries = append(uq.queries, r.ctx.Qhash)
+	}
+	uq.byQuery[r.ctx.Qhash] = append(uq.byQuery[r.ctx.Qhash], r)
+	q.size++
+}
+
+// pop takes next request from the queue, the user and query of this request
+// are moved to the end of round-robin lists
+func (q *fairQueue) pop() *UrlRequest {
+	if q.size == 0 {
+		return nil
+	}
+	user := q.users[0]
+	q.users = q.users[1:]
+	uq := q.byUser[user]
+	qhash := uq.queries[0]
+	uq.queries = uq.queries[1:]
+	requests := uq.byQuery[qhash]
+	r := requests[0]
+	if len(requests) > 1 {
+		uq.byQuery[qhash] = requests[1:]
+		uq.queries = append(uq.queries, qhash)
+	} else {
+		delete(uq.byQuery, qhash)
+	}
+	if len(uq.queries) > 0 {
+		q.users = append(q.users, user)
+	} else {
+		delete(q.byUser, user)
+	}
+	q.size--
+	return r
+}
+
+// systemQueue holds requests and limits of upstream system
+type systemQueue struct {
+	name    string
+	limit   SystemLimit
+	bucket  *tokenBucket
+	running int32
+	queue   fairQueue
+}
+
+// helper function to check if system can run another request
+func (s *systemQueue) admit() bool {
+	if s.limit.Concurrency > 0 && atomic.LoadInt32(&s.running) >= int32(s.limit.Concurrency) {
+		return false
+	}
+	if s.bucket != nil && !s.bucket.take() {
+		return false
+	}
+	return true
+}
+
+// SystemQueueInfo represents state of upstream system queue
+type SystemQueueInfo struct {
+	System      string  `json:"system"`
+	Queued      int     `json:"queued"`
+	Running     int32   `json:"running"`
+	Users       int     `json:"users"`
+	Concurrency int     `json:"concurrency"`
+	Rate        float64 `json:"rate"`
+}
+
+// fetchScheduler dispatches queued URL requests according to global
+// UrlQueueLimit and per system limits
+type fetchScheduler struct {
+	systems map[string]*systemQueue
+	order   []string // sorted list of systems
+	next    int      // system to start next dispatch round with
+	running int32    // number of dispatched requests
+	mutex   sync.Mutex
+}
+
+// global fetch scheduler used by URLFetchWorker
+var scheduler = &fetchScheduler{systems: make(map[string]*systemQueue)}
+
+// push adds request to the queue of its upstream system
+func (s *fetchScheduler) push(r *UrlRequest) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	name := limitSystem(system(r.rurl))
+	sq, ok := s.systems[name]
+	if !ok {
+		sq = &systemQueue{name: name, limit: systemLimit(name)}
+		if sq.limit.Rate > 0 {
+			sq.bucket = newTokenBucket(sq.limit.Rate, sq.limit.Burst)
+		}
+		s.systems[name] = sq
+		s.order = append(s.order, name)
+		sort.Strings(s.order)
+	}
+	sq.queue.push(r)
+}
+
+// dispatch starts queued requests, every round takes at most one request
+// from every system to share global queue limit fairly among systems
+func (s *fetchScheduler) dispatch() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.order) == 0 {
+		return
+	}
+	for {
+		dispatched := false
+		start := s.next % len(s.order)
+		for i := 0; i < len(s.order); i++ {
+			if limit := atomic.LoadInt32(&UrlQueueLimit); limit > 0 && atomic.LoadInt32(&s.running) >= limit {
+				return
+			}
+			sq := s.systems[s.order[(start+i)%len(s.order)]]
+			if sq.queue.size == 0 || !sq.admit() {
+				continue
+			}
+			s.start(sq, sq.queue.pop())
+			dispatched = true
+		}
+		s.next = start + 1
+		if !dispatched {
+			return
+		}
+	}
+}
+
+// helper function to run given request of given system
+func (s *fetchScheduler) start(sq *systemQueue, r *UrlRequest) {
+	atomic.AddInt32(&s.running, 1)
+	atomic.AddInt32(&sq.running, 1)
+	go func() {
+		defer func() {
+			atomic.AddInt32(&sq.running, -1)
+			atomic.AddInt32(&s.running, -1)
+		}()
+		fetch(r.client, r.rurl, r.args, r.ctx, r.out)
+	}()
+}
+
+// FetchQueueLength returns number of URL requests waiting in queues of
+// upstream systems
+func FetchQueueLength() int {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	nreq := 0
+	for _, sq := range scheduler.systems {
+		nreq += sq.queue.size
+	}
+	return nreq
+}
+
+// FetchQueueStatus returns state of URL fetch queues of upstream systems
+func FetchQueueStatus() []SystemQueueInfo {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	var out []SystemQueueInfo
+	for _, name := range scheduler.order {
+		sq := scheduler.systems[name]
+		info := SystemQueueInfo{
+			System:      name,
+			Queued:      sq.queue.size,
+			Running:     atomic.LoadInt32(&sq.running),
+			Users:       len(sq.queue.users),
+			Concurrency: sq.limit.Concurrency,
+			Rate:        sq.limit.Rate,
+		}
+		out = append(out, info)
+	}
+	return out
+}
@@ -0,0 +1,101 @@
+package utils
+
+// DAS streaming of upstream responses
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+// Upstream responses can be large, e.g. DBS files/filelumis or Rucio replicas
+// of big datasets. When FetchContext.Stream is set FetchResponse does not
+// read successful response into memory, instead it passes response body to
+// the caller which decodes records incrementally. The fetch request (and its
+// slot in fetch scheduler) is kept until the caller closes the body.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// streamBody represents body of upstream response passed to the caller
+type streamBody struct {
+	url     string
+	reader  io.Reader
+	closers []io.Closer
+	bytes   int64
+	done    chan struct{}
+	once    sync.Once
+	span    *Span        // trace span of upstream request
+	ctx     FetchContext // context of upstream request, used by metrics and logs
+}
+
+// helper function to create stream body of given response, it handles
+// gzipped content
+func newStreamBody(rurl string, resp *http.Response) (*streamBody, error) {
+	body := &streamBody{url: rurl, reader: resp.Body, closers: []io.Closer{resp.Body}, done: make(chan struct{})}
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		body.reader = gz
+		body.closers = append(body.closers, gz)
+	}
+	return body, nil
+}
+
+// Read implements io.Reader interface
+func (b *streamBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+// Close implements io.Closer interface, it releases fetch request
+func (b *streamBody) Close() error {
+	var err error
+	b.once.Do(func() {
+		for i := len(b.closers) - 1; i >= 0; i-- {
+			if e := b.closers[i].Close(); e != nil {
+				err = e
+			}
+		}
+		b.ctx.Logger().Debug("DAS stream", "system", system(b.url), "url", b.url, "recvBytes", b.bytes)
+		AddCounter("das_upstream_received_bytes_total", float64(b.bytes), "system", system(b.url), "urn", b.ctx.Urn)
+		b.span.SetAttr("http.response_bytes", b.bytes)
+		b.span.SetError(err)
+		b.span.End()
+		close(b.done)
+	})
+	return err
+}
+
+// Reader returns reader of response body, either streamed from upstream
+// system or read into Data
+func (r *ResponseType) Reader() io.Reader {
+	if r.Body != nil {
+		return r.Body
+	}
+	return bytes.NewReader(r.Data)
+}
+
+// Close closes streamed response body, it must be called by consumers of
+// streamed responses
+func (r *ResponseType) Close() error {
+	if r.Body != nil {
+		return r.Body.Close()
+	}
+	return nil
+}
+
+// helper function to send response to given channel, request of streamed
+// response is kept until consumer closes its body
+func deliver(resp ResponseType, ch chan<- ResponseType) {
+	body, ok := resp.Body.(*streamBody)
+	ch <- resp
+	if ok {
+		<-body.done
+	}
+}
@@ -0,0 +1,357 @@
+package utils
+
+// DAS tracing module
+//
+// Copyright (c) 2015-2016 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+//
+// DAS requests are traced by spans: the root span is created for every DAS
+// server request and child spans for query parsing, look-up of DAS maps,
+// upstream requests, local APIs, unmarshalling of upstream data, merge step
+// and MongoDB operations. Trace context is propagated to upstream services
+// via W3C traceparent and X-Request-ID headers. Finished spans are exported
+// in OTLP JSON format either to a file (one ExportTraceServiceRequest per
+// line, e.g. for otlpjsonfile receiver of OpenTelemetry collector) or to
+// OTLP/HTTP collector endpoint, e.g. http://localhost:4318/v1/traces
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceServiceName defines service.name resource attribute of exported spans
+var TraceServiceName = "das2go"
+
+// TraceBatchSize defines max number of spans exported at once
+var TraceBatchSize = 100
+
+// TraceFlushInterval defines how often finished spans are exported
+var TraceFlushInterval = 5 * time.Second
+
+// span kinds, see OTLP SpanKind
+const (
+	SpanInternal = 1
+	SpanServer   = 2
+	SpanClient   = 3
+)
+
+// Span represents single operation within a trace of DAS request
+type Span struct {
+	TraceID   string // 16 bytes hex encoded trace id
+	SpanID    string // 8 bytes hex encoded span id
+	ParentID  string // span id of parent span
+	RequestID string // request id propagated to upstream services
+	Name      string // span name, e.g. FetchResponse
+	Kind      int    // span kind, e.g. SpanClient
+	start     time.Time
+	end       time.Time
+	attrs     map[string]interface{}
+	errMsg    string
+	mutex     sync.Mutex
+}
+
+// helper function to generate random hex id of given size in bytes
+func randomID(size int) string {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("ERROR: unable to generate random id, error %v\n", err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// helper function to parse W3C traceparent header, it returns trace and
+// parent span ids, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceParent(value string) (string, string, bool) {
+	arr := strings.Split(strings.TrimSpace(value), "-")
+	if len(arr) != 4 || len(arr[1]) != 32 || len(arr[2]) != 16 {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(arr[1] + arr[2]); err != nil {
+		return "", "", false
+	}
+	if arr[1] == strings.Repeat("0", 32) || arr[2] == strings.Repeat("0", 16) {
+		return "", "", false
+	}
+	return strings.ToLower(arr[1]), strings.ToLower(arr[2]), true
+}
+
+// NewTrace creates root span of DAS request, given traceparent and request
+// id of incoming request (if any) are used to continue upstream trace
+func NewTrace(name, traceparent, requestID string) *Span {
+	span := &Span{Name: name, Kind: SpanServer, SpanID: randomID(8), start: time.Now()}
+	if traceID, parentID, ok := parseTraceParent(traceparent); ok {
+		span.TraceID, span.ParentID = traceID, parentID
+	} else {
+		span.TraceID = randomID(16)
+	}
+	span.RequestID = requestID
+	if span.RequestID == "" {
+		span.RequestID = span.TraceID
+	}
+	return span
+}
+
+// StartSpan starts child span of given parent span, it returns nil if parent
+// is nil, i.e. request is not traced. All Span methods accept nil span.
+func StartSpan(parent *Span, name string) *Span {
+	if parent == nil {
+		return nil
+	}
+	return &Span{
+		TraceID:   parent.TraceID,
+		SpanID:    randomID(8),
+		ParentID:  parent.SpanID,
+		RequestID: parent.RequestID,
+		Name:      name,
+		Kind:      SpanInternal,
+		start:     time.Now(),
+	}
+}
+
+// SetAttr sets span attribute
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+}
+
+// SetError marks span as failed with given error
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.errMsg = err.Error()
+}
+
+// End finishes the span and passes it to trace exporter
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if !s.end.IsZero() {
+		s.mutex.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mutex.Unlock()
+	if tracer != nil {
+		tracer.add(s)
+	}
+}
+
+// TraceParent returns W3C traceparent header value of the span
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID)
+}
+
+// Inject adds trace context headers to upstream request
+func (s *Span) Inject(req *http.Request) {
+	if s == nil {
+		return
+	}
+	req.Header.Set("traceparent", s.TraceParent())
+	req.Header.Set("X-Request-ID", s.RequestID)
+}
+
+// otlp JSON representation of span attributes
+func otlpAttributes(attrs map[string]interface{}) []map[string]interface{} {
+	var out []map[string]interface{}
+	for key, val := range attrs {
+		var value map[string]interface{}
+		switch v := val.(type) {
+		case int:
+			value = map[string]interface{}{"intValue": fmt.Sprintf("%d", v)}
+		case int64:
+			value = map[string]interface{}{"intValue": fmt.Sprintf("%d", v)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprintf("%v", v)}
+		}
+		out = append(out, map[string]interface{}{"key": key, "value": value})
+	}
+	return out
+}
+
+// otlp JSON representation of the span
+func (s *Span) otlp() map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rec := map[string]interface{}{
+		"traceId":           s.TraceID,
+		"spanId":            s.SpanID,
+		"name":              s.Name,
+		"kind":              s.Kind,
+		"startTimeUnixNano": fmt.Sprintf("%d", s.start.UnixNano()),
+		"endTimeUnixNano":   fmt.Sprintf("%d", s.end.UnixNano()),
+	}
+	if s.ParentID != "" {
+		rec["parentSpanId"] = s.ParentID
+	}
+	attrs := map[string]interface{}{"das.request_id": s.RequestID}
+	for k, v := range s.attrs {
+		attrs[k] = v
+	}
+	rec["attributes"] = otlpAttributes(attrs)
+	if s.errMsg != "" {
+		rec["status"] = map[string]interface{}{"code": 2, "message": s.errMsg}
+	}
+	return rec
+}
+
+// traceExporter exports finished spans in batches
+type traceExporter struct {
+	file     string
+	endpoint string
+	spans    chan *Span
+}
+
+// global trace exporter, nil means that spans are not exported
+var tracer *traceExporter
+
+// InitTracer starts export of finished spans to given file and/or OTLP/HTTP
+// endpoint, tracing is disabled if both are empty
+func InitTracer(file, endpoint string) {
+	if file == "" && endpoint == "" {
+		return
+	}
+	t := &traceExporter{file: file, endpoint: endpoint, spans: make(chan *Span, 10*TraceBatchSize)}
+	tracer = t
+	go t.run()
+	log.Printf("DAS tracing file=%s endpoint=%s\n", file, endpoint)
+}
+
+// helper function to queue finished span, spans are dropped if exporter
+// can't keep up
+func (t *traceExporter) add(s *Span) {
+	select {
+	case t.spans <- s:
+	default:
+		if VERBOSE > 0 {
+			log.Println("trace exporter queue is full, drop span", s.Name)
+		}
+	}
+}
+
+// helper function to export queued spans
+func (t *traceExporter) run() {
+	ticker := time.NewTicker(TraceFlushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < TraceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if len(batch) > 0 {
+			t.export(batch)
+			batch = nil
+		}
+	}
+}
+
+// helper function to export given spans as OTLP ExportTraceServiceRequest
+func (t *traceExporter) export(batch []*Span) {
+	var spans []map[string]interface{}
+	for _, s := range batch {
+		spans = append(spans, s.otlp())
+	}
+	resource := map[string]interface{}{
+		"attributes": otlpAttributes(map[string]interface{}{"service.name": TraceServiceName}),
+	}
+	req := map[string]interface{}{
+		"resourceSpans": []map[string]interface{}{{
+			"resource":   resource,
+			"scopeSpans": []map[string]interface{}{{"scope": map[string]string{"name": "das2go"}, "spans": spans}},
+		}},
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		log.Printf("ERROR: unable to marshal spans, error %v\n", err)
+		return
+	}
+	if t.file != "" {
+		if err := appendLine(t.file, data); err != nil {
+			log.Printf("ERROR: unable to write spans to %s, error %v\n", t.file, err)
+		}
+	}
+	if t.endpoint != "" {
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(t.endpoint, "application/json", bytes.NewReader(data))
+		if err != nil {
+			log.Printf("ERROR: unable to export spans to %s, error %v\n", t.endpoint, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Printf("ERROR: unable to export spans to %s, status %d\n", t.endpoint, resp.StatusCode)
+		}
+	}
+}
+
+// helper function to append line to given file
+func appendLine(fname string, data []byte) error {
+	file, err := os.OpenFile(fname, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	w.Write(data)
+	w.WriteString("\n")
+	return w.Flush()
+}
+
+// helper function to finish span of upstream request, span of streamed
+// response is finished when its body is closed
+func endFetchSpan(span *Span, ctx FetchContext, response ResponseType) {
+	if span == nil {
+		return
+	}
+	span.Kind = SpanClient
+	span.SetAttr("das.system", system(response.Url))
+	if ctx.Urn != "" {
+		span.SetAttr("das.urn", ctx.Urn)
+	}
+	if ctx.Hedge {
+		span.SetAttr("das.hedge", true)
+	}
+	span.SetAttr("http.url", response.Url)
+	span.SetAttr("http.method", response.Method)
+	span.SetAttr("http.status_code", response.StatusCode)
+	span.SetAttr("http.request_bytes", response.SendBytes)
+	span.SetError(response.Error)
+	if body, ok := response.Body.(*streamBody); ok {
+		body.span = span
+		return
+	}
+	span.SetAttr("http.response_bytes", response.RecvBytes)
+	span.End()
+}
@@ -11,6 +11,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"reflect"
 	"runtime"
@@ -414,13 +415,120 @@ func Median(data []interface{}) float64 {
 	if l == 0 {
 		return 0
 	} else if l%2 == 0 {
-		median = (input[l/2-1] + input[l/2+1]) / 2.
+		median = (input[l/2-1] + input[l/2]) / 2.
 	} else {
 		median = float64(input[l/2])
 	}
 	return median
 }
 
+// helper function to convert numeric values of given array into floats,
+// non-numeric values are skipped
+func floatValues(data []interface{}) []float64 {
+	var out []float64
+	for _, v := range data {
+		switch val := v.(type) {
+		case float64:
+			out = append(out, val)
+		case json.Number:
+			vv, e := val.Float64()
+			if e == nil {
+				out = append(out, vv)
+			}
+		case int64:
+			out = append(out, float64(val))
+		case int:
+			out = append(out, float64(val))
+		}
+	}
+	return out
+}
+
+// CountDistinct helper function to count distinct (non nil) values of provided array
+func CountDistinct(data []interface{}) int {
+	values := make(map[string]bool)
+	for _, v := range data {
+		if v != nil {
+			values[fmt.Sprintf("%v", v)] = true
+		}
+	}
+	return len(values)
+}
+
+// StdDev helper function to calculate (population) standard deviation of provided array of values
+func StdDev(data []interface{}) float64 {
+	input := floatValues(data)
+	if len(input) == 0 {
+		return 0
+	}
+	var sum, sum2 float64
+	for _, v := range input {
+		sum += v
+	}
+	mean := sum / float64(len(input))
+	for _, v := range input {
+		sum2 += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(sum2 / float64(len(input)))
+}
+
+// Percentile helper function to calculate p-th percentile (0-100) of provided
+// array of values, it uses linear interpolation between closest ranks
+func Percentile(data []interface{}, p float64) float64 {
+	input := sort.Float64Slice(floatValues(data))
+	if len(input) == 0 {
+		return 0
+	}
+	input.Sort()
+	if p <= 0 {
+		return input[0]
+	}
+	if p >= 100 {
+		return input[len(input)-1]
+	}
+	rank := p / 100 * float64(len(input)-1)
+	low := int(math.Floor(rank))
+	high := int(math.Ceil(rank))
+	return input[low] + (input[high]-input[low])*(rank-float64(low))
+}
+
+// HistogramBin represents single bin of histogram
+type HistogramBin struct {
+	Low   float64 `json:"low"`
+	High  float64 `json:"high"`
+	Count int     `json:"count"`
+}
+
+// Histogram helper function to build histogram with given number of equal
+// width bins over provided array of values
+func Histogram(data []interface{}, nbins int) []HistogramBin {
+	var out []HistogramBin
+	input := floatValues(data)
+	if len(input) == 0 || nbins <= 0 {
+		return out
+	}
+	low, high := input[0], input[0]
+	for _, v := range input {
+		low = math.Min(low, v)
+		high = math.Max(high, v)
+	}
+	width := (high - low) / float64(nbins)
+	if width == 0 {
+		return []HistogramBin{{Low: low, High: high, Count: len(input)}}
+	}
+	for i := 0; i < nbins; i++ {
+		out = append(out, HistogramBin{Low: low + float64(i)*width, High: low + float64(i+1)*width})
+	}
+	for _, v := range input {
+		idx := int((v - low) / width)
+		if idx >= nbins { // max value belongs to the last bin
+			idx = nbins - 1
+		}
+		out[idx].Count++
+	}
+	return out
+}
+
 // IntList implement sort for []int type
 type IntList []int
 
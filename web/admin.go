@@ -0,0 +1,164 @@
+package web
+
+// das2go - DAS web server admin handlers
+//
+// Copyright (c) 2015-2017 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/dmwm/das2go/config"
+	"github.com/dmwm/das2go/das"
+	"github.com/dmwm/das2go/dasql"
+	"github.com/dmwm/das2go/utils"
+)
+
+// helper function to check if request comes from DAS administrator
+func isAdmin(r *http.Request) bool {
+	if len(config.Config.AdminDNs) == 0 {
+		return false
+	}
+	userDN := UserDN(r)
+	return utils.InList(userDN, config.Config.AdminDNs)
+}
+
+// helper function to write JSON response
+func writeJSON(w http.ResponseWriter, code int, data interface{}) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(js)
+}
+
+// helper function to write JSON error response
+func writeJSONError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]interface{}{"status": "fail", "reason": err.Error()})
+}
+
+// helper function to enable debug mode of DAS query, cached results of the
+// query without debug trace are invalidated so the query is processed again
+func enableDebug(dasquery *dasql.DASQuery) {
+	dasquery.Debug = utils.NewDebugTrace()
+	if !das.CheckDataReadiness(dasquery.Qhash) {
+		return
+	}
+	if _, ok := das.DebugInfo(dasquery.Qhash); ok {
+		return
+	}
+	if _, err := das.Invalidate(das.CacheSelection{Qhash: dasquery.Qhash}, _dasmaps); err != nil {
+		dasquery.Logger().Error("unable to invalidate DAS query for debug mode", "error", err)
+	}
+}
+
+// DebugAPIHandler provides debug trace of DAS query processed in debug mode,
+// GET /api/v1/debug/<pid>, it is allowed only for admins
+func DebugAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	if !isAdmin(r) {
+		writeJSONError(w, http.StatusForbidden, errors.New("debug traces are allowed only for admins"))
+		return
+	}
+	pid := strings.Trim(strings.TrimPrefix(r.URL.Path, config.Config.Base+"/api/v1/debug"), "/")
+	if len(pid) != 32 {
+		writeJSONError(w, http.StatusBadRequest, errors.New("DAS query pid is not valid"))
+		return
+	}
+	trace, ok := das.DebugInfo(pid)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("debug trace of DAS query %s is not found", pid))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "pid": pid, "debug": trace})
+}
+
+// helper function to read cache selection either from JSON body or form values
+func cacheSelection(r *http.Request) (das.CacheSelection, error) {
+	var sel das.CacheSelection
+	if r.Method == "POST" && strings.Contains(r.Header.Get("Content-Type"), "json") {
+		defer r.Body.Close()
+		err := json.NewDecoder(r.Body).Decode(&sel)
+		return sel, err
+	}
+	sel.Qhash = r.FormValue("qhash")
+	sel.Query = r.FormValue("query")
+	sel.System = r.FormValue("system")
+	sel.Key = r.FormValue("key")
+	return sel, nil
+}
+
+// AdminHandler handles DAS cache administration requests, it provides
+// the following APIs:
+// - GET  /admin/cache      list cached queries
+// - POST /admin/invalidate remove cached queries
+// - POST /admin/refresh    remove cached queries and process them again
+// All APIs accept qhash, query (regex), system and key (e.g. dataset=/a/b/c)
+// selection parameters
+func AdminHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		log.Printf("ERROR: user DN %s is not allowed to use admin APIs\n", UserDN(r))
+		http.Error(w, "You are not allowed to access this resource", http.StatusForbidden)
+		return
+	}
+	arr := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+	api := arr[len(arr)-1]
+	sel, err := cacheSelection(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	switch api {
+	case "cache":
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		records, err := das.CachedQueries(sel, _dasmaps)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "nresults": len(records), "queries": records})
+	case "invalidate":
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		qhashes, err := das.Invalidate(sel, _dasmaps)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		log.Printf("admin %s invalidated %d queries, %s\n", UserDN(r), len(qhashes), sel.String())
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "invalidated": qhashes})
+	case "refresh":
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if sel.Qhash == "" && sel.Query == "" && sel.System == "" && sel.Key == "" {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("empty cache selection"))
+			return
+		}
+		qhashes, err := das.Refresh(sel, _dasmaps)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		log.Printf("admin %s refreshed %d queries, %s\n", UserDN(r), len(qhashes), sel.String())
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "refreshed": qhashes})
+	default:
+		http.Error(w, "Not implemented path", http.StatusNotFound)
+	}
+}
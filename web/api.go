@@ -0,0 +1,262 @@
+package web
+
+// das2go - DAS web server JSON API
+//
+// Copyright (c) 2015-2017 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dmwm/das2go/config"
+	"github.com/dmwm/das2go/das"
+	"github.com/dmwm/das2go/dasql"
+	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/utils"
+)
+
+// QueryResponse represents JSON envelope of DAS query API
+type QueryResponse struct {
+	Status    string              `json:"status"`           // requested, processing, ok, partial or fail
+	Pid       string              `json:"pid"`              // DAS query pid used for polling
+	Query     string              `json:"query"`            // DAS query
+	Instance  string              `json:"instance"`         // DBS instance
+	Nresults  int                 `json:"nresults"`         // total number of results
+	Timestamp int64               `json:"timestamp"`        // time when DAS query was requested
+	ProcTime  float64             `json:"procTime"`         // processing time in seconds
+	Idx       int                 `json:"idx"`              // index of first returned record
+	Limit     int                 `json:"limit"`            // max number of returned records, -1 for all
+	Cursor    string              `json:"cursor,omitempty"` // cursor to poll this request
+	Next      string              `json:"next,omitempty"`   // cursor of next page of results
+	Services  []string            `json:"services"`         // services used to process DAS query
+	Errors    map[string][]string `json:"errors"`           // errors keyed by service
+	Reason    string              `json:"reason,omitempty"` // reason of failure, e.g. query parse error
+	Debug     mongo.DASRecord     `json:"debug,omitempty"`  // debug trace of DAS query requested in debug mode
+	Data      []mongo.DASRecord   `json:"data"`             // DAS records
+}
+
+// queryCursor represents position in results of DAS query, it is passed to
+// clients as opaque base64 encoded string
+type queryCursor struct {
+	Query    string `json:"q"`
+	Instance string `json:"i"`
+	Pid      string `json:"p"`
+	Idx      int    `json:"x"`
+	Limit    int    `json:"l"`
+}
+
+// helper function to encode query cursor
+func (c queryCursor) encode() string {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// helper function to decode query cursor
+func decodeCursor(cursor string) (queryCursor, error) {
+	var c queryCursor
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return c, errors.New("invalid cursor")
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, errors.New("invalid cursor")
+	}
+	return c, nil
+}
+
+// helper function to read parameters of query API, either from cursor or
+// from query, instance, pid, idx, limit and pipe parameters. Pipe options,
+// e.g. pipe=grep dataset.name&pipe=sort dataset.name, are appended to query.
+func queryParams(r *http.Request) (queryCursor, error) {
+	c := queryCursor{Limit: 50}
+	if err := r.ParseForm(); err != nil {
+		return c, err
+	}
+	if cursor := r.FormValue("cursor"); cursor != "" {
+		var err error
+		if c, err = decodeCursor(cursor); err != nil {
+			return c, err
+		}
+	} else {
+		c.Query = strings.TrimSpace(r.FormValue("query"))
+		c.Instance = r.FormValue("instance")
+		c.Pid = r.FormValue("pid")
+		for _, pipe := range r.Form["pipe"] {
+			if pipe = strings.TrimSpace(pipe); pipe != "" {
+				c.Query = fmt.Sprintf("%s | %s", c.Query, pipe)
+			}
+		}
+		if v := r.FormValue("idx"); v != "" {
+			idx, err := strconv.Atoi(v)
+			if err != nil {
+				return c, fmt.Errorf("invalid idx %s", v)
+			}
+			c.Idx = idx
+		}
+		if v := r.FormValue("limit"); v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil {
+				return c, fmt.Errorf("invalid limit %s", v)
+			}
+			c.Limit = limit
+		}
+	}
+	if c.Query == "" {
+		return c, errors.New("DAS query is not provided")
+	}
+	if c.Pid != "" && len(c.Pid) != 32 {
+		return c, errors.New("DAS query pid is not valid")
+	}
+	if c.Idx < 0 || c.Limit == 0 || c.Limit < -1 {
+		return c, fmt.Errorf("invalid idx=%d limit=%d", c.Idx, c.Limit)
+	}
+	if c.Instance == "" {
+		c.Instance = _dasmaps.DBSInstance()
+		if c.Instance == "" && len(config.Config.DbsInstances) > 0 { // case of dbs2go
+			c.Instance = config.Config.DbsInstances[0]
+		}
+	}
+	return c, nil
+}
+
+// helper function to build query API envelope from processRequest response
+func queryResponse(c queryCursor, response map[string]interface{}) QueryResponse {
+	resp := QueryResponse{
+		Pid:      c.Pid,
+		Query:    c.Query,
+		Instance: c.Instance,
+		Idx:      c.Idx,
+		Limit:    c.Limit,
+		Cursor:   c.encode(),
+		Services: das.Services(c.Pid),
+		Errors:   make(map[string][]string),
+		Data:     []mongo.DASRecord{},
+	}
+	resp.Status, _ = response["status"].(string)
+	resp.Timestamp = das.GetTimestamp(c.Pid)
+	resp.ProcTime = time.Since(time.Unix(resp.Timestamp, 0)).Seconds()
+	if v, ok := response["procTime"].(time.Duration); ok {
+		resp.ProcTime = v.Seconds()
+	}
+	if v, ok := response["nresults"].(int); ok {
+		resp.Nresults = v
+	}
+	if v, ok := response["data"].([]mongo.DASRecord); ok && v != nil {
+		resp.Data = v
+	}
+	if resp.Status == "ok" || resp.Status == "partial" || resp.Status == "fail" {
+		resp.Errors = das.ServiceErrors(c.Pid)
+		if errs, ok := response["errors"].([]string); ok && len(errs) > 0 && len(resp.Errors) == 0 {
+			// DAS records without per-service errors
+			resp.Errors["das"] = errs
+		}
+		if c.Limit > 0 && c.Idx+c.Limit < resp.Nresults {
+			next := c
+			next.Idx = c.Idx + c.Limit
+			resp.Next = next.encode()
+		}
+	}
+	return resp
+}
+
+// APIHandler routes requests of DAS JSON API, it provides the following APIs:
+// - GET|POST /api/v1/query DAS query
+// - /api/v1/jobs DAS query jobs, see JobsAPIHandler
+// - GET /api/v1/debug/<pid> debug trace of DAS query, see DebugAPIHandler
+func APIHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, config.Config.Base+"/api/v1/"), "/")
+	api := strings.Split(path, "/")[0]
+	switch api {
+	case "query":
+		QueryAPIHandler(w, r)
+	case "jobs":
+		JobsAPIHandler(w, r)
+	case "debug":
+		DebugAPIHandler(w, r)
+	default:
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("unknown API %s", api))
+	}
+}
+
+// QueryAPIHandler handles DAS query API requests. It accepts query,
+// instance, idx, limit, pipe, pid or cursor parameters, admins may request
+// debug mode via debug parameter. It returns QueryResponse envelope with the
+// following HTTP status codes:
+//   - 200 DAS query is processed, records are returned, status is partial
+//     when some services failed and their errors are returned
+//   - 202 DAS query is requested or processing, client should poll pid/cursor
+//   - 400 invalid parameters or DAS query parse error
+//   - 403 debug mode is requested by non-admin user
+//   - 500 DAS query failed without results, errors are returned
+func QueryAPIHandler(w http.ResponseWriter, r *http.Request) {
+
+	// defer function profiler
+	defer utils.MeasureTime("web/api/QueryAPIHandler")()
+
+	if r.Method != "GET" && r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+
+	// trace DAS request, incoming trace context and request id are preserved
+	span := utils.NewTrace("QueryAPIHandler", r.Header.Get("traceparent"), r.Header.Get("X-Request-ID"))
+	defer span.End()
+	span.SetAttr("http.method", r.Method)
+	span.SetAttr("http.target", r.URL.Path)
+	w.Header().Set("X-Request-ID", span.RequestID)
+
+	c, err := queryParams(r)
+	if err != nil {
+		span.SetError(err)
+		writeJSON(w, http.StatusBadRequest, QueryResponse{Status: "fail", Query: c.Query, Instance: c.Instance, Reason: err.Error(), Services: []string{}, Errors: map[string][]string{}, Data: []mongo.DASRecord{}})
+		return
+	}
+	pspan := utils.StartSpan(span, "dasql.Parse")
+	dasquery, err2, _ := dasql.Parse(c.Query, c.Instance, _dasmaps.DASKeys())
+	pspan.End()
+	dasquery.User = requestUser(r)
+	dasquery.Client = requestClient(r)
+	dasquery.Span = span
+	logRequest(dasquery, c.Query, err2)
+	if err2 != "" {
+		span.SetError(errors.New(err2))
+		writeJSON(w, http.StatusBadRequest, QueryResponse{Status: "fail", Query: c.Query, Instance: c.Instance, Reason: err2, Services: []string{}, Errors: map[string][]string{}, Data: []mongo.DASRecord{}})
+		return
+	}
+	span.SetAttr("das.query", dasquery.Query)
+	span.SetAttr("das.qhash", dasquery.Qhash)
+	if c.Pid == "" {
+		c.Pid = dasquery.Qhash
+	}
+	debug := r.FormValue("debug") != ""
+	if debug {
+		if !isAdmin(r) {
+			writeJSONError(w, http.StatusForbidden, errors.New("debug mode is allowed only for admins"))
+			return
+		}
+		enableDebug(&dasquery)
+	}
+	das.RemoveExpired(c.Pid)
+	resp := queryResponse(c, processRequest(dasquery, c.Pid, c.Idx, c.Limit))
+	if debug && (resp.Status == "ok" || resp.Status == "partial" || resp.Status == "fail") {
+		resp.Debug, _ = das.DebugInfo(c.Pid)
+	}
+	switch resp.Status {
+	case "ok", "partial":
+		writeJSON(w, http.StatusOK, resp)
+	case "fail":
+		writeJSON(w, http.StatusInternalServerError, resp)
+	default:
+		w.Header().Set("Retry-After", "2")
+		writeJSON(w, http.StatusAccepted, resp)
+	}
+}
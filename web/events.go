@@ -0,0 +1,123 @@
+package web
+
+// das2go - DAS web server Server-Sent Events
+//
+// Copyright (c) 2015-2017 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dmwm/das2go/das"
+	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/utils"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// EventsTimeout defines max duration of events stream, clients fall back to
+// polling afterwards
+var EventsTimeout = 10 * time.Minute
+
+// EventsCheckInterval defines how often events stream checks readiness of
+// DAS query, e.g. when it is processed by another DAS server, and sends
+// keep-alive message
+var EventsCheckInterval = 5 * time.Second
+
+// helper function to write status event to events stream
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, event das.StatusEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: status\ndata: %s\n\n", data); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// helper function to get current status of DAS query, it returns status and
+// true if processing of the query is finished
+func currentStatus(pid string) (string, bool) {
+	if das.Cancelled(pid) {
+		return "cancelled", true
+	}
+	if das.CheckDataReadiness(pid) {
+		if len(das.Errors(pid)) > 0 {
+			return das.QueryStatus(pid, "fail"), true
+		}
+		return "ok", true
+	}
+	spec := bson.M{"qhash": pid, "das.record": 0}
+	recs, err := mongo.Get("das", "cache", spec, 0, 1)
+	if err != nil || len(recs) == 0 {
+		return "requested", false
+	}
+	status, _ := mongo.GetValue(recs[0], "das.status").(string)
+	return status, false
+}
+
+// EventsHandler streams status transitions of DAS query with given pid as
+// Server-Sent Events, e.g. "process dbs3:files", "merge", "ok". The stream
+// is closed when processing of the query is finished.
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+
+	// defer function profiler
+	defer utils.MeasureTime("web/events/EventsHandler")()
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	pid := r.FormValue("pid")
+	if len(pid) != 32 {
+		http.Error(w, "DAS query pid is not valid", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	// subscribe before we look-up current status to not miss transitions
+	events, unsubscribe := das.SubscribeStatus(pid)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	status, done := currentStatus(pid)
+	event := das.StatusEvent{Pid: pid, Status: status, Done: done, Time: time.Now().Unix()}
+	if err := writeEvent(w, flusher, event); err != nil || done {
+		return
+	}
+	ticker := time.NewTicker(EventsCheckInterval)
+	defer ticker.Stop()
+	timeout := time.After(EventsTimeout)
+	for {
+		select {
+		case event := <-events:
+			if err := writeEvent(w, flusher, event); err != nil || event.Done {
+				return
+			}
+		case <-ticker.C:
+			if status, done := currentStatus(pid); done {
+				writeEvent(w, flusher, das.StatusEvent{Pid: pid, Status: status, Done: true, Time: time.Now().Unix()})
+				return
+			}
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-timeout:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -6,9 +6,11 @@ package web
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"runtime"
@@ -22,6 +24,7 @@ import (
 	"github.com/dmwm/das2go/dasmaps"
 	"github.com/dmwm/das2go/dasql"
 	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/services"
 	"github.com/dmwm/das2go/utils"
 	"github.com/prometheus/procfs"
 	"github.com/shirou/gopsutil/cpu"
@@ -39,6 +42,7 @@ var TotalPostRequests uint64
 // ServerSettings controls server parameters
 type ServerSettings struct {
 	Level          int    `json:"level"`          // verbosity level
+	LogLevel       string `json:"logLevel"`       // minimum level of log records, unchanged if empty
 	RucioTokenCurl bool   `json:"rucioTokenCurl"` // use curl method to obtain Rucio Token
 	ProfileFile    string `json:"profileFile"`    // send profile data to a given file
 }
@@ -153,11 +157,23 @@ func processRequest(dasquery dasql.DASQuery, pid string, idx, limit int) map[str
 
 	response := make(map[string]interface{})
 	if das.CheckDataReadiness(pid) { // data exists in cache and ready for retrieval
+		utils.AddCounter("das_query_cache_requests_total", 1, "result", "hit")
 		status, data := das.GetData(dasquery, "merge", idx, limit)
 		ts := das.TimeStamp(dasquery)
 		procTime := time.Now().Sub(time.Unix(ts, 0))
-		nrec := das.Count(pid)
-		size := das.Bytes(pid)
+		nrec, err := das.Count(pid)
+		if err != nil {
+			dasquery.Logger().Error("unable to count DAS records", "error", err)
+		}
+		status = services.QueryStatus(status, nrec)
+		if len(dasquery.Filters) > 0 && len(dasquery.Aggregators) == 0 {
+			// number of records after applying grep/unique filters
+			nrec = das.CountData(dasquery, "merge")
+		}
+		size, err := das.Bytes(pid)
+		if err != nil {
+			dasquery.Logger().Error("unable to get size of DAS records", "error", err)
+		}
 		response["bytes"] = size
 		response["nresults"] = nrec
 		response["timestamp"] = das.GetTimestamp(pid)
@@ -165,18 +181,29 @@ func processRequest(dasquery dasql.DASQuery, pid string, idx, limit int) map[str
 		response["pid"] = pid
 		response["data"] = data
 		response["procTime"] = procTime
-		log.Printf("%v pid=%v status=%v nrecords=%d idx=%v limit=%v bytes=%v processing_time=%v\n", dasquery, pid, status, nrec, idx, limit, size, procTime)
+		if status == "fail" || status == "partial" {
+			response["errors"] = das.Errors(pid)
+		}
+		dasquery.Logger().Info("DAS query result", "status", status, "nresults", nrec, "idx", idx, "limit", limit, "bytes", size, "duration", procTime)
 	} else if das.CheckData(pid) { // data exists in cache but still processing
+		utils.AddCounter("das_query_cache_requests_total", 1, "result", "processing")
 		response["status"] = "processing"
 		response["pid"] = pid
 	} else { // no data in cache (even client supplied the pid), process it
-		log.Printf("%v pid=%v\n", dasquery, pid)
+		dasquery.Logger().Info("DAS query requested", "query", dasquery.Query, "instance", dasquery.Instance)
+		utils.AddCounter("das_query_cache_requests_total", 1, "result", "miss")
 		go das.Process(dasquery, _dasmaps)
 		response["status"] = "requested"
 		response["pid"] = pid
 	}
 	response["idx"] = idx
 	response["limit"] = limit
+	if len(dasquery.Filters) > 0 {
+		response["filters"] = dasquery.Filters
+	}
+	if len(dasquery.Aggregators) > 0 {
+		response["aggregators"] = dasquery.Aggregators
+	}
 	return response
 }
 
@@ -202,6 +229,43 @@ func UserDN(r *http.Request) string {
 	return fmt.Sprintf("/DC=%s/DC=%s/OU=%s/OU=%s/CN=%s/CN=%s/CN=%s", parts...)
 }
 
+// helper function to identify user of HTTP request for fair scheduling of
+// upstream requests: user DN, CMS login set by frontend or client host
+func requestUser(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return UserDN(r)
+	}
+	if login := r.Header.Get("Cms-Authn-Login"); login != "" {
+		return login
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// helper function to get IP address of client which placed the request,
+// requests passed by frontend carry it in X-Forwarded-For header
+func requestClient(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		return strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// helper function to log incoming DAS request, the cache warmer looks-up
+// the most frequent queries in these records, see das.TopQueries
+func logRequest(dasquery dasql.DASQuery, input, perr string) {
+	attrs := []any{"input", input, "query", dasquery.Query, "instance", dasquery.Instance}
+	if perr != "" {
+		attrs = append(attrs, "error", perr)
+	}
+	dasquery.Logger().Info("DAS request", attrs...)
+}
+
 // custom logic for CMS authentication, users may implement their own logic here
 func auth(r *http.Request) bool {
 	if !_auth {
@@ -228,6 +292,12 @@ func AuthHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	*/
+	// record request metrics, see MetricsHandler
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	defer func() { observeRequest(r, sw.status, start) }()
+	w = sw
+
 	// increment GET/POST counters
 	if r.Method == "GET" {
 		atomic.AddUint64(&TotalGetRequests, 1)
@@ -243,6 +313,14 @@ func AuthHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, msg, http.StatusForbidden)
 		return
 	}
+	if strings.HasPrefix(r.URL.Path, config.Config.Base+"/admin/") {
+		AdminHandler(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, config.Config.Base+"/api/v1/") {
+		APIHandler(w, r)
+		return
+	}
 	arr := strings.Split(r.URL.Path, "/")
 	path := arr[len(arr)-1]
 	switch path {
@@ -260,6 +338,8 @@ func AuthHandler(w http.ResponseWriter, r *http.Request) {
 		SettingsHandler(w, r)
 	case "services":
 		ServicesHandler(w, r)
+	case "events":
+		EventsHandler(w, r)
 	default:
 		RequestHandler(w, r)
 	}
@@ -431,6 +511,14 @@ func StatusHandler(w http.ResponseWriter, r *http.Request) {
 	tmplData["postRequests"] = TotalPostRequests
 	tmplData["getCalls"] = utils.TotalGetCalls
 	tmplData["postCalls"] = utils.TotalPostCalls
+	tmplData["Breakers"] = utils.BreakerStatus()
+	tmplData["FetchQueues"] = utils.FetchQueueStatus()
+	tmplData["Endpoints"] = utils.EndpointStatus()
+	tmplData["Hedges"] = utils.HedgeStatus()
+	tmplData["RucioToken"] = utils.RucioAuth.Info()
+	if utils.ResponseCache != nil {
+		tmplData["HTTPCache"] = utils.ResponseCache.Stats()
+	}
 	page := templates.Status(config.Config.Templates, tmplData)
 	if strings.Contains(accept, "json") || strings.Contains(content, "json") {
 		data, err := json.Marshal(tmplData)
@@ -471,10 +559,13 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) {
 	// defer function profiler
 	defer utils.MeasureTime("web/handlers/RequestHandler")()
 
-	if v, err := strconv.Atoi(r.FormValue("verbose")); err == nil {
-		log.Println("verbose level", v)
-		utils.VERBOSE = v
-	}
+	// trace DAS request, incoming trace context and request id are preserved
+	span := utils.NewTrace("RequestHandler", r.Header.Get("traceparent"), r.Header.Get("X-Request-ID"))
+	defer span.End()
+	span.SetAttr("http.method", r.Method)
+	span.SetAttr("http.target", r.URL.Path)
+	w.Header().Set("X-Request-ID", span.RequestID)
+
 	// Example to parse all args
 	/*
 		if err := r.ParseForm(); err == nil {
@@ -498,7 +589,8 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	if hash != "" {
 		dasquery, err, _ := dasql.Parse(query, inst, _dasmaps.DASKeys())
-		log.Printf("input=\"%s\" %s", query, dasquery)
+		dasquery.Client = requestClient(r)
+		dasquery.Logger().Info("DAS query hash", "input", query, "query", dasquery.Query, "instance", dasquery.Instance)
 		msg := fmt.Sprintf("%s spec=%v filters=%v aggregators=%v err=%s", dasquery, dasquery.Spec, dasquery.Filters, dasquery.Aggregators, err)
 		w.Write([]byte(msg))
 		return
@@ -551,12 +643,29 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) {
 			w.Write(js)
 		}
 	}()
+	pspan := utils.StartSpan(span, "dasql.Parse")
 	dasquery, err2, pLine := dasql.Parse(query, inst, _dasmaps.DASKeys())
-	log.Printf("input=\"%s\" %s", query, dasquery)
+	pspan.End()
+	dasquery.User = requestUser(r)
+	dasquery.Client = requestClient(r)
+	dasquery.Span = span
+	logRequest(dasquery, query, err2)
 	if err2 != "" {
+		span.SetError(errors.New(err2))
 		w.Write([]byte(dasError(query, err2, pLine)))
 		return
 	}
+	// debug mode collects processing details of this query only
+	debug := r.FormValue("debug") != ""
+	if debug {
+		if !isAdmin(r) {
+			http.Error(w, "debug mode is allowed only for admins", http.StatusForbidden)
+			return
+		}
+		enableDebug(&dasquery)
+	}
+	span.SetAttr("das.query", dasquery.Query)
+	span.SetAttr("das.qhash", dasquery.Qhash)
 	if pid == "" {
 		pid = dasquery.Qhash
 	}
@@ -586,31 +695,56 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) {
 		msg := "DAS web server no longer support python clients, please switch to dasgoclient"
 		http.Error(w, msg, http.StatusInternalServerError)
 	} else if path == base+"/request" || path == base+"/request/" {
+		if strings.Contains(strings.ToLower(r.Header.Get("Accept")), "json") {
+			delete(response, "procTime")
+			if trace, ok := das.DebugInfo(pid); debug && ok {
+				response["debug"] = trace
+			}
+			js, err := json.Marshal(&response)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(js)
+			return
+		}
 		status := response["status"]
 		var procTime time.Duration
 		if response["procTime"] != nil {
 			procTime = response["procTime"].(time.Duration)
 		}
 		var page string
+		if status == "fail" || status == "partial" {
+			// DAS query failed, e.g. we were unable to store results, report it
+			// to the user along with whatever data we have
+			tmplData["Query"] = query
+			tmplData["Error"] = strings.Join(response["errors"].([]string), "; ")
+			page = parseTmpl(config.Config.Templates, "error.tmpl", tmplData)
+			status = "ok"
+		}
 		if status == "ok" {
 			data := response["data"].([]mongo.DASRecord)
 			if view == "plain" {
-				page = PresentDataPlain(path, dasquery, data)
+				page += PresentDataPlain(path, dasquery, data)
 				w.Write([]byte(page))
 				return
 			}
 			nres := response["nresults"].(int)
 			if nres == 0 {
-				page = dasZero(config.Config.Base)
+				page += dasZero(config.Config.Base)
 			} else {
 				presentationMap := _dasmaps.PresentationMap()
-				page = PresentData(path, dasquery, data, presentationMap, nres, idx, limit, procTime)
+				page += PresentData(path, dasquery, data, presentationMap, nres, idx, limit, procTime)
 			}
 		} else {
 			tmplData["Base"] = config.Config.Base
 			tmplData["PID"] = pid
 			page = parseTmpl(config.Config.Templates, "check_pid.tmpl", tmplData)
-			page += fmt.Sprintf("<script>setTimeout('ajaxCheckPid(\"%s\", \"request\", \"%s\", \"%s\", \"%s\", \"%s\", \"%d\")', %d)</script>", config.Config.Base, query, inst, pid, view, 2500, 2500)
+			page += fmt.Sprintf("<script>sseCheckPid(\"%s\", \"request\", \"%s\", \"%s\", \"%s\", \"%s\")</script>", config.Config.Base, query, inst, pid, view)
+		}
+		if debug {
+			page += fmt.Sprintf("<div>Debug trace: <a href=\"%s/api/v1/debug/%s\">%s</a></div>", config.Config.Base, pid, pid)
 		}
 		if ajax == "" {
 			w.Write([]byte(_top + _search + _hiddenCards + page + _bottom))
@@ -624,12 +758,18 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) {
 
 // POST methods
 
-// SettingsHandler handlers Settings requests
+// SettingsHandler handlers Settings requests, server settings affect all
+// requests and therefore can be changed only by admins
 func SettingsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	if !isAdmin(r) {
+		log.Printf("ERROR: user DN %s is not allowed to change server settings\n", UserDN(r))
+		http.Error(w, "You are not allowed to access this resource", http.StatusForbidden)
+		return
+	}
 	defer r.Body.Close()
 	var s = ServerSettings{}
 	err := json.NewDecoder(r.Body).Decode(&s)
@@ -638,16 +778,22 @@ func SettingsHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if s.LogLevel != "" {
+		if err := utils.SetLogLevel(s.LogLevel); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 	utils.VERBOSE = s.Level
 	// change function profiler if necessary
 	if s.ProfileFile != "" {
 		utils.InitFunctionProfiler(s.ProfileFile)
 	} else {
-		utils.Profiler = nil
+		utils.CloseFunctionProfiler()
 	}
 	// change RucioTokenCurl with whatever is supplied in server settings POST request
 	utils.RucioTokenCurl = s.RucioTokenCurl
-	log.Printf("Set, verbose %v, rucio %v, profile %v\n", utils.VERBOSE, s.RucioTokenCurl, s.ProfileFile)
+	log.Printf("admin %s set verbose %v, log level %v, rucio %v, profile %v\n", UserDN(r), utils.VERBOSE, utils.LogLevel.Level(), s.RucioTokenCurl, s.ProfileFile)
 	w.WriteHeader(http.StatusOK)
 	return
 }
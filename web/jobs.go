@@ -0,0 +1,263 @@
+package web
+
+// das2go - DAS web server query jobs API
+//
+// Copyright (c) 2015-2017 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dmwm/das2go/config"
+	"github.com/dmwm/das2go/das"
+	"github.com/dmwm/das2go/dasql"
+	"github.com/dmwm/das2go/utils"
+)
+
+// JobTimeout defines how long we wait for job to finish before giving up
+// its callback
+var JobTimeout = time.Hour
+
+// JobPollInterval defines how often status of job with callback is checked,
+// e.g. when query is processed by another DAS server
+var JobPollInterval = 10 * time.Second
+
+// JobCallbackRetries defines number of attempts to deliver job callback
+var JobCallbackRetries = 3
+
+// JobRequest represents job submission request
+type JobRequest struct {
+	Query    string `json:"query"`    // DAS query
+	Instance string `json:"instance"` // DBS instance
+	Callback string `json:"callback"` // optional url to POST job status when job is finished
+}
+
+// helper function to read job request either from JSON body or form values
+func jobRequest(r *http.Request) (JobRequest, error) {
+	var req JobRequest
+	if strings.Contains(r.Header.Get("Content-Type"), "json") {
+		defer r.Body.Close()
+		err := json.NewDecoder(r.Body).Decode(&req)
+		return req, err
+	}
+	req.Query = strings.TrimSpace(r.FormValue("query"))
+	req.Instance = r.FormValue("instance")
+	req.Callback = r.FormValue("callback")
+	return req, nil
+}
+
+// helper function to validate job callback url. Callbacks are denied unless
+// their host is listed in jobCallbackHosts configuration, and hosts which
+// resolve to loopback, link-local or unspecified addresses are rejected, such
+// that users can not make DAS server POST to its internal services.
+func validCallback(callback string) error {
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid callback url %s", callback)
+	}
+	host := u.Hostname()
+	if !utils.InList(host, config.Config.JobCallbackHosts) {
+		return fmt.Errorf("callback host %s is not allowed", host)
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return fmt.Errorf("unable to resolve callback host %s", host)
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+			return fmt.Errorf("callback host %s resolves to not allowed address %s", host, ip)
+		}
+	}
+	return nil
+}
+
+// helper function to POST job status to its callback url
+func postCallback(callback string, progress das.QueryProgress) {
+	logger := utils.QueryLogger(progress.Pid, "", "")
+	data, err := json.Marshal(progress)
+	if err != nil {
+		logger.Error("unable to marshal job status", "error", err)
+		return
+	}
+	// callback host is validated again in case its address has changed and
+	// redirects are not followed to not bypass the validation
+	if err := validCallback(callback); err != nil {
+		logger.Error("job callback is not allowed", "callback", callback, "error", err)
+		return
+	}
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for i := 0; i < JobCallbackRetries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * time.Second)
+		}
+		resp, err := client.Post(callback, "application/json", bytes.NewReader(data))
+		if err != nil {
+			logger.Error("unable to POST job status", "callback", callback, "error", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			logger.Info("job callback", "status", progress.Status, "callback", callback)
+			return
+		}
+		logger.Error("unable to POST job status", "callback", callback, "code", resp.StatusCode)
+	}
+}
+
+// helper function to wait for job to finish and POST its status to callback
+// url, done channel is signaled by das.OnDone
+func watchJob(pid, callback string, done <-chan struct{}) {
+	ticker := time.NewTicker(JobPollInterval)
+	defer ticker.Stop()
+	timeout := time.After(JobTimeout)
+	for {
+		// DAS record may not exist yet, we keep waiting for it
+		if progress, ok := das.Progress(pid); ok && progress.Done() {
+			postCallback(callback, progress)
+			return
+		}
+		select {
+		case <-done:
+		case <-ticker.C:
+		case <-timeout:
+			utils.QueryLogger(pid, "", "").Error("job is not finished in time, callback is not called", "timeout", JobTimeout, "callback", callback)
+			return
+		}
+	}
+}
+
+// JobsAPIHandler handles DAS query jobs API requests:
+// - POST   /api/v1/jobs       submit DAS query, job id is DAS query pid
+// - GET    /api/v1/jobs/<pid> job status with per-service progress
+// - DELETE /api/v1/jobs/<pid> cancel job, allowed to its owner or admin
+// The job is submitted with query, instance and optional callback url which
+// is POSTed job status when the job is finished.
+func JobsAPIHandler(w http.ResponseWriter, r *http.Request) {
+
+	// defer function profiler
+	defer utils.MeasureTime("web/jobs/JobsAPIHandler")()
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, config.Config.Base+"/api/v1/jobs"), "/")
+	switch r.Method {
+	case "POST":
+		if path != "" {
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+		submitJob(w, r)
+	case "GET", "DELETE":
+		if path == "" || len(path) != 32 {
+			writeJSONError(w, http.StatusBadRequest, errors.New("job id is not valid"))
+			return
+		}
+		progress, ok := das.Progress(path)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("job %s is not found", path))
+			return
+		}
+		if r.Method == "GET" {
+			writeJSON(w, http.StatusOK, progress)
+			return
+		}
+		if progress.Done() {
+			writeJSONError(w, http.StatusConflict, fmt.Errorf("job %s is already finished", path))
+			return
+		}
+		// job pid is shared by all users who placed the same query, it can be
+		// cancelled only by its single owner or by admin
+		owners := das.JobOwners(path)
+		if !isAdmin(r) && (len(owners) != 1 || owners[0] != requestUser(r)) {
+			writeJSONError(w, http.StatusForbidden, fmt.Errorf("job %s can be cancelled only by its owner", path))
+			return
+		}
+		if err := das.Cancel(path); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		utils.QueryLogger(path, requestUser(r), requestClient(r)).Info("job cancelled")
+		progress, _ = das.Progress(path)
+		writeJSON(w, http.StatusOK, progress)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+	}
+}
+
+// helper function to submit DAS query job
+func submitJob(w http.ResponseWriter, r *http.Request) {
+	req, err := jobRequest(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Query == "" {
+		writeJSONError(w, http.StatusBadRequest, errors.New("DAS query is not provided"))
+		return
+	}
+	if req.Callback != "" {
+		if err := validCallback(req.Callback); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if req.Instance == "" {
+		req.Instance = _dasmaps.DBSInstance()
+		if req.Instance == "" && len(config.Config.DbsInstances) > 0 { // case of dbs2go
+			req.Instance = config.Config.DbsInstances[0]
+		}
+	}
+
+	// trace DAS request, incoming trace context and request id are preserved
+	span := utils.NewTrace("JobsAPIHandler", r.Header.Get("traceparent"), r.Header.Get("X-Request-ID"))
+	defer span.End()
+	w.Header().Set("X-Request-ID", span.RequestID)
+
+	dasquery, err2, _ := dasql.Parse(req.Query, req.Instance, _dasmaps.DASKeys())
+	dasquery.User = requestUser(r)
+	dasquery.Client = requestClient(r)
+	dasquery.Span = span
+	logRequest(dasquery, req.Query, err2)
+	if err2 != "" {
+		span.SetError(errors.New(err2))
+		writeJSONError(w, http.StatusBadRequest, errors.New(err2))
+		return
+	}
+	pid := dasquery.Qhash
+	dasquery.Logger().Info("job submitted", "callback", req.Callback)
+	das.RemoveExpired(pid)
+	// register callback before processing starts to not miss its end
+	done := make(chan struct{}, 1)
+	if req.Callback != "" {
+		das.OnDone(pid, func() {
+			select {
+			case done <- struct{}{}:
+			default:
+			}
+		})
+	}
+	das.Submit(dasquery, _dasmaps)
+	if req.Callback != "" {
+		go watchJob(pid, req.Callback, done)
+	}
+	progress, ok := das.Progress(pid)
+	if !ok {
+		progress = das.QueryProgress{Pid: pid, Query: dasquery.Query, Instance: dasquery.Instance, Status: "requested", Services: []das.ServiceProgress{}}
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/api/v1/jobs/%s", config.Config.Base, pid))
+	if progress.Done() {
+		writeJSON(w, http.StatusOK, progress)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, progress)
+}
@@ -0,0 +1,143 @@
+package web
+
+// das2go - DAS web server metrics
+//
+// Copyright (c) 2015-2017 - Valentin Kuznetsov <vkuznet AT gmail dot com>
+
+import (
+	"bytes"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dmwm/das2go/config"
+	"github.com/dmwm/das2go/das"
+	"github.com/dmwm/das2go/utils"
+)
+
+// statusWriter records status code of response written by DAS handlers
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter interface
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush implements http.Flusher interface used by events stream
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// paths of DAS server used as metric labels, other paths are reported as
+// "other" to keep number of time series bounded
+var metricPaths = []string{
+	"/", "/request", "/cache", "/cli", "/faq", "/keys", "/apis", "/status",
+	"/server", "/services", "/events", "/api/v1/query", "/api/v1/jobs",
+	"/api/v1/debug",
+	"/admin/cache", "/admin/invalidate", "/admin/refresh",
+}
+
+// helper function to map request path to metric label
+func metricPath(path string) string {
+	path = "/" + strings.Trim(strings.TrimPrefix(path, config.Config.Base), "/")
+	if strings.HasPrefix(path, "/api/v1/jobs/") {
+		return "/api/v1/jobs/{pid}"
+	}
+	if strings.HasPrefix(path, "/api/v1/debug/") {
+		return "/api/v1/debug/{pid}"
+	}
+	if utils.InList(path, metricPaths) {
+		return path
+	}
+	return "other"
+}
+
+// helper function to record metrics of DAS server request
+func observeRequest(r *http.Request, status int, start time.Time) {
+	path := metricPath(r.URL.Path)
+	code := strconv.Itoa(status)
+	utils.AddCounter("das_http_requests_total", 1, "path", path, "method", r.Method, "code", code)
+	utils.ObserveDuration("das_http_request_duration_seconds", start, "path", path, "code", code)
+}
+
+// helper function to compute hit ratio
+func hitRatio(hits, misses float64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return hits / (hits + misses)
+}
+
+// MetricsHandler provides DAS server metrics in Prometheus format
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var buf bytes.Buffer
+	utils.WriteSamples(&buf, "das_uptime_seconds", "gauge", "DAS server uptime",
+		utils.MetricSample{Value: time.Since(Time0).Seconds()})
+	utils.WriteSamples(&buf, "das_goroutines", "gauge", "Number of goroutines",
+		utils.MetricSample{Value: float64(runtime.NumGoroutine())})
+	utils.WriteSamples(&buf, "das_server_requests_total", "counter", "Number of DAS server requests by method",
+		utils.MetricSample{Labels: []string{"method", "GET"}, Value: float64(atomic.LoadUint64(&TotalGetRequests))},
+		utils.MetricSample{Labels: []string{"method", "POST"}, Value: float64(atomic.LoadUint64(&TotalPostRequests))})
+	utils.WriteSamples(&buf, "das_upstream_calls_total", "counter", "Number of upstream calls by method",
+		utils.MetricSample{Labels: []string{"method", "GET"}, Value: float64(atomic.LoadUint64(&utils.TotalGetCalls))},
+		utils.MetricSample{Labels: []string{"method", "POST"}, Value: float64(atomic.LoadUint64(&utils.TotalPostCalls))})
+	utils.WriteSamples(&buf, "das_inflight_queries", "gauge", "Number of DAS queries which are being processed",
+		utils.MetricSample{Value: float64(das.InFlightQueries())})
+	utils.WriteSamples(&buf, "das_upstream_inflight_requests", "gauge", "Number of upstream requests in flight",
+		utils.MetricSample{Value: float64(atomic.LoadInt32(&utils.UrlQueueSize))})
+
+	// URLFetchWorker queues
+	var queued, running []utils.MetricSample
+	for _, q := range utils.FetchQueueStatus() {
+		queued = append(queued, utils.MetricSample{Labels: []string{"system", q.System}, Value: float64(q.Queued)})
+		running = append(running, utils.MetricSample{Labels: []string{"system", q.System}, Value: float64(q.Running)})
+	}
+	utils.WriteSamples(&buf, "das_fetch_queue_depth", "gauge", "Number of upstream requests waiting in URLFetchWorker queue by system", queued...)
+	utils.WriteSamples(&buf, "das_fetch_queue_running", "gauge", "Number of running upstream requests of URLFetchWorker by system", running...)
+
+	// upstream HTTP cache
+	if utils.ResponseCache != nil {
+		stats := utils.ResponseCache.Stats()
+		utils.WriteSamples(&buf, "das_http_cache_requests_total", "counter", "Number of conditional upstream requests by result",
+			utils.MetricSample{Labels: []string{"result", "hit"}, Value: float64(stats.Hits)},
+			utils.MetricSample{Labels: []string{"result", "miss"}, Value: float64(stats.Misses)})
+		utils.WriteSamples(&buf, "das_http_cache_hit_ratio", "gauge", "Hit ratio of upstream HTTP cache",
+			utils.MetricSample{Value: hitRatio(float64(stats.Hits), float64(stats.Misses))})
+		utils.WriteSamples(&buf, "das_http_cache_entries", "gauge", "Number of responses in upstream HTTP cache",
+			utils.MetricSample{Value: float64(stats.Entries)})
+	}
+
+	// Rucio token
+	info := utils.RucioAuth.Info()
+	valid := 0.0
+	if info.Valid {
+		valid = 1
+	}
+	utils.WriteSamples(&buf, "das_rucio_token_refreshes_total", "counter", "Number of Rucio token refreshes",
+		utils.MetricSample{Value: float64(info.Renewals)})
+	utils.WriteSamples(&buf, "das_rucio_token_valid", "gauge", "Validity of Rucio token",
+		utils.MetricSample{Value: valid})
+
+	// counters and histograms recorded by DAS server
+	utils.WriteMetrics(&buf)
+	hits, misses := utils.CounterValue("das_query_cache_requests_total", "result", "hit"), utils.CounterValue("das_query_cache_requests_total", "result", "miss")
+	utils.WriteSamples(&buf, "das_query_cache_hit_ratio", "gauge", "Hit ratio of DAS cache",
+		utils.MetricSample{Value: hitRatio(hits, misses)})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
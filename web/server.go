@@ -16,14 +16,17 @@ import (
 	"crypto/tls"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/dmwm/cmsauth"
 	"github.com/dmwm/das2go/config"
+	"github.com/dmwm/das2go/das"
 	"github.com/dmwm/das2go/dasmaps"
 	"github.com/dmwm/das2go/mongo"
 	"github.com/dmwm/das2go/services"
@@ -42,6 +45,12 @@ var _top, _bottom, _search, _cards, _hiddenCards string
 var _cmsAuth cmsauth.CMSAuth
 var _auth bool
 
+// SetDASMaps sets DAS maps used by DAS handlers, e.g. maps read from a file,
+// Server loads DAS maps from MongoDB only if they are not set
+func SetDASMaps(dmaps dasmaps.DASMaps) {
+	_dasmaps = dmaps
+}
+
 // Time0 represents initial time when we started the server
 var Time0 time.Time
 
@@ -106,9 +115,51 @@ func (w rotateLogWriter) Write(data []byte) (int, error) {
 	return w.RotateLogs.Write([]byte(utcMsg(data)))
 }
 
+// helper function to collect DAS queries for cache warmer from DAS configuration
+func warmupQueries() []das.WarmQuery {
+	inst := _dasmaps.DBSInstance()
+	if inst == "" && len(config.Config.DbsInstances) > 0 {
+		inst = config.Config.DbsInstances[0]
+	}
+	var out []das.WarmQuery
+	for _, q := range config.Config.WarmupQueries {
+		out = append(out, das.WarmQuery{Query: q, Instance: inst})
+	}
+	if config.Config.WarmupFile != "" {
+		data, err := os.ReadFile(config.Config.WarmupFile)
+		if err != nil {
+			log.Printf("ERROR: unable to read %s, error %v\n", config.Config.WarmupFile, err)
+		} else {
+			out = append(out, das.ReadQueries(string(data), inst)...)
+		}
+	}
+	for _, fname := range config.Config.WarmupExamples {
+		content := utils.LoadExamples(fname, config.Config.DasExamples)
+		out = append(out, das.ReadQueries(content, inst)...)
+	}
+	if config.Config.WarmupLogTopN > 0 && config.Config.LogFile != "" {
+		files, err := filepath.Glob(config.Config.LogFile + "-*")
+		if err != nil {
+			log.Printf("ERROR: unable to find log files, error %v\n", err)
+		}
+		out = append(out, das.TopQueries(files, config.Config.WarmupLogTopN)...)
+	}
+	// remove duplicates
+	var queries []das.WarmQuery
+	seen := make(map[das.WarmQuery]bool)
+	for _, q := range out {
+		if !seen[q] {
+			seen[q] = true
+			queries = append(queries, q)
+		}
+	}
+	return queries
+}
+
 // Server is proxy server. It defines /fetch public interface
 func Server(configFile string) {
 	err := config.ParseConfig(configFile)
+	var logOutput io.Writer = os.Stderr
 	if config.Config.LogFile != "" {
 		logName := config.Config.LogFile + "-%Y%m%d"
 		hostname, err := os.Hostname()
@@ -117,23 +168,47 @@ func Server(configFile string) {
 		}
 		rl, err := rotatelogs.New(logName)
 		if err == nil {
-			rotlogs := rotateLogWriter{RotateLogs: rl}
-			log.SetOutput(rotlogs)
-			log.SetFlags(log.LstdFlags | log.Lshortfile)
-		} else {
-			log.SetFlags(log.LstdFlags | log.Lshortfile)
+			// JSON records are written as is, unescaping may break them
+			logOutput = rotateLogWriter{RotateLogs: rl}
+			if config.Config.LogFormat == "json" {
+				logOutput = rl
+			}
 		}
-	} else {
-		// log time, filename, and line number
-		log.SetFlags(log.LstdFlags | log.Lshortfile)
+	}
+	// structured logger, records carry time, level, filename and line number
+	if e := utils.InitLogger(logOutput, config.Config.LogFormat); e != nil {
+		utils.InitLogger(logOutput, "text")
+		log.Println("ERROR: unable to init logger", e)
+	}
+	if e := utils.SetLogLevel(config.Config.LogLevel); e != nil {
+		log.Println("ERROR: unable to set log level", e)
 	}
 	if err != nil {
-		log.Println("ERROR: unable to parse config file", configFile)
+		log.Println("ERROR: unable to parse config file", configFile, err)
 	}
 
 	utils.VERBOSE = config.Config.Verbose
 	utils.UrlQueueLimit = config.Config.UrlQueueLimit
 	utils.UrlRetry = config.Config.UrlRetry
+	utils.BreakerThreshold = config.Config.BreakerThreshold
+	utils.BreakerTimeout = time.Duration(config.Config.BreakerTimeout) * time.Second
+	utils.SystemLimits = config.Config.SystemLimits
+	utils.Endpoints = config.Config.Endpoints
+	if config.Config.EndpointTimeout > 0 {
+		utils.EndpointTimeout = time.Duration(config.Config.EndpointTimeout) * time.Second
+	}
+	utils.HedgeBudget = config.Config.HedgeBudget
+	utils.FetchMode = config.Config.FetchMode
+	utils.FixtureDir = config.Config.FixtureDir
+	if utils.FetchMode != utils.FetchLive {
+		log.Printf("upstream fetch mode %s, fixtures %s\n", utils.FetchMode, utils.FixtureDir)
+	}
+	if config.Config.HTTPCacheMemory > 0 {
+		utils.ResponseCache = utils.NewHTTPCache(
+			int64(config.Config.HTTPCacheMemory)*1024*1024,
+			int64(config.Config.HTTPCacheDisk)*1024*1024,
+			config.Config.HTTPCacheDir)
+	}
 	utils.DASMAPS = config.Config.DasMaps
 	utils.TIMEOUT = config.Config.Timeout
 	services.FrontendURL = config.Config.Frontend
@@ -143,15 +218,23 @@ func Server(configFile string) {
 	utils.RucioTokenCurl = config.Config.RucioTokenCurl
 	log.Println(config.Config.String())
 
+	// init outbound auth providers of upstream systems
+	if err := utils.InitAuthProviders(config.Config.AuthProviders); err != nil {
+		log.Fatalf("ERROR: unable to init auth providers, error %v\n", err)
+	}
+
 	// acquire rucio token
 	log.Println("rucio", utils.RucioAuth.String())
 	token, terr := utils.RucioAuth.Token()
-	log.Println("rucio token", token, terr)
+	log.Println("rucio token", utils.RedactToken(token), terr)
+	go utils.RucioAuth.Refresher()
 
 	// init CMS Authentication module
 	if config.Config.Hkey != "" {
 		_cmsAuth.Init(config.Config.Hkey)
 	}
+	// enable export of request traces
+	utils.InitTracer(config.Config.TraceFile, config.Config.TraceEndpoint)
 	// enable function profiler
 	if config.Config.ProfileFile != "" {
 		utils.InitFunctionProfiler(config.Config.ProfileFile)
@@ -178,8 +261,10 @@ func Server(configFile string) {
 	// set default urls for our services
 	services.UrlMap = make(map[string]string)
 	for _, srv := range _dasmaps.Services() {
-		services.UrlMap[srv] = _dasmaps.GetUrl(srv)
+		services.UrlMap[srv] = dasmaps.RewriteUrl(_dasmaps.GetUrl(srv), config.Config.UrlRewrite)
 	}
+	// redirect upstream calls, e.g. to fake upstream services
+	_dasmaps.RewriteUrls(config.Config.UrlRewrite)
 	log.Println("DAS url map", services.UrlMap)
 
 	// list URLs we're going to use
@@ -215,12 +300,27 @@ func Server(configFile string) {
 	mongo.CreateIndexes("das", "cache", indexes)
 	mongo.CreateIndexes("das", "merge", indexes)
 
+	// start cache warmer
+	if queries := warmupQueries(); len(queries) > 0 {
+		warmer := das.CacheWarmer{
+			Queries:     queries,
+			Interval:    time.Duration(config.Config.WarmupInterval) * time.Second,
+			Lead:        time.Duration(config.Config.WarmupLead) * time.Second,
+			Concurrency: config.Config.WarmupConcurrency,
+			MaxRequests: config.Config.WarmupMaxRequests,
+			DASMaps:     _dasmaps,
+		}
+		go warmer.Run()
+	}
+
 	// assign handlers
 	base := config.Config.Base
 	http.Handle(base+"/css/", http.StripPrefix(base+"/css/", http.FileServer(http.Dir(config.Config.Styles))))
 	http.Handle(base+"/js/", http.StripPrefix(base+"/js/", http.FileServer(http.Dir(config.Config.Jscripts))))
 	http.Handle(base+"/images/", http.StripPrefix(base+"/images/", http.FileServer(http.Dir(config.Config.Images))))
 	//     http.Handle(base+"/debug/pprof/", http.StripPrefix(base, http.RedirectHandler("/debug/pprof/", http.StatusTemporaryRedirect)))
+	// metrics are scraped by Prometheus without user certificates
+	http.HandleFunc(base+"/metrics", MetricsHandler)
 	http.HandleFunc(fmt.Sprintf("%s/", config.Config.Base), AuthHandler)
 
 	// init userDNs and update it periodically
@@ -4,6 +4,7 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
+	"html/template"
 	"log"
 	"net/url"
 	"sort"
@@ -400,6 +401,58 @@ func parseDBSError(dbsErr mongo.DASRecord) string {
 	return out
 }
 
+// helper function to represent aggregated value
+func aggregateCell(key string, val interface{}) string {
+	switch v := val.(type) {
+	case []utils.HistogramBin:
+		var bins []string
+		for _, b := range v {
+			bins = append(bins, fmt.Sprintf("[%s, %s]: %d", aggregateCell(key, b.Low), aggregateCell(key, b.High), b.Count))
+		}
+		return strings.Join(bins, "<br/>")
+	}
+	if strings.Contains(key, "_size") {
+		return template.HTMLEscapeString(utils.SizeFormat(val))
+	}
+	return template.HTMLEscapeString(fmt.Sprintf("%v", val))
+}
+
+// helper function to represent aggregator record as HTML table
+func aggregateTable(item mongo.DASRecord) string {
+	fname, _ := item["function"].(string)
+	fkey, _ := item["key"].(string)
+	title := fmt.Sprintf("%s(%s)", fname, fkey)
+	if param, ok := item["param"].(string); ok {
+		title = fmt.Sprintf("%s(%s, %s)", fname, fkey, param)
+	}
+	res, _ := item["result"].(mongo.DASRecord)
+	var out []string
+	out = append(out, "<table class=\"daskeys\">")
+	if gkey, ok := item["by"].(string); ok {
+		out = append(out, fmt.Sprintf("<tr><th>%s</th><th>%s</th></tr>", gkey, title))
+		var groups []mongo.DASRecord
+		switch g := res["groups"].(type) {
+		case []mongo.DASRecord:
+			groups = g
+		case []interface{}:
+			for _, v := range g {
+				if r, ok := v.(mongo.DASRecord); ok {
+					groups = append(groups, r)
+				}
+			}
+		}
+		for _, g := range groups {
+			gval := template.HTMLEscapeString(fmt.Sprintf("%v", g["group"]))
+			out = append(out, fmt.Sprintf("<tr><td>%s</td><td>%s</td></tr>", gval, aggregateCell(fkey, g["value"])))
+		}
+	} else {
+		out = append(out, fmt.Sprintf("<tr><th>%s</th></tr>", title))
+		out = append(out, fmt.Sprintf("<tr><td>%s</td></tr>", aggregateCell(fkey, res["value"])))
+	}
+	out = append(out, "</table>")
+	return strings.Join(out, "\n")
+}
+
 // PresentData represents DAS records for web UI
 func PresentData(path string, dasquery dasql.DASQuery, data []mongo.DASRecord, pmap mongo.DASRecord, nres, startIdx, limit int, procTime time.Duration) string {
 	var out []string
@@ -443,16 +496,7 @@ func PresentData(path string, dasquery dasql.DASQuery, data []mongo.DASRecord, p
 		inst = dasrec["instance"].(string)
 		// aggregator part
 		if len(dasquery.Aggregators) > 0 {
-			fname := item["function"].(string)
-			fkey := item["key"].(string)
-			res := item["result"].(mongo.DASRecord)
-			var val string
-			if strings.Contains(fkey, "_size") {
-				val = fmt.Sprintf("%s(%s)=%v<br/>\n", fname, fkey, utils.SizeFormat(res["value"]))
-			} else {
-				val = fmt.Sprintf("%s(%s)=%v<br/>\n", fname, fkey, res["value"])
-			}
-			out = append(out, val)
+			out = append(out, aggregateTable(item))
 			out = append(out, colServices(services))
 			out = append(out, showRecord(item))
 			if jdx != len(data) {